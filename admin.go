@@ -0,0 +1,462 @@
+package sshhipot
+
+/*
+ * admin.go
+ * Operator console for watching and meddling with live sessions
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* TAGOPERATOR is the tag used in channel logs for data sent by the operator */
+const TAGOPERATOR = "operator->attacker"
+
+/* ADMINHELP is sent to operators who ask for help */
+const ADMINHELP = `Commands:
+  list                     List active sessions
+  watch ID [channel]       Show what the attacker sees, until Enter
+  inject ID channel data   Send data (with Go escapes, e.g. \r\n) to the
+                           attacker
+  pause ID                 Stop passing on the attacker's input
+  resume ID                Start passing on the attacker's input again
+  kill ID                  Disconnect the attacker
+  help                     This help
+`
+
+/* liveSession is an active session, which can be watched and controlled from
+the admin console. */
+type liveSession struct {
+	l        sync.Mutex
+	cond     *sync.Cond
+	all      *liveSessions /* Which this is in */
+	sess     *Session
+	conn     ssh.Conn
+	lg       *log.Logger
+	paused   bool
+	chans    map[int]*liveChannel
+	watchers map[*watcher]struct{}
+}
+
+/* liveChannel is an open channel in a liveSession */
+type liveChannel struct {
+	ls  *liveSession
+	cs  *ChannelSummary
+	ac  ssh.Channel /* Attacker's side */
+	clg *log.Logger
+}
+
+/* watcher receives what's sent to the attacker on channel ch, or all
+channels if ch is 0. */
+type watcher struct {
+	ch int
+	c  chan []byte
+}
+
+/* liveSessions are one Server's sessions which can be controlled, by ID.  The
+zero value is ready to use. */
+type liveSessions struct {
+	l sync.Mutex
+	m map[string]*liveSession
+}
+
+/* goLive makes the session sess, which is carried over conn and logged to
+lg, available to the admin console.  The returned liveSession's Done method
+should be called when the session's finished. */
+func (lss *liveSessions) goLive(
+	sess *Session,
+	conn ssh.Conn,
+	lg *log.Logger,
+) *liveSession {
+	ls := &liveSession{
+		all:      lss,
+		sess:     sess,
+		conn:     conn,
+		lg:       lg,
+		chans:    make(map[int]*liveChannel),
+		watchers: make(map[*watcher]struct{}),
+	}
+	ls.cond = sync.NewCond(&ls.l)
+	lss.l.Lock()
+	defer lss.l.Unlock()
+	if nil == lss.m {
+		lss.m = make(map[string]*liveSession)
+	}
+	lss.m[sess.ID] = ls
+	return ls
+}
+
+/* get returns the session with the given ID */
+func (lss *liveSessions) get(id string) (*liveSession, bool) {
+	lss.l.Lock()
+	defer lss.l.Unlock()
+	ls, ok := lss.m[id]
+	return ls, ok
+}
+
+/* list returns the sessions, oldest first */
+func (lss *liveSessions) list() []*liveSession {
+	lss.l.Lock()
+	ls := make([]*liveSession, 0, len(lss.m))
+	for _, l := range lss.m {
+		ls = append(ls, l)
+	}
+	lss.l.Unlock()
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].sess.Start.Before(ls[j].sess.Start)
+	})
+	return ls
+}
+
+/* Done removes the session from the admin console, and lets any paused
+readers carry on. */
+func (ls *liveSession) Done() {
+	ls.all.l.Lock()
+	delete(ls.all.m, ls.sess.ID)
+	ls.all.l.Unlock()
+	ls.l.Lock()
+	defer ls.l.Unlock()
+	ls.paused = false
+	ls.cond.Broadcast()
+	for w := range ls.watchers {
+		close(w.c)
+		delete(ls.watchers, w)
+	}
+}
+
+/* addChannel makes the channel described by cs, of which ac is the
+attacker's side and clg the logger, available to the admin console.  The
+returned liveChannel's Done method should be called when the channel's
+closed. */
+func (ls *liveSession) addChannel(
+	cs *ChannelSummary,
+	ac ssh.Channel,
+	clg *log.Logger,
+) *liveChannel {
+	lc := &liveChannel{ls: ls, cs: cs, ac: ac, clg: clg}
+	ls.l.Lock()
+	defer ls.l.Unlock()
+	ls.chans[cs.ID] = lc
+	return lc
+}
+
+/* Done removes the channel from the admin console */
+func (lc *liveChannel) Done() {
+	lc.ls.l.Lock()
+	defer lc.ls.l.Unlock()
+	delete(lc.ls.chans, lc.cs.ID)
+}
+
+/* Output passes b, which was sent to the attacker, to anybody watching. */
+func (lc *liveChannel) Output(b []byte) {
+	lc.ls.l.Lock()
+	defer lc.ls.l.Unlock()
+	for w := range lc.ls.watchers {
+		if 0 != w.ch && lc.cs.ID != w.ch {
+			continue
+		}
+		/* Slow watchers miss out */
+		select {
+		case w.c <- append([]byte{}, b...):
+		default:
+		}
+	}
+}
+
+/* Input returns a reader which reads from the attacker's side of the
+channel, but doesn't return what it's read while the session is paused. */
+func (lc *liveChannel) Input() io.Reader {
+	return pausableReader{r: lc.ac, ls: lc.ls}
+}
+
+/* Inject sends b to the attacker. */
+func (lc *liveChannel) Inject(b []byte) error {
+	lc.clg.Printf("[%v] %q", TAGOPERATOR, b)
+	_, err := lc.ac.Write(b)
+	return err
+}
+
+/* SetPaused pauses or resumes passing on the attacker's input. */
+func (ls *liveSession) SetPaused(p bool) {
+	ls.l.Lock()
+	defer ls.l.Unlock()
+	ls.paused = p
+	ls.cond.Broadcast()
+	if p {
+		ls.lg.Printf("Operator paused attacker input")
+	} else {
+		ls.lg.Printf("Operator resumed attacker input")
+	}
+}
+
+/* waitUnpaused blocks until the session isn't paused */
+func (ls *liveSession) waitUnpaused() {
+	ls.l.Lock()
+	defer ls.l.Unlock()
+	for ls.paused {
+		ls.cond.Wait()
+	}
+}
+
+/* Kill disconnects the attacker on behalf of the operator */
+func (ls *liveSession) Kill() error {
+	ls.lg.Printf("Operator killed session")
+	return ls.conn.Close()
+}
+
+/* Disconnect disconnects the attacker */
+func (ls *liveSession) Disconnect() {
+	ls.lg.Printf("Disconnecting attacker")
+	ls.conn.Close()
+}
+
+/* Watch returns a watcher for channel ch, or all channels if ch is 0.  The
+watcher should be passed to Unwatch when no longer needed. */
+func (ls *liveSession) Watch(ch int) *watcher {
+	w := &watcher{ch: ch, c: make(chan []byte, 1024)}
+	ls.l.Lock()
+	defer ls.l.Unlock()
+	ls.watchers[w] = struct{}{}
+	return w
+}
+
+/* Unwatch stops sending data to w. */
+func (ls *liveSession) Unwatch(w *watcher) {
+	ls.l.Lock()
+	defer ls.l.Unlock()
+	if _, ok := ls.watchers[w]; ok {
+		delete(ls.watchers, w)
+		close(w.c)
+	}
+}
+
+/* channel returns the live channel with the given ID */
+func (ls *liveSession) channel(id int) (*liveChannel, bool) {
+	ls.l.Lock()
+	defer ls.l.Unlock()
+	lc, ok := ls.chans[id]
+	return lc, ok
+}
+
+/* pausableReader is a reader which holds on to what it reads while its
+session is paused. */
+type pausableReader struct {
+	r  io.Reader
+	ls *liveSession
+}
+
+/* Read implements io.Reader */
+func (p pausableReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.ls.waitUnpaused()
+	return n, err
+}
+
+/* adminListen listens on a Unix socket at path for admin console
+connections.  Only the user running sshhipot may connect.  The socket is made
+in a private directory and moved into place once it's no longer accessible to
+everybody else. */
+func (s *Server) adminListen(path string) (net.Listener, error) {
+	/* Clean up after the last run */
+	if fi, err := os.Lstat(path); nil == err &&
+		0 != fi.Mode()&os.ModeSocket {
+		os.Remove(path)
+	}
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".admin-")
+	if nil != err {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, filepath.Base(path))
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if nil != err {
+		return nil, err
+	}
+	/* The socket won't be where the listener thinks it is */
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); nil != err {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); nil != err {
+		l.Close()
+		return nil, err
+	}
+	s.logf(LEVELINFO, SUBSYSGENERAL, "Admin console on %v", path)
+	return l, nil
+}
+
+/* adminServe serves the admin console for s to anybody who connects to l.  It
+returns when l.Accept fails. */
+func (s *Server) adminServe(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if nil != err {
+			s.logf(
+				LEVELERROR,
+				SUBSYSGENERAL,
+				"Unable to accept admin connection: %v",
+				err,
+			)
+			return
+		}
+		go s.handleAdmin(c)
+	}
+}
+
+/* handleAdmin serves the admin console to c */
+func (s *Server) handleAdmin(c net.Conn) {
+	defer c.Close()
+	s.logf(LEVELINFO, SUBSYSGENERAL, "Admin connected")
+	defer s.logf(LEVELINFO, SUBSYSGENERAL, "Admin disconnected")
+
+	/* Read lines in the background, so we can tell when to stop
+	watching */
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		s := bufio.NewScanner(c)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+	}()
+
+	for l := range lines {
+		args := strings.Fields(l)
+		if 0 == len(args) {
+			continue
+		}
+		s.logf(LEVELINFO, SUBSYSGENERAL, "Admin command: %q", l)
+		if err := s.adminCommand(c, args, l, lines); nil != err {
+			fmt.Fprintf(c, "Error: %v\n", err)
+		}
+	}
+}
+
+/* adminCommand runs the command in args, which came from the line l, sending
+output to w.  lines is used to stop watching. */
+func (s *Server) adminCommand(
+	w io.Writer,
+	args []string,
+	l string,
+	lines <-chan string,
+) error {
+	if "list" == args[0] {
+		s.adminList(w)
+		return nil
+	}
+	if "help" == args[0] {
+		io.WriteString(w, ADMINHELP)
+		return nil
+	}
+	/* Everything else needs a session */
+	if 2 > len(args) {
+		return fmt.Errorf("need a command and session ID (try help)")
+	}
+	ls, ok := s.live.get(args[1])
+	if !ok {
+		return fmt.Errorf("no session with ID %q", args[1])
+	}
+	switch args[0] {
+	case "watch":
+		ch := 0
+		if 3 <= len(args) {
+			var err error
+			if ch, err = strconv.Atoi(args[2]); nil != err {
+				return err
+			}
+		}
+		wr := ls.Watch(ch)
+		defer ls.Unwatch(wr)
+		for {
+			select {
+			case b, ok := <-wr.c:
+				if !ok {
+					fmt.Fprintf(w, "\nSession finished\n")
+					return nil
+				}
+				if _, err := w.Write(b); nil != err {
+					return err
+				}
+			case <-lines:
+				return nil
+			}
+		}
+	case "inject":
+		if 4 > len(args) {
+			return fmt.Errorf("need a channel and data")
+		}
+		id, err := strconv.Atoi(args[2])
+		if nil != err {
+			return err
+		}
+		lc, ok := ls.channel(id)
+		if !ok {
+			return fmt.Errorf("no channel %v", id)
+		}
+		/* Data is everything after the channel, unescaped if it
+		makes sense */
+		d := strings.TrimLeft(l, " \t")
+		for i := 0; i < 3; i++ {
+			d = strings.TrimLeft(d[len(args[i]):], " \t")
+		}
+		if u, err := strconv.Unquote(`"` + d + `"`); nil == err {
+			d = u
+		}
+		return lc.Inject([]byte(d))
+	case "pause":
+		ls.SetPaused(true)
+	case "resume":
+		ls.SetPaused(false)
+	case "kill":
+		return ls.Kill()
+	default:
+		return fmt.Errorf("unknown command %q (try help)", args[0])
+	}
+	return nil
+}
+
+/* adminList lists s's live sessions to w */
+func (s *Server) adminList(w io.Writer) {
+	for _, ls := range s.live.list() {
+		ls.l.Lock()
+		var cs []string
+		for id, lc := range ls.chans {
+			cs = append(cs, fmt.Sprintf("%v:%v", id, lc.cs.Type))
+		}
+		paused := ls.paused
+		ls.l.Unlock()
+		sort.Strings(cs)
+		sess := ls.sess
+		sess.l.Lock()
+		fmt.Fprintf(
+			w,
+			"ID:%v Address:%v User:%q Start:%v Upstream:%q "+
+				"Paused:%v Channels:%v\n",
+			sess.ID,
+			sess.Address,
+			sess.User,
+			sess.Start.Format(LOGTIMEFORMAT),
+			sess.Upstream,
+			paused,
+			strings.Join(cs, ","),
+		)
+		sess.l.Unlock()
+	}
+}
@@ -0,0 +1,233 @@
+package sshhipot
+
+/*
+ * admin_test.go
+ * Tests for the admin console
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* adminDo sends the commands in cmds to the admin console listening on the
+socket at path and returns everything it sends back. */
+func adminDo(t *testing.T, path string, cmds ...string) string {
+	t.Helper()
+	c, err := net.Dial("unix", path)
+	if nil != err {
+		t.Fatalf("Unable to connect to admin console: %v", err)
+	}
+	defer c.Close()
+	for _, cmd := range cmds {
+		if _, err := io.WriteString(c, cmd+"\n"); nil != err {
+			t.Fatalf("Unable to send %q: %v", cmd, err)
+		}
+	}
+	c.(*net.UnixConn).CloseWrite()
+	b, err := ioutil.ReadAll(c)
+	if nil != err {
+		t.Fatalf("Error reading from admin console: %v", err)
+	}
+	return string(b)
+}
+
+func TestAdminSocket(t *testing.T) {
+	dir := t.TempDir()
+	var (
+		hs    []*testHoneypot
+		socks []string
+	)
+	for _, n := range []string{"a1", "a2"} {
+		sock := filepath.Join(dir, n)
+		hs = append(hs, newTestHoneypotConfig(t, func(c *Config) {
+			c.AdminSocket = sock
+		}))
+		socks = append(socks, sock)
+	}
+
+	/* Only we should be able to connect, and there should be no
+	leftovers */
+	for _, sock := range socks {
+		fi, err := os.Stat(sock)
+		if nil != err {
+			t.Fatalf("Unable to stat %v: %v", sock, err)
+		}
+		if 0 == fi.Mode()&os.ModeSocket || 0600 != fi.Mode().Perm() {
+			t.Errorf("Admin socket %v has mode %v", sock, fi.Mode())
+		}
+	}
+	fs, _ := filepath.Glob(filepath.Join(dir, ".admin-*"))
+	if 0 != len(fs) {
+		t.Errorf("Leftover files %q", fs)
+	}
+
+	/* Each Server's console should only know about its own sessions */
+	c := hs[0].Dial(t, ssh.Password(TESTPASSWORD))
+	defer c.Close()
+	var list string
+	waitFor(t, "session in admin console", func() bool {
+		list = adminDo(t, socks[0], "list")
+		return strings.HasPrefix(list, "ID:")
+	})
+	if 1 != strings.Count(list, "\n") {
+		t.Errorf("First console listed %q", list)
+	}
+	if l := adminDo(t, socks[1], "list"); "" != l {
+		t.Errorf("Second console listed %q", l)
+	}
+	id := strings.TrimPrefix(strings.Fields(list)[0], "ID:")
+	if out := adminDo(t, socks[1], "kill "+id); !strings.Contains(
+		out,
+		"no session",
+	) {
+		t.Errorf("Second console killed session: %q", out)
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "admin")
+	h := newTestHoneypotConfig(t, func(c *Config) { c.AdminSocket = sock })
+	c := h.Dial(t, ssh.Password(TESTPASSWORD))
+	defer c.Close()
+	s, err := c.NewSession()
+	if nil != err {
+		t.Fatalf("Unable to open session: %v", err)
+	}
+	in, err := s.StdinPipe()
+	if nil != err {
+		t.Fatalf("Unable to get stdin: %v", err)
+	}
+	out, err := s.StdoutPipe()
+	if nil != err {
+		t.Fatalf("Unable to get stdout: %v", err)
+	}
+	if err := s.Start(TESTCAT); nil != err {
+		t.Fatalf("Unable to start %v: %v", TESTCAT, err)
+	}
+	io.WriteString(in, "hello\n")
+	readUntil(t, out, "hello\n")
+
+	/* Work out the session and channel IDs */
+	list := adminDo(t, sock, "list")
+	var id, ch string
+	for _, f := range strings.Fields(list) {
+		if strings.HasPrefix(f, "ID:") {
+			id = strings.TrimPrefix(f, "ID:")
+		} else if strings.HasPrefix(f, "Channels:") {
+			ch = strings.SplitN(
+				strings.TrimPrefix(f, "Channels:"),
+				":",
+				2,
+			)[0]
+		}
+	}
+	if "" == id || "" == ch {
+		t.Fatalf("Unable to find session and channel in %q", list)
+	}
+
+	/* Things which shouldn't work */
+	for cmd, want := range map[string]string{
+		"help":                    ADMINHELP,
+		"watch":                   "Error: need a command and session",
+		"watch nope":              `Error: no session with ID "nope"`,
+		"frob " + id:              `Error: unknown command "frob"`,
+		"inject " + id:            "Error: need a channel and data",
+		"inject " + id + " x y":   "Error: strconv.Atoi",
+		"inject " + id + " 999 y": "Error: no channel 999",
+		"watch " + id + " x":      "Error: strconv.Atoi",
+	} {
+		if got := adminDo(t, sock, cmd); !strings.HasPrefix(got, want) {
+			t.Errorf("%q: got %q, want %q", cmd, got, want)
+		}
+	}
+
+	/* Injected data goes to the attacker, escapes and all */
+	if got := adminDo(
+		t,
+		sock,
+		"inject "+id+" "+ch+"  \\tinjected  \\x21\\n",
+	); "" != got {
+		t.Errorf("Inject said %q", got)
+	}
+	readUntil(t, out, "\tinjected  !\n")
+
+	/* Watchers see what the attacker sees until they hit Enter */
+	wc, err := net.Dial("unix", sock)
+	if nil != err {
+		t.Fatalf("Unable to connect to admin console: %v", err)
+	}
+	defer wc.Close()
+	io.WriteString(wc, "watch "+id+" "+ch+"\n")
+	waitFor(t, "watcher", func() bool {
+		ls, ok := h.srv.live.get(id)
+		if !ok {
+			return false
+		}
+		ls.l.Lock()
+		defer ls.l.Unlock()
+		return 0 != len(ls.watchers)
+	})
+	io.WriteString(in, "watched\n")
+	readUntil(t, out, "watched\n")
+	readUntil(t, wc, "watched\n")
+	io.WriteString(wc, "\nlist\n")
+	readUntil(t, wc, "ID:"+id)
+
+	/* Paused input doesn't get through until the session's resumed */
+	if got := adminDo(t, sock, "pause "+id); "" != got {
+		t.Errorf("Pause said %q", got)
+	}
+	if l := adminDo(t, sock, "list"); !strings.Contains(l, "Paused:true") {
+		t.Errorf("Paused session listed as %q", l)
+	}
+	outc := make(chan string, 1)
+	go func() {
+		b := make([]byte, BUFLEN)
+		n, _ := out.Read(b)
+		outc <- string(b[:n])
+	}()
+	io.WriteString(in, "held\n")
+	select {
+	case got := <-outc:
+		t.Fatalf("Paused session passed on input: %q", got)
+	case <-time.After(time.Second / 4):
+	}
+	if got := adminDo(t, sock, "resume "+id); "" != got {
+		t.Errorf("Resume said %q", got)
+	}
+	select {
+	case got := <-outc:
+		if "held\n" != got {
+			t.Errorf("Resumed session sent back %q", got)
+		}
+	case <-time.After(TESTTIMEOUT):
+		t.Fatalf("Resumed session didn't pass on input")
+	}
+
+	/* Killing the session disconnects the attacker */
+	if got := adminDo(t, sock, "kill "+id); "" != got {
+		t.Errorf("Kill said %q", got)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(TESTTIMEOUT):
+		t.Fatalf("Killed session still connected")
+	}
+	waitFor(t, "killed session to go", func() bool {
+		return "" == adminDo(t, sock, "list")
+	})
+}
@@ -0,0 +1,542 @@
+package sshhipot
+
+/*
+ * alert.go
+ * Tell someone when something interesting happens
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Events which may be alerted on */
+const (
+	EVENTLOGIN    = "login"
+	EVENTHASSH    = "hassh"
+	EVENTUPLOAD   = "upload"
+	EVENTCOMMAND  = "command"
+	EVENTDURATION = "duration"
+)
+
+const (
+	/* ALERTQUEUELEN is the number of alerts which may wait to be sent to
+	a single destination before more are dropped */
+	ALERTQUEUELEN = 1024
+	/* ALERTTRIES is the number of times we'll try to send an alert */
+	ALERTTRIES = 5
+	/* ALERTTIMEOUT is how long we'll wait for an alert to be sent */
+	ALERTTIMEOUT = 30 * time.Second
+	/* HASSHFILE is the name of the file in the log directory which holds
+	the HASSHes we've seen */
+	HASSHFILE = "hasshes"
+	/* SYSLOGPRI is the syslog priority for alerts, local0.warning */
+	SYSLOGPRI = 16*8 + 4
+)
+
+/* An alerts file has one rule per line, of the form
+
+	event [argument] destination target
+
+Blank lines and lines starting with # are ignored.  The events are
+
+	login
+		An attacker authenticated.
+	hassh
+		A client with a HASSH we've not seen before authenticated.
+	upload
+		The attacker sent a file with scp or SFTP.
+	command regex
+		The attacker ran a command matching regex, which may not
+		contain spaces (use \s).
+	duration duration
+		A session lasted longer than duration (e.g. 10m).
+
+and the destinations are
+
+	webhook URL
+		POST the event, as JSON, to URL.
+	syslog udp://host:port or syslog tcp://host:port
+		Send the event to a syslog server, in RFC 5424 format.
+	command shell-command
+		Run shell-command with /bin/sh, with the event as JSON on
+		stdin.  The event type is in the environment variable
+		SSHHIPOT_EVENT.
+
+Alerts are queued and sent in the background, and retried if they can't be
+sent. */
+
+/* event is something interesting which happened in a session */
+type event struct {
+	Type          string       `json:"type"`
+	Time          time.Time    `json:"time"`
+	Rule          string       `json:"rule"`
+	Session       string       `json:"session"`
+	Address       string       `json:"address"`
+	User          string       `json:"user"`
+	ClientVersion string       `json:"client_version"`
+	HASSH         string       `json:"hassh,omitempty"`
+	Upstream      string       `json:"upstream,omitempty"`
+	Geo           *GeoInfo     `json:"geo,omitempty"`
+	Channel       int          `json:"channel,omitempty"`
+	Command       string       `json:"command,omitempty"`
+	File          *FileSummary `json:"file,omitempty"`
+	Duration      float64      `json:"duration,omitempty"`
+}
+
+/* String describes the event in a single line, for syslog and logging */
+func (e event) String() string {
+	s := fmt.Sprintf(
+		"Event:%v Session:%v Address:%v User:%q Version:%q",
+		e.Type,
+		e.Session,
+		e.Address,
+		e.User,
+		e.ClientVersion,
+	)
+	if "" != e.HASSH {
+		s += " HASSH:" + e.HASSH
+	}
+	if nil != e.Geo {
+		s += " " + e.Geo.String()
+	}
+	switch e.Type {
+	case EVENTCOMMAND:
+		s += fmt.Sprintf(" Channel:%v Command:%q", e.Channel, e.Command)
+	case EVENTUPLOAD:
+		if nil != e.File {
+			s += fmt.Sprintf(
+				" Channel:%v Name:%q Size:%v",
+				e.Channel,
+				e.File.Name,
+				e.File.Size,
+			)
+		}
+	case EVENTDURATION:
+		s += fmt.Sprintf(" Duration:%v", e.Duration)
+	}
+	return s
+}
+
+/* alertRule sends matching events to a destination */
+type alertRule struct {
+	text  string /* The line from the alerts file */
+	event string
+	re    *regexp.Regexp /* Commands to match */
+	after time.Duration  /* For duration events */
+	dest  alertDestination
+	queue chan event
+}
+
+/* alertDestination is somewhere to send alerts */
+type alertDestination interface {
+	Send(e event) error
+}
+
+/* alerter sends alerts according to its rules */
+type alerter struct {
+	rules     []*alertRule
+	seenL     sync.Mutex
+	seen      map[string]struct{} /* HASSHes */
+	seenFile  string
+	hasDurs   bool      /* Some rules want duration events */
+	hasHASSHs bool      /* Some rules want HASSH events */
+	levels    logLevels /* Log verbosity */
+}
+
+/* loadAlerts reads the alert rules from the file named fn and starts
+sending alerts in the background.  HASSHes are remembered in a file in
+logDir.  What happens is logged at the verbosity set by levels.  If fn is the
+empty string, there are no rules and nil is returned. */
+func loadAlerts(fn, logDir string, levels logLevels) (*alerter, error) {
+	if "" == fn {
+		return nil, nil
+	}
+	f, err := os.Open(fn)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+	a := &alerter{
+		levels:   levels,
+		seen:     make(map[string]struct{}),
+		seenFile: filepath.Join(logDir, HASSHFILE),
+	}
+	var (
+		s  = bufio.NewScanner(f)
+		ln int
+	)
+	for s.Scan() {
+		ln++
+		l := strings.TrimSpace(s.Text())
+		if "" == l || strings.HasPrefix(l, "#") {
+			continue
+		}
+		r, err := parseAlertRule(l)
+		if nil != err {
+			return nil, fmt.Errorf("line %v: %v", ln, err)
+		}
+		switch r.event {
+		case EVENTDURATION:
+			a.hasDurs = true
+		case EVENTHASSH:
+			a.hasHASSHs = true
+		}
+		a.rules = append(a.rules, r)
+	}
+	if err := s.Err(); nil != err {
+		return nil, err
+	}
+
+	/* Work out which HASSHes we've seen */
+	if err := a.loadHASSHs(); nil != err {
+		return nil, err
+	}
+
+	/* Start sending alerts */
+	for _, r := range a.rules {
+		go r.send(a.levels)
+	}
+	return a, nil
+}
+
+/* parseAlertRule parses a single line from an alerts file */
+func parseAlertRule(l string) (*alertRule, error) {
+	all := strings.Fields(l)
+	if 0 == len(all) {
+		return nil, fmt.Errorf("empty rule")
+	}
+	r := &alertRule{
+		text:  l,
+		event: all[0],
+		queue: make(chan event, ALERTQUEUELEN),
+	}
+	fs := all[1:]
+
+	/* Some events need an argument */
+	var err error
+	switch r.event {
+	case EVENTLOGIN, EVENTHASSH, EVENTUPLOAD:
+	case EVENTCOMMAND:
+		if 0 == len(fs) {
+			return nil, fmt.Errorf("command needs a regex")
+		}
+		if r.re, err = regexp.Compile(fs[0]); nil != err {
+			return nil, err
+		}
+		fs = fs[1:]
+	case EVENTDURATION:
+		if 0 == len(fs) {
+			return nil, fmt.Errorf("duration needs a duration")
+		}
+		if r.after, err = time.ParseDuration(fs[0]); nil != err {
+			return nil, err
+		}
+		fs = fs[1:]
+	default:
+		return nil, fmt.Errorf("unknown event %q", r.event)
+	}
+
+	/* Target is everything after the destination */
+	if 2 > len(fs) {
+		return nil, fmt.Errorf("need a destination and target")
+	}
+	target := l
+	for _, f := range all[:len(all)-len(fs)+1] {
+		target = strings.TrimLeft(target[len(f):], " \t")
+	}
+	switch fs[0] {
+	case "webhook":
+		if _, err := url.Parse(target); nil != err {
+			return nil, err
+		}
+		r.dest = webhook{url: target}
+	case "syslog":
+		u, err := url.Parse(target)
+		if nil != err {
+			return nil, err
+		}
+		if "udp" != u.Scheme && "tcp" != u.Scheme {
+			return nil, fmt.Errorf(
+				"syslog needs udp://host:port or " +
+					"tcp://host:port",
+			)
+		}
+		r.dest = &syslogger{network: u.Scheme, addr: u.Host}
+	case "command":
+		r.dest = alertCommand(target)
+	default:
+		return nil, fmt.Errorf("unknown destination %q", fs[0])
+	}
+	return r, nil
+}
+
+/* loadHASSHs reads the HASSHes we've already seen */
+func (a *alerter) loadHASSHs() error {
+	b, err := ioutil.ReadFile(a.seenFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if nil != err {
+		return err
+	}
+	for _, h := range strings.Fields(string(b)) {
+		a.seen[h] = struct{}{}
+	}
+	return nil
+}
+
+/* NewHASSH returns true if we've not seen HASSH h before, and remembers it.
+Nothing is remembered if there are no rules for HASSH events. */
+func (a *alerter) NewHASSH(h string) bool {
+	if nil == a || !a.hasHASSHs || "" == h {
+		return false
+	}
+	a.seenL.Lock()
+	defer a.seenL.Unlock()
+	if _, ok := a.seen[h]; ok {
+		return false
+	}
+	a.seen[h] = struct{}{}
+	f, err := os.OpenFile(
+		a.seenFile,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600,
+	)
+	if nil != err {
+		logf(
+			a.levels,
+			LEVELWARN,
+			SUBSYSGENERAL,
+			"Unable to remember HASSH %v: %v",
+			h,
+			err,
+		)
+		return true
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%v\n", h); nil != err {
+		logf(
+			a.levels,
+			LEVELWARN,
+			SUBSYSGENERAL,
+			"Unable to remember HASSH %v: %v",
+			h,
+			err,
+		)
+	}
+	return true
+}
+
+/* Send queues e to be sent to the destination of every matching rule.  If a
+queue is full, the alert is dropped. */
+func (a *alerter) Send(e event) {
+	if nil == a {
+		return
+	}
+	for _, r := range a.rules {
+		if !r.matches(e) {
+			continue
+		}
+		re := e
+		re.Rule = r.text
+		select {
+		case r.queue <- re:
+		default:
+			logf(
+				a.levels,
+				LEVELWARN,
+				SUBSYSGENERAL,
+				"Alert queue full, dropped %v",
+				re,
+			)
+		}
+	}
+}
+
+/* Watch sends duration events for the session s.  The returned function
+should be called when the session's finished. */
+func (a *alerter) Watch(s *Session) func() {
+	if nil == a || !a.hasDurs {
+		return func() {}
+	}
+	var ts []*time.Timer
+	for _, r := range a.rules {
+		if EVENTDURATION != r.event {
+			continue
+		}
+		r := r
+		ts = append(ts, time.AfterFunc(r.after, func() {
+			e := s.event(EVENTDURATION, nil)
+			e.Duration = r.after.Seconds()
+			e.Rule = r.text
+			select {
+			case r.queue <- e:
+			default:
+				logf(
+					a.levels,
+					LEVELWARN,
+					SUBSYSGENERAL,
+					"Alert queue full, dropped %v",
+					e,
+				)
+			}
+		}))
+	}
+	return func() {
+		for _, t := range ts {
+			t.Stop()
+		}
+	}
+}
+
+/* matches returns true if e should be sent to r's destination.  Duration
+events are handled by Watch. */
+func (r *alertRule) matches(e event) bool {
+	if r.event != e.Type {
+		return false
+	}
+	switch r.event {
+	case EVENTCOMMAND:
+		return r.re.MatchString(e.Command)
+	case EVENTDURATION:
+		return false
+	}
+	return true
+}
+
+/* send sends queued alerts to r's destination, logging at the verbosity set
+by ls.  It does not return. */
+func (r *alertRule) send(ls logLevels) {
+	for e := range r.queue {
+		for i := 0; i < ALERTTRIES; i++ {
+			err := r.dest.Send(e)
+			if nil == err {
+				logf(
+					ls,
+					LEVELINFO,
+					SUBSYSGENERAL,
+					"Sent alert %v Rule:%q",
+					e,
+					r.text,
+				)
+				break
+			}
+			logf(
+				ls,
+				LEVELWARN,
+				SUBSYSGENERAL,
+				"Unable to send alert Rule:%q Try:%v Error:%v",
+				r.text,
+				i+1,
+				err,
+			)
+			time.Sleep(time.Duration(1<<uint(i)) * time.Second)
+		}
+	}
+}
+
+/* webhook POSTs alerts as JSON to a URL */
+type webhook struct {
+	url string
+}
+
+/* Send implements alertDestination */
+func (w webhook) Send(e event) error {
+	b, err := json.Marshal(e)
+	if nil != err {
+		return err
+	}
+	c := &http.Client{Timeout: ALERTTIMEOUT}
+	res, err := c.Post(w.url, "application/json", bytes.NewReader(b))
+	if nil != err {
+		return err
+	}
+	defer res.Body.Close()
+	ioutil.ReadAll(res.Body)
+	if 200 > res.StatusCode || 300 <= res.StatusCode {
+		return fmt.Errorf("response status %v", res.Status)
+	}
+	return nil
+}
+
+/* syslogger sends alerts to a syslog server in RFC 5424 format */
+type syslogger struct {
+	l       sync.Mutex
+	network string
+	addr    string
+	c       net.Conn
+}
+
+/* Send implements alertDestination */
+func (s *syslogger) Send(e event) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if nil == s.c {
+		c, err := net.DialTimeout(s.network, s.addr, ALERTTIMEOUT)
+		if nil != err {
+			return err
+		}
+		s.c = c
+	}
+	hn, err := os.Hostname()
+	if nil != err || "" == hn {
+		hn = "-"
+	}
+	msg := fmt.Sprintf(
+		"<%v>1 %v %v sshhipot %v %v - %v",
+		SYSLOGPRI,
+		e.Time.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		hn,
+		os.Getpid(),
+		e.Type,
+		e,
+	)
+	/* TCP uses octet counting (RFC 6587) */
+	if "tcp" == s.network {
+		msg = fmt.Sprintf("%v %v", len(msg), msg)
+	}
+	s.c.SetWriteDeadline(time.Now().Add(ALERTTIMEOUT))
+	if _, err := s.c.Write([]byte(msg)); nil != err {
+		s.c.Close()
+		s.c = nil
+		return err
+	}
+	return nil
+}
+
+/* alertCommand is a shell command to which alerts are sent */
+type alertCommand string
+
+/* Send implements alertDestination */
+func (a alertCommand) Send(e event) error {
+	b, err := json.Marshal(e)
+	if nil != err {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ALERTTIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", string(a))
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Env = append(os.Environ(), "SSHHIPOT_EVENT="+e.Type)
+	if o, err := cmd.CombinedOutput(); nil != err {
+		return fmt.Errorf("%v (output %q)", err, o)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package sshhipot
+
+/*
+ * alert_test.go
+ * Tests for alerts
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAlertRule(t *testing.T) {
+	for l, ok := range map[string]bool{
+		"login webhook http://127.0.0.1/x":          true,
+		"upload command cat >/dev/null":             true,
+		`command ^wget\s syslog tcp://10.0.0.5:601`: true,
+		"duration 10m webhook http://127.0.0.1/x":   true,
+		"hassh syslog udp://10.0.0.5:514":           true,
+		"login":                                     false,
+		"login webhook":                             false,
+		"logout webhook http://127.0.0.1/x":         false,
+		"login email root@localhost":                false,
+		"command ( webhook http://127.0.0.1/x":      false,
+		"duration soon webhook http://127.0.0.1/x":  false,
+		"hassh syslog http://10.0.0.5:514":          false,
+	} {
+		if _, err := parseAlertRule(l); ok != (nil == err) {
+			t.Errorf("%q: error %v", l, err)
+		}
+	}
+
+	/* The target is everything after the destination */
+	r, err := parseAlertRule("upload  command\tcat  >/dev/null")
+	if nil != err {
+		t.Fatalf("Unable to parse rule: %v", err)
+	}
+	if "cat  >/dev/null" != string(r.dest.(alertCommand)) {
+		t.Errorf("Wrong command %q", r.dest)
+	}
+}
+
+func TestAlertWebhook(t *testing.T) {
+	evs := make(chan event, 10)
+	hs := httptest.NewServer(http.HandlerFunc(func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		var e event
+		if err := json.NewDecoder(r.Body).Decode(&e); nil != err {
+			t.Errorf("Unable to decode event: %v", err)
+		}
+		e.Rule = r.URL.Path + " " + e.Rule
+		evs <- e
+	}))
+	defer hs.Close()
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "alerts")
+	if err := ioutil.WriteFile(fn, []byte(fmt.Sprintf(
+		"# Comment\n\n"+
+			"command ^wget\\s webhook %[1]v/wget\n"+
+			"login webhook %[1]v/login\n",
+		hs.URL,
+	)), 0600); nil != err {
+		t.Fatalf("Unable to write alerts file: %v", err)
+	}
+	a, err := loadAlerts(fn, dir, nil)
+	if nil != err {
+		t.Fatalf("Unable to load alerts: %v", err)
+	}
+
+	/* Only matching events should be sent */
+	a.Send(event{Type: EVENTCOMMAND, Command: "id"})
+	a.Send(event{Type: EVENTUPLOAD})
+	a.Send(event{Type: EVENTCOMMAND, Command: "wget http://x"})
+	a.Send(event{Type: EVENTLOGIN, User: "root"})
+	got := make(map[string]event)
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-evs:
+			got[e.Type] = e
+		case <-time.After(TESTTIMEOUT):
+			t.Fatalf("Timeout waiting for alert %v", i)
+		}
+	}
+	if e := got[EVENTCOMMAND]; "wget http://x" != e.Command ||
+		`/wget command ^wget\s webhook `+hs.URL+"/wget" != e.Rule {
+		t.Errorf("Wrong command alert %+v", e)
+	}
+	if e := got[EVENTLOGIN]; "root" != e.User ||
+		"/login login webhook "+hs.URL+"/login" != e.Rule {
+		t.Errorf("Wrong login alert %+v", e)
+	}
+	select {
+	case e := <-evs:
+		t.Errorf("Unexpected alert %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAlertCommand(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	a := alertCommand(fmt.Sprintf(
+		`{ cat; echo; echo "$SSHHIPOT_EVENT"; } >%v`,
+		out,
+	))
+	if err := a.Send(event{
+		Type:    EVENTCOMMAND,
+		Command: "id",
+	}); nil != err {
+		t.Fatalf("Error running command: %v", err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if nil != err {
+		t.Fatalf("Unable to read command's output: %v", err)
+	}
+	parts := strings.SplitN(strings.TrimSpace(string(b)), "\n", 2)
+	if 2 != len(parts) {
+		t.Fatalf("Command output %q", b)
+	}
+	var e event
+	if err := json.Unmarshal([]byte(parts[0]), &e); nil != err {
+		t.Errorf("Unable to unmarshal %q: %v", parts[0], err)
+	} else if EVENTCOMMAND != e.Type || "id" != e.Command {
+		t.Errorf("Command got event %+v", e)
+	}
+	if EVENTCOMMAND != parts[1] {
+		t.Errorf("SSHHIPOT_EVENT is %q", parts[1])
+	}
+
+	/* Failures should be errors */
+	if err := alertCommand("echo no; false").Send(
+		event{Type: EVENTLOGIN},
+	); nil == err || !strings.Contains(err.Error(), `"no\n"`) {
+		t.Errorf("Failing command gave error %v", err)
+	}
+}
+
+func TestAlertNewHASSH(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "alerts")
+	if err := ioutil.WriteFile(
+		fn,
+		[]byte("hassh command true\n"),
+		0600,
+	); nil != err {
+		t.Fatalf("Unable to write alerts file: %v", err)
+	}
+	a, err := loadAlerts(fn, dir, nil)
+	if nil != err {
+		t.Fatalf("Unable to load alerts: %v", err)
+	}
+	if !a.NewHASSH("h1") || a.NewHASSH("h1") {
+		t.Errorf("h1 not new exactly once")
+	}
+
+	/* HASSHes should be remembered between restarts */
+	if a, err = loadAlerts(fn, dir, nil); nil != err {
+		t.Fatalf("Unable to reload alerts: %v", err)
+	}
+	if a.NewHASSH("h1") || !a.NewHASSH("h2") {
+		t.Errorf("HASSHes not remembered")
+	}
+}
@@ -0,0 +1,586 @@
+package sshhipot
+
+/*
+ * artifact.go
+ * Keep one copy of every file attackers send
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	/* ARTIFACTDIR is the name of the directory in the log directory in
+	which artifacts are stored */
+	ARTIFACTDIR = "artifacts"
+	/* ARTIFACTSUFFIX is added to an artifact's name to get the name of
+	the file with its metadata */
+	ARTIFACTSUFFIX = ".json"
+	/* ARTIFACTMAX is the largest artifact which will be stored */
+	ARTIFACTMAX = 64 * 1024 * 1024
+	/* ARTIFACTSTDINMIN is the smallest exec'd command's input which will
+	be stored as an artifact */
+	ARTIFACTSTDINMIN = 4096
+	/* YARATIMEOUT is how long YARA may take to scan an artifact */
+	YARATIMEOUT = time.Minute
+)
+
+/* Ways artifacts are captured */
+const (
+	ARTIFACTSCP   = "scp"   /* Uploaded with scp */
+	ARTIFACTSFTP  = "sftp"  /* Uploaded with SFTP */
+	ARTIFACTSTDIN = "stdin" /* Sent to an exec'd command */
+	ARTIFACTURL   = "url"   /* Downloaded by the attacker */
+)
+
+/* errArtifactTooBig is returned when an artifact's bigger than ARTIFACTMAX */
+var errArtifactTooBig = fmt.Errorf("larger than %v bytes", ARTIFACTMAX)
+
+/* Artifact describes a captured file.  Files are named after their SHA256
+hashes, and the Artifact is next to the file, with ARTIFACTSUFFIX added to the
+name. */
+type Artifact struct {
+	SHA256      string           `json:"sha256"`
+	Size        int64            `json:"size"`
+	ContentType string           `json:"content_type,omitempty"`
+	First       time.Time        `json:"first"`
+	Last        time.Time        `json:"last"`
+	Names       []string         `json:"names"`
+	Sessions    []string         `json:"sessions"`
+	Tags        []string         `json:"tags,omitempty"`
+	Sources     []ArtifactSource `json:"sources"`
+}
+
+/* ArtifactSource is how an artifact was captured, or for a URL which hasn't
+been downloaded yet, how it will be.  Error and Tries are only set for URLs
+waiting to be downloaded. */
+type ArtifactSource struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"` /* One of the ARTIFACT* kinds */
+	Name    string    `json:"name,omitempty"`
+	URL     string    `json:"url,omitempty"`
+	Session string    `json:"session"`
+	Channel int       `json:"channel"`
+	Command string    `json:"command,omitempty"`
+	Address string    `json:"address"`
+	Error   string    `json:"error,omitempty"`
+	Tries   int       `json:"tries,omitempty"` /* Failed downloads */
+}
+
+/* artifactStore stores artifacts in a directory.  If it's got YARA rules,
+artifacts are scanned in the background when they're first stored and tagged
+with the rules they match.  A nil *artifactStore stores nothing. */
+type artifactStore struct {
+	dir    string
+	rules  []string       /* YARA rule files */
+	l      sync.Mutex     /* Metadata */
+	scans  sync.WaitGroup /* Running YARA scans */
+	levels logLevels      /* Log verbosity */
+}
+
+/* openArtifactStore opens the artifact store in dir, which will be created if
+it doesn't exist.  If yaraDir isn't the empty string, artifacts are scanned
+with the YARA rules in the .yar and .yara files in yaraDir.  What happens is
+logged at the verbosity set by levels. */
+func openArtifactStore(
+	dir string,
+	yaraDir string,
+	levels logLevels,
+) (*artifactStore, error) {
+	if err := os.MkdirAll(dir, 0700); nil != err {
+		return nil, err
+	}
+	a := &artifactStore{dir: dir, levels: levels}
+	if "" == yaraDir {
+		return a, nil
+	}
+	if err := filepath.Walk(yaraDir, func(
+		p string,
+		fi os.FileInfo,
+		err error,
+	) error {
+		if nil != err {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".yar", ".yara":
+			if !fi.IsDir() {
+				a.rules = append(a.rules, p)
+			}
+		}
+		return nil
+	}); nil != err {
+		return nil, fmt.Errorf("finding YARA rules: %v", err)
+	}
+	if 0 == len(a.rules) {
+		return nil, fmt.Errorf("no YARA rules in %v", yaraDir)
+	}
+	if _, err := exec.LookPath("yara"); nil != err {
+		return nil, fmt.Errorf("finding yara: %v", err)
+	}
+	return a, nil
+}
+
+/* Create returns an artifactWriter which writes a new artifact to the store.
+If a is nil, Create returns nil. */
+func (a *artifactStore) Create() (*artifactWriter, error) {
+	if nil == a {
+		return nil, nil
+	}
+	f, err := ioutil.TempFile(a.dir, ".artifact-")
+	if nil != err {
+		return nil, err
+	}
+	return &artifactWriter{st: a, f: f, h: sha256.New()}, nil
+}
+
+/* artifactWriter writes a single artifact.  Once it's written, it should be
+saved with Commit or thrown away with Abort.  A nil *artifactWriter discards
+everything. */
+type artifactWriter struct {
+	st   *artifactStore
+	f    *os.File
+	h    hash.Hash /* Nil if the writes weren't in order */
+	size int64
+	err  error
+}
+
+/* Write writes b to the end of the artifact.  It always succeeds, but if the
+artifact gets too big or writing fails, Commit will return an error. */
+func (w *artifactWriter) Write(b []byte) (int, error) {
+	if nil == w {
+		return len(b), nil
+	}
+	w.writeAt(b, w.size)
+	return len(b), nil
+}
+
+/* WriteAt writes b to the artifact at offset off.  As with Write, errors
+are saved for Commit. */
+func (w *artifactWriter) WriteAt(b []byte, off int64) (int, error) {
+	if nil == w {
+		return len(b), nil
+	}
+	w.writeAt(b, off)
+	return len(b), nil
+}
+
+/* writeAt does the writing for Write and WriteAt */
+func (w *artifactWriter) writeAt(b []byte, off int64) {
+	if nil != w.err {
+		return
+	}
+	if 0 > off || ARTIFACTMAX < off+int64(len(b)) {
+		w.err = errArtifactTooBig
+		return
+	}
+	if _, w.err = w.f.WriteAt(b, off); nil != w.err {
+		return
+	}
+	/* Hash as we go, if we can */
+	if nil != w.h && w.size == off {
+		w.h.Write(b)
+	} else {
+		w.h = nil
+	}
+	if end := off + int64(len(b)); end > w.size {
+		w.size = end
+	}
+}
+
+/* Size returns the number of bytes in the artifact so far */
+func (w *artifactWriter) Size() int64 {
+	if nil == w {
+		return 0
+	}
+	return w.size
+}
+
+/* Abort throws away the artifact */
+func (w *artifactWriter) Abort() {
+	if nil == w {
+		return
+	}
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+/* Commit puts the artifact in the store, unless it's there already, and adds
+src and ctype, the content type if it's not the empty string, to its
+metadata. */
+func (w *artifactWriter) Commit(
+	src ArtifactSource,
+	ctype string,
+) (*Artifact, error) {
+	if nil == w {
+		return nil, nil
+	}
+	defer w.Abort()
+	if nil != w.err {
+		return nil, w.err
+	}
+
+	/* Work out the hash, if we couldn't as it was written */
+	h := w.h
+	if nil == h {
+		h = sha256.New()
+		if _, err := io.Copy(
+			h,
+			io.NewSectionReader(w.f, 0, w.size),
+		); nil != err {
+			return nil, err
+		}
+	}
+	if err := w.f.Close(); nil != err {
+		return nil, err
+	}
+	sha := hex.EncodeToString(h.Sum(nil))
+
+	/* Put it in place, unless we have it already */
+	fn := filepath.Join(w.st.dir, sha)
+	isNew := false
+	if _, err := os.Stat(fn); os.IsNotExist(err) {
+		if err := os.Rename(w.f.Name(), fn); nil != err {
+			return nil, err
+		}
+		isNew = true
+	} else if nil != err {
+		return nil, err
+	}
+	art, err := w.st.update(sha, func(art *Artifact) {
+		art.Size = w.size
+		if "" != ctype {
+			art.ContentType = ctype
+		}
+		src.Error, src.Tries = "", 0
+		art.Sources = append(art.Sources, src)
+		art.Names = addUnique(art.Names, src.Name)
+		art.Sessions = addUnique(art.Sessions, src.Session)
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	/* Tag new ones */
+	if isNew && 0 != len(w.st.rules) {
+		w.st.scans.Add(1)
+		go w.st.scan(sha)
+	}
+	return art, nil
+}
+
+/* Trim removes the least-recently-seen artifacts until the store is no
+larger than max bytes.  Other files in the store, like the pending URLs, count
+towards max but aren't removed.  Trim is a no-op if a is nil. */
+func (a *artifactStore) Trim(max int64) error {
+	if nil == a {
+		return nil
+	}
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	/* Work out how big each artifact is and when it was last seen */
+	fis, err := ioutil.ReadDir(a.dir)
+	if nil != err {
+		return err
+	}
+	type entry struct {
+		sha  string
+		size int64     /* File and metadata */
+		last time.Time /* Latest modification time */
+	}
+	var (
+		total int64
+		es    []*entry
+		bySHA = make(map[string]*entry)
+	)
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		total += fi.Size()
+		sha := strings.TrimSuffix(fi.Name(), ARTIFACTSUFFIX)
+		if _, err := hex.DecodeString(sha); nil != err ||
+			2*sha256.Size != len(sha) {
+			continue
+		}
+		e, ok := bySHA[sha]
+		if !ok {
+			e = &entry{sha: sha}
+			bySHA[sha] = e
+			es = append(es, e)
+		}
+		e.size += fi.Size()
+		if fi.ModTime().After(e.last) {
+			e.last = fi.ModTime()
+		}
+	}
+	if total <= max {
+		return nil
+	}
+
+	/* Remove the oldest until we're under */
+	sort.Slice(es, func(i, j int) bool {
+		return es[i].last.Before(es[j].last)
+	})
+	for _, e := range es {
+		if total <= max {
+			break
+		}
+		for _, n := range []string{e.sha, e.sha + ARTIFACTSUFFIX} {
+			err := os.Remove(filepath.Join(a.dir, n))
+			if nil != err && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		logf(
+			a.levels,
+			LEVELINFO,
+			SUBSYSGENERAL,
+			"Removed artifact %v (%v bytes) to enforce artifact "+
+				"quota",
+			e.sha,
+			e.size,
+		)
+		total -= e.size
+	}
+	if total > max {
+		logf(
+			a.levels,
+			LEVELWARN,
+			SUBSYSGENERAL,
+			"Artifact store %v still %v bytes over quota",
+			a.dir,
+			total-max,
+		)
+	}
+	return nil
+}
+
+/* update calls f to change the metadata for the artifact with the given
+hash, and writes it back. */
+func (a *artifactStore) update(
+	sha string,
+	f func(*Artifact),
+) (*Artifact, error) {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	/* Get what we have so far */
+	fn := filepath.Join(a.dir, sha+ARTIFACTSUFFIX)
+	now := time.Now()
+	art := &Artifact{SHA256: sha, First: now}
+	b, err := ioutil.ReadFile(fn)
+	if nil == err {
+		if err := json.Unmarshal(b, art); nil != err {
+			return nil, fmt.Errorf("parsing %v: %v", fn, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	/* Change it and write it back */
+	art.Last = now
+	f(art)
+	if b, err = json.MarshalIndent(art, "", "\t"); nil != err {
+		return nil, err
+	}
+	tfn := fn + ".tmp"
+	if err := ioutil.WriteFile(tfn, b, 0600); nil != err {
+		return nil, err
+	}
+	return art, os.Rename(tfn, fn)
+}
+
+/* scan scans the artifact with the given hash with YARA and tags it with the
+names of the rules it matches.  a.scans.Done is called when it's done. */
+func (a *artifactStore) scan(sha string) {
+	defer a.scans.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), YARATIMEOUT)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(
+		ctx,
+		"yara",
+		append(append([]string{"-w"}, a.rules...),
+			filepath.Join(a.dir, sha))...,
+	)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if nil != err {
+		logf(
+			a.levels,
+			LEVELWARN,
+			SUBSYSGENERAL,
+			"Unable to scan artifact %v: %v (%q)",
+			sha,
+			err,
+			strings.TrimSpace(stderr.String()),
+		)
+		return
+	}
+
+	/* Lines are rule names followed by the file */
+	var tags []string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		if fs := strings.Fields(s.Text()); 0 != len(fs) {
+			tags = addUnique(tags, fs[0])
+		}
+	}
+	if 0 == len(tags) {
+		return
+	}
+	if _, err := a.update(sha, func(art *Artifact) {
+		for _, t := range tags {
+			art.Tags = addUnique(art.Tags, t)
+		}
+	}); nil != err {
+		logf(
+			a.levels,
+			LEVELERROR,
+			SUBSYSGENERAL,
+			"Unable to tag artifact %v: %v",
+			sha,
+			err,
+		)
+		return
+	}
+	logf(
+		a.levels,
+		LEVELINFO,
+		SUBSYSGENERAL,
+		"Artifact SHA256:%v Tags:%q",
+		sha,
+		tags,
+	)
+}
+
+/* Wait waits for running YARA scans to finish */
+func (a *artifactStore) Wait() {
+	if nil == a {
+		return
+	}
+	a.scans.Wait()
+}
+
+/* addUnique adds s to ss, in order, if it's not empty and not already in
+ss. */
+func addUnique(ss []string, s string) []string {
+	if "" == s {
+		return ss
+	}
+	i := sort.SearchStrings(ss, s)
+	if i < len(ss) && s == ss[i] {
+		return ss
+	}
+	ss = append(ss, "")
+	copy(ss[i+1:], ss[i:])
+	ss[i] = s
+	return ss
+}
+
+/* blobWatcher stores the data it's fed as an artifact once it's been
+enabled.  Errors are logged to clg. */
+type blobWatcher struct {
+	l   sync.Mutex
+	st  *artifactStore
+	clg *log.Logger
+	w   *artifactWriter
+}
+
+/* Enable starts saving data */
+func (b *blobWatcher) Enable() {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if nil != b.w {
+		return
+	}
+	var err error
+	if b.w, err = b.st.Create(); nil != err {
+		b.clg.Printf("Unable to start saving input: %v", err)
+	}
+}
+
+/* Input saves p, if b's enabled */
+func (b *blobWatcher) Input(p []byte) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.w.Write(p)
+}
+
+/* Finish stops saving data and returns what's been saved, if anything. */
+func (b *blobWatcher) Finish() *artifactWriter {
+	b.l.Lock()
+	defer b.l.Unlock()
+	w := b.w
+	b.w = nil
+	return w
+}
+
+/* storeArtifact commits the artifact being written by w, which was captured
+on channel c in the way given by kind.  The artifact's hash is logged to clg
+and returned, or the empty string if w is nil or there's an error. */
+func (s *Session) storeArtifact(
+	c *ChannelSummary,
+	w *artifactWriter,
+	kind string,
+	name string,
+	cmd string,
+	clg *log.Logger,
+) string {
+	if nil == w {
+		return ""
+	}
+	art, err := w.Commit(ArtifactSource{
+		Time:    time.Now(),
+		Kind:    kind,
+		Name:    name,
+		Session: s.ID,
+		Channel: c.ID,
+		Command: cmd,
+		Address: s.Address,
+	}, "")
+	if errors.Is(err, errArtifactTooBig) {
+		clg.Printf("Not storing %v artifact %q: %v", kind, name, err)
+		return ""
+	} else if nil != err {
+		clg.Printf(
+			"Unable to store %v artifact %q: %v",
+			kind,
+			name,
+			err,
+		)
+		return ""
+	}
+	clg.Printf(
+		"Artifact SHA256:%v Size:%v Kind:%v Name:%q",
+		art.SHA256,
+		art.Size,
+		kind,
+		name,
+	)
+	s.addArtifact(art.SHA256)
+	return art.SHA256
+}
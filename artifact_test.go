@@ -0,0 +1,295 @@
+package sshhipot
+
+/*
+ * artifact_test.go
+ * Tests for the artifact store
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/* sftpPacket builds an SFTP packet from typ and fields, which may be
+uint32s, uint64s, or strings. */
+func sftpPacket(typ byte, fields ...interface{}) []byte {
+	b := []byte{0, 0, 0, 0, typ}
+	for _, f := range fields {
+		switch v := f.(type) {
+		case uint32:
+			b = binary.BigEndian.AppendUint32(b, v)
+		case uint64:
+			b = binary.BigEndian.AppendUint64(b, v)
+		case string:
+			b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+			b = append(b, v...)
+		}
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b
+}
+
+/* readTestArtifact reads the metadata for the artifact with the given hash
+from the store in dir. */
+func readTestArtifact(t *testing.T, dir, sha string) Artifact {
+	t.Helper()
+	var a Artifact
+	b, err := ioutil.ReadFile(filepath.Join(dir, sha+ARTIFACTSUFFIX))
+	if nil != err {
+		t.Fatalf("Unable to read artifact metadata: %v", err)
+	}
+	if err := json.Unmarshal(b, &a); nil != err {
+		t.Fatalf("Unable to parse artifact metadata: %v", err)
+	}
+	return a
+}
+
+func TestSFTPWatcher(t *testing.T) {
+	dir := t.TempDir()
+	st, err := openArtifactStore(dir, "", nil)
+	if nil != err {
+		t.Fatalf("Unable to open store: %v", err)
+	}
+	var (
+		files []FileSummary
+		shas  []string
+	)
+	s := newSFTPWatcher(st, func(f FileSummary, w *artifactWriter) {
+		files = append(files, f)
+		a, err := w.Commit(ArtifactSource{
+			Kind:    ARTIFACTSFTP,
+			Name:    f.Name,
+			Session: "test",
+		}, "")
+		if nil != err {
+			t.Errorf("Unable to commit %q: %v", f.Name, err)
+			return
+		}
+		shas = append(shas, a.SHA256)
+	})
+
+	/* Nothing happens until it's enabled */
+	s.Input(sftpPacket(sftpOpen, uint32(1), "ignored", uint32(0x1a),
+		uint32(0)))
+	s.Enable()
+
+	/* Open one file for writing and one for reading */
+	open := sftpPacket(sftpOpen, uint32(2), "/tmp/bot", uint32(0x1a),
+		uint32(sftpAttrPerms), uint32(0100755))
+	s.Input(open[:7]) /* Packets may be split */
+	s.Input(open[7:])
+	s.Input(sftpPacket(sftpOpen, uint32(3), "/etc/passwd", uint32(0x01),
+		uint32(0)))
+	s.Output(append(
+		sftpPacket(sftpHandle, uint32(2), "h2"),
+		sftpPacket(sftpHandle, uint32(3), "h3")...,
+	))
+
+	/* Write to it out of order and close it */
+	s.Input(append(
+		sftpPacket(sftpWrite, uint32(4), "h2", uint64(6), "world\n"),
+		sftpPacket(sftpWrite, uint32(5), "h2", uint64(0), "hello ")...,
+	))
+	s.Input(sftpPacket(sftpClose, uint32(6), "h3"))
+	s.Input(sftpPacket(sftpClose, uint32(7), "h2"))
+
+	/* A file which doesn't get closed */
+	s.Input(sftpPacket(sftpOpen, uint32(8), "/tmp/x", uint32(0x1a),
+		uint32(0)))
+	s.Output(sftpPacket(sftpHandle, uint32(8), "h8"))
+	s.Input(sftpPacket(sftpWrite, uint32(9), "h8", uint64(0), "x"))
+	s.Finish()
+
+	want := []FileSummary{{
+		Direction: UPLOAD,
+		Name:      "/tmp/bot",
+		Mode:      "0755",
+		Size:      12,
+	}, {
+		Direction: UPLOAD,
+		Name:      "/tmp/x",
+		Size:      1,
+	}}
+	for i := range files {
+		files[i].Time = want[0].Time
+	}
+	if !reflect.DeepEqual(want, files) {
+		t.Fatalf("Got files:\n%+v\nwant:\n%+v", files, want)
+	}
+	for i, c := range []string{"hello world\n", "x"} {
+		sha := fmt.Sprintf("%x", sha256.Sum256([]byte(c)))
+		if sha != shas[i] {
+			t.Errorf(
+				"File %v has hash %v, want %v",
+				i,
+				shas[i],
+				sha,
+			)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, sha))
+		if nil != err || c != string(b) {
+			t.Errorf("File %v is %q (%v), want %q", i, b, err, c)
+		}
+	}
+	if a := readTestArtifact(t, dir, shas[0]); !reflect.DeepEqual(
+		[]string{"/tmp/bot"},
+		a.Names,
+	) {
+		t.Errorf("Artifact names %q", a.Names)
+	}
+}
+
+func TestArtifactYARA(t *testing.T) {
+	/* Stand-in for yara, which matches files with EVIL in them */
+	bin := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(bin, "yara"), []byte(`#!/bin/sh
+for f; do :; done
+if grep -q EVIL "$f"; then echo "is_evil $f"; echo "also_bad $f"; fi
+`), 0700); nil != err {
+		t.Fatalf("Unable to write fake yara: %v", err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	/* Need rules to scan */
+	rules := t.TempDir()
+	dir := t.TempDir()
+	if _, err := openArtifactStore(dir, rules, nil); nil == err {
+		t.Errorf("Opened store with no YARA rules")
+	}
+	if err := ioutil.WriteFile(
+		filepath.Join(rules, "test.yar"),
+		[]byte("rule is_evil { condition: true }\n"),
+		0600,
+	); nil != err {
+		t.Fatalf("Unable to write rules: %v", err)
+	}
+	st, err := openArtifactStore(dir, rules, nil)
+	if nil != err {
+		t.Fatalf("Unable to open store: %v", err)
+	}
+
+	/* Store something evil and something not */
+	var shas []string
+	for _, c := range []string{"very EVIL", "nice"} {
+		w, err := st.Create()
+		if nil != err {
+			t.Fatalf("Unable to create artifact: %v", err)
+		}
+		w.Write([]byte(c))
+		a, err := w.Commit(ArtifactSource{Kind: ARTIFACTSTDIN}, "")
+		if nil != err {
+			t.Fatalf("Unable to commit %q: %v", c, err)
+		}
+		shas = append(shas, a.SHA256)
+	}
+	st.Wait()
+
+	if a := readTestArtifact(t, dir, shas[0]); !reflect.DeepEqual(
+		[]string{"also_bad", "is_evil"},
+		a.Tags,
+	) {
+		t.Errorf("Evil artifact has tags %q", a.Tags)
+	}
+	if a := readTestArtifact(t, dir, shas[1]); 0 != len(a.Tags) {
+		t.Errorf("Nice artifact has tags %q", a.Tags)
+	}
+}
+
+func TestArtifactTrim(t *testing.T) {
+	logDir := t.TempDir()
+	dir := filepath.Join(logDir, ARTIFACTDIR)
+	if err := os.Mkdir(dir, 0700); nil != err {
+		t.Fatalf("Unable to make artifact store: %v", err)
+	}
+	st, err := openArtifactStore(dir, "", nil)
+	if nil != err {
+		t.Fatalf("Unable to open store: %v", err)
+	}
+
+	/* Three artifacts, seen a day apart, and something which isn't */
+	var shas []string
+	for i := 0; i < 3; i++ {
+		w, err := st.Create()
+		if nil != err {
+			t.Fatalf("Unable to create artifact: %v", err)
+		}
+		w.Write(make([]byte, 1000+i))
+		a, err := w.Commit(ArtifactSource{Kind: ARTIFACTSTDIN}, "")
+		if nil != err {
+			t.Fatalf("Unable to commit artifact %v: %v", i, err)
+		}
+		shas = append(shas, a.SHA256)
+		when := time.Now().Add(time.Duration(i-3) * 24 * time.Hour)
+		for _, n := range []string{
+			a.SHA256,
+			a.SHA256 + ARTIFACTSUFFIX,
+		} {
+			if err := os.Chtimes(
+				filepath.Join(dir, n),
+				when,
+				when,
+			); nil != err {
+				t.Fatalf("Unable to age %v: %v", n, err)
+			}
+		}
+	}
+	if err := ioutil.WriteFile(
+		filepath.Join(dir, PENDINGNAME),
+		make([]byte, 100),
+		0600,
+	); nil != err {
+		t.Fatalf("Unable to write pending URLs: %v", err)
+	}
+
+	/* The store should count towards the log directory's size */
+	_, before, err := scanSessions(logDir)
+	if nil != err {
+		t.Fatalf("Unable to scan log directory: %v", err)
+	}
+	if 3100 > before {
+		t.Errorf("Log directory only %v bytes", before)
+	}
+
+	/* Only enough to get under the quota should go, oldest first */
+	if err := st.Trim(before - 500); nil != err {
+		t.Fatalf("Trim failed: %v", err)
+	}
+	for i, sha := range shas {
+		_, err := os.Stat(filepath.Join(dir, sha+ARTIFACTSUFFIX))
+		if gone := os.IsNotExist(err); (0 == i) != gone {
+			t.Errorf("Artifact %v removed: %v", i, gone)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, PENDINGNAME)); nil != err {
+		t.Errorf("Pending URLs removed: %v", err)
+	}
+	_, after, err := scanSessions(logDir)
+	if nil != err {
+		t.Fatalf("Unable to rescan log directory: %v", err)
+	}
+	if after > before-500 {
+		t.Errorf("Log directory still %v bytes", after)
+	}
+
+	/* Storing artifacts with a quota needs an artifact quota */
+	if _, err := NewServer(Config{
+		Password:    TESTPASSWORD,
+		HostKeyFile: filepath.Join(logDir, "id_hostkey"),
+		LogDir:      logDir,
+		Quota:       1 << 20,
+		Artifacts:   true,
+	}); nil == err {
+		t.Errorf("Server with a quota but no artifact quota")
+	}
+}
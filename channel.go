@@ -1,11 +1,11 @@
-package main
+package sshhipot
 
 /*
  * channel.go
  * Handle channel opens
  * By J. Stuart McMurray
  * Created 20160517
- * Last Modified 20160518
+ * Last Modified 20261018
  */
 
 import (
@@ -15,6 +15,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -22,6 +23,14 @@ import (
 
 const BUFLEN = 1024
 
+/* Directions (tags) used in channel logs */
+const (
+	TAGTOATTACKER    = "server->attacker"
+	TAGTOSERVER      = "attacker->server"
+	TAGERRTOATTACKER = "server-(err)->attacker"
+	TAGERRTOSERVER   = "attacker-(err)->server"
+)
+
 /* Channel wraps an ssh.Channel so we can have a consistent SendRequest */
 type Channel struct {
 	oc ssh.Channel
@@ -37,45 +46,105 @@ func (c Channel) SendRequest(
 	return ok, []byte{}, err
 }
 
-/* handleChans logs each channel request, which will be proxied to the
+/* handleChans proxies channel requests from chans and global requests from
+reqs to client, in the order in which they were sent.  Global requests are
+proxied to rable, logged to rlg, and passed to hook as with handleReqs.  A
+request isn't proxied until the channels opened before it have been opened by
 client. */
 func handleChans(
 	chans <-chan ssh.NewChannel,
+	reqs <-chan *ssh.Request,
+	rable Requestable,
+	hook func(r *ssh.Request, ok bool),
 	client ssh.Conn,
 	ldir string,
 	lg *log.Logger,
+	rlg *log.Logger,
+	sess *Session,
+	live *liveSession,
+	gov *governor,
+	rules []*rule,
+	icpt Interceptor,
 	direction string,
 ) {
-	/* Read channel requests until there's no more */
-	for cr := range chans {
-		go handleChan(cr, client, ldir, lg, direction)
-	}
+	sequence(
+		chans,
+		reqs,
+		func(nc ssh.NewChannel) {
+			opened := make(chan struct{})
+			sess.goChannel(func() {
+				handleChan(
+					nc,
+					client,
+					ldir,
+					lg,
+					sess,
+					live,
+					gov,
+					rules,
+					icpt,
+					direction,
+					opened,
+				)
+			})
+			<-opened
+		},
+		func(r *ssh.Request) {
+			handleRequest(r, rable, rlg, direction, hook)
+		},
+	)
 }
 
 /* handleChan handles a single channel request from sc, proxying it to the
 client.  General logging messages will be written to lg, and channel-specific
-data and messages will be written to a new file in ldir. */
+data and messages will be written to a new file in ldir.  What happens on the
+channel is summarized in sess and made available to the admin console via
+live.  Commands are checked against rules and requests and data are passed
+through icpt, if it's not nil, before they're sent on, and gov limits how much
+the channel is used.  opened is closed once client has opened the channel or
+refused to. */
 func handleChan(
 	nc ssh.NewChannel,
 	client ssh.Conn,
 	ldir string,
 	lg *log.Logger,
+	sess *Session,
+	live *liveSession,
+	gov *governor,
+	rules []*rule,
+	icpt Interceptor,
 	direction string,
+	opened chan<- struct{},
 ) {
+	cs := sess.newChannel(nc, direction)
+	defer sess.endChannel(cs)
+	ci := channelInfo(cs)
+
 	/* Log the channel request */
-	crl := fmt.Sprintf(
-		"Type:%q Data:%q Direction:%q",
-		nc.ChannelType(),
-		nc.ExtraData(),
-		direction,
-	)
+	crl := channelLogLine(nc, direction)
+
+	/* Don't let the attacker have too many channels */
+	release := func() {}
+	if TAGTOSERVER == direction {
+		if !gov.OpenChannel() {
+			close(opened)
+			sess.rejectChannel(cs, channelLimitError)
+			go rejectChannel(channelLimitError, crl, nc, lg)
+			return
+		}
+		var once sync.Once
+		release = func() { once.Do(gov.CloseChannel) }
+		defer release()
+	}
 
 	/* Pass to server */
 	cc, creqs, err := client.OpenChannel(
 		nc.ChannelType(),
 		nc.ExtraData(),
 	)
+	close(opened)
 	if nil != err {
+		sess.rejectChannel(cs, err)
 		go rejectChannel(err, crl, nc, lg)
 		return
 	}
@@ -95,7 +164,7 @@ func handleChan(
 	defer ac.Close()
 
 	/* Channel worked, make a logger for it */
-	clg, lf, clgn, err := logChannel(ldir, nc)
+	clg, lf, clgn, err := sess.srv.logChannel(ldir, nc, sess.ID)
 	if nil != err {
 		lg.Printf(
 			"Unable to open log file for channel of type %q:%v",
@@ -106,65 +175,317 @@ func handleChan(
 	}
 	defer lf.Close()
 	clg.Printf("Start of log")
+	rlg := sess.srv.newLogger(lf, sess.ID, SUBSYSREQUEST, LEVELDEBUG)
+	dlg := sess.srv.newLogger(lf, sess.ID, SUBSYSCHANNEL, LEVELTRACE)
+	sess.setChannelLog(cs, clgn)
+	tr := sess.channelTranscript(cs, clgn, clg)
+	defer tr.Close()
+	lch := live.addChannel(cs, ac, clg)
+	defer lch.Done()
+	cg := gov.Channel(clg)
+
+	/* Work out what the attacker typed in shells and sent with scp, SFTP,
+	and to commands */
+	le := NewLineEditor(false, func(l string) {
+		clg.Printf("[%v] Command:%q", TAGTOSERVER, l)
+		sess.addCommand(cs, l)
+	})
+	noteFile := func(kind string) func(FileSummary, *artifactWriter) {
+		return func(f FileSummary, w *artifactWriter) {
+			if sha := sess.storeArtifact(
+				cs,
+				w,
+				kind,
+				f.Name,
+				"",
+				clg,
+			); "" != sha {
+				f.SHA256 = sha
+			}
+			clg.Printf(
+				"File Direction:%v Name:%q Mode:%v Size:%v "+
+					"SHA256:%v",
+				f.Direction,
+				f.Name,
+				f.Mode,
+				f.Size,
+				f.SHA256,
+			)
+			sess.addFile(cs, f)
+		}
+	}
+	scp := newSCPWatcher(sess.srv.art, noteFile(ARTIFACTSCP))
+	sftp := newSFTPWatcher(sess.srv.art, noteFile(ARTIFACTSFTP))
+	stdin := &blobWatcher{st: sess.srv.art, clg: clg}
+	var execCmd string /* Set before areqsDone is closed */
+	ic := newInterceptor(
+		rules,
+		le,
+		cc,
+		ac,
+		func(cmd string, r *rule, action string) {
+			clg.Printf(
+				"[%v] Intercepted Command:%q Rule:%q Action:%v",
+				TAGTOSERVER,
+				cmd,
+				r.text,
+				action,
+			)
+			sess.addInterception(cs, cmd, r.text, action)
+		},
+		live.Disconnect,
+	)
+	noteAReq := sess.requestHook(cs, TAGTOSERVER)
+	areqHook := func(r *ssh.Request, ok bool) {
+		noteAReq(r, ok)
+		if !ok {
+			return
+		}
+		switch r.Type {
+		case "pty-req":
+			ic.SetTTY(true)
+		case "shell":
+			le.Enable()
+			ic.Release()
+		case "exec":
+			defer ic.Release()
+			cmd, _ := sshString(r.Payload)
+			if d := scpDirection(cmd); "" != d {
+				scp.Enable(d)
+				return
+			}
+			execCmd = cmd
+			stdin.Enable()
+			/* Commands piped to a shell are still commands */
+			if execShell(cmd) {
+				le.Enable()
+			}
+		case "subsystem":
+			if ss, _ := sshString(r.Payload); "sftp" == ss {
+				sftp.Enable()
+			}
+			ic.Release()
+		}
+	}
+	/* Don't check input until we know what it's for */
+	if "session" == nc.ChannelType() {
+		ic.Hold()
+	}
 
-	/* Proxy requests on channels */
-	go handleReqs(areqs, Channel{oc: cc}, clg, "attacker->server")
-	go handleReqs(creqs, Channel{oc: ac}, clg, "server->attacker")
+	/* Proxy requests on channels.  Each side's requests stop when it
+	closes the channel.  The locks are held while a request is waiting
+	for its reply. */
+	var areqsL, creqsL sync.Mutex
+	areqsDone := make(chan struct{})
+	go func() {
+		defer close(areqsDone)
+		defer ic.Release()
+		handleReqsLocked(
+			areqs,
+			interceptRequests(
+				ic.Requests(Channel{oc: cc}),
+				icpt,
+				sess.ID,
+				&ci,
+				TAGTOSERVER,
+				rlg,
+			),
+			rlg,
+			TAGTOSERVER,
+			areqHook,
+			&areqsL,
+		)
+	}()
+	creqsDone := make(chan struct{})
+	go func() {
+		defer close(creqsDone)
+		handleReqsLocked(
+			creqs,
+			interceptRequests(
+				Channel{oc: ac},
+				icpt,
+				sess.ID,
+				&ci,
+				TAGTOATTACKER,
+				rlg,
+			),
+			rlg,
+			TAGTOATTACKER,
+			sess.requestHook(cs, TAGTOATTACKER),
+			&creqsL,
+		)
+	}()
 
 	/* Log the channel */
 	lg.Printf("Channel %s Log:%q", crl, clgn)
 
-	/* Proxy comms */
-	wg := make(chan int, 4)
-	go ProxyChannel(
-		ac,
-		cc,
-		clg,
-		"server->attacker",
-		wg,
-		1,
-	)
-	go ProxyChannel(
-		cc,
-		ac,
-		clg,
-		"attacker->server",
-		wg,
-		1,
-	)
-	go ProxyChannel(
-		cc.Stderr(),
-		ac.Stderr(),
-		clg,
-		"attacker-(err)->server",
-		wg,
-		0,
-	)
-	go ProxyChannel(
-		ac.Stderr(),
-		cc.Stderr(),
-		clg,
-		"server-(err)->attacker",
-		wg,
-		0,
-	)
-	sum := 0
-	for i := range wg {
-		sum += i
-		if 2 <= sum {
-			break
+	/* Proxy comms.  Each side's data and stderr are proxied until it sends
+	EOF or closes the channel, after which the other side gets EOF. */
+	budget := sess.channelBudget()
+	var up, down sync.WaitGroup
+	up.Add(2)
+	down.Add(2)
+	go func() {
+		defer down.Done()
+		ProxyChannel(
+			interceptData(
+				ic.Output(),
+				icpt,
+				sess.ID,
+				ci,
+				TAGTOATTACKER,
+			),
+			cg.Down(cc),
+			dlg,
+			tr,
+			TAGTOATTACKER,
+			func(b []byte) {
+				sess.addBytes(cs, TAGTOATTACKER, b)
+				le.Output(b)
+				scp.Output(b)
+				sftp.Output(b)
+				lch.Output(b)
+			},
+			budget,
+		)
+	}()
+	go func() {
+		defer up.Done()
+		ProxyChannel(
+			interceptData(ic, icpt, sess.ID, ci, TAGTOSERVER),
+			cg.Up(lch.Input()),
+			dlg,
+			tr,
+			TAGTOSERVER,
+			func(b []byte) {
+				sess.addBytes(cs, TAGTOSERVER, b)
+				scp.Input(b)
+				sftp.Input(b)
+				stdin.Input(b)
+			},
+			budget,
+		)
+	}()
+	go func() {
+		defer up.Done()
+		ProxyChannel(
+			interceptData(
+				cc.Stderr(),
+				icpt,
+				sess.ID,
+				ci,
+				TAGERRTOSERVER,
+			),
+			cg.Up(ac.Stderr()),
+			dlg,
+			tr,
+			TAGERRTOSERVER,
+			func(b []byte) { sess.addBytes(cs, TAGERRTOSERVER, b) },
+			budget,
+		)
+	}()
+	go func() {
+		defer down.Done()
+		ProxyChannel(
+			interceptData(
+				ac.Stderr(),
+				icpt,
+				sess.ID,
+				ci,
+				TAGERRTOATTACKER,
+			),
+			cg.Down(cc.Stderr()),
+			dlg,
+			tr,
+			TAGERRTOATTACKER,
+			func(b []byte) {
+				sess.addBytes(cs, TAGERRTOATTACKER, b)
+			},
+			budget,
+		)
+	}()
+	upDone := sendEOF(&up, func() error {
+		/* Don't lose a partial last line waiting for rules */
+		if err := ic.Flush(); nil != err {
+			return err
 		}
+		return cc.CloseWrite()
+	}, clg, TAGTOSERVER)
+	downDone := sendEOF(&down, ac.CloseWrite, clg, TAGTOATTACKER)
+
+	/* Once one side's closed the channel and everything it sent, exit
+	statuses included, has been passed on, close the other side and wait
+	for it to finish as well. */
+	closed := make(chan string, 2)
+	go func() {
+		<-creqsDone
+		<-downDone
+		closed <- TAGTOATTACKER
+	}()
+	go func() {
+		<-areqsDone
+		<-upDone
+		closed <- TAGTOSERVER
+	}()
+	first := <-closed
+	/* As far as the attacker's concerned, the channel's done before it
+	hears it's closed, so it may open another one straight away */
+	release()
+	/* Requests already proxied still get their replies, e.g. an exec
+	request whose command finished straight away. */
+	switch first {
+	case TAGTOATTACKER: /* Server closed first */
+		areqsL.Lock()
+		ac.Close()
+		areqsL.Unlock()
+	case TAGTOSERVER: /* Attacker closed first */
+		creqsL.Lock()
+		cc.Close()
+		creqsL.Unlock()
 	}
+	<-closed
 
-	/* TODO: Proxy comms */
+	/* Save what's left of what the attacker sent */
+	scp.Finish()
+	sftp.Finish()
+	if w := stdin.Finish(); ARTIFACTSTDINMIN <= w.Size() {
+		sess.storeArtifact(cs, w, ARTIFACTSTDIN, "", execCmd, clg)
+	} else {
+		w.Abort()
+	}
+}
+
+/* sendEOF calls closeWrite to send EOF after wg is done.  Errors are logged to
+lg, along with tag.  The returned channel is closed after closeWrite
+returns. */
+func sendEOF(
+	wg *sync.WaitGroup,
+	closeWrite func() error,
+	lg *log.Logger,
+	tag string,
+) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wg.Wait()
+		/* io.EOF means the channel's already closed */
+		if err := closeWrite(); nil != err && io.EOF != err {
+			lg.Printf("[%v] Unable to send EOF: %v", tag, err)
+			return
+		}
+		lg.Printf("[%v] EOF", tag)
+	}()
+	return done
 }
 
 /* logChannel returns a logger which can be used to log channel activities to a
-file in the directory ldir.  The logger as well as the filename are
-returned. */
-func logChannel(
+file in the directory ldir.  Log lines will have the connection ID id.  The
+logger as well as the file and its name are returned.  More loggers for the
+file may be made with s.newLogger. */
+func (s *Server) logChannel(
 	ldir string,
 	nc ssh.NewChannel,
+	id string,
 ) (*log.Logger, *os.File, string, error) {
 	/* Log file is named after the channel time and type */
 	logName := filepath.Join(
@@ -180,12 +501,7 @@ func logChannel(
 	if nil != err {
 		return nil, nil, "", err
 	}
-	return log.New(
-		//lf,
-		io.MultiWriter(lf, os.Stderr), /* DEBUG */
-		"",
-		log.LstdFlags|log.Lmicroseconds,
-	), lf, logName, nil
+	return s.newLogger(lf, id, SUBSYSCHANNEL, LEVELINFO), lf, logName, nil
 }
 
 /* rejectChannel tells the attacker the channel's been rejected by the real
@@ -217,23 +533,85 @@ func rejectChannel(nce error, crl string, nc ssh.NewChannel, lg *log.Logger) {
 	}
 }
 
-/* ProxyChannel copies data from one channel to another */
+/* channelLogLine describes the channel request nc, for logging. */
+func channelLogLine(nc ssh.NewChannel, direction string) string {
+	return fmt.Sprintf(
+		"Type:%q Data:%q Direction:%q",
+		nc.ChannelType(),
+		nc.ExtraData(),
+		direction,
+	)
+}
+
+/* dataLogger logs data sent in one direction on a channel. */
+type dataLogger struct {
+	lg        *log.Logger
+	tr        *TranscriptWriter
+	tag       string
+	tee       func([]byte)
+	budget    *logBudget
+	truncated bool
+	trFailed  bool
+}
+
+/* newDataLogger returns a dataLogger which logs data to lg and tr, which may
+be nil, with the given tag while there's room left in budget.  If tee isn't
+nil, it will be called with every chunk of data logged, even after the
+budget's exhausted. */
+func newDataLogger(
+	lg *log.Logger,
+	tr *TranscriptWriter,
+	tag string,
+	tee func([]byte),
+	budget *logBudget,
+) *dataLogger {
+	return &dataLogger{lg: lg, tr: tr, tag: tag, tee: tee, budget: budget}
+}
+
+/* Log logs b. */
+func (d *dataLogger) Log(b []byte) {
+	if nil != d.tee {
+		d.tee(b)
+	}
+	/* Stop logging if we've logged too much */
+	if d.truncated {
+		return
+	}
+	if !d.budget.Take(len(b)) {
+		d.lg.Printf("[%v] Log size limit reached", d.tag)
+		d.truncated = true
+		return
+	}
+	/* Log it all */
+	for _, l := range bytes.SplitAfter(b, []byte{'\n'}) {
+		d.lg.Printf("[%v] %q", d.tag, l)
+	}
+	if err := d.tr.Record(d.tag, b); nil != err && !d.trFailed {
+		d.lg.Printf("[%v] Unable to write transcript: %v", d.tag, err)
+		d.trFailed = true
+	}
+}
+
+/* ProxyChannel copies data from one channel to another until reading or
+writing fails, which includes the reader returning io.EOF.  If tee isn't nil,
+it will be called with every chunk of data successfully copied.  Data is only
+logged, to lg and to tr if it's not nil, while there's room left in budget. */
 func ProxyChannel(
 	w io.Writer,
 	r io.Reader,
 	lg *log.Logger,
+	tr *TranscriptWriter,
 	tag string,
-	wg chan<- int,
-	token int,
+	tee func([]byte),
+	budget *logBudget,
 ) {
-	defer func(c chan<- int, i int) { c <- i }(wg, token)
 	var (
 		buf  = make([]byte, BUFLEN)
 		done = false
+		dl   = newDataLogger(lg, tr, tag, tee, budget)
 		n    int
 		err  error
 	)
-	var lines [][]byte
 	for !done {
 		/* Reset buffer */
 		buf = buf[:cap(buf)]
@@ -252,15 +630,9 @@ func ProxyChannel(
 		if _, err = w.Write(buf); nil != err {
 			lg.Printf("[%v] Write Error: %v", tag, err)
 			done = true
-		}
-		if done {
 			continue
 		}
-		/* Log it all */
-		lines = bytes.SplitAfter(buf, []byte{'\n'})
-		for i := range lines {
-			lg.Printf("[%v] %q", tag, lines[i])
-		}
+		dl.Log(buf)
 	}
 	lg.Printf("[%v] Finished", tag)
 }
@@ -1,17 +1,16 @@
-package main
+package sshhipot
 
 /*
  * client.go
  * SSH client to connect upstream
  * By J. Stuart McMurray
  * Created 20160515
- * Last Modified 20160517
+ * Last Modified 20261018
  */
 
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"net"
 	"time"
 
@@ -43,20 +42,36 @@ func clientDial(
 
 /* clientConfig makes an SSH client config which uses the given username and
 key */
-func makeClientConfig(user, key, fingerprint string) *ssh.ClientConfig {
+func (s *Server) makeClientConfig(
+	user string,
+	key string,
+	fingerprint string,
+) (*ssh.ClientConfig, error) {
 	/* Get SSH key */
 	k, g, err := getKey(key)
 	if nil != err {
-		log.Fatalf("Unable to get client key: %v", err)
+		return nil, fmt.Errorf("getting client key: %v", err)
 	}
 	if g {
-		log.Printf("Generated client key in %v", key)
-		log.Printf(
+		s.logf(
+			LEVELINFO,
+			SUBSYSUPSTREAM,
+			"Generated client key in %v",
+			key,
+		)
+		s.logf(
+			LEVELINFO,
+			SUBSYSUPSTREAM,
 			"Public Key: %s",
 			bytes.TrimSpace(ssh.MarshalAuthorizedKey(k.PublicKey())),
 		)
 	} else {
-		log.Printf("Loaded client key from %v", key)
+		s.logf(
+			LEVELINFO,
+			SUBSYSUPSTREAM,
+			"Loaded client key from %v",
+			key,
+		)
 	}
 	/* Config to return */
 	cc := &ssh.ClientConfig{
@@ -82,5 +97,5 @@ func makeClientConfig(user, key, fingerprint string) *ssh.ClientConfig {
 		return nil
 	}
 
-	return cc
+	return cc, nil
 }
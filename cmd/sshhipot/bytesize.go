@@ -0,0 +1,46 @@
+package main
+
+/*
+ * bytesize.go
+ * Flag for sizes in bytes
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/* byteSize is a flag.Value for a number of bytes, which may have a K, M, G, or
+T suffix. */
+type byteSize int64
+
+/* String implements flag.Value */
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+/* Set implements flag.Value */
+func (b *byteSize) Set(s string) error {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	m := int64(1)
+	for i, u := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(s, u) || strings.HasSuffix(s, u+"B") {
+			s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), u)
+			m = 1 << (10 * uint(i+1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if nil != err {
+		return err
+	}
+	if 0 > n {
+		return fmt.Errorf("size must not be negative")
+	}
+	*b = byteSize(n * m)
+	return nil
+}
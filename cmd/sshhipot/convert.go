@@ -0,0 +1,110 @@
+package main
+
+/*
+ * convert.go
+ * Convert binary transcripts to other formats
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/magisterquis/sshhipot"
+)
+
+/* convertMain converts a channel transcript to a text log or an asciicast
+recording.  args should not include the subcommand name. */
+func convertMain(args []string) {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	var format = fs.String(
+		"f",
+		"text",
+		"Output `format`, text or asciicast",
+	)
+	var id = fs.String(
+		"id",
+		"",
+		"Connection `ID` to put in text log lines",
+	)
+	var width = fs.Int(
+		"w",
+		80,
+		"Terminal `width` for asciicast",
+	)
+	var height = fs.Int(
+		"h",
+		24,
+		"Terminal `height` for asciicast",
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v convert [options] transcript
+
+Converts a binary channel transcript (written with -tr) to a text log like
+the ones written for every channel, or to an asciicast v2 recording which can
+be played with asciinema.  The result is written to stdout.
+
+Options:
+`,
+			os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if 1 != fs.NArg() {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	/* Get the records */
+	f, err := os.Open(fs.Arg(0))
+	if nil != err {
+		log.Fatalf("Unable to open %v: %v", fs.Arg(0), err)
+	}
+	defer f.Close()
+	tr, err := sshhipot.NewTranscriptReader(f)
+	if nil != err {
+		log.Fatalf("Unable to read %v: %v", fs.Arg(0), err)
+	}
+	var recs []sshhipot.TranscriptRecord
+	for {
+		rec, err := tr.Next()
+		if nil != err {
+			if io.EOF != err {
+				log.Printf(
+					"Stopped reading %v: %v",
+					fs.Arg(0),
+					err,
+				)
+			}
+			break
+		}
+		recs = append(recs, rec)
+	}
+
+	/* Write them back out */
+	switch *format {
+	case "text":
+		err = sshhipot.WriteTextLog(os.Stdout, *id, recs)
+	case "asciicast":
+		err = sshhipot.WriteAsciicast(
+			os.Stdout,
+			recs,
+			tr.Start(),
+			*width,
+			*height,
+		)
+	default:
+		log.Fatalf("Unknown format %q", *format)
+	}
+	if nil != err {
+		log.Fatalf("Error writing %v: %v", *format, err)
+	}
+}
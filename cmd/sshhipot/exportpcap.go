@@ -0,0 +1,497 @@
+package main
+
+/*
+ * exportpcap.go
+ * Export a session as PCAP-NG
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/magisterquis/sshhipot"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	/* pcapMSS is the most data put in a single synthetic segment */
+	pcapMSS = 1460
+	/* pcapSSHPort is the port used for an upstream server without one */
+	pcapSSHPort = 22
+	/* pcapChanPort is added to a channel's ID to make the port from
+	which it comes, for channels with no real source address */
+	pcapChanPort = 49152
+)
+
+/* pcapSyntheticNet is where addresses are made up for hostnames and the like,
+from the range set aside for benchmarking (RFC 2544), as real traffic is
+unlikely to be there. */
+var pcapSyntheticNet = net.IPv4(198, 18, 0, 0)
+
+/* exportPcapMain writes a session as a PCAP-NG file.  args should not include
+the subcommand name. */
+func exportPcapMain(args []string) {
+	fs := flag.NewFlagSet("export-pcap", flag.ExitOnError)
+	var out = fs.String(
+		"o",
+		"",
+		"Output `file`, instead of stdout",
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v export-pcap [options] session-dir
+
+Writes a session as a synthetic PCAP-NG file, suitable for Wireshark and
+friends.  Every channel is a TCP connection carrying the channel's data.
+direct-tcpip and forwarded-tcpip channels use the addresses and ports from the
+channel requests; other channels go from the attacker to the upstream server.
+Hostnames get made-up addresses in %v/15.  SSH requests, channel details,
+and so on are in packet comments.
+
+Options:
+`,
+			os.Args[0],
+			pcapSyntheticNet,
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if 1 != fs.NArg() {
+		fs.Usage()
+		os.Exit(1)
+	}
+	dir := fs.Arg(0)
+
+	/* Get the session summary */
+	b, err := ioutil.ReadFile(filepath.Join(dir, sshhipot.SUMMARYNAME))
+	if nil != err {
+		log.Fatalf("Unable to read session summary: %v", err)
+	}
+	var sess sshhipot.Session
+	if err := json.Unmarshal(b, &sess); nil != err {
+		log.Fatalf("Unable to parse session summary: %v", err)
+	}
+
+	/* Work out where to put it */
+	var w io.Writer = os.Stdout
+	if "" != *out {
+		f, err := os.Create(*out)
+		if nil != err {
+			log.Fatalf("Unable to create %v: %v", *out, err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := exportPcap(w, dir, &sess); nil != err {
+		log.Fatalf("Error writing PCAP-NG: %v", err)
+	}
+}
+
+/* exportPcap writes the session sess, logged in dir, to w as PCAP-NG. */
+func exportPcap(w io.Writer, dir string, sess *sshhipot.Session) error {
+	var (
+		pkts  []pcapPacket
+		addrs = newPcapAddrs()
+		pw    = newPcapngWriter(w, fmt.Sprintf(
+			"ID:%v Address:%v User:%q ClientVersion:%q "+
+				"HASSH:%v Upstream:%q Start:%v End:%v",
+			sess.ID,
+			sess.Address,
+			sess.User,
+			sess.ClientVersion,
+			sess.HASSH,
+			sess.Upstream,
+			sess.Start.Format(time.RFC3339Nano),
+			sess.End.Format(time.RFC3339Nano),
+		))
+	)
+	attacker := addrs.Addr(sess.Address, 0)
+	upstream := addrs.Addr(upstreamAddr(sess.Upstream), pcapSSHPort)
+
+	/* The connection itself only has global requests */
+	conn := &pcapFlow{
+		client: attacker,
+		server: upstream,
+		pw:     pw,
+		pkts:   &pkts,
+	}
+	conn.Open(sess.Start, fmt.Sprintf("Connection ID:%v", sess.ID))
+	for _, r := range sess.Requests {
+		conn.Request(r, true)
+	}
+	conn.Close(sess.End, "")
+
+	/* Each channel's its own TCP connection */
+	for _, cs := range sess.Channels {
+		if err := exportChannel(
+			dir,
+			cs,
+			attacker,
+			upstream,
+			addrs,
+			pw,
+			&pkts,
+		); nil != err {
+			return fmt.Errorf("channel %v: %v", cs.ID, err)
+		}
+	}
+
+	/* Write everything in order */
+	sort.SliceStable(pkts, func(i, j int) bool {
+		return pkts[i].t.Before(pkts[j].t)
+	})
+	for _, p := range pkts {
+		pw.Packet(p.t, p.data, p.comment)
+	}
+	return pw.Flush()
+}
+
+/* exportChannel adds the packets for the channel cs to pkts. */
+func exportChannel(
+	dir string,
+	cs *sshhipot.ChannelSummary,
+	attacker *net.TCPAddr,
+	upstream *net.TCPAddr,
+	addrs *pcapAddrs,
+	pw *pcapngWriter,
+	pkts *[]pcapPacket,
+) error {
+	/* Work out who's talking to whom.  The client is whoever opened the
+	channel. */
+	f := &pcapFlow{pw: pw, pkts: pkts}
+	fromAttacker := sshhipot.TAGTOSERVER == cs.Direction
+	address, originator := cs.Address, cs.Originator
+	if "" == address {
+		address, originator = forwardTuple(cs)
+	}
+	port := pcapChanPort + cs.ID%(65536-pcapChanPort)
+	comment := fmt.Sprintf(
+		"Channel ID:%v Type:%q Direction:%q",
+		cs.ID,
+		cs.Type,
+		cs.Direction,
+	)
+	switch {
+	case "" != address:
+		f.client = addrs.Addr(originator, port)
+		f.server = addrs.Addr(address, 0)
+		comment += fmt.Sprintf(
+			" Address:%q Originator:%q",
+			address,
+			originator,
+		)
+	case fromAttacker:
+		f.client = &net.TCPAddr{IP: attacker.IP, Port: port}
+		s := *upstream
+		f.server = &s
+	default:
+		f.client = &net.TCPAddr{IP: upstream.IP, Port: port}
+		s := *attacker
+		f.server = &s
+	}
+	/* Forwarded connections don't always have a real address or port */
+	if f.client.IP.IsUnspecified() {
+		f.client.IP = upstream.IP
+		if fromAttacker {
+			f.client.IP = attacker.IP
+		}
+	}
+	if f.server.IP.IsUnspecified() {
+		f.server.IP = upstream.IP
+	}
+	if 0 == f.server.Port {
+		f.server.Port = port
+	}
+
+	/* Rejected channels never get going */
+	if "" != cs.Rejected {
+		f.Open(cs.Start, comment)
+		f.Reject(cs.Start, fmt.Sprintf("Rejected:%q", cs.Rejected))
+		return nil
+	}
+
+	/* Data and requests, in order */
+	var evs []pcapEvent
+	if n := channelFile(dir, cs); "" != n {
+		rs, err := readRecords(n)
+		if nil != err {
+			return err
+		}
+		for _, r := range rs {
+			if nil == r.Data {
+				continue
+			}
+			ev := pcapEvent{t: r.Time, data: r.Data}
+			var sent bool
+			switch r.Tag {
+			case sshhipot.TAGTOSERVER:
+				sent = true
+			case sshhipot.TAGERRTOSERVER:
+				sent, ev.comment = true, "Stderr"
+			case sshhipot.TAGTOATTACKER:
+			case sshhipot.TAGERRTOATTACKER:
+				ev.comment = "Stderr"
+			case sshhipot.TAGOPERATOR:
+				ev.comment = "Operator"
+			default:
+				continue
+			}
+			ev.fromClient = sent == fromAttacker
+			evs = append(evs, ev)
+		}
+	}
+	for i, r := range cs.Requests {
+		sent := sshhipot.TAGTOSERVER == r.Direction
+		evs = append(evs, pcapEvent{
+			t:          r.Time,
+			fromClient: sent == fromAttacker,
+			req:        &cs.Requests[i],
+		})
+	}
+	sort.SliceStable(evs, func(i, j int) bool {
+		return evs[i].t.Before(evs[j].t)
+	})
+
+	/* Turn it all into packets */
+	f.Open(cs.Start, comment)
+	for _, ev := range evs {
+		if nil != ev.req {
+			f.Request(*ev.req, ev.fromClient)
+			continue
+		}
+		f.Data(ev.t, ev.fromClient, ev.data, ev.comment)
+	}
+	var ec string
+	if nil != cs.ExitStatus {
+		ec = fmt.Sprintf("ExitStatus:%v", *cs.ExitStatus)
+	}
+	if "" != cs.ExitSignal {
+		ec = strings.TrimSpace(ec + " ExitSignal:" + cs.ExitSignal)
+	}
+	f.Close(cs.End, ec)
+	return nil
+}
+
+/* channelFile returns the name of the file in dir with cs's data, preferring
+its transcript to its text log.  Summaries may have been written with paths
+relative to somewhere else, so only the last part of the path's used.  If
+there's no file, channelFile returns the empty string. */
+func channelFile(dir string, cs *sshhipot.ChannelSummary) string {
+	for _, n := range []string{cs.Transcript, cs.Log} {
+		if "" == n {
+			continue
+		}
+		n = filepath.Join(dir, filepath.Base(n))
+		if _, err := os.Stat(n); nil == err {
+			return n
+		}
+	}
+	return ""
+}
+
+/* forwardTuple gets the address and originator from cs's data, for summaries
+from before they were saved separately.  Ports with bytes which aren't valid
+UTF-8 will have been mangled in the summary; oh well. */
+func forwardTuple(cs *sshhipot.ChannelSummary) (address, originator string) {
+	switch cs.Type {
+	case "direct-tcpip", "forwarded-tcpip":
+	default:
+		return "", ""
+	}
+	var d struct {
+		Host  string
+		Port  uint32
+		OHost string
+		OPort uint32
+	}
+	if nil != ssh.Unmarshal([]byte(cs.Data), &d) {
+		return "", ""
+	}
+	return net.JoinHostPort(d.Host, strconv.Itoa(int(d.Port))),
+		net.JoinHostPort(d.OHost, strconv.Itoa(int(d.OPort)))
+}
+
+/* upstreamAddr removes the user from the upstream server in a session
+summary. */
+func upstreamAddr(u string) string {
+	if i := strings.LastIndexByte(u, '@'); -1 != i {
+		return u[i+1:]
+	}
+	return u
+}
+
+/* pcapPacket is a packet waiting to be written */
+type pcapPacket struct {
+	t       time.Time
+	data    []byte
+	comment string
+}
+
+/* pcapEvent is a bit of data or a request sent on a channel */
+type pcapEvent struct {
+	t          time.Time
+	fromClient bool
+	data       []byte
+	comment    string
+	req        *sshhipot.RequestSummary
+}
+
+/* pcapFlow is a synthetic TCP connection.  Packets are added to pkts.  Times
+never go backwards, to keep Wireshark happy. */
+type pcapFlow struct {
+	client *net.TCPAddr
+	server *net.TCPAddr
+	pw     *pcapngWriter
+	pkts   *[]pcapPacket
+	cseq   uint32 /* Client's next sequence number */
+	sseq   uint32 /* Server's next sequence number */
+	last   time.Time
+}
+
+/* send adds a segment sent by the client or server at time t. */
+func (f *pcapFlow) send(
+	t time.Time,
+	fromClient bool,
+	flags byte,
+	data []byte,
+	comment string,
+) {
+	if t.Before(f.last) {
+		t = f.last
+	}
+	f.last = t
+	src, dst, seq, ack := f.client, f.server, &f.cseq, f.sseq
+	if !fromClient {
+		src, dst, seq, ack = f.server, f.client, &f.sseq, f.cseq
+	}
+	if 0 == flags&tcpACK {
+		ack = 0
+	}
+	*f.pkts = append(*f.pkts, pcapPacket{
+		t:       t,
+		data:    f.pw.TCP(src, dst, *seq, ack, flags, data),
+		comment: comment,
+	})
+	*seq += uint32(len(data))
+	if 0 != flags&(tcpSYN|tcpFIN) {
+		*seq++
+	}
+}
+
+/* Open adds a handshake at time t.  The comment goes on the SYN. */
+func (f *pcapFlow) Open(t time.Time, comment string) {
+	f.send(t, true, tcpSYN, nil, comment)
+	f.send(t, false, tcpSYN|tcpACK, nil, "")
+	f.send(t, true, tcpACK, nil, "")
+}
+
+/* Reject adds a reset from the server at time t, after a SYN. */
+func (f *pcapFlow) Reject(t time.Time, comment string) {
+	f.send(t, false, tcpRST|tcpACK, nil, comment)
+}
+
+/* Data adds data sent at time t, split into segments no bigger than pcapMSS.
+The comment goes on the first segment. */
+func (f *pcapFlow) Data(
+	t time.Time,
+	fromClient bool,
+	data []byte,
+	comment string,
+) {
+	for 0 != len(data) {
+		n := len(data)
+		if pcapMSS < n {
+			n = pcapMSS
+		}
+		f.send(t, fromClient, tcpPSH|tcpACK, data[:n], comment)
+		data = data[n:]
+		comment = ""
+	}
+}
+
+/* Request adds an empty segment with a comment describing r. */
+func (f *pcapFlow) Request(r sshhipot.RequestSummary, fromClient bool) {
+	f.send(r.Time, fromClient, tcpACK, nil, fmt.Sprintf(
+		"Request Type:%q WantReply:%v Payload:%q OK:%v",
+		r.Type,
+		r.WantReply,
+		requestPayload(r.Payload),
+		r.OK,
+	))
+}
+
+/* Close adds FINs from both sides at time t, which may be the zero time to
+close after the last packet.  The comment goes on the server's FIN. */
+func (f *pcapFlow) Close(t time.Time, comment string) {
+	f.send(t, true, tcpFIN|tcpACK, nil, "")
+	f.send(t, false, tcpFIN|tcpACK, nil, comment)
+	f.send(t, true, tcpACK, nil, "")
+}
+
+/* requestPayload returns the string in p, if it's a single SSH string (e.g.
+an exec request's command), or else p itself. */
+func requestPayload(p string) string {
+	if 4 > len(p) {
+		return p
+	}
+	l := binary.BigEndian.Uint32([]byte(p))
+	if uint64(len(p)-4) != uint64(l) {
+		return p
+	}
+	return p[4:]
+}
+
+/* pcapAddrs turns the addresses in session summaries into TCP addresses,
+making up IP addresses for hostnames. */
+type pcapAddrs struct {
+	names map[string]net.IP
+	next  uint32
+}
+
+/* newPcapAddrs returns a new pcapAddrs, ready for use */
+func newPcapAddrs() *pcapAddrs {
+	return &pcapAddrs{
+		names: make(map[string]net.IP),
+		next:  binary.BigEndian.Uint32(pcapSyntheticNet.To4()) + 1,
+	}
+}
+
+/* Addr returns a TCP address for a, which should be a host and port.  If a
+has no port or the port is 0, port is used instead.  If the host isn't an IP
+address, an address is made up; the same host always gets the same made-up
+address. */
+func (p *pcapAddrs) Addr(a string, port int) *net.TCPAddr {
+	host, ps, err := net.SplitHostPort(a)
+	if nil != err {
+		host = a
+	}
+	if n, err := strconv.Atoi(ps); nil == err && 0 != n {
+		port = n
+	}
+	ip := net.ParseIP(host)
+	if nil == ip {
+		if ip = p.names[host]; nil == ip {
+			ip = make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, p.next)
+			p.next++
+			p.names[host] = ip
+		}
+	}
+	return &net.TCPAddr{IP: ip, Port: port}
+}
@@ -0,0 +1,72 @@
+package main
+
+/*
+ * fetch.go
+ * Download URLs saved for later
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/magisterquis/sshhipot"
+)
+
+/* fetchMain downloads the URLs saved in a log directory's artifact store
+because they couldn't be downloaded at the time.  args should not include the
+subcommand name. */
+func fetchMain(args []string) {
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+	var proxy = fs.String(
+		"p",
+		"",
+		"HTTP or SOCKS5 proxy `URL` (default from the environment)",
+	)
+	var yaraDir = fs.String(
+		"y",
+		"",
+		"Tag new files with the YARA rules in `directory` (default "+
+			"none)",
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v fetch [options] log-dir
+
+Tries again to download the URLs saved in a log directory's artifact store
+(-dl) which weren't downloaded when the attacker tried, because the honeypot
+was offline (-dlo), the download failed, or the URL wasn't http or https.  URLs
+which still can't be downloaded are kept for next time, until they've been
+tried %v times, after which they're moved to %v.
+
+Options:
+`,
+			os.Args[0],
+			sshhipot.DOWNLOADTRIES,
+			sshhipot.FAILEDNAME,
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if 1 != fs.NArg() {
+		fs.Usage()
+		os.Exit(1)
+	}
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	log.SetOutput(os.Stdout)
+
+	fetched, failed, err := sshhipot.FetchPending(
+		fs.Arg(0),
+		*proxy,
+		*yaraDir,
+	)
+	log.Printf("Downloaded %v files, %v failed", fetched, failed)
+	if nil != err {
+		log.Fatalf("Error: %v", err)
+	}
+}
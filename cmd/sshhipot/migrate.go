@@ -0,0 +1,85 @@
+package main
+
+/*
+ * migrate.go
+ * Move sessions to match a path template
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/magisterquis/sshhipot"
+)
+
+/* migrateMain moves the sessions in a log directory to where a path template
+says they should go.  args should not include the subcommand name. */
+func migrateMain(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	var tmpl = fs.String(
+		"t",
+		sshhipot.DEFAULTPATHTEMPLATE,
+		"Session directory path `template`, as for -dt",
+	)
+	var dryRun = fs.Bool(
+		"n",
+		false,
+		"Only print what would be moved",
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v migrate [options] log-dir
+
+Moves the sessions in a log directory (-d) to where they'd be had they been
+logged with the given path template (-dt).  Sessions without summaries are
+assumed to be in the original address/time layout.  Paths to channel logs in
+session summaries are updated, but not in the database (-db) or in compressed
+sessions.  The honeypot shouldn't be running while sessions are being moved.
+
+Options:
+`,
+			os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if 1 != fs.NArg() {
+		fs.Usage()
+		os.Exit(1)
+	}
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	log.SetOutput(os.Stdout)
+
+	var moved, failed int
+	if err := sshhipot.MigrateLogDir(
+		fs.Arg(0),
+		*tmpl,
+		*dryRun,
+		func(from, to string, err error) {
+			if nil != err {
+				log.Printf("Unable to move %v: %v", from, err)
+				failed++
+				return
+			}
+			if *dryRun {
+				log.Printf("Would move %v -> %v", from, to)
+			} else {
+				log.Printf("Moved %v -> %v", from, to)
+			}
+			moved++
+		},
+	); nil != err {
+		log.Fatalf("Error: %v", err)
+	}
+	verb := "Moved"
+	if *dryRun {
+		verb = "Would move"
+	}
+	log.Printf("%v %v sessions, %v failed", verb, moved, failed)
+}
@@ -0,0 +1,241 @@
+package main
+
+/*
+ * pcapng.go
+ * Write synthetic TCP packets as PCAP-NG
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+/* PCAP-NG block types, options, and so on.  See
+https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html */
+const (
+	pcapngSHB       = 0x0A0D0D0A /* Section Header Block */
+	pcapngIDB       = 0x00000001 /* Interface Description Block */
+	pcapngEPB       = 0x00000006 /* Enhanced Packet Block */
+	pcapngBOM       = 0x1A2B3C4D /* Byte-order magic */
+	pcapngLinkRaw   = 101        /* LINKTYPE_RAW, packets start with IP */
+	pcapngEndOpt    = 0          /* opt_endofopt */
+	pcapngComment   = 1          /* opt_comment */
+	pcapngIfName    = 2          /* if_name */
+	pcapngIfTSResol = 9          /* if_tsresol */
+	pcapngUserAppl  = 4          /* shb_userappl */
+)
+
+/* TCP flags */
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+/* pcapngOption is an option in a PCAP-NG block */
+type pcapngOption struct {
+	code  uint16
+	value []byte
+}
+
+/* pcapngWriter writes a PCAP-NG file with a single raw IP interface with
+nanosecond timestamps.  Errors are sticky; once a write fails, nothing else is
+written and Flush returns the error. */
+type pcapngWriter struct {
+	w    *bufio.Writer
+	err  error
+	ipID uint16 /* IPv4 ID counter */
+}
+
+/* newPcapngWriter writes the section header, with comment if it's not empty,
+and the interface description to w and returns a pcapngWriter which writes
+packets to w. */
+func newPcapngWriter(w io.Writer, comment string) *pcapngWriter {
+	p := &pcapngWriter{w: bufio.NewWriter(w)}
+
+	/* Section header */
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb, pcapngBOM)
+	binary.LittleEndian.PutUint16(shb[4:], 1) /* Major version */
+	binary.LittleEndian.PutUint16(shb[6:], 0) /* Minor version */
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+	opts := []pcapngOption{{pcapngUserAppl, []byte("sshhipot")}}
+	if "" != comment {
+		opts = append(
+			opts,
+			pcapngOption{pcapngComment, []byte(comment)},
+		)
+	}
+	p.block(pcapngSHB, shb, opts)
+
+	/* Interface description */
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb, pcapngLinkRaw)
+	p.block(pcapngIDB, idb, []pcapngOption{
+		{pcapngIfName, []byte("sshhipot")},
+		{pcapngIfTSResol, []byte{9}}, /* Nanoseconds */
+	})
+
+	return p
+}
+
+/* block writes a block of type typ with the given body and options. */
+func (p *pcapngWriter) block(typ uint32, body []byte, opts []pcapngOption) {
+	if nil != p.err {
+		return
+	}
+	/* Body, padded, then the options */
+	b := pad32(body)
+	for _, o := range opts {
+		oh := make([]byte, 4)
+		binary.LittleEndian.PutUint16(oh, o.code)
+		binary.LittleEndian.PutUint16(oh[2:], uint16(len(o.value)))
+		b = append(b, oh...)
+		b = append(b, pad32(o.value)...)
+	}
+	if 0 != len(opts) {
+		b = append(b, pcapngEndOpt, 0, 0, 0)
+	}
+	/* Type and length at the start, length again at the end */
+	l := make([]byte, 4)
+	binary.LittleEndian.PutUint32(l, uint32(12+len(b)))
+	h := make([]byte, 4)
+	binary.LittleEndian.PutUint32(h, typ)
+	for _, bs := range [][]byte{h, l, b, l} {
+		if _, p.err = p.w.Write(bs); nil != p.err {
+			return
+		}
+	}
+}
+
+/* Packet writes the IP packet pkt, captured at time t, with comment, if it's
+not empty. */
+func (p *pcapngWriter) Packet(t time.Time, pkt []byte, comment string) {
+	epb := make([]byte, 20, 20+len(pkt))
+	ts := uint64(t.UnixNano())
+	binary.LittleEndian.PutUint32(epb, 0) /* Interface ID */
+	binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(len(pkt)))
+	epb = append(epb, pkt...)
+	var opts []pcapngOption
+	if "" != comment {
+		opts = append(
+			opts,
+			pcapngOption{pcapngComment, []byte(comment)},
+		)
+	}
+	p.block(pcapngEPB, epb, opts)
+}
+
+/* Flush flushes buffered packets to the underlying writer and returns the
+first error encountered while writing, if any. */
+func (p *pcapngWriter) Flush() error {
+	if nil != p.err {
+		return p.err
+	}
+	return p.w.Flush()
+}
+
+/* TCP builds a TCP segment from src to dst, wrapped in IPv4 if both addresses
+are IPv4 or IPv6 otherwise. */
+func (p *pcapngWriter) TCP(
+	src *net.TCPAddr,
+	dst *net.TCPAddr,
+	seq uint32,
+	ack uint32,
+	flags byte,
+	data []byte,
+) []byte {
+	/* TCP header and data, checksum later */
+	seg := make([]byte, 20, 20+len(data))
+	binary.BigEndian.PutUint16(seg, uint16(src.Port))
+	binary.BigEndian.PutUint16(seg[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(seg[4:], seq)
+	binary.BigEndian.PutUint32(seg[8:], ack)
+	seg[12] = 5 << 4 /* Data offset, in words */
+	seg[13] = flags
+	binary.BigEndian.PutUint16(seg[14:], 0xFFFF) /* Window */
+	seg = append(seg, data...)
+
+	/* IP header */
+	var (
+		hdr    []byte
+		pseudo []byte
+	)
+	s4, d4 := src.IP.To4(), dst.IP.To4()
+	if nil != s4 && nil != d4 {
+		hdr = make([]byte, 20)
+		hdr[0] = 0x45 /* Version 4, 5-word header */
+		binary.BigEndian.PutUint16(hdr[2:], uint16(20+len(seg)))
+		p.ipID++
+		binary.BigEndian.PutUint16(hdr[4:], p.ipID)
+		binary.BigEndian.PutUint16(hdr[6:], 0x4000) /* Don't Fragment */
+		hdr[8] = 64                                 /* TTL */
+		hdr[9] = 6                                  /* TCP */
+		copy(hdr[12:], s4)
+		copy(hdr[16:], d4)
+		binary.BigEndian.PutUint16(hdr[10:], checksum(hdr, 0))
+		pseudo = make([]byte, 12)
+		copy(pseudo, s4)
+		copy(pseudo[4:], d4)
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(seg)))
+	} else {
+		hdr = make([]byte, 40)
+		hdr[0] = 0x60 /* Version 6 */
+		binary.BigEndian.PutUint16(hdr[4:], uint16(len(seg)))
+		hdr[6] = 6  /* TCP */
+		hdr[7] = 64 /* Hop limit */
+		copy(hdr[8:], src.IP.To16())
+		copy(hdr[24:], dst.IP.To16())
+		pseudo = make([]byte, 40)
+		copy(pseudo, hdr[8:40])
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(seg)))
+		pseudo[39] = 6
+	}
+	binary.BigEndian.PutUint16(
+		seg[16:],
+		checksum(seg, checksumSum(pseudo)),
+	)
+
+	return append(hdr, seg...)
+}
+
+/* checksum returns the internet checksum of b, starting with the partial sum
+sum, as returned by checksumSum. */
+func checksum(b []byte, sum uint32) uint16 {
+	sum += checksumSum(b)
+	for 0 != sum>>16 {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+/* checksumSum returns the unfolded sum of b's 16-bit words, for checksum. */
+func checksumSum(b []byte) uint32 {
+	var sum uint32
+	for ; 1 < len(b); b = b[2:] {
+		sum += uint32(binary.BigEndian.Uint16(b))
+	}
+	if 1 == len(b) {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+/* pad32 returns a copy of b padded with NULs to a multiple of 32 bits. */
+func pad32(b []byte) []byte {
+	p := make([]byte, (len(b)+3)/4*4)
+	copy(p, b)
+	return p
+}
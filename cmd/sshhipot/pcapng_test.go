@@ -0,0 +1,359 @@
+package main
+
+/*
+ * pcapng_test.go
+ * Tests for writing PCAP-NG
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/magisterquis/sshhipot"
+)
+
+/* testBlock is a PCAP-NG block read back from a file */
+type testBlock struct {
+	typ  uint32
+	body []byte            /* Fixed part of the body, padded */
+	opts map[uint16][]byte /* Options, unpadded */
+}
+
+/* parseTestPcapng parses the blocks in b, checking the lengths and padding
+as it goes. */
+func parseTestPcapng(t *testing.T, b []byte) []testBlock {
+	t.Helper()
+	var bs []testBlock
+	for 0 != len(b) {
+		if 12 > len(b) {
+			t.Fatalf("Short block %x", b)
+		}
+		blk := testBlock{
+			typ:  binary.LittleEndian.Uint32(b),
+			opts: make(map[uint16][]byte),
+		}
+		l := binary.LittleEndian.Uint32(b[4:])
+		if 0 != l%4 || 12 > l || uint32(len(b)) < l {
+			t.Fatalf("Block %x has bad length %v", blk.typ, l)
+		}
+		if tl := binary.LittleEndian.Uint32(b[l-4:]); l != tl {
+			t.Fatalf(
+				"Block %x has length %v, trailer %v",
+				blk.typ,
+				l,
+				tl,
+			)
+		}
+		body := b[8 : l-4]
+		b = b[l:]
+
+		/* Fixed part of the body */
+		var fixed int
+		switch blk.typ {
+		case pcapngSHB:
+			fixed = 16
+		case pcapngIDB:
+			fixed = 8
+		case pcapngEPB:
+			if 20 > len(body) {
+				t.Fatalf("Short EPB %x", body)
+			}
+			fixed = 20 + int(
+				binary.LittleEndian.Uint32(body[12:])+3,
+			)/4*4
+		default:
+			t.Fatalf("Unexpected block type %x", blk.typ)
+		}
+		if len(body) < fixed {
+			t.Fatalf("Block %x body too short", blk.typ)
+		}
+		blk.body, body = body[:fixed], body[fixed:]
+
+		/* Options, which end with opt_endofopt */
+		for 0 != len(body) {
+			if 4 > len(body) {
+				t.Fatalf("Short option %x", body)
+			}
+			code := binary.LittleEndian.Uint16(body)
+			ol := int(binary.LittleEndian.Uint16(body[2:]))
+			body = body[4:]
+			if pcapngEndOpt == code {
+				if 0 != ol || 0 != len(body) {
+					t.Fatalf("Bad end of options")
+				}
+				break
+			}
+			pl := (ol + 3) / 4 * 4
+			if len(body) < pl {
+				t.Fatalf("Option %v too long", code)
+			}
+			if !bytes.Equal(
+				make([]byte, pl-ol),
+				body[ol:pl],
+			) {
+				t.Errorf("Option %v has bad padding", code)
+			}
+			blk.opts[code] = body[:ol]
+			body = body[pl:]
+			if 0 == len(body) {
+				t.Fatalf("No end of options")
+			}
+		}
+		bs = append(bs, blk)
+	}
+	return bs
+}
+
+/* testSum returns the ones' complement sum of the 16-bit words in bs,
+which is 0xFFFF if the bytes include a correct checksum. */
+func testSum(bs ...[]byte) uint16 {
+	var (
+		sum uint64
+		all []byte
+	)
+	for _, b := range bs {
+		all = append(all, b...)
+	}
+	if 1 == len(all)%2 {
+		all = append(all, 0)
+	}
+	for i := 0; i < len(all); i += 2 {
+		sum += uint64(all[i])<<8 | uint64(all[i+1])
+	}
+	for 0 != sum>>16 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return uint16(sum)
+}
+
+/* testSegment is a TCP segment read back from a packet */
+type testSegment struct {
+	src, dst string /* Addresses and ports */
+	seq, ack uint32
+	flags    byte
+	data     []byte
+}
+
+/* parseTestPacket checks the IP and TCP headers and checksums in pkt and
+returns the TCP segment. */
+func parseTestPacket(t *testing.T, pkt []byte) testSegment {
+	t.Helper()
+	var (
+		seg      []byte
+		pseudo   []byte
+		src, dst net.IP
+	)
+	switch pkt[0] >> 4 {
+	case 4:
+		hdr := pkt[:20]
+		if 0xFFFF != testSum(hdr) {
+			t.Errorf("Bad IPv4 header checksum in %x", hdr)
+		}
+		if int(binary.BigEndian.Uint16(hdr[2:])) != len(pkt) {
+			t.Errorf("Bad IPv4 total length in %x", hdr)
+		}
+		seg = pkt[20:]
+		src, dst = net.IP(hdr[12:16]), net.IP(hdr[16:20])
+		pseudo = append(append([]byte{}, hdr[12:20]...), 0, 6, 0, 0)
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(seg)))
+	case 6:
+		hdr := pkt[:40]
+		if int(binary.BigEndian.Uint16(hdr[4:])) != len(pkt)-40 {
+			t.Errorf("Bad IPv6 payload length in %x", hdr)
+		}
+		seg = pkt[40:]
+		src, dst = net.IP(hdr[8:24]), net.IP(hdr[24:40])
+		pseudo = append(append([]byte{}, hdr[8:40]...), make(
+			[]byte,
+			8,
+		)...)
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(seg)))
+		pseudo[39] = 6
+	default:
+		t.Fatalf("Packet %x isn't IPv4 or IPv6", pkt)
+	}
+	if 0xFFFF != testSum(pseudo, seg) {
+		t.Errorf("Bad TCP checksum in %x", pkt)
+	}
+	return testSegment{
+		src: net.JoinHostPort(src.String(), fmt.Sprint(
+			binary.BigEndian.Uint16(seg),
+		)),
+		dst: net.JoinHostPort(dst.String(), fmt.Sprint(
+			binary.BigEndian.Uint16(seg[2:]),
+		)),
+		seq:   binary.BigEndian.Uint32(seg[4:]),
+		ack:   binary.BigEndian.Uint32(seg[8:]),
+		flags: seg[13],
+		data:  seg[20:],
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	/* https://en.wikipedia.org/wiki/Internet_checksum */
+	hdr := []byte{
+		0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11,
+		0x00, 0x00, 0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7,
+	}
+	if got := checksum(hdr, 0); 0xb861 != got {
+		t.Errorf("Checksum %04x, want b861", got)
+	}
+	/* Odd lengths are padded */
+	if got := checksum([]byte{0x01, 0x02, 0x03}, 0); ^uint16(0x0402) !=
+		got {
+		t.Errorf("Odd-length checksum %04x", got)
+	}
+}
+
+func TestExportPcap(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2026, 10, 18, 12, 0, 0, 123456000, time.Local)
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	/* A shell with a bit of data each way, odd lengths to need
+	padding */
+	var lines string
+	for _, l := range []struct {
+		t    time.Time
+		tag  string
+		data string
+	}{
+		{at(10), sshhipot.TAGTOSERVER, "id\r"},
+		{at(20), sshhipot.TAGTOATTACKER, "uid=0(root)\r\n"},
+		{at(30), sshhipot.TAGTOSERVER, "exit\r"},
+	} {
+		lines += fmt.Sprintf(
+			"%v ID:0123456789abcdef [%v] %q\n",
+			l.t.Format(sshhipot.LOGTIMEFORMAT),
+			l.tag,
+			l.data,
+		)
+	}
+	if err := ioutil.WriteFile(
+		filepath.Join(dir, "shell.log"),
+		[]byte(lines),
+		0600,
+	); nil != err {
+		t.Fatalf("Unable to write channel log: %v", err)
+	}
+	sess := &sshhipot.Session{
+		ID:       "0123456789abcdef",
+		Start:    start,
+		End:      at(100),
+		Address:  "192.0.2.1:5555",
+		User:     "root",
+		Upstream: "root@192.0.2.2:2222",
+		Channels: []*sshhipot.ChannelSummary{{
+			ID:        0,
+			Type:      "session",
+			Direction: sshhipot.TAGTOSERVER,
+			Start:     at(1),
+			End:       at(40),
+			Log:       "/elsewhere/shell.log",
+		}, {
+			/* An IPv6 forward, with nothing sent */
+			ID:         1,
+			Type:       "direct-tcpip",
+			Direction:  sshhipot.TAGTOSERVER,
+			Start:      at(50),
+			End:        at(60),
+			Address:    "[2001:db8::2]:80",
+			Originator: "[2001:db8::1]:4444",
+		}},
+	}
+	var buf bytes.Buffer
+	if err := exportPcap(&buf, dir, sess); nil != err {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	/* Headers */
+	bs := parseTestPcapng(t, buf.Bytes())
+	if 2 > len(bs) || pcapngSHB != bs[0].typ || pcapngIDB != bs[1].typ {
+		t.Fatalf("File doesn't start with a SHB and IDB")
+	}
+	if pcapngBOM != binary.LittleEndian.Uint32(bs[0].body) {
+		t.Errorf("Bad byte-order magic")
+	}
+	if pcapngLinkRaw != binary.LittleEndian.Uint16(bs[1].body) {
+		t.Errorf("Link type isn't raw")
+	}
+	if r := bs[1].opts[pcapngIfTSResol]; !bytes.Equal([]byte{9}, r) {
+		t.Errorf("if_tsresol is %x", r)
+	}
+
+	/* Packets, with sequence numbers which follow on */
+	var (
+		segs  []testSegment
+		next  = make(map[string]uint32) /* Next seq, by src->dst */
+		first = true
+	)
+	for _, b := range bs[2:] {
+		if pcapngEPB != b.typ {
+			t.Fatalf("Unexpected block type %x", b.typ)
+		}
+		ts := int64(binary.LittleEndian.Uint32(b.body[4:]))<<32 |
+			int64(binary.LittleEndian.Uint32(b.body[8:]))
+		if first && start.UnixNano() != ts {
+			t.Errorf(
+				"First packet at %v, want %v",
+				time.Unix(0, ts),
+				start,
+			)
+		}
+		first = false
+		l := binary.LittleEndian.Uint32(b.body[12:])
+		if ol := binary.LittleEndian.Uint32(b.body[16:]); l != ol {
+			t.Errorf("Captured %v bytes of %v", l, ol)
+		}
+		s := parseTestPacket(t, b.body[20:20+l])
+		fwd, rev := s.src+">"+s.dst, s.dst+">"+s.src
+		if seq := next[fwd]; seq != s.seq {
+			t.Errorf("%v seq %v, want %v", fwd, s.seq, seq)
+		}
+		if 0 != s.flags&tcpACK && next[rev] != s.ack {
+			t.Errorf("%v ack %v, want %v", fwd, s.ack, next[rev])
+		}
+		next[fwd] = s.seq + uint32(len(s.data))
+		if 0 != s.flags&(tcpSYN|tcpFIN) {
+			next[fwd]++
+		}
+		segs = append(segs, s)
+	}
+
+	/* Connection, shell, and forward */
+	var data []string
+	v6 := 0
+	for _, s := range segs {
+		if 0 != len(s.data) {
+			data = append(data, s.src+" "+string(s.data))
+		}
+		if "[2001:db8::1]:4444" == s.src {
+			v6++
+		}
+	}
+	want := []string{
+		"192.0.2.1:49152 id\r",
+		"192.0.2.2:2222 uid=0(root)\r\n",
+		"192.0.2.1:49152 exit\r",
+	}
+	if fmt.Sprintf("%q", want) != fmt.Sprintf("%q", data) {
+		t.Errorf("Data %q, want %q", data, want)
+	}
+	if 3*6+3 != len(segs) {
+		t.Errorf("Got %v segments, want %v", len(segs), 3*6+3)
+	}
+	if 4 != v6 {
+		t.Errorf("Got %v IPv6 segments from the client, want 4", v6)
+	}
+}
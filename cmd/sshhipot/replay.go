@@ -0,0 +1,340 @@
+package main
+
+/*
+ * replay.go
+ * Play back logged channels
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/magisterquis/sshhipot"
+)
+
+/* record is a single timestamped entry in a channel log.  If Data is nil, the
+record is a message (e.g. a request) and not proxied data. */
+type record struct {
+	Time time.Time
+	Tag  string
+	Data []byte
+	Msg  string
+}
+
+/* recordFormat is a format in which channel logs may be stored.  Detect is
+passed the first few bytes of a file and should return true if the file is in
+the format.  Parse reads all of the records from a file. */
+type recordFormat struct {
+	Name   string
+	Detect func(head []byte) bool
+	Parse  func(r io.Reader) ([]record, error)
+}
+
+/* recordFormats are the formats replay understands, in the order in which
+they're tried.  The text format should stay last, as it accepts anything. */
+var recordFormats = []recordFormat{
+	{
+		Name:   "transcript",
+		Detect: sshhipot.IsTranscript,
+		Parse:  parseTranscript,
+	},
+	{
+		Name:   "text",
+		Detect: func([]byte) bool { return true },
+		Parse:  parseTextLog,
+	},
+}
+
+/* replayMain plays back the channels logged in a session directory.  args
+should not include the subcommand name. */
+func replayMain(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var speed = fs.Float64(
+		"s",
+		1,
+		"Playback speed `multiplier`, or 0 to play without delays",
+	)
+	var maxIdle = fs.Duration(
+		"i",
+		5*time.Second,
+		"Maximum `delay` between chunks of output, or 0 for no limit",
+	)
+	var transcriptOnly = fs.Bool(
+		"t",
+		false,
+		"Only print the typed-command transcript",
+	)
+	var noTranscript = fs.Bool(
+		"T",
+		false,
+		"Don't print the typed-command transcript",
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v replay [options] session-dir|channel-log [...]
+
+Plays back the output sent to the attacker in each logged channel and prints
+a transcript of the commands the attacker typed.
+
+Options:
+`,
+			os.Args[0],
+		)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if 0 == fs.NArg() {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if 0 > *speed {
+		log.Fatalf("Playback speed must not be negative")
+	}
+
+	/* Work out which channel logs to play */
+	var names []string
+	for _, a := range fs.Args() {
+		ns, err := channelLogs(a)
+		if nil != err {
+			log.Fatalf(
+				"Unable to find channel logs in %v: %v",
+				a,
+				err,
+			)
+		}
+		names = append(names, ns...)
+	}
+
+	/* Parse them all, play them in order */
+	chans := make([]replayChannel, 0, len(names))
+	for _, n := range names {
+		rs, err := readRecords(n)
+		if nil != err {
+			log.Fatalf("Unable to read %v: %v", n, err)
+		}
+		if 0 == len(rs) {
+			continue
+		}
+		chans = append(chans, replayChannel{name: n, records: rs})
+	}
+	sort.SliceStable(chans, func(i, j int) bool {
+		return chans[i].records[0].Time.Before(
+			chans[j].records[0].Time,
+		)
+	})
+	for _, c := range chans {
+		if !*transcriptOnly {
+			fmt.Fprintf(os.Stderr, "=== %v ===\n", c.name)
+			playRecords(os.Stdout, c.records, *speed, *maxIdle)
+			fmt.Fprintf(os.Stderr, "\n=== End of %v ===\n", c.name)
+		}
+		if !*noTranscript {
+			printTranscript(os.Stdout, c.name, c.records)
+		}
+	}
+}
+
+/* replayChannel holds the records from a single channel log */
+type replayChannel struct {
+	name    string
+	records []record
+}
+
+/* channelLogs returns the names of the channel logs in the session directory
+d.  Channels with a binary transcript are represented by the transcript, which
+has exact timing and byte boundaries, instead of the text log.  If d is a
+file, it is returned by itself. */
+func channelLogs(d string) ([]string, error) {
+	fi, err := os.Stat(d)
+	if nil != err {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{d}, nil
+	}
+	fis, err := ioutil.ReadDir(d)
+	if nil != err {
+		return nil, err
+	}
+	have := make(map[string]bool)
+	for _, fi := range fis {
+		have[fi.Name()] = true
+	}
+	var ns []string
+	for _, fi := range fis {
+		/* The main session log isn't a channel log */
+		if fi.IsDir() || sshhipot.LOGNAME == fi.Name() {
+			continue
+		}
+		/* Prefer the transcript, if there is one */
+		if have[fi.Name()+sshhipot.TRANSCRIPTSUFFIX] {
+			continue
+		}
+		ns = append(ns, filepath.Join(d, fi.Name()))
+	}
+	return ns, nil
+}
+
+/* readRecords reads the records from the channel log named n, in whichever
+format it's in. */
+func readRecords(n string) ([]record, error) {
+	f, err := os.Open(n)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	head, err := br.Peek(64)
+	if nil != err && io.EOF != err {
+		return nil, err
+	}
+	for _, rf := range recordFormats {
+		if rf.Detect(head) {
+			return rf.Parse(br)
+		}
+	}
+	return nil, fmt.Errorf("unknown log format")
+}
+
+/* parseTranscript parses a binary transcript written with -tr */
+func parseTranscript(r io.Reader) ([]record, error) {
+	trs, err := sshhipot.ReadTranscript(r)
+	if nil != err {
+		return nil, err
+	}
+	rs := make([]record, len(trs))
+	for i, tr := range trs {
+		rs[i] = record{Time: tr.Time, Tag: tr.Tag(), Data: tr.Data}
+	}
+	return rs, nil
+}
+
+/* parseTextLog parses the text logs written by ProxyChannel and friends.
+Lines look like
+	2016/05/17 12:34:56.123456 ID:0123456789abcdef [server->attacker] "data"
+Lines which aren't data are returned as messages. */
+func parseTextLog(r io.Reader) ([]record, error) {
+	var rs []record
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		rec, ok := parseTextLine(s.Text())
+		if !ok {
+			continue
+		}
+		rs = append(rs, rec)
+	}
+	return rs, s.Err()
+}
+
+/* parseTextLine parses a single line of a text log.  It returns false if the
+line doesn't start with a timestamp. */
+func parseTextLine(l string) (record, bool) {
+	var rec record
+	if len(l) < len(sshhipot.LOGTIMEFORMAT)+1 {
+		return rec, false
+	}
+	t, err := time.ParseInLocation(
+		sshhipot.LOGTIMEFORMAT,
+		l[:len(sshhipot.LOGTIMEFORMAT)],
+		time.Local,
+	)
+	if nil != err {
+		return rec, false
+	}
+	rec.Time = t
+	l = l[len(sshhipot.LOGTIMEFORMAT)+1:]
+	/* Newer logs have the connection ID after the time */
+	if strings.HasPrefix(l, "ID:") {
+		if i := strings.IndexByte(l, ' '); -1 != i {
+			l = l[i+1:]
+		}
+	}
+	rec.Msg = l
+
+	/* Data lines are a [tag] followed by a quoted string */
+	if !strings.HasPrefix(l, "[") {
+		return rec, true
+	}
+	end := strings.Index(l, "] ")
+	if -1 == end {
+		return rec, true
+	}
+	rest := l[end+2:]
+	if !strings.HasPrefix(rest, `"`) {
+		return rec, true
+	}
+	d, err := strconv.Unquote(rest)
+	if nil != err {
+		return rec, true
+	}
+	rec.Tag = l[1:end]
+	rec.Data = []byte(d)
+	rec.Msg = ""
+	return rec, true
+}
+
+/* playRecords writes the data sent to the attacker in rs to w, sleeping
+between records to reproduce the original timing.  Delays are divided by speed
+and capped at maxIdle, if it's not 0.  A speed of 0 causes no delays. */
+func playRecords(
+	w io.Writer,
+	rs []record,
+	speed float64,
+	maxIdle time.Duration,
+) {
+	var last time.Time
+	for _, r := range rs {
+		if sshhipot.TAGTOATTACKER != r.Tag &&
+			sshhipot.TAGERRTOATTACKER != r.Tag {
+			continue
+		}
+		if 0 != speed && !last.IsZero() {
+			d := time.Duration(float64(r.Time.Sub(last)) / speed)
+			if 0 != maxIdle && d > maxIdle {
+				d = maxIdle
+			}
+			time.Sleep(d)
+		}
+		last = r.Time
+		w.Write(r.Data)
+	}
+}
+
+/* printTranscript prints the lines the attacker typed in rs to w, each with
+the time at which it was sent and the name of the channel. */
+func printTranscript(w io.Writer, name string, rs []record) {
+	var t time.Time
+	le := sshhipot.NewLineEditor(true, func(l string) {
+		fmt.Fprintf(
+			w,
+			"%v %v: %q\n",
+			t.Format(sshhipot.LOGTIMEFORMAT),
+			filepath.Base(name),
+			l,
+		)
+	})
+	for _, r := range rs {
+		t = r.Time
+		switch r.Tag {
+		case sshhipot.TAGTOSERVER:
+			le.Input(r.Data)
+		case sshhipot.TAGTOATTACKER:
+			le.Output(r.Data)
+		}
+	}
+}
@@ -0,0 +1,799 @@
+package main
+
+/*
+ * report.go
+ * Summarize what attackers have been up to
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/magisterquis/sshhipot"
+)
+
+/* reportSections are the sections report can print, in order */
+var reportSections = []struct {
+	name string
+	help string
+	make func(cs []reportConn, n int) reportSection
+}{
+	{"users", "Usernames tried", reportUsers},
+	{"passwords", "Passwords tried", reportPasswords},
+	{"pairs", "Username/password pairs tried", reportPairs},
+	{"versions", "Client versions", reportVersions},
+	{"sources", "Source addresses", reportSources},
+	{"subnets", "Source /24 (IPv4) and /48 (IPv6) networks", reportSubnets},
+	{
+		"countries",
+		"Source countries (needs data collected with the " +
+			"honeypot's -geo flag)",
+		reportCountries,
+	},
+	{
+		"asns",
+		"Source autonomous systems (needs data collected with the " +
+			"honeypot's -geo flag)",
+		reportASNs,
+	},
+	{"methods", "Authentication success rates", reportMethods},
+	{"commands", "Commands run", reportCommands},
+	{"files", "Files transferred", reportFiles},
+}
+
+/* reportConn is what we know about a single connection */
+type reportConn struct {
+	ID       string
+	Time     time.Time
+	Host     string
+	Version  string
+	Geo      *sshhipot.GeoInfo /* Nil if not looked up */
+	Attempts []sshhipot.AuthAttempt
+	Session  *sshhipot.Session /* Nil if we don't know about a session */
+}
+
+/* reportSection is a single table in a report */
+type reportSection struct {
+	Name    string          `json:"name"`
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+/* reportMain prints a report about the connections in the log directory or
+database.  args should not include the subcommand name. */
+func reportMain(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	var logDir = fs.String(
+		"d",
+		"conns",
+		"Per-connection log `directory` to read",
+	)
+	var dbFile = fs.String(
+		"db",
+		"",
+		"SQLite `database` to read instead of the log directory, "+
+			"which includes connections which didn't authenticate",
+	)
+	var since = fs.String(
+		"s",
+		"",
+		"Only report on connections since this `time`, either a "+
+			"duration ago (e.g. 168h), a date, or an RFC3339 time",
+	)
+	var until = fs.String(
+		"u",
+		"",
+		"Only report on connections before this `time`, in the same "+
+			"format as -s",
+	)
+	var top = fs.Int(
+		"n",
+		10,
+		"Show the top `number` of each thing, or 0 for all",
+	)
+	var format = fs.String(
+		"o",
+		"table",
+		"Output `format`, one of table, json, or csv",
+	)
+	var sections = fs.String(
+		"r",
+		"",
+		"Comma-separated `list` of sections to report (default all)",
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v report [options]
+
+Reports on the connections and sessions in the log directory or database.
+The log directory only has authentication attempts from connections which
+eventually authenticated; the database has them all.
+
+Sections:
+`,
+			os.Args[0],
+		)
+		for _, s := range reportSections {
+			fmt.Fprintf(os.Stderr, "  %-9v %v\n", s.name, s.help)
+		}
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if 0 != fs.NArg() {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	/* Work out the window */
+	var from, to time.Time
+	var err error
+	if "" != *since {
+		if from, err = parseWhen(*since); nil != err {
+			log.Fatalf("Invalid time %q: %v", *since, err)
+		}
+	}
+	if "" != *until {
+		if to, err = parseWhen(*until); nil != err {
+			log.Fatalf("Invalid time %q: %v", *until, err)
+		}
+	}
+
+	/* Get the data */
+	var cs []reportConn
+	if "" != *dbFile {
+		cs, err = reportFromDB(*dbFile)
+	} else {
+		cs, err = reportFromLogs(*logDir)
+	}
+	if nil != err {
+		log.Fatalf("Unable to read connections: %v", err)
+	}
+	var inWindow []reportConn
+	for _, c := range cs {
+		if !from.IsZero() && c.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !c.Time.Before(to) {
+			continue
+		}
+		inWindow = append(inWindow, c)
+	}
+
+	/* Make the report */
+	want := make(map[string]bool)
+	for _, s := range strings.Split(*sections, ",") {
+		if s = strings.TrimSpace(s); "" != s {
+			want[s] = true
+		}
+	}
+	var rs []reportSection
+	for _, s := range reportSections {
+		if 0 != len(want) && !want[s.name] {
+			continue
+		}
+		rs = append(rs, s.make(inWindow, *top))
+	}
+	if len(rs) < len(want) {
+		log.Fatalf("Unknown section in %q", *sections)
+	}
+
+	/* Print it */
+	switch *format {
+	case "table":
+		err = printReportTable(os.Stdout, rs)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "\t")
+		err = enc.Encode(rs)
+	case "csv":
+		err = printReportCSV(os.Stdout, rs)
+	default:
+		log.Fatalf("Unknown output format %q", *format)
+	}
+	if nil != err {
+		log.Fatalf("Unable to print report: %v", err)
+	}
+}
+
+/* parseWhen parses s as a duration ago, a date, or an RFC3339 time */
+func parseWhen(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); nil == err {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.ParseInLocation(
+		"2006-01-02",
+		s,
+		time.Local,
+	); nil == err {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+/* reportFromLogs reads the session summaries in logDir, including those in
+compressed sessions. */
+func reportFromLogs(logDir string) ([]reportConn, error) {
+	ss, err := sshhipot.ReadSummaries(logDir)
+	if nil != err {
+		return nil, err
+	}
+	cs := make([]reportConn, 0, len(ss))
+	for _, s := range ss {
+		host, _, err := net.SplitHostPort(s.Address)
+		if nil != err {
+			host = s.Address
+		}
+		cs = append(cs, reportConn{
+			ID:       s.ID,
+			Time:     s.Start,
+			Host:     host,
+			Version:  s.ClientVersion,
+			Geo:      s.Geo,
+			Attempts: s.AuthAttempts,
+			Session:  s,
+		})
+	}
+	return cs, nil
+}
+
+/* reportFromDB reads connections from the database in the file named fn */
+func reportFromDB(fn string) ([]reportConn, error) {
+	sdb, err := sql.Open("sqlite3", fn+"?mode=ro")
+	if nil != err {
+		return nil, err
+	}
+	defer sdb.Close()
+	var (
+		cs   []reportConn
+		byID = make(map[string]int)
+	)
+	/* Connections */
+	if err := dbRows(sdb, `SELECT id, time, host FROM connections`, func(
+		scan func(...interface{}) error,
+	) error {
+		var (
+			c reportConn
+			t string
+		)
+		if err := scan(&c.ID, &t, &c.Host); nil != err {
+			return err
+		}
+		c.Time, _ = time.Parse(sshhipot.DBTIMEFORMAT, t)
+		byID[c.ID] = len(cs)
+		cs = append(cs, c)
+		return nil
+	}); nil != err {
+		return nil, err
+	}
+	/* Where they're from, if the database is new enough to know */
+	var v int
+	if err := sdb.QueryRow("PRAGMA user_version").Scan(&v); nil != err {
+		return nil, err
+	}
+	if 3 <= v {
+		if err := dbRows(sdb, `SELECT
+			id,
+			country,
+			country_code,
+			city,
+			asn,
+			org
+		FROM connections
+		WHERE country_code IS NOT NULL OR asn IS NOT NULL`, func(
+			scan func(...interface{}) error,
+		) error {
+			var (
+				id                string
+				co, cc, city, org sql.NullString
+				asn               sql.NullInt64
+			)
+			if err := scan(
+				&id,
+				&co,
+				&cc,
+				&city,
+				&asn,
+				&org,
+			); nil != err {
+				return err
+			}
+			i, ok := byID[id]
+			if !ok {
+				return nil
+			}
+			cs[i].Geo = &sshhipot.GeoInfo{
+				Country:     co.String,
+				CountryCode: cc.String,
+				City:        city.String,
+				ASN:         uint(asn.Int64),
+				Org:         org.String,
+			}
+			return nil
+		}); nil != err {
+			return nil, err
+		}
+	}
+	/* Authentication attempts */
+	if err := dbRows(sdb, `SELECT
+		connection,
+		time,
+		client_version,
+		method,
+		user,
+		prompt,
+		credential,
+		successful
+	FROM auth_attempts ORDER BY id`, func(
+		scan func(...interface{}) error,
+	) error {
+		var (
+			a          sshhipot.AuthAttempt
+			id, t, ver string
+		)
+		if err := scan(
+			&id,
+			&t,
+			&ver,
+			&a.Method,
+			&a.User,
+			&a.Prompt,
+			&a.Credential,
+			&a.Successful,
+		); nil != err {
+			return err
+		}
+		a.Time, _ = time.Parse(sshhipot.DBTIMEFORMAT, t)
+		i, ok := byID[id]
+		if !ok {
+			return nil
+		}
+		cs[i].Version = ver
+		cs[i].Attempts = append(cs[i].Attempts, a)
+		return nil
+	}); nil != err {
+		return nil, err
+	}
+	/* Sessions */
+	if err := dbRows(sdb, `SELECT id, client_version FROM sessions`, func(
+		scan func(...interface{}) error,
+	) error {
+		s := new(sshhipot.Session)
+		if err := scan(&s.ID, &s.ClientVersion); nil != err {
+			return err
+		}
+		i, ok := byID[s.ID]
+		if !ok {
+			return nil
+		}
+		cs[i].Version = s.ClientVersion
+		cs[i].Session = s
+		return nil
+	}); nil != err {
+		return nil, err
+	}
+	/* Commands and files */
+	sess := func(id string) *sshhipot.Session {
+		i, ok := byID[id]
+		if !ok {
+			return nil
+		}
+		return cs[i].Session
+	}
+	if err := dbRows(sdb, `SELECT session, command FROM commands`, func(
+		scan func(...interface{}) error,
+	) error {
+		var (
+			id string
+			c  sshhipot.CommandSummary
+		)
+		if err := scan(&id, &c.Command); nil != err {
+			return err
+		}
+		if s := sess(id); nil != s {
+			s.Commands = append(s.Commands, c)
+		}
+		return nil
+	}); nil != err {
+		return nil, err
+	}
+	if err := dbRows(sdb, `SELECT
+		session,
+		direction,
+		name,
+		size,
+		COALESCE(sha256, '')
+	FROM files`, func(scan func(...interface{}) error) error {
+		var (
+			id string
+			f  sshhipot.FileSummary
+		)
+		if err := scan(
+			&id,
+			&f.Direction,
+			&f.Name,
+			&f.Size,
+			&f.SHA256,
+		); nil != err {
+			return err
+		}
+		if s := sess(id); nil != s {
+			s.Files = append(s.Files, f)
+		}
+		return nil
+	}); nil != err {
+		return nil, err
+	}
+	return cs, nil
+}
+
+/* dbRows calls f with a scan function for each row returned by query */
+func dbRows(
+	sdb *sql.DB,
+	query string,
+	f func(scan func(...interface{}) error) error,
+) error {
+	rows, err := sdb.Query(query)
+	if nil != err {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := f(rows.Scan); nil != err {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+/* counter counts things, for the top-n sections */
+type counter map[string]int
+
+/* Rows returns the top n things counted, or all if n is 0, with their
+counts. */
+func (c counter) Rows(n int) [][]interface{} {
+	ks := make([]string, 0, len(c))
+	for k := range c {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		if c[ks[i]] != c[ks[j]] {
+			return c[ks[i]] > c[ks[j]]
+		}
+		return ks[i] < ks[j]
+	})
+	if 0 != n && n < len(ks) {
+		ks = ks[:n]
+	}
+	rs := make([][]interface{}, 0, len(ks))
+	for _, k := range ks {
+		rs = append(rs, []interface{}{k, c[k]})
+	}
+	return rs
+}
+
+/* reportUsers counts usernames tried */
+func reportUsers(cs []reportConn, n int) reportSection {
+	c := make(counter)
+	for _, rc := range cs {
+		for _, a := range rc.Attempts {
+			c[a.User]++
+		}
+	}
+	return reportSection{
+		Name:    "users",
+		Columns: []string{"user", "attempts"},
+		Rows:    c.Rows(n),
+	}
+}
+
+/* reportPasswords counts passwords tried, including keyboard-interactive
+answers */
+func reportPasswords(cs []reportConn, n int) reportSection {
+	c := make(counter)
+	for _, rc := range cs {
+		for _, a := range rc.Attempts {
+			if isPassword(a) {
+				c[a.Credential]++
+			}
+		}
+	}
+	return reportSection{
+		Name:    "passwords",
+		Columns: []string{"password", "attempts"},
+		Rows:    c.Rows(n),
+	}
+}
+
+/* reportPairs counts username/password pairs tried */
+func reportPairs(cs []reportConn, n int) reportSection {
+	c := make(counter)
+	for _, rc := range cs {
+		for _, a := range rc.Attempts {
+			if isPassword(a) {
+				c[a.User+"\x00"+a.Credential]++
+			}
+		}
+	}
+	rs := c.Rows(n)
+	for i, r := range rs {
+		p := strings.SplitN(r[0].(string), "\x00", 2)
+		rs[i] = []interface{}{p[0], p[1], r[1]}
+	}
+	return reportSection{
+		Name:    "pairs",
+		Columns: []string{"user", "password", "attempts"},
+		Rows:    rs,
+	}
+}
+
+/* isPassword returns true if a was an attempt with a password (or something
+like it) */
+func isPassword(a sshhipot.AuthAttempt) bool {
+	return "Password" == a.Method || "Keyboard" == a.Method
+}
+
+/* reportVersions counts connections by client version */
+func reportVersions(cs []reportConn, n int) reportSection {
+	c := make(counter)
+	for _, rc := range cs {
+		if "" != rc.Version {
+			c[rc.Version]++
+		}
+	}
+	return reportSection{
+		Name:    "versions",
+		Columns: []string{"version", "connections"},
+		Rows:    c.Rows(n),
+	}
+}
+
+/* reportSources counts connections by source address */
+func reportSources(cs []reportConn, n int) reportSection {
+	c := make(counter)
+	for _, rc := range cs {
+		c[rc.Host]++
+	}
+	return reportSection{
+		Name:    "sources",
+		Columns: []string{"address", "connections"},
+		Rows:    c.Rows(n),
+	}
+}
+
+/* reportSubnets counts connections by source network */
+func reportSubnets(cs []reportConn, n int) reportSection {
+	c := make(counter)
+	for _, rc := range cs {
+		c[subnet(rc.Host)]++
+	}
+	return reportSection{
+		Name:    "subnets",
+		Columns: []string{"network", "connections"},
+		Rows:    c.Rows(n),
+	}
+}
+
+/* reportCountries counts connections by source country */
+func reportCountries(cs []reportConn, n int) reportSection {
+	c := make(counter)
+	for _, rc := range cs {
+		if nil == rc.Geo || "" == rc.Geo.CountryCode {
+			continue
+		}
+		c[rc.Geo.CountryCode+" "+rc.Geo.Country]++
+	}
+	return reportSection{
+		Name:    "countries",
+		Columns: []string{"country", "connections"},
+		Rows:    c.Rows(n),
+	}
+}
+
+/* reportASNs counts connections by source autonomous system */
+func reportASNs(cs []reportConn, n int) reportSection {
+	c := make(counter)
+	for _, rc := range cs {
+		if nil == rc.Geo || 0 == rc.Geo.ASN {
+			continue
+		}
+		c[fmt.Sprintf("AS%v %v", rc.Geo.ASN, rc.Geo.Org)]++
+	}
+	return reportSection{
+		Name:    "asns",
+		Columns: []string{"asn", "connections"},
+		Rows:    c.Rows(n),
+	}
+}
+
+/* subnet returns the /24 (IPv4) or /48 (IPv6) containing host, or host if
+it's not an IP address. */
+func subnet(host string) string {
+	ip := net.ParseIP(host)
+	if nil == ip {
+		return host
+	}
+	if v4 := ip.To4(); nil != v4 {
+		return (&net.IPNet{
+			IP:   v4.Mask(net.CIDRMask(24, 32)),
+			Mask: net.CIDRMask(24, 32),
+		}).String()
+	}
+	return (&net.IPNet{
+		IP:   ip.Mask(net.CIDRMask(48, 128)),
+		Mask: net.CIDRMask(48, 128),
+	}).String()
+}
+
+/* reportMethods works out the success rate of each authentication method */
+func reportMethods(cs []reportConn, n int) reportSection {
+	tries := make(counter)
+	wins := make(counter)
+	for _, rc := range cs {
+		for _, a := range rc.Attempts {
+			tries[a.Method]++
+			if a.Successful {
+				wins[a.Method]++
+			}
+		}
+	}
+	rs := tries.Rows(0)
+	for i, r := range rs {
+		m := r[0].(string)
+		rs[i] = []interface{}{
+			m,
+			tries[m],
+			wins[m],
+			fmt.Sprintf(
+				"%.1f%%",
+				100*float64(wins[m])/float64(tries[m]),
+			),
+		}
+	}
+	return reportSection{
+		Name:    "methods",
+		Columns: []string{"method", "attempts", "successes", "rate"},
+		Rows:    rs,
+	}
+}
+
+/* reportCommands counts commands run */
+func reportCommands(cs []reportConn, n int) reportSection {
+	c := make(counter)
+	for _, rc := range cs {
+		if nil == rc.Session {
+			continue
+		}
+		for _, cmd := range rc.Session.Commands {
+			c[cmd.Command]++
+		}
+	}
+	return reportSection{
+		Name:    "commands",
+		Columns: []string{"command", "runs"},
+		Rows:    c.Rows(n),
+	}
+}
+
+/* reportFiles counts files transferred, by hash */
+func reportFiles(cs []reportConn, n int) reportSection {
+	var (
+		c     = make(counter)
+		names = make(map[string]map[string]bool)
+		sizes = make(map[string]uint64)
+	)
+	for _, rc := range cs {
+		if nil == rc.Session {
+			continue
+		}
+		for _, f := range rc.Session.Files {
+			k := f.Direction + "\x00" + f.SHA256
+			c[k]++
+			if nil == names[k] {
+				names[k] = make(map[string]bool)
+			}
+			names[k][f.Name] = true
+			sizes[k] = f.Size
+		}
+	}
+	rs := c.Rows(n)
+	for i, r := range rs {
+		k := r[0].(string)
+		p := strings.SplitN(k, "\x00", 2)
+		var ns []string
+		for n := range names[k] {
+			ns = append(ns, n)
+		}
+		sort.Strings(ns)
+		rs[i] = []interface{}{
+			p[1],
+			p[0],
+			sizes[k],
+			r[1],
+			strings.Join(ns, " "),
+		}
+	}
+	return reportSection{
+		Name: "files",
+		Columns: []string{
+			"sha256",
+			"direction",
+			"size",
+			"transfers",
+			"names",
+		},
+		Rows: rs,
+	}
+}
+
+/* printReportTable prints the report rs to w as aligned tables */
+func printReportTable(w io.Writer, rs []reportSection) error {
+	for i, r := range rs {
+		if 0 != i {
+			fmt.Fprintf(w, "\n")
+		}
+		fmt.Fprintf(w, "== %v ==\n", r.Name)
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "%v\n", strings.ToUpper(
+			strings.Join(r.Columns, "\t"),
+		))
+		for _, row := range r.Rows {
+			vs := make([]string, len(row))
+			for j, v := range row {
+				/* Keep odd credentials on one line */
+				if s, ok := v.(string); ok {
+					s = strconv.Quote(s)
+					vs[j] = s[1 : len(s)-1]
+				} else {
+					vs[j] = fmt.Sprintf("%v", v)
+				}
+			}
+			fmt.Fprintf(tw, "%v\n", strings.Join(vs, "\t"))
+		}
+		if err := tw.Flush(); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+/* printReportCSV prints the report rs to w as CSV.  Each row starts with the
+name of its section, and each section starts with a header. */
+func printReportCSV(w io.Writer, rs []reportSection) error {
+	cw := csv.NewWriter(w)
+	for _, r := range rs {
+		if err := cw.Write(
+			append([]string{"section"}, r.Columns...),
+		); nil != err {
+			return err
+		}
+		for _, row := range r.Rows {
+			vs := []string{r.Name}
+			for _, v := range row {
+				vs = append(vs, fmt.Sprintf("%v", v))
+			}
+			if err := cw.Write(vs); nil != err {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
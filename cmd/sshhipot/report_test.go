@@ -0,0 +1,199 @@
+package main
+
+/*
+ * report_test.go
+ * Tests for reporting on connections
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/magisterquis/sshhipot"
+)
+
+/* testReportConns are the connections about which the tests report */
+var testReportConns = []reportConn{{
+	ID:      "a",
+	Host:    "192.0.2.10",
+	Version: "SSH-2.0-Go",
+	Geo: &sshhipot.GeoInfo{
+		Country:     "Narnia",
+		CountryCode: "NA",
+		ASN:         64500,
+		Org:         "Wardrobe",
+	},
+	Attempts: []sshhipot.AuthAttempt{
+		{Method: "Password", User: "root", Credential: "123456"},
+		{Method: "Password", User: "root", Credential: "admin"},
+		{
+			Method:     "Password",
+			User:       "admin",
+			Credential: "admin",
+			Successful: true,
+		},
+	},
+	Session: &sshhipot.Session{
+		Commands: []sshhipot.CommandSummary{
+			{Command: "uname -a"},
+			{Command: "id"},
+		},
+		Files: []sshhipot.FileSummary{
+			{Direction: "up", Name: "x", Size: 3, SHA256: "aa"},
+			{Direction: "up", Name: "y", Size: 3, SHA256: "aa"},
+		},
+	},
+}, {
+	ID:      "b",
+	Host:    "192.0.2.200",
+	Version: "SSH-2.0-Go",
+	Attempts: []sshhipot.AuthAttempt{
+		{Method: "Key", User: "root", Credential: "FF"},
+		{Method: "Keyboard", User: "root", Credential: "123456"},
+	},
+	Session: &sshhipot.Session{
+		Commands: []sshhipot.CommandSummary{{Command: "uname -a"}},
+		Files: []sshhipot.FileSummary{
+			{Direction: "down", Name: "z", Size: 5, SHA256: "aa"},
+		},
+	},
+}, {
+	ID:      "c",
+	Host:    "2001:db8:1:2::1",
+	Version: "SSH-2.0-libssh",
+	Attempts: []sshhipot.AuthAttempt{
+		{Method: "Password", User: "pi", Credential: "raspberry"},
+	},
+}}
+
+func TestReportSections(t *testing.T) {
+	for _, c := range []struct {
+		f    func([]reportConn, int) reportSection
+		n    int
+		want string
+	}{{
+		f:    reportUsers,
+		want: "[[root 4] [admin 1] [pi 1]]",
+	}, {
+		f:    reportUsers,
+		n:    1,
+		want: "[[root 4]]",
+	}, {
+		f:    reportPasswords,
+		want: "[[123456 2] [admin 2] [raspberry 1]]",
+	}, {
+		f: reportPairs,
+		want: "[[root 123456 2] [admin admin 1] [pi raspberry 1] " +
+			"[root admin 1]]",
+	}, {
+		f:    reportVersions,
+		want: "[[SSH-2.0-Go 2] [SSH-2.0-libssh 1]]",
+	}, {
+		f:    reportSources,
+		want: "[[192.0.2.10 1] [192.0.2.200 1] [2001:db8:1:2::1 1]]",
+	}, {
+		f:    reportSubnets,
+		want: "[[192.0.2.0/24 2] [2001:db8:1::/48 1]]",
+	}, {
+		f:    reportCountries,
+		want: "[[NA Narnia 1]]",
+	}, {
+		f:    reportASNs,
+		want: "[[AS64500 Wardrobe 1]]",
+	}, {
+		f: reportMethods,
+		want: "[[Password 4 1 25.0%] [Key 1 0 0.0%] " +
+			"[Keyboard 1 0 0.0%]]",
+	}, {
+		f:    reportCommands,
+		want: "[[uname -a 2] [id 1]]",
+	}, {
+		f:    reportFiles,
+		want: "[[aa up 3 2 x y] [aa down 5 1 z]]",
+	}} {
+		s := c.f(testReportConns, c.n)
+		if got := fmt.Sprintf("%v", s.Rows); got != c.want {
+			t.Errorf(
+				"%v (%v): got %v, want %v",
+				s.Name,
+				c.n,
+				got,
+				c.want,
+			)
+		}
+		for _, r := range s.Rows {
+			if len(r) != len(s.Columns) {
+				t.Errorf(
+					"%v: row %v doesn't match columns %v",
+					s.Name,
+					r,
+					s.Columns,
+				)
+			}
+		}
+	}
+}
+
+func TestReportSectionsEmpty(t *testing.T) {
+	for _, rs := range reportSections {
+		if s := rs.make(nil, 0); 0 != len(s.Rows) {
+			t.Errorf(
+				"%v: got rows %v with no connections",
+				rs.name,
+				s.Rows,
+			)
+		}
+	}
+}
+
+func TestSubnet(t *testing.T) {
+	for in, want := range map[string]string{
+		"198.51.100.7":      "198.51.100.0/24",
+		"::ffff:10.1.2.3":   "10.1.2.0/24",
+		"2001:db8:a:b:c::1": "2001:db8:a::/48",
+		"not-an-address":    "not-an-address",
+	} {
+		if got := subnet(in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestPrintReport(t *testing.T) {
+	rs := []reportSection{
+		reportUsers(testReportConns, 2),
+		reportVersions(testReportConns, 0),
+	}
+	var b bytes.Buffer
+	if err := printReportCSV(&b, rs); nil != err {
+		t.Fatalf("CSV error: %v", err)
+	}
+	want := "section,user,attempts\n" +
+		"users,root,4\n" +
+		"users,admin,1\n" +
+		"section,version,connections\n" +
+		"versions,SSH-2.0-Go,2\n" +
+		"versions,SSH-2.0-libssh,1\n"
+	if got := b.String(); got != want {
+		t.Errorf("CSV:\n%s\nwant:\n%s", got, want)
+	}
+
+	/* Odd credentials stay on one line */
+	b.Reset()
+	if err := printReportTable(&b, []reportSection{{
+		Name:    "odd",
+		Columns: []string{"cred", "n"},
+		Rows:    [][]interface{}{{"a\nb", 1}},
+	}}); nil != err {
+		t.Fatalf("Table error: %v", err)
+	}
+	if got := b.String(); 3 != strings.Count(got, "\n") ||
+		!strings.Contains(got, `a\nb`) {
+		t.Errorf("Table:\n%s", got)
+	}
+}
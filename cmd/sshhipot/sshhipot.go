@@ -0,0 +1,507 @@
+package main
+
+/*
+ * sshhipot.go
+ * Hi-interaction ssh honeypot
+ * By J. Stuart McMurray
+ * Created 20160514
+ * Last Modified 20261018
+ */
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/magisterquis/sshhipot"
+)
+
+func main() {
+	/* Subcommands which aren't the honeypot itself */
+	if 1 < len(os.Args) {
+		switch os.Args[1] {
+		case "replay":
+			replayMain(os.Args[2:])
+			return
+		case "report":
+			reportMain(os.Args[2:])
+			return
+		case "convert":
+			convertMain(os.Args[2:])
+			return
+		case "export-pcap":
+			exportPcapMain(os.Args[2:])
+			return
+		case "fetch":
+			fetchMain(os.Args[2:])
+			return
+		case "migrate":
+			migrateMain(os.Args[2:])
+			return
+		}
+	}
+
+	/* Network addresses */
+	var laddr = flag.String(
+		"l",
+		":2222",
+		"Listen `address`",
+	)
+	var noAuthOk = flag.Bool(
+		"A",
+		false,
+		"Allow clients to connect without authentication",
+	)
+	var serverVersion = flag.String(
+		"v",
+		"SSH-2.0-OpenSSH_7.2",
+		"Server `version` to present to clients",
+		/* TODO: Get from real server */
+	)
+	var password = flag.String(
+		"p",
+		"hunter2",
+		"Allowed `password`",
+	)
+	var passList = flag.String(
+		"pf",
+		"",
+		"Password `file` with one password per line",
+	)
+	var passProb = flag.Float64(
+		"pp",
+		.05,
+		"Accept any password with this `probability`",
+	)
+	var kicHost = flag.String(
+		"H",
+		"localhost",
+		"Keyboard-Interactive challenge and fallback shell `hostname`",
+	)
+	var kiScript = flag.String(
+		"ki",
+		"",
+		"Keyboard-Interactive challenge script `file` "+
+			"(default: ask for a password)",
+	)
+	var bannerFile = flag.String(
+		"b",
+		"",
+		"Pre-authentication banner `file`, like sshd's Banner",
+	)
+	var maxTries = flag.Int(
+		"mt",
+		6,
+		"Disconnect after this many authentication `failures`, "+
+			"like sshd's MaxAuthTries (but the disconnect "+
+			"message is lowercase)",
+	)
+	var failDelay = flag.Duration(
+		"ad",
+		0,
+		"Approximate `delay` after each failed password or "+
+			"keyboard-interactive attempt, like PAM's (try 2s)",
+	)
+	var authMethods = flag.String(
+		"am",
+		"password,publickey,keyboard-interactive",
+		"Comma-separated `list` of authentication methods to offer, "+
+			"which are always offered in the default order, "+
+			"whatever the order in list",
+	)
+	var keyName = flag.String(
+		"k",
+		"shp_id_rsa",
+		"SSH RSA `key`, which will be created if it does not exist",
+	)
+	/* Logging */
+	var logDir = flag.String(
+		"d",
+		"conns",
+		"Per-connection log `directory`",
+	)
+	var pathTemplate = flag.String(
+		"dt",
+		sshhipot.DEFAULTPATHTEMPLATE,
+		"Session directory path `template` in the log directory, "+
+			"with fields {date}, {year}, {month}, {day}, {time}, "+
+			"{ip}, {port}, {listener}, {user}, {session_id}, and "+
+			"{hassh}",
+	)
+	var hideBanners = flag.Bool(
+		"B",
+		false,
+		"Don't log connections with no authentication attempts (banners).",
+	)
+	var chanCap, sessCap, quota byteSize
+	flag.Var(
+		&chanCap,
+		"lc",
+		"Maximum `size` of data logged per channel, or 0 for no limit",
+	)
+	flag.Var(
+		&sessCap,
+		"ls",
+		"Maximum `size` of data logged per session, or 0 for no limit",
+	)
+	var transcripts = flag.Bool(
+		"tr",
+		false,
+		"Also write a binary transcript of each channel's data, with "+
+			"exact timing and byte boundaries",
+	)
+	var logLevel = flag.String(
+		"ll",
+		"info",
+		"Global and debug log `level`: error, warn, info, debug, "+
+			"or trace",
+	)
+	var logLevels = flag.String(
+		"lsl",
+		"",
+		"Comma-separated per-subsystem log `levels`, like "+
+			"auth=debug,channel=trace, for subsystems auth, "+
+			"channel, request, upstream, and general",
+	)
+	var logOut = flag.String(
+		"lo",
+		"-",
+		"Global log `file`, or - for stdout",
+	)
+	var debugOut = flag.String(
+		"dbg",
+		"",
+		"Mirror session logs to `file`, or - for stderr, filtered by "+
+			"the log levels (default none)",
+	)
+	flag.Var(
+		&quota,
+		"q",
+		"Maximum `size` of the per-connection log directory, "+
+			"enforced by removing the oldest sessions, or 0 for "+
+			"no limit",
+	)
+	var compress = flag.Bool(
+		"qc",
+		false,
+		"Compress old sessions before removing them to enforce -q",
+	)
+	var retention = flag.Uint(
+		"r",
+		0,
+		"Remove sessions older than this many `days`, or 0 to keep "+
+			"them forever",
+	)
+	/* Keeping the upstream safe */
+	var rulesFile = flag.String(
+		"R",
+		"",
+		"Command interception rules `file` (default none)",
+	)
+	/* Keeping attackers from hogging the upstream */
+	var chanUp, chanDown, sessUp, sessDown byteSize
+	flag.Var(
+		&chanUp,
+		"rcu",
+		"Maximum attacker->server `rate` per channel, in bytes per "+
+			"second, or 0 for no limit",
+	)
+	flag.Var(
+		&chanDown,
+		"rcd",
+		"Maximum server->attacker `rate` per channel, in bytes per "+
+			"second, or 0 for no limit",
+	)
+	flag.Var(
+		&sessUp,
+		"rsu",
+		"Maximum attacker->server `rate` per session, in bytes per "+
+			"second, or 0 for no limit",
+	)
+	flag.Var(
+		&sessDown,
+		"rsd",
+		"Maximum server->attacker `rate` per session, in bytes per "+
+			"second, or 0 for no limit",
+	)
+	var idleTimeout = flag.Duration(
+		"it",
+		0,
+		"Disconnect sessions with no channel data for this "+
+			"`duration`, or 0 for no limit",
+	)
+	var maxDuration = flag.Duration(
+		"md",
+		0,
+		"Disconnect attackers after this `duration`, or 0 for no limit",
+	)
+	var maxChans = flag.Int(
+		"mc",
+		0,
+		"Maximum `number` of channels an attacker may have open at "+
+			"once, or 0 for no limit",
+	)
+	/* Storage */
+	var dbFile = flag.String(
+		"db",
+		"",
+		"SQLite database `file` in which to store connections and "+
+			"sessions (default none)",
+	)
+	var geoFiles = flag.String(
+		"geo",
+		"",
+		"Comma-separated MaxMind-format (mmdb) `files` with which to "+
+			"look up attackers' locations and networks (default "+
+			"none)",
+	)
+	/* Artifacts and downloads */
+	var artifacts = flag.Bool(
+		"art",
+		false,
+		"Keep one copy of each file attackers upload or pipe to "+
+			"commands in the log directory's artifact store",
+	)
+	var artQuota byteSize
+	flag.Var(
+		&artQuota,
+		"artq",
+		"Maximum `size` of the artifact store, enforced by removing "+
+			"the least recently seen artifacts, or 0 for no "+
+			"limit (required with -q)",
+	)
+	var yaraDir = flag.String(
+		"yara",
+		"",
+		"Tag new artifacts with the YARA rules in the .yar and .yara "+
+			"files in `directory` (default none)",
+	)
+	var downloads = flag.Bool(
+		"dl",
+		false,
+		"Download what attackers try to download with wget, curl, "+
+			"and so on into the artifact store (implies -art)",
+	)
+	var dlProxy = flag.String(
+		"dlp",
+		"",
+		"HTTP or SOCKS5 proxy `URL` for -dl downloads (default "+
+			"from the environment)",
+	)
+	var dlOffline = flag.Bool(
+		"dlo",
+		false,
+		"Don't download anything, only save URLs to fetch later",
+	)
+	/* Alerting */
+	var alertFile = flag.String(
+		"al",
+		"",
+		"Alert rules `file` (default none)",
+	)
+	/* Operator console */
+	var adminSock = flag.String(
+		"as",
+		"",
+		"Admin console Unix socket `path` (default none)",
+	)
+	/* Client */
+	var cUser = flag.String(
+		"cu",
+		"root",
+		"Upstream `username`",
+	)
+	var cKey = flag.String(
+		"ck",
+		"id_rsa",
+		"RSA `key` to use as a client, "+
+			"which will be created if it does not exist",
+	)
+	var saddr = flag.String(
+		"cs",
+		"192.168.0.2:22",
+		"Real server `address`",
+	)
+	var fingerprint = flag.String(
+		"sf",
+		"",
+		"Real server host key `fingerprint`",
+	)
+	/* Fallback shell */
+	var fakeFS = flag.String(
+		"f",
+		"",
+		"Fallback shell filesystem `tarball`, which may be gzipped "+
+			"(default built-in)",
+	)
+	var fbPrompt = flag.String(
+		"fp",
+		"%u@%h:%w%$ ",
+		"Fallback shell prompt `format` (%u: user, %h: hostname, "+
+			"%w: directory, %W: directory basename, %$: # or $)",
+	)
+	var fbAlways = flag.Bool(
+		"fa",
+		false,
+		"Always use the fallback shell, never the upstream server",
+	)
+	var fbVersions = flag.String(
+		"fv",
+		"",
+		"Comma-separated `list` of client version substrings to send "+
+			"to the fallback shell",
+	)
+	var fbUsers = flag.String(
+		"fu",
+		"",
+		"Comma-separated `list` of usernames to send to the fallback "+
+			"shell",
+	)
+	/* Local server config */
+	flag.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			`Usage: %v [options]
+       %v replay [options] session-dir [...]
+       %v report [options]
+       %v convert [options] transcript
+       %v export-pcap [options] session-dir
+       %v fetch [options] log-dir
+       %v migrate [options] log-dir
+
+Options:
+`,
+			os.Args[0],
+			os.Args[0],
+			os.Args[0],
+			os.Args[0],
+			os.Args[0],
+			os.Args[0],
+			os.Args[0],
+		)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	/* Log better */
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	lo, err := openLogFile(*logOut, os.Stdout)
+	if nil != err {
+		log.Fatalf("Unable to open global log %v: %v", *logOut, err)
+	}
+	log.SetOutput(lo)
+	var debugLog io.Writer
+	if "" != *debugOut {
+		dl, err := openLogFile(*debugOut, os.Stderr)
+		if nil != err {
+			log.Fatalf(
+				"Unable to open debug log %v: %v",
+				*debugOut,
+				err,
+			)
+		}
+		debugLog = dl
+	}
+	/* TODO: Log target server */
+
+	/* Make the honeypot */
+	s, err := sshhipot.NewServer(sshhipot.Config{
+		NoClientAuth:        *noAuthOk,
+		ServerVersion:       *serverVersion,
+		Password:            *password,
+		PasswordFile:        *passList,
+		PasswordChance:      *passProb,
+		Hostname:            *kicHost,
+		KIScriptFile:        *kiScript,
+		BannerFile:          *bannerFile,
+		MaxAuthTries:        *maxTries,
+		FailDelay:           *failDelay,
+		EnabledAuthMethods:  *authMethods,
+		HostKeyFile:         *keyName,
+		LogDir:              *logDir,
+		PathTemplate:        *pathTemplate,
+		HideBanners:         *hideBanners,
+		LogLevel:            *logLevel,
+		LogLevels:           *logLevels,
+		DebugLog:            debugLog,
+		SessionLogCap:       int64(sessCap),
+		ChannelLogCap:       int64(chanCap),
+		Transcripts:         *transcripts,
+		Quota:               int64(quota),
+		Retention:           time.Duration(*retention) * 24 * time.Hour,
+		Compress:            *compress,
+		DBFile:              *dbFile,
+		GeoIPFiles:          *geoFiles,
+		Artifacts:           *artifacts,
+		ArtifactQuota:       int64(artQuota),
+		YARARulesDir:        *yaraDir,
+		Downloads:           *downloads,
+		DownloadProxy:       *dlProxy,
+		DownloadOffline:     *dlOffline,
+		AlertFile:           *alertFile,
+		AdminSocket:         *adminSock,
+		UpstreamAddr:        *saddr,
+		UpstreamUser:        *cUser,
+		UpstreamKeyFile:     *cKey,
+		UpstreamFingerprint: *fingerprint,
+		FakeFSFile:          *fakeFS,
+		FallbackPrompt:      *fbPrompt,
+		FallbackAlways:      *fbAlways,
+		FallbackVersions:    *fbVersions,
+		FallbackUsers:       *fbUsers,
+		RulesFile:           *rulesFile,
+		ChannelUpRate:       int64(chanUp),
+		ChannelDownRate:     int64(chanDown),
+		SessionUpRate:       int64(sessUp),
+		SessionDownRate:     int64(sessDown),
+		IdleTimeout:         *idleTimeout,
+		MaxDuration:         *maxDuration,
+		MaxChannels:         *maxChans,
+	})
+	if nil != err {
+		log.Fatalf("Unable to start: %v", err)
+	}
+
+	/* Listen for clients */
+	l, err := net.Listen("tcp", addSSHPort(*laddr))
+	if nil != err {
+		log.Fatalf("Unable to listen on %v: %v", *laddr, err)
+	}
+	log.Printf("Listening on %v", l.Addr())
+
+	/* Accept clients, handle */
+	log.Fatalf("Unable to accept client: %v", s.Serve(l))
+}
+
+/* openLogFile opens the named file for appending, or returns std if name is
+-. */
+func openLogFile(name string, std *os.File) (*os.File, error) {
+	if "-" == name {
+		return std, nil
+	}
+	return os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
+
+/* addSSHPort adds the default SSH port to an address if it has no port. */
+func addSSHPort(addr string) string {
+	/* Make sure we have a port */
+	_, _, err := net.SplitHostPort(addr)
+	if nil != err {
+		if !strings.HasPrefix(err.Error(), "missing port in address") {
+			log.Fatalf(
+				"Unable to check for port in %q: %v",
+				addr,
+				err,
+			)
+		}
+		addr = net.JoinHostPort(addr, "ssh")
+	}
+	return addr
+}
+
+/* TODO: Log to stdout or logfile */
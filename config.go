@@ -1,11 +1,11 @@
-package main
+package sshhipot
 
 /*
  * config.go
  * Make a server config
  * By J. Stuart McMurray
  * Created 20160514
- * Last Modified 20160702
+ * Last Modified 20261018
  */
 
 import (
@@ -13,8 +13,9 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"math/rand"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -25,74 +26,159 @@ const (
 	IGNORENMS = true
 )
 
+/* AUTHMETHODORDER is the order in which the SSH library offers
+authentication methods.  It can't be changed; the library builds the list
+itself and gives no way to reorder it or to send our own failure or disconnect
+messages. */
+var AUTHMETHODORDER = []string{"password", "publickey", "keyboard-interactive"}
+
 /* IgnoreRequests are request types to ignore */
 var IGNOREREQUESTS = []string{
 	/* Don't bother sending our host keys, mostly to keep the logs from
 	being cluttered.  Remove this if you really expect someone's looking
 	hard for honeypots. */
 	"hostkeys-00@openssh.com",
-
-	/* A dirty hack to avoid a race condition in which the no-more-sessions
-	message gets there before the session request.  :( */
-	"no-more-sessions@openssh.com",
 }
 
-func makeServerConfig(
-	noAuthNeeded bool,
-	serverVersion string,
-	password, passList string,
-	passProb float64,
-	hostname string,
-	keyname string,
-) *ssh.ServerConfig {
+/* makeServerConfig makes the SSH server config from s's Config */
+func (s *Server) makeServerConfig() (*ssh.ServerConfig, error) {
+	conf := s.conf
 	/* Get allowed passwords */
-	passwords, err := getPasswords(password, passList)
+	passwords, err := getPasswords(conf.Password, conf.PasswordFile)
 	if nil != err {
-		log.Fatalf("Unable to get allowed passwords: %v", err)
+		return nil, fmt.Errorf("getting allowed passwords: %v", err)
 	}
 	/* Make sure we have a password */
 	if 0 == len(passwords) {
-		if !noAuthNeeded {
-			log.Fatalf("no passwords from command line or " +
-				"password file and authless connections " +
-				"not allowed",
+		if !conf.NoClientAuth {
+			return nil, fmt.Errorf("no passwords from command " +
+				"line or password file and authless " +
+				"connections not allowed",
 			)
 		}
 	} else {
-		log.Printf("Will accept %v passwords", len(passwords))
+		s.logf(
+			LEVELINFO,
+			SUBSYSAUTH,
+			"Will accept %v passwords",
+			len(passwords),
+		)
+	}
+	/* Get the keyboard-interactive challenges */
+	script, err := loadKIScript(conf.KIScriptFile)
+	if nil != err {
+		return nil, fmt.Errorf(
+			"loading keyboard-interactive script %v: %v",
+			conf.KIScriptFile,
+			err,
+		)
+	}
+	/* Get the banner to send before authentication */
+	var banner []byte
+	if "" != conf.BannerFile {
+		if banner, err = ioutil.ReadFile(conf.BannerFile); nil != err {
+			return nil, fmt.Errorf("reading banner: %v", err)
+		}
 	}
 	/* Get server key */
-	key, gen, err := getKey(keyname)
+	key, gen, err := getKey(conf.HostKeyFile)
 	if nil != err {
-		log.Fatalf("Error generating/loading key: %v", err)
+		return nil, fmt.Errorf("generating/loading key: %v", err)
 	}
 	if gen {
-		log.Printf("Generated key and stored in %v", keyname)
+		s.logf(
+			LEVELINFO,
+			SUBSYSGENERAL,
+			"Generated key and stored in %v",
+			conf.HostKeyFile,
+		)
 	} else {
-		log.Printf("Loaded key from %v", keyname)
+		s.logf(
+			LEVELINFO,
+			SUBSYSGENERAL,
+			"Loaded key from %v",
+			conf.HostKeyFile,
+		)
 	}
 	/* Config to return */
 	c := &ssh.ServerConfig{
-		NoClientAuth:     noAuthNeeded,
-		ServerVersion:    serverVersion,
-		PasswordCallback: passwordCallback(passwords, passProb),
-		KeyboardInteractiveCallback: keyboardInteractiveCallback(
+		NoClientAuth:  conf.NoClientAuth,
+		ServerVersion: conf.ServerVersion,
+		MaxAuthTries:  conf.MaxAuthTries,
+		PasswordCallback: s.passwordCallback(
+			passwords,
+			conf.PasswordChance,
+			conf.FailDelay,
+		),
+		KeyboardInteractiveCallback: s.keyboardInteractiveCallback(
 			passwords,
-			hostname,
-			passProb,
+			script,
+			conf.Hostname,
+			conf.PasswordChance,
+			conf.FailDelay,
 		),
-		PublicKeyCallback: publicKeyCallback(),
+		PublicKeyCallback: s.publicKeyCallback(),
+	}
+	if 0 != len(banner) {
+		c.BannerCallback = func(ssh.ConnMetadata) string {
+			return string(banner)
+		}
 	}
 	c.AddHostKey(key)
 
-	return c
+	/* Only offer the methods we're told to */
+	offer := make(map[string]bool)
+	var asked []string
+	for _, m := range splitList(conf.EnabledAuthMethods) {
+		switch m {
+		case "password", "publickey", "keyboard-interactive":
+			if !offer[m] {
+				asked = append(asked, m)
+			}
+			offer[m] = true
+		default:
+			return nil, fmt.Errorf(
+				"unknown authentication method %q",
+				m,
+			)
+		}
+	}
+	/* Which the library does in its own order */
+	var offered []string
+	for _, m := range AUTHMETHODORDER {
+		if offer[m] {
+			offered = append(offered, m)
+		}
+	}
+	if strings.Join(asked, ",") != strings.Join(offered, ",") {
+		s.logf(
+			LEVELWARN,
+			SUBSYSAUTH,
+			"Authentication methods will be offered in the "+
+				"order %v, not %v",
+			strings.Join(offered, ","),
+			strings.Join(asked, ","),
+		)
+	}
+	if !offer["password"] {
+		c.PasswordCallback = nil
+	}
+	if !offer["publickey"] {
+		c.PublicKeyCallback = nil
+	}
+	if !offer["keyboard-interactive"] {
+		c.KeyboardInteractiveCallback = nil
+	}
+
+	return c, nil
 }
 
 /* passwordCallback makes a callback function which accepts the allowed
 passwords */
-func passwordCallback(
+func (s *Server) passwordCallback(
 	passwords map[string]struct{},
 	passProb float64,
+	failDelay time.Duration,
 ) func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
 	/* Return a function to check for the password */
 	return func(
@@ -104,10 +190,11 @@ func passwordCallback(
 		if !ok && diceRoll(passProb) {
 			ok = true
 		}
-		logAttempt(conn, "Password", p, ok)
+		s.logAttempt(conn, "Password", p, ok)
 		if ok {
 			return nil, nil
 		}
+		pamDelay(failDelay)
 		return nil, fmt.Errorf("Permission denied, please try again.")
 	}
 }
@@ -146,11 +233,14 @@ func getPasswords(password, passList string) (map[string]struct{}, error) {
 }
 
 /* keyboardInteractiveCallback returns a keyboard-interactive callback which
-accepts any of the allowed passwords. */
-func keyboardInteractiveCallback(
+asks the challenges in script.  Answers to prompts which need a password must
+be one of the allowed passwords. */
+func (s *Server) keyboardInteractiveCallback(
 	passwords map[string]struct{},
+	script []kiRound,
 	hostname string,
 	passProb float64,
+	failDelay time.Duration,
 ) func(
 	ssh.ConnMetadata,
 	ssh.KeyboardInteractiveChallenge,
@@ -159,42 +249,60 @@ func keyboardInteractiveCallback(
 		conn ssh.ConnMetadata,
 		client ssh.KeyboardInteractiveChallenge,
 	) (*ssh.Permissions, error) {
-		/* Ask for a password */
-		as, err := client(
-			"",
-			"",
-			[]string{fmt.Sprintf(
-				"%v@%v's password:",
-				conn.User(),
-				hostname,
-			)},
-			[]bool{false},
-		)
-		if nil != err {
-			return nil, err
+		x := func(s string) string {
+			return kiExpand(s, conn.User(), hostname)
 		}
-		/* Check it */
-		if 1 != len(as) {
-			logAttempt(conn, "Keyboard", "", false)
-		} else {
-			p := string(as[0])
-			_, ok := passwords[p]
-			if !ok && diceRoll(passProb) {
-				ok = true
+		for _, r := range script {
+			/* Ask the questions */
+			qs := make([]string, len(r.prompts))
+			es := make([]bool, len(r.prompts))
+			for i, p := range r.prompts {
+				qs[i] = x(p.text)
+				es[i] = p.echo
+			}
+			as, err := client(x(r.name), x(r.instruction), qs, es)
+			if nil != err {
+				return nil, err
 			}
-			logAttempt(conn, "Keyboard", p, ok)
-			if ok {
-				return nil, nil
+			if len(qs) != len(as) {
+				s.logAttempt(conn, "Keyboard", "", false)
+				pamDelay(failDelay)
+				return nil, fmt.Errorf(
+					"Permission denied, please try again.",
+				)
+			}
+			/* Check the answers */
+			ok := true
+			for i, a := range as {
+				aok := true
+				if r.prompts[i].check {
+					_, aok = passwords[a]
+					if !aok && diceRoll(passProb) {
+						aok = true
+					}
+				}
+				s.logPromptAttempt(
+					conn,
+					"Keyboard",
+					qs[i],
+					a,
+					aok,
+				)
+				ok = ok && aok
+			}
+			if !ok {
+				pamDelay(failDelay)
+				return nil, fmt.Errorf(
+					"Permission denied, please try again.",
+				)
 			}
 		}
-		return nil, fmt.Errorf(
-			"Permission denied, please try again.",
-		)
+		return nil, nil
 	}
 }
 
 /* publicKeyCallback logs that public key auth was attempted. */
-func publicKeyCallback() func(
+func (s *Server) publicKeyCallback() func(
 	ssh.ConnMetadata,
 	ssh.PublicKey,
 ) (*ssh.Permissions, error) {
@@ -202,7 +310,7 @@ func publicKeyCallback() func(
 		conn ssh.ConnMetadata,
 		key ssh.PublicKey,
 	) (*ssh.Permissions, error) {
-		logAttempt(conn, "Key", fmt.Sprintf(
+		s.logAttempt(conn, "Key", fmt.Sprintf(
 			"%02X",
 			sha256.Sum256(key.Marshal()),
 		), false)
@@ -210,20 +318,65 @@ func publicKeyCallback() func(
 	}
 }
 
-/* logAttempt logs an authorization attempt. */
-func logAttempt(conn ssh.ConnMetadata, method, cred string, suc bool) {
-	log.Printf(
-		"Address:%v Authorization Attempt Version:%q User:%q %v:%q "+
-			"Successful:%v",
+/* logAttempt logs an authorization attempt and saves it for the session
+summary. */
+func (s *Server) logAttempt(
+	conn ssh.ConnMetadata,
+	method string,
+	cred string,
+	suc bool,
+) {
+	s.logPromptAttempt(conn, method, "", cred, suc)
+}
+
+/* logPromptAttempt is like logAttempt, but also notes the prompt to which
+cred was the answer, if prompt isn't empty. */
+func (s *Server) logPromptAttempt(
+	conn ssh.ConnMetadata,
+	method string,
+	prompt string,
+	cred string,
+	suc bool,
+) {
+	a := AuthAttempt{
+		Time:       time.Now(),
+		Method:     method,
+		User:       conn.User(),
+		Prompt:     prompt,
+		Credential: cred,
+		Successful: suc,
+	}
+	pc := connOf(conn)
+	pc.addAttempt(a)
+	var id string
+	if nil != pc {
+		id = pc.id
+	}
+	s.db.AuthAttempt(id, string(conn.ClientVersion()), a)
+	s.obs.Auth(id, a)
+	s.logf(
+		LEVELINFO,
+		SUBSYSAUTH,
+		"ID:%v Address:%v Authorization Attempt Version:%q User:%q "+
+			"%v Successful:%v",
+		id,
 		conn.RemoteAddr(),
 		string(conn.ClientVersion()),
 		conn.User(),
-		method,
-		cred,
+		a.logCredential(),
 		suc,
 	)
 }
 
+/* pamDelay sleeps for somewhere between 75% and 125% of d, like PAM does
+after a failed login. */
+func pamDelay(d time.Duration) {
+	if 0 >= d {
+		return
+	}
+	time.Sleep(d*3/4 + time.Duration(rand.Int63n(int64(d/2)+1)))
+}
+
 /* diceRoll will return true with a probability of prob */
 func diceRoll(prob float64) bool {
 	return rand.Float64() < prob
@@ -0,0 +1,105 @@
+package sshhipot
+
+/*
+ * conn.go
+ * Keep track of connections before they're authenticated
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* pendingConn holds what we know about a connection before it
+authenticates. */
+type pendingConn struct {
+	id       string
+	l        sync.Mutex
+	attempts []AuthAttempt
+}
+
+/* newPendingConn gives a new connection an ID. */
+func newPendingConn() *pendingConn {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); nil != err {
+		panic(err)
+	}
+	return &pendingConn{id: hex.EncodeToString(b)}
+}
+
+/* addAttempt saves an authentication attempt.  It is a no-op if pc is
+nil. */
+func (pc *pendingConn) addAttempt(a AuthAttempt) {
+	if nil == pc {
+		return
+	}
+	pc.l.Lock()
+	defer pc.l.Unlock()
+	pc.attempts = append(pc.attempts, a)
+}
+
+/* takeAttempts returns and forgets the saved authentication attempts. */
+func (pc *pendingConn) takeAttempts() []AuthAttempt {
+	if nil == pc {
+		return nil
+	}
+	pc.l.Lock()
+	defer pc.l.Unlock()
+	as := pc.attempts
+	pc.attempts = nil
+	return as
+}
+
+/* pendingMeta is the ssh.ConnMetadata passed to the auth callbacks, with the
+connection it describes.  Addresses aren't unique enough to tell
+connections apart. */
+type pendingMeta struct {
+	ssh.ConnMetadata
+	pc *pendingConn
+}
+
+/* connOf returns the connection described by conn, or nil if there isn't
+one. */
+func connOf(conn ssh.ConnMetadata) *pendingConn {
+	if pm, ok := conn.(pendingMeta); ok {
+		return pm.pc
+	}
+	return nil
+}
+
+/* connConfig returns a copy of s's server config whose auth callbacks know
+they're authenticating pc. */
+func (s *Server) connConfig(pc *pendingConn) *ssh.ServerConfig {
+	c := *s.sconfig
+	if f := s.sconfig.PasswordCallback; nil != f {
+		c.PasswordCallback = func(
+			conn ssh.ConnMetadata,
+			password []byte,
+		) (*ssh.Permissions, error) {
+			return f(pendingMeta{conn, pc}, password)
+		}
+	}
+	if f := s.sconfig.KeyboardInteractiveCallback; nil != f {
+		c.KeyboardInteractiveCallback = func(
+			conn ssh.ConnMetadata,
+			client ssh.KeyboardInteractiveChallenge,
+		) (*ssh.Permissions, error) {
+			return f(pendingMeta{conn, pc}, client)
+		}
+	}
+	if f := s.sconfig.PublicKeyCallback; nil != f {
+		c.PublicKeyCallback = func(
+			conn ssh.ConnMetadata,
+			key ssh.PublicKey,
+		) (*ssh.Permissions, error) {
+			return f(pendingMeta{conn, pc}, key)
+		}
+	}
+	return &c
+}
@@ -0,0 +1,103 @@
+package sshhipot
+
+/*
+ * conn_test.go
+ * Tests for keeping track of connections
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* sameAddrConn is a net.Conn with the same remote address as every other
+sameAddrConn, like connections on some Unix sockets */
+type sameAddrConn struct{ net.Conn }
+
+func (c sameAddrConn) RemoteAddr() net.Addr {
+	return &net.UnixAddr{Name: "@", Net: "unix"}
+}
+
+func TestPendingConnAttempts(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewServer(Config{
+		Password:           TESTPASSWORD,
+		EnabledAuthMethods: "password",
+		HostKeyFile:        filepath.Join(dir, "id_hostkey"),
+		UpstreamKeyFile:    filepath.Join(dir, "id_upstream"),
+		LogDir:             filepath.Join(dir, "conns"),
+	})
+	if nil != err {
+		t.Fatalf("Unable to make honeypot: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer l.Close()
+
+	/* Connections with the same address mustn't be confused */
+	passwords := []string{"first", "second", TESTPASSWORD}
+	pcs := make([]*pendingConn, len(passwords))
+	var wg sync.WaitGroup
+	for i, p := range passwords {
+		pcs[i] = newPendingConn()
+		cp, err := net.Dial("tcp", l.Addr().String())
+		if nil != err {
+			t.Fatalf("Unable to connect: %v", err)
+		}
+		c, err := l.Accept()
+		if nil != err {
+			t.Fatalf("Unable to accept: %v", err)
+		}
+		sp := sameAddrConn{c}
+		wg.Add(2)
+		go func(pc *pendingConn) {
+			defer wg.Done()
+			defer sp.Close()
+			ssh.NewServerConn(sp, s.connConfig(pc))
+		}(pcs[i])
+		go func(p string) {
+			defer wg.Done()
+			defer cp.Close()
+			auth := []ssh.AuthMethod{ssh.Password(p)}
+			ssh.NewClientConn(cp, "", &ssh.ClientConfig{
+				User:            TESTUSER,
+				Auth:            auth,
+				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			})
+		}(p)
+	}
+	wg.Wait()
+
+	for i, pc := range pcs {
+		as := pc.takeAttempts()
+		if 1 != len(as) {
+			t.Errorf("Connection %v has %v attempts", i, len(as))
+			continue
+		}
+		if passwords[i] != as[0].Credential {
+			t.Errorf(
+				"Connection %v has password %q, want %q",
+				i,
+				as[0].Credential,
+				passwords[i],
+			)
+		}
+		if want := TESTPASSWORD == passwords[i]; want !=
+			as[0].Successful {
+			t.Errorf("Connection %v success wrong", i)
+		}
+		if nil != pc.takeAttempts() {
+			t.Errorf("Connection %v attempts not forgotten", i)
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package sshhipot
+
+/*
+ * db.go
+ * Store what happened in an SQLite database
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	/* DBQUEUELEN is the number of writes which may wait for the database
+	before more are dropped */
+	DBQUEUELEN = 4096
+	/* DBBATCH is the most writes done in a single transaction */
+	DBBATCH = 256
+	/* DBTIMEFORMAT is the format for times in the database, which
+	SQLite's date and time functions understand */
+	DBTIMEFORMAT = "2006-01-02 15:04:05.000000"
+)
+
+/* migrations are the changes to make to the database schema, in order.  Each
+migration is run once, and the number of migrations run is kept in the
+database's user_version.  New migrations go on the end; old ones are never
+changed. */
+var migrations = []string{
+	/* 1: Initial schema */
+	`CREATE TABLE connections (
+		id      TEXT PRIMARY KEY,
+		time    TEXT NOT NULL,
+		address TEXT NOT NULL,
+		host    TEXT NOT NULL,
+		result  TEXT
+	);
+	CREATE TABLE auth_attempts (
+		id             INTEGER PRIMARY KEY,
+		connection     TEXT NOT NULL,
+		time           TEXT NOT NULL,
+		client_version TEXT NOT NULL,
+		method         TEXT NOT NULL,
+		user           TEXT NOT NULL,
+		prompt         TEXT NOT NULL,
+		credential     TEXT NOT NULL,
+		successful     INTEGER NOT NULL
+	);
+	CREATE INDEX auth_attempts_time ON auth_attempts (time);
+	CREATE TABLE sessions (
+		id             TEXT PRIMARY KEY,
+		start          TEXT NOT NULL,
+		end            TEXT,
+		duration       REAL,
+		address        TEXT NOT NULL,
+		client_version TEXT NOT NULL,
+		hassh          TEXT NOT NULL,
+		user           TEXT NOT NULL,
+		upstream       TEXT,
+		limit_reached  TEXT
+	);
+	CREATE TABLE channels (
+		session     TEXT NOT NULL,
+		channel     INTEGER NOT NULL,
+		type        TEXT NOT NULL,
+		data        BLOB NOT NULL,
+		direction   TEXT NOT NULL,
+		start       TEXT NOT NULL,
+		end         TEXT,
+		duration    REAL,
+		log         TEXT,
+		rejected    TEXT,
+		exit_status INTEGER,
+		exit_signal TEXT,
+		PRIMARY KEY (session, channel)
+	);
+	CREATE TABLE requests (
+		id         INTEGER PRIMARY KEY,
+		session    TEXT NOT NULL,
+		channel    INTEGER,
+		time       TEXT NOT NULL,
+		type       TEXT NOT NULL,
+		direction  TEXT NOT NULL,
+		want_reply INTEGER NOT NULL,
+		payload    BLOB NOT NULL,
+		ok         INTEGER NOT NULL
+	);
+	CREATE TABLE commands (
+		id      INTEGER PRIMARY KEY,
+		session TEXT NOT NULL,
+		channel INTEGER NOT NULL,
+		time    TEXT NOT NULL,
+		command TEXT NOT NULL
+	);
+	CREATE TABLE files (
+		id        INTEGER PRIMARY KEY,
+		session   TEXT NOT NULL,
+		channel   INTEGER NOT NULL,
+		time      TEXT NOT NULL,
+		direction TEXT NOT NULL,
+		name      TEXT NOT NULL,
+		mode      TEXT NOT NULL,
+		size      INTEGER NOT NULL
+	);`,
+	/* 2: File hashes */
+	`ALTER TABLE files ADD COLUMN sha256 TEXT;`,
+	/* 3: Where connections come from */
+	`ALTER TABLE connections ADD COLUMN country TEXT;
+	ALTER TABLE connections ADD COLUMN country_code TEXT;
+	ALTER TABLE connections ADD COLUMN city TEXT;
+	ALTER TABLE connections ADD COLUMN asn INTEGER;
+	ALTER TABLE connections ADD COLUMN org TEXT;`,
+}
+
+/* database is an SQLite database to which writes are made in the background
+by a single goroutine.  A nil *database discards writes. */
+type database struct {
+	db     *sql.DB
+	c      chan dbWrite
+	levels logLevels /* Log verbosity */
+}
+
+/* dbWrite is a single statement to execute */
+type dbWrite struct {
+	query string
+	args  []interface{}
+}
+
+/* openDB opens the SQLite database in the file named fn, creating it if
+necessary, brings its schema up to date, and starts writing to it in the
+background.  Problems are logged at the verbosity set by levels.  If fn is the
+empty string, nil is returned. */
+func openDB(fn string, levels logLevels) (*database, error) {
+	if "" == fn {
+		return nil, nil
+	}
+	sdb, err := sql.Open(
+		"sqlite3",
+		fn+"?_journal_mode=WAL&_busy_timeout=5000",
+	)
+	if nil != err {
+		return nil, err
+	}
+	if err := migrate(sdb, levels); nil != err {
+		sdb.Close()
+		return nil, err
+	}
+	d := &database{
+		db:     sdb,
+		c:      make(chan dbWrite, DBQUEUELEN),
+		levels: levels,
+	}
+	go d.write()
+	return d, nil
+}
+
+/* migrate runs the migrations which haven't yet been run on sdb, logging at
+the verbosity set by ls. */
+func migrate(sdb *sql.DB, ls logLevels) error {
+	var v int
+	if err := sdb.QueryRow("PRAGMA user_version").Scan(&v); nil != err {
+		return err
+	}
+	if len(migrations) < v {
+		return fmt.Errorf(
+			"database schema version %v is newer than ours (%v)",
+			v,
+			len(migrations),
+		)
+	}
+	for ; v < len(migrations); v++ {
+		tx, err := sdb.Begin()
+		if nil != err {
+			return err
+		}
+		if _, err := tx.Exec(migrations[v]); nil != err {
+			tx.Rollback()
+			return fmt.Errorf("migration %v: %v", v+1, err)
+		}
+		/* PRAGMA doesn't take parameters */
+		if _, err := tx.Exec(
+			fmt.Sprintf("PRAGMA user_version = %d", v+1),
+		); nil != err {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); nil != err {
+			return err
+		}
+		logf(
+			ls,
+			LEVELINFO,
+			SUBSYSGENERAL,
+			"Database schema migrated to version %v",
+			v+1,
+		)
+	}
+	return nil
+}
+
+/* exec queues query to be executed with args.  If the queue's full, the
+write is dropped. */
+func (d *database) exec(query string, args ...interface{}) {
+	if nil == d {
+		return
+	}
+	select {
+	case d.c <- dbWrite{query: query, args: args}:
+	default:
+		logf(
+			d.levels,
+			LEVELWARN,
+			SUBSYSGENERAL,
+			"Database queue full, dropped write %q",
+			query,
+		)
+	}
+}
+
+/* write executes queued writes in batches.  It does not return. */
+func (d *database) write() {
+	for w := range d.c {
+		/* Grab whatever else is waiting */
+		ws := []dbWrite{w}
+	Batch:
+		for DBBATCH > len(ws) {
+			select {
+			case w := <-d.c:
+				ws = append(ws, w)
+			default:
+				break Batch
+			}
+		}
+		tx, err := d.db.Begin()
+		if nil != err {
+			logf(
+				d.levels,
+				LEVELERROR,
+				SUBSYSGENERAL,
+				"Unable to start database transaction: %v",
+				err,
+			)
+			continue
+		}
+		for _, w := range ws {
+			if _, err := tx.Exec(w.query, w.args...); nil != err {
+				logf(
+					d.levels,
+					LEVELERROR,
+					SUBSYSGENERAL,
+					"Database Error:%q Query:%q",
+					err,
+					w.query,
+				)
+			}
+		}
+		if err := tx.Commit(); nil != err {
+			logf(
+				d.levels,
+				LEVELERROR,
+				SUBSYSGENERAL,
+				"Unable to commit to database: %v",
+				err,
+			)
+		}
+	}
+}
+
+/* dbTime formats t for the database.  The zero time is NULL. */
+func dbTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(DBTIMEFORMAT)
+}
+
+/* dbString returns s for the database.  The empty string is NULL. */
+func dbString(s string) interface{} {
+	if "" == s {
+		return nil
+	}
+	return s
+}
+
+/* Connection notes a new connection with the given ID from addr, which came
+from the host host, which is located at gi, which may be nil. */
+func (d *database) Connection(id, addr, host string, gi *GeoInfo) {
+	if nil == gi {
+		gi = &GeoInfo{}
+	}
+	var asn interface{}
+	if 0 != gi.ASN {
+		asn = gi.ASN
+	}
+	d.exec(
+		`INSERT INTO connections (
+			id,
+			time,
+			address,
+			host,
+			country,
+			country_code,
+			city,
+			asn,
+			org
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id,
+		dbTime(time.Now()),
+		addr,
+		host,
+		dbString(gi.Country),
+		dbString(gi.CountryCode),
+		dbString(gi.City),
+		asn,
+		dbString(gi.Org),
+	)
+}
+
+/* ConnectionResult notes how the connection with the given ID ended up */
+func (d *database) ConnectionResult(id, result string) {
+	d.exec(`UPDATE connections SET result = ? WHERE id = ?`, result, id)
+}
+
+/* AuthAttempt notes an authentication attempt on the connection with the
+given ID by a client with the given version. */
+func (d *database) AuthAttempt(id, version string, a AuthAttempt) {
+	d.exec(
+		`INSERT INTO auth_attempts (
+			connection,
+			time,
+			client_version,
+			method,
+			user,
+			prompt,
+			credential,
+			successful
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		id,
+		dbTime(a.Time),
+		version,
+		a.Method,
+		a.User,
+		a.Prompt,
+		a.Credential,
+		a.Successful,
+	)
+}
+
+/* SessionStart notes the start of the session s.  The caller must hold
+s.l. */
+func (d *database) SessionStart(s *Session) {
+	d.exec(
+		`INSERT INTO sessions (
+			id,
+			start,
+			address,
+			client_version,
+			hassh,
+			user
+		) VALUES (?, ?, ?, ?, ?, ?)`,
+		s.ID,
+		dbTime(s.Start),
+		s.Address,
+		s.ClientVersion,
+		s.HASSH,
+		s.User,
+	)
+}
+
+/* SessionEnd notes the end of the session s.  The caller must hold s.l. */
+func (d *database) SessionEnd(s *Session) {
+	d.exec(
+		`UPDATE sessions SET
+			end = ?,
+			duration = ?,
+			upstream = ?,
+			limit_reached = ?
+		WHERE id = ?`,
+		dbTime(s.End),
+		s.Duration,
+		dbString(s.Upstream),
+		dbString(s.Limit),
+		s.ID,
+	)
+}
+
+/* ChannelStart notes the start of channel c in the session with the given
+ID.  The caller must hold the session's lock. */
+func (d *database) ChannelStart(sid string, c *ChannelSummary) {
+	d.exec(
+		`INSERT INTO channels (
+			session,
+			channel,
+			type,
+			data,
+			direction,
+			start
+		) VALUES (?, ?, ?, ?, ?, ?)`,
+		sid,
+		c.ID,
+		c.Type,
+		[]byte(c.Data),
+		c.Direction,
+		dbTime(c.Start),
+	)
+}
+
+/* ChannelEnd notes the end of channel c in the session with the given ID.
+The caller must hold the session's lock. */
+func (d *database) ChannelEnd(sid string, c *ChannelSummary) {
+	var es interface{}
+	if nil != c.ExitStatus {
+		es = *c.ExitStatus
+	}
+	d.exec(
+		`UPDATE channels SET
+			end = ?,
+			duration = ?,
+			log = ?,
+			rejected = ?,
+			exit_status = ?,
+			exit_signal = ?
+		WHERE session = ? AND channel = ?`,
+		dbTime(c.End),
+		c.Duration,
+		dbString(c.Log),
+		dbString(c.Rejected),
+		es,
+		dbString(c.ExitSignal),
+		sid,
+		c.ID,
+	)
+}
+
+/* Request notes a request in the session with the given ID, on channel c or
+for the whole connection if c is nil. */
+func (d *database) Request(sid string, c *ChannelSummary, r RequestSummary) {
+	var ch interface{}
+	if nil != c {
+		ch = c.ID
+	}
+	d.exec(
+		`INSERT INTO requests (
+			session,
+			channel,
+			time,
+			type,
+			direction,
+			want_reply,
+			payload,
+			ok
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		sid,
+		ch,
+		dbTime(r.Time),
+		r.Type,
+		r.Direction,
+		r.WantReply,
+		[]byte(r.Payload),
+		r.OK,
+	)
+}
+
+/* Command notes a command run in the session with the given ID */
+func (d *database) Command(sid string, c CommandSummary) {
+	d.exec(
+		`INSERT INTO commands (session, channel, time, command)
+		VALUES (?, ?, ?, ?)`,
+		sid,
+		c.Channel,
+		dbTime(c.Time),
+		c.Command,
+	)
+}
+
+/* File notes a file sent in the session with the given ID */
+func (d *database) File(sid string, f FileSummary) {
+	d.exec(
+		`INSERT INTO files (
+			session,
+			channel,
+			time,
+			direction,
+			name,
+			mode,
+			size,
+			sha256
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		sid,
+		f.Channel,
+		dbTime(f.Time),
+		f.Direction,
+		f.Name,
+		f.Mode,
+		f.Size,
+		dbString(f.SHA256),
+	)
+}
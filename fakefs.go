@@ -0,0 +1,372 @@
+package sshhipot
+
+/*
+ * fakefs.go
+ * In-memory filesystem for the fallback shell
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* MAXFAKEFILE is the most we'll keep of any one file from the tarball */
+const MAXFAKEFILE = 1024 * 1024
+
+/* fakeFile is a file, directory, or symlink in a fakeFS */
+type fakeFile struct {
+	name  string
+	mode  os.FileMode
+	size  int64
+	mtime time.Time
+	owner string
+	group string
+	link  string /* Symlink target */
+	data  []byte
+	kids  map[string]*fakeFile
+}
+
+/* fakeFS is a filesystem which exists only in memory.  Changes made to a
+fakeFS are lost when the program exits. */
+type fakeFS struct {
+	l    sync.Mutex
+	root *fakeFile
+}
+
+/* newFakeDir makes a new directory named n */
+func newFakeDir(n string, mode os.FileMode) *fakeFile {
+	return &fakeFile{
+		name:  n,
+		mode:  os.ModeDir | mode,
+		size:  4096,
+		mtime: time.Now(),
+		owner: "root",
+		group: "root",
+		kids:  make(map[string]*fakeFile),
+	}
+}
+
+/* loadFakeFS makes a fakeFS from the tarball (which may be gzipped) named
+tn. */
+func loadFakeFS(tn string) (*fakeFS, error) {
+	f, err := os.Open(tn)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+
+	/* Work out if it's compressed */
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if m, err := br.Peek(2); nil == err && 0x1f == m[0] && 0x8b == m[1] {
+		zr, err := gzip.NewReader(br)
+		if nil != err {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	/* Add every file */
+	fs := &fakeFS{root: newFakeDir("/", 0755)}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if io.EOF == err {
+			break
+		}
+		if nil != err {
+			return nil, err
+		}
+		ff := &fakeFile{
+			mode:  h.FileInfo().Mode(),
+			size:  h.Size,
+			mtime: h.ModTime,
+			owner: h.Uname,
+			group: h.Gname,
+		}
+		if "" == ff.owner {
+			ff.owner = fmt.Sprintf("%v", h.Uid)
+		}
+		if "" == ff.group {
+			ff.group = fmt.Sprintf("%v", h.Gid)
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			ff.kids = make(map[string]*fakeFile)
+			ff.size = 4096
+		case tar.TypeSymlink:
+			ff.link = h.Linkname
+			ff.size = int64(len(h.Linkname))
+		case tar.TypeReg, tar.TypeRegA:
+			if ff.data, err = ioutil.ReadAll(
+				io.LimitReader(tr, MAXFAKEFILE),
+			); nil != err {
+				return nil, err
+			}
+		default:
+			continue
+		}
+		fs.add(path.Join("/", h.Name), ff)
+	}
+	return fs, nil
+}
+
+/* defaultFakeFS returns a fakeFS which looks a bit like a small Linux box
+named hostname. */
+func defaultFakeFS(hostname string) *fakeFS {
+	fs := &fakeFS{root: newFakeDir("/", 0755)}
+	for _, d := range []string{
+		"/bin", "/boot", "/dev", "/etc", "/home", "/lib", "/mnt",
+		"/opt", "/proc", "/root", "/run", "/sbin", "/srv", "/sys",
+		"/usr", "/usr/bin", "/usr/lib", "/usr/local", "/usr/sbin",
+		"/var", "/var/log", "/var/tmp",
+	} {
+		fs.add(d, newFakeDir(path.Base(d), 0755))
+	}
+	fs.add("/root", newFakeDir("root", 0700))
+	fs.add("/tmp", newFakeDir("tmp", 0777|os.ModeSticky))
+	for n, c := range map[string]string{
+		"/etc/hostname": hostname + "\n",
+		"/etc/passwd": "root:x:0:0:root:/root:/bin/bash\n" +
+			"daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin\n" +
+			"bin:x:2:2:bin:/bin:/usr/sbin/nologin\n" +
+			"sys:x:3:3:sys:/dev:/usr/sbin/nologin\n" +
+			"www-data:x:33:33:www-data:/var/www:" +
+			"/usr/sbin/nologin\n" +
+			"sshd:x:110:65534::/run/sshd:/usr/sbin/nologin\n",
+		"/etc/issue": "Ubuntu 18.04.5 LTS \\n \\l\n\n",
+		"/etc/motd": "Welcome to Ubuntu 18.04.5 LTS (GNU/Linux " +
+			FAKEKERNEL + " " + FAKEARCH + ")\n\n" +
+			" * Documentation:  https://help.ubuntu.com\n" +
+			" * Management:     https://landscape.canonical.com\n" +
+			" * Support:        https://ubuntu.com/advantage\n\n",
+		"/etc/os-release": "NAME=\"Ubuntu\"\n" +
+			"VERSION=\"18.04.5 LTS (Bionic Beaver)\"\n" +
+			"ID=ubuntu\nID_LIKE=debian\n" +
+			"PRETTY_NAME=\"Ubuntu 18.04.5 LTS\"\n" +
+			"VERSION_ID=\"18.04\"\n",
+		"/proc/cpuinfo": "processor\t: 0\nvendor_id\t: GenuineIntel\n" +
+			"model name\t: Intel(R) Xeon(R) CPU E5-2650 v4 @ " +
+			"2.20GHz\ncpu MHz\t\t: 2199.998\ncache size\t: " +
+			"30720 KB\n\n",
+		"/proc/version": "Linux version " + FAKEKERNEL +
+			" (buildd@lgw01-amd64-038) (gcc version 7.5.0 " +
+			"(Ubuntu 7.5.0-3ubuntu1~18.04)) " + FAKEKERNELVERSION +
+			"\n",
+	} {
+		fs.add(n, &fakeFile{
+			name:  path.Base(n),
+			mode:  0644,
+			size:  int64(len(c)),
+			mtime: time.Now(),
+			owner: "root",
+			group: "root",
+			data:  []byte(c),
+		})
+	}
+	return fs
+}
+
+/* add adds f to the fakeFS at the absolute path p, making any missing parent
+directories. */
+func (fs *fakeFS) add(p string, f *fakeFile) {
+	fs.l.Lock()
+	defer fs.l.Unlock()
+	p = path.Clean(p)
+	if "/" == p {
+		if nil != f.kids {
+			f.kids = fs.root.kids
+			f.name = "/"
+			fs.root = f
+		}
+		return
+	}
+	d := fs.root
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for _, part := range parts[:len(parts)-1] {
+		k, ok := d.kids[part]
+		if !ok || nil == k.kids {
+			k = newFakeDir(part, 0755)
+			d.kids[part] = k
+		}
+		d = k
+	}
+	f.name = parts[len(parts)-1]
+	/* Don't lose the contents of directories we've already made */
+	if o, ok := d.kids[f.name]; ok && nil != o.kids && nil != f.kids {
+		f.kids = o.kids
+	}
+	d.kids[f.name] = f
+}
+
+/* Clone returns a copy of the fakeFS which may be changed without affecting
+the original. */
+func (fs *fakeFS) Clone() *fakeFS {
+	fs.l.Lock()
+	defer fs.l.Unlock()
+	return &fakeFS{root: fs.root.clone()}
+}
+
+/* clone recursively copies f.  File contents are shared, as they're never
+modified in place. */
+func (f *fakeFile) clone() *fakeFile {
+	c := *f
+	if nil != f.kids {
+		c.kids = make(map[string]*fakeFile, len(f.kids))
+		for n, k := range f.kids {
+			c.kids[n] = k.clone()
+		}
+	}
+	return &c
+}
+
+/* Lookup finds the file at p, relative to cwd if p isn't absolute.  Symlinks
+are followed.  The file and its cleaned absolute path are returned. */
+func (fs *fakeFS) Lookup(cwd, p string) (*fakeFile, string, error) {
+	fs.l.Lock()
+	defer fs.l.Unlock()
+	return fs.lookup(cwd, p, 0)
+}
+
+/* lookup does the work for Lookup.  depth is the number of symlinks
+followed so far. */
+func (fs *fakeFS) lookup(
+	cwd string,
+	p string,
+	depth int,
+) (*fakeFile, string, error) {
+	if 40 < depth {
+		return nil, "", fmt.Errorf("Too many levels of symbolic links")
+	}
+	if !path.IsAbs(p) {
+		p = path.Join(cwd, p)
+	}
+	p = path.Clean(p)
+	f := fs.root
+	cur := "/"
+	if "/" == p {
+		return f, p, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for i, part := range parts {
+		if nil == f.kids {
+			return nil, "", fmt.Errorf("Not a directory")
+		}
+		k, ok := f.kids[part]
+		if !ok {
+			return nil, "", fmt.Errorf("No such file or directory")
+		}
+		/* Follow symlinks */
+		if "" != k.link {
+			rest := path.Join(parts[i+1:]...)
+			return fs.lookup(cur, path.Join(k.link, rest), depth+1)
+		}
+		f = k
+		cur = path.Join(cur, part)
+	}
+	return f, cur, nil
+}
+
+/* WriteFile writes data to the file at p, relative to cwd.  If app is true,
+data is appended to the file. */
+func (fs *fakeFS) WriteFile(cwd, p string, data []byte, app bool) error {
+	if !path.IsAbs(p) {
+		p = path.Join(cwd, p)
+	}
+	p = path.Clean(p)
+	d, _, err := fs.Lookup("/", path.Dir(p))
+	if nil != err {
+		return err
+	}
+	fs.l.Lock()
+	defer fs.l.Unlock()
+	if nil == d.kids {
+		return fmt.Errorf("Not a directory")
+	}
+	n := path.Base(p)
+	f, ok := d.kids[n]
+	if ok && nil != f.kids {
+		return fmt.Errorf("Is a directory")
+	}
+	if !ok {
+		f = &fakeFile{name: n, mode: 0644, owner: "root", group: "root"}
+		d.kids[n] = f
+	}
+	if app {
+		f.data = append(append([]byte{}, f.data...), data...)
+	} else {
+		f.data = append([]byte{}, data...)
+	}
+	f.size = int64(len(f.data))
+	f.mtime = time.Now()
+	return nil
+}
+
+/* Mkdir makes a directory at p, relative to cwd. */
+func (fs *fakeFS) Mkdir(cwd, p string) error {
+	if !path.IsAbs(p) {
+		p = path.Join(cwd, p)
+	}
+	p = path.Clean(p)
+	if _, _, err := fs.Lookup("/", p); nil == err {
+		return fmt.Errorf("File exists")
+	}
+	d, _, err := fs.Lookup("/", path.Dir(p))
+	if nil != err {
+		return err
+	}
+	fs.l.Lock()
+	defer fs.l.Unlock()
+	if nil == d.kids {
+		return fmt.Errorf("Not a directory")
+	}
+	d.kids[path.Base(p)] = newFakeDir(path.Base(p), 0755)
+	return nil
+}
+
+/* Remove removes the file at p, relative to cwd. */
+func (fs *fakeFS) Remove(cwd, p string) error {
+	if !path.IsAbs(p) {
+		p = path.Join(cwd, p)
+	}
+	p = path.Clean(p)
+	d, _, err := fs.Lookup("/", path.Dir(p))
+	if nil != err {
+		return err
+	}
+	fs.l.Lock()
+	defer fs.l.Unlock()
+	if _, ok := d.kids[path.Base(p)]; !ok {
+		return fmt.Errorf("No such file or directory")
+	}
+	delete(d.kids, path.Base(p))
+	return nil
+}
+
+/* List returns the files in the directory d, sorted by name. */
+func (fs *fakeFS) List(d *fakeFile) []*fakeFile {
+	fs.l.Lock()
+	defer fs.l.Unlock()
+	ks := make([]*fakeFile, 0, len(d.kids))
+	for _, k := range d.kids {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		return ks[i].name < ks[j].name
+	})
+	return ks
+}
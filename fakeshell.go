@@ -0,0 +1,1277 @@
+package sshhipot
+
+/*
+ * fakeshell.go
+ * Emulated shell for when there's no upstream
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Values uname and friends report, if there's nothing better in the fake
+filesystem */
+const (
+	FAKEKERNEL        = "4.15.0-112-generic"
+	FAKEKERNELVERSION = "#113-Ubuntu SMP Thu Jul 9 23:41:39 UTC 2020"
+	FAKEARCH          = "x86_64"
+)
+
+/* FAKESHELLMAXDEPTH is how deeply sh and bash may run each other, to stop
+scripts which run themselves from using up the stack. */
+const FAKESHELLMAXDEPTH = 32
+
+/* Single-letter wget and curl flags which take a value */
+const (
+	WGETVALUEDFLAGS = "OoP"
+	CURLVALUEDFLAGS = "oOdHXAeuwTx"
+)
+
+/* fakeShell is a very small, very fake, bash-like shell. */
+type fakeShell struct {
+	fs       *fakeFS
+	cwd      string
+	home     string
+	user     string
+	hostname string
+	status   int  /* Exit status of the last command, for $? */
+	tty      bool /* Output goes to a terminal */
+	depth    int  /* Number of nested sh and bash commands */
+}
+
+/* shellCommand is a command the fakeShell knows how to run.  It is passed the
+arguments (including the command name), stdin from a pipe (which is nil if
+there's no pipe), and where to send stdout and stderr.  It returns the
+command's exit status. */
+type shellCommand func(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int
+
+/* shellCommands are the commands the fakeShell understands.  It's populated
+in init to avoid an initialization loop. */
+var shellCommands map[string]shellCommand
+
+func init() {
+	shellCommands = map[string]shellCommand{
+		"bash":     shSh,
+		"cat":      shCat,
+		"cd":       shCd,
+		"curl":     shCurl,
+		"echo":     shEcho,
+		"false":    shFalse,
+		"grep":     shGrep,
+		"head":     shHeadTail,
+		"hostname": shHostname,
+		"id":       shID,
+		"ls":       shLs,
+		"mkdir":    shMkdir,
+		"nproc":    shNproc,
+		"pwd":      shPwd,
+		"rm":       shRm,
+		"sh":       shSh,
+		"tail":     shHeadTail,
+		"touch":    shTouch,
+		"uname":    shUname,
+		"uptime":   shUptime,
+		"wc":       shWc,
+		"wget":     shWget,
+		"whoami":   shWhoami,
+	}
+	/* Commands which do nothing, successfully */
+	for _, n := range []string{
+		":", "alias", "chmod", "chown", "export", "history", "set",
+		"sleep", "true", "ulimit", "unalias", "unset",
+	} {
+		shellCommands[n] = func(
+			*fakeShell,
+			[]string,
+			[]byte,
+			io.Writer,
+			io.Writer,
+		) int {
+			return 0
+		}
+	}
+}
+
+/* newFakeShell returns a fakeShell for user on the host named hostname which
+uses fs. */
+func newFakeShell(fs *fakeFS, user, hostname string) *fakeShell {
+	sh := &fakeShell{
+		fs:       fs,
+		user:     user,
+		hostname: hostname,
+		home:     "/home/" + user,
+	}
+	if "root" == user {
+		sh.home = "/root"
+	}
+	/* Make sure we have a home directory */
+	if _, _, err := fs.Lookup("/", sh.home); nil != err {
+		if err := fs.Mkdir("/", sh.home); nil != err {
+			sh.home = "/"
+		}
+	}
+	sh.cwd = sh.home
+	return sh
+}
+
+/* Prompt expands the prompt format f.  %u is replaced with the username, %h
+with the hostname, %w with the working directory, %W with the last element of
+the working directory, %$ with # for root and $ for anybody else, and %% with
+a %. */
+func (sh *fakeShell) Prompt(f string) string {
+	var b strings.Builder
+	for i := 0; i < len(f); i++ {
+		if '%' != f[i] || len(f)-1 == i {
+			b.WriteByte(f[i])
+			continue
+		}
+		i++
+		switch f[i] {
+		case 'u':
+			b.WriteString(sh.user)
+		case 'h':
+			b.WriteString(sh.hostname)
+		case 'w':
+			b.WriteString(sh.tildeCwd())
+		case 'W':
+			b.WriteString(path.Base(sh.tildeCwd()))
+		case '$':
+			if "root" == sh.user {
+				b.WriteByte('#')
+			} else {
+				b.WriteByte('$')
+			}
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(f[i])
+		}
+	}
+	return b.String()
+}
+
+/* tildeCwd returns the working directory with the home directory replaced
+with a ~. */
+func (sh *fakeShell) tildeCwd() string {
+	if sh.cwd == sh.home {
+		return "~"
+	}
+	if strings.HasPrefix(sh.cwd, sh.home+"/") {
+		return "~" + strings.TrimPrefix(sh.cwd, sh.home)
+	}
+	return sh.cwd
+}
+
+/* shellToken is a word or operator in a command line */
+type shellToken struct {
+	s  string
+	op bool /* Operator, not a word */
+}
+
+/* split splits a command line into words and operators, removing quotes and
+expanding a few variables. */
+func (sh *fakeShell) split(line string) []shellToken {
+	var (
+		toks   []shellToken
+		cur    strings.Builder
+		inWord bool
+		quote  byte
+	)
+	end := func() {
+		if inWord {
+			toks = append(toks, shellToken{s: cur.String()})
+		}
+		cur.Reset()
+		inWord = false
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		/* Inside quotes */
+		if 0 != quote {
+			switch {
+			case c == quote:
+				quote = 0
+			case '\\' == c && '"' == quote && i+1 < len(line):
+				i++
+				cur.WriteByte(line[i])
+			case '$' == c && '"' == quote:
+				i += sh.expand(line[i+1:], &cur)
+			default:
+				cur.WriteByte(c)
+			}
+			continue
+		}
+		switch c {
+		case ' ', '\t':
+			end()
+		case '\'', '"':
+			quote = c
+			inWord = true
+		case '\\':
+			if i+1 < len(line) {
+				i++
+				cur.WriteByte(line[i])
+				inWord = true
+			}
+		case '$':
+			i += sh.expand(line[i+1:], &cur)
+			inWord = true
+		case '#':
+			if !inWord {
+				end()
+				return toks
+			}
+			cur.WriteByte(c)
+		case ';', '&', '|', '>', '<':
+			/* Redirecting stderr */
+			if '>' == c && inWord && "2" == cur.String() {
+				cur.Reset()
+				inWord = false
+				c = '2'
+				i--
+			}
+			end()
+			op := string(line[i])
+			if '2' == c {
+				op = "2" + string(line[i+1])
+				i++
+			}
+			/* Two-character operators */
+			if i+1 < len(line) {
+				switch line[i : i+2] {
+				case "&&", "||", ">>", "&>":
+					op += string(line[i+1])
+					i++
+				}
+				if "2>" == op && i+1 < len(line) &&
+					'>' == line[i+1] {
+					op += ">"
+					i++
+				}
+			}
+			toks = append(toks, shellToken{s: op, op: true})
+		default:
+			cur.WriteByte(c)
+			inWord = true
+		}
+	}
+	end()
+	return toks
+}
+
+/* expand expands the variable at the start of s (which was preceded by a $),
+writing its value to b and returning the number of bytes of s used. */
+func (sh *fakeShell) expand(s string, b *strings.Builder) int {
+	if "" == s {
+		b.WriteByte('$')
+		return 0
+	}
+	if '?' == s[0] {
+		b.WriteString(strconv.Itoa(sh.status))
+		return 1
+	}
+	/* Name might be in braces */
+	n, used := s, 0
+	if '{' == s[0] {
+		e := strings.IndexByte(s, '}')
+		if -1 == e {
+			return 0
+		}
+		n, used = s[1:e], e+1
+	} else {
+		e := 0
+		for e < len(s) && ('_' == s[e] ||
+			('a' <= s[e] && 'z' >= s[e]) ||
+			('A' <= s[e] && 'Z' >= s[e]) ||
+			('0' <= s[e] && '9' >= s[e])) {
+			e++
+		}
+		n, used = s[:e], e
+	}
+	switch n {
+	case "":
+		b.WriteByte('$')
+	case "HOME":
+		b.WriteString(sh.home)
+	case "USER", "LOGNAME":
+		b.WriteString(sh.user)
+	case "PWD":
+		b.WriteString(sh.cwd)
+	case "HOSTNAME":
+		b.WriteString(sh.hostname)
+	case "SHELL":
+		b.WriteString("/bin/bash")
+	case "PATH":
+		b.WriteString("/usr/local/sbin:/usr/local/bin:/usr/sbin:" +
+			"/usr/bin:/sbin:/bin")
+	}
+	return used
+}
+
+/* Run runs the command line line, writing output to w.  It returns true if
+the shell should exit. */
+func (sh *fakeShell) Run(line string, w io.Writer) bool {
+	toks := sh.split(line)
+	var (
+		stmt []shellToken
+		skip bool /* Skip the statement because of && or || */
+	)
+	for i := 0; i <= len(toks); i++ {
+		/* Statements end at separators or the end of the line */
+		if i < len(toks) && !(toks[i].op && isSeparator(toks[i].s)) {
+			stmt = append(stmt, toks[i])
+			continue
+		}
+		if !skip && 0 != len(stmt) {
+			if sh.pipeline(stmt, w) {
+				return true
+			}
+		}
+		stmt = stmt[:0]
+		skip = false
+		if i < len(toks) {
+			switch toks[i].s {
+			case "&&":
+				skip = 0 != sh.status
+			case "||":
+				skip = 0 == sh.status
+			}
+		}
+	}
+	return false
+}
+
+/* isSeparator returns true if op separates statements */
+func isSeparator(op string) bool {
+	switch op {
+	case ";", "&", "&&", "||":
+		return true
+	}
+	return false
+}
+
+/* pipeline runs a pipeline of commands.  It returns true if the shell should
+exit. */
+func (sh *fakeShell) pipeline(toks []shellToken, w io.Writer) bool {
+	var (
+		cmd   []shellToken
+		stdin []byte
+	)
+	for i := 0; i <= len(toks); i++ {
+		if i < len(toks) && !(toks[i].op && "|" == toks[i].s) {
+			cmd = append(cmd, toks[i])
+			continue
+		}
+		last := i == len(toks)
+		out, exit := sh.command(cmd, stdin, w)
+		if exit {
+			return true
+		}
+		if last {
+			w.Write(out)
+		}
+		stdin = out
+		cmd = cmd[:0]
+	}
+	return false
+}
+
+/* command runs a single command, with redirections.  Output which isn't
+redirected is returned.  Errors go straight to w.  The returned bool is true
+if the shell should exit. */
+func (sh *fakeShell) command(
+	toks []shellToken,
+	stdin []byte,
+	w io.Writer,
+) ([]byte, bool) {
+	var (
+		args    []string
+		outFile string
+		app     bool
+		stderr  = w
+	)
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		if !t.op {
+			args = append(args, t.s)
+			continue
+		}
+		/* Redirections need a target */
+		if i+1 >= len(toks) || toks[i+1].op {
+			fmt.Fprintf(
+				w,
+				"-bash: syntax error near unexpected token "+
+					"`newline'\n",
+			)
+			sh.status = 2
+			return nil, false
+		}
+		i++
+		switch t.s {
+		case ">", "&>":
+			outFile, app = toks[i].s, false
+			if "&>" == t.s {
+				stderr = ioutil.Discard
+			}
+		case ">>":
+			outFile, app = toks[i].s, true
+		case "2>", "2>>":
+			if "/dev/null" == toks[i].s {
+				stderr = ioutil.Discard
+			}
+		case "<":
+			f, _, err := sh.fs.Lookup(sh.cwd, toks[i].s)
+			if nil != err {
+				fmt.Fprintf(
+					w,
+					"-bash: %v: %v\n",
+					toks[i].s,
+					err,
+				)
+				sh.status = 1
+				return nil, false
+			}
+			stdin = f.data
+		}
+	}
+	if 0 == len(args) {
+		return nil, false
+	}
+
+	/* Run the command */
+	var out bytes.Buffer
+	switch args[0] {
+	case "exit", "logout":
+		return nil, true
+	}
+	c, ok := shellCommands[path.Base(args[0])]
+	switch {
+	case ok:
+		sh.status = c(sh, args, stdin, &out, stderr)
+	case strings.Contains(args[0], "/"):
+		if _, _, err := sh.fs.Lookup(sh.cwd, args[0]); nil != err {
+			fmt.Fprintf(stderr, "-bash: %v: %v\n", args[0], err)
+			sh.status = 127
+		} else {
+			fmt.Fprintf(
+				stderr,
+				"-bash: %v: Permission denied\n",
+				args[0],
+			)
+			sh.status = 126
+		}
+	default:
+		fmt.Fprintf(stderr, "-bash: %v: command not found\n", args[0])
+		sh.status = 127
+	}
+
+	/* Send output where it's meant to go */
+	if "" == outFile {
+		return out.Bytes(), false
+	}
+	if "/dev/null" == outFile {
+		return nil, false
+	}
+	if err := sh.fs.WriteFile(
+		sh.cwd,
+		outFile,
+		out.Bytes(),
+		app,
+	); nil != err {
+		fmt.Fprintf(w, "-bash: %v: %v\n", outFile, err)
+		sh.status = 1
+	}
+	return nil, false
+}
+
+/* splitFlags separates the flags (arguments starting with -) in args from
+the other arguments.  args should not contain the command name. */
+func splitFlags(args []string) (flags string, rest []string) {
+	for _, a := range args {
+		if 1 < len(a) && '-' == a[0] && '-' != a[1] {
+			flags += a[1:]
+			continue
+		}
+		rest = append(rest, a)
+	}
+	return
+}
+
+/* shFalse fails */
+func shFalse(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	return 1
+}
+
+/* shSh runs the commands given with -c, in a file, or on stdin */
+func shSh(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	script := string(stdin)
+	switch {
+	case 2 < len(args) && "-c" == args[1]:
+		script = args[2]
+	case 1 < len(args):
+		in, ret := sh.inputs(args[0], args[1:2], stdin, stderr)
+		if 0 != ret {
+			return 127
+		}
+		script = string(in)
+	}
+	if FAKESHELLMAXDEPTH <= sh.depth {
+		fmt.Fprintf(
+			stderr,
+			"%v: maximum nesting level exceeded (%v)\n",
+			args[0],
+			FAKESHELLMAXDEPTH,
+		)
+		return 1
+	}
+	sh.depth++
+	defer func() { sh.depth-- }()
+	for _, l := range strings.Split(script, "\n") {
+		if sh.Run(l, stdout) {
+			break
+		}
+	}
+	return sh.status
+}
+
+/* shCat catenates files */
+func shCat(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	_, fs := splitFlags(args[1:])
+	if 0 == len(fs) {
+		stdout.Write(stdin)
+		return 0
+	}
+	ret := 0
+	for _, n := range fs {
+		f, _, err := sh.fs.Lookup(sh.cwd, n)
+		if nil == err && nil != f.kids {
+			err = fmt.Errorf("Is a directory")
+		}
+		if nil != err {
+			fmt.Fprintf(stderr, "cat: %v: %v\n", n, err)
+			ret = 1
+			continue
+		}
+		stdout.Write(f.data)
+	}
+	return ret
+}
+
+/* shCd changes directory */
+func shCd(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	d := sh.home
+	if 1 < len(args) && "~" != args[1] {
+		d = strings.Replace(args[1], "~", sh.home, 1)
+	}
+	f, p, err := sh.fs.Lookup(sh.cwd, d)
+	if nil == err && nil == f.kids {
+		err = fmt.Errorf("Not a directory")
+	}
+	if nil != err {
+		fmt.Fprintf(stderr, "-bash: cd: %v: %v\n", d, err)
+		return 1
+	}
+	sh.cwd = p
+	return 0
+}
+
+/* shEcho echos its arguments */
+func shEcho(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	args = args[1:]
+	nl, esc := true, false
+	for 0 != len(args) && 1 < len(args[0]) && '-' == args[0][0] &&
+		"" == strings.Trim(args[0][1:], "neE") {
+		nl = nl && !strings.Contains(args[0], "n")
+		esc = strings.Contains(args[0], "e")
+		args = args[1:]
+	}
+	s := strings.Join(args, " ")
+	if esc {
+		s = strings.NewReplacer(
+			`\n`, "\n",
+			`\t`, "\t",
+			`\r`, "\r",
+			`\\`, `\`,
+		).Replace(s)
+	}
+	if nl {
+		s += "\n"
+	}
+	io.WriteString(stdout, s)
+	return 0
+}
+
+/* shGrep prints lines which contain a string */
+func shGrep(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	flags, rest := splitFlags(args[1:])
+	if 0 == len(rest) {
+		fmt.Fprintf(
+			stderr,
+			"Usage: grep [OPTION]... PATTERNS [FILE]...\n",
+		)
+		return 2
+	}
+	pat := rest[0]
+	in, ret := sh.inputs(args[0], rest[1:], stdin, stderr)
+	inv := strings.Contains(flags, "v")
+	fold := strings.Contains(flags, "i")
+	if fold {
+		pat = strings.ToLower(pat)
+	}
+	found := false
+	for _, l := range strings.SplitAfter(string(in), "\n") {
+		if "" == l {
+			continue
+		}
+		m := l
+		if fold {
+			m = strings.ToLower(m)
+		}
+		if strings.Contains(m, pat) != inv {
+			io.WriteString(stdout, l)
+			found = true
+		}
+	}
+	if 0 != ret {
+		return ret
+	}
+	if !found {
+		return 1
+	}
+	return 0
+}
+
+/* shHeadTail prints the first or last few lines */
+func shHeadTail(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	n := 10
+	var files []string
+	for i := 1; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case "-n" == a && i+1 < len(args):
+			i++
+			a = "-" + args[i]
+			fallthrough
+		case strings.HasPrefix(a, "-"):
+			if v, err := strconv.Atoi(a[1:]); nil == err {
+				n = v
+			}
+		default:
+			files = append(files, a)
+		}
+	}
+	in, ret := sh.inputs(args[0], files, stdin, stderr)
+	ls := strings.SplitAfter(string(in), "\n")
+	if 0 != len(ls) && "" == ls[len(ls)-1] {
+		ls = ls[:len(ls)-1]
+	}
+	if n > len(ls) {
+		n = len(ls)
+	}
+	if "head" == path.Base(args[0]) {
+		ls = ls[:n]
+	} else {
+		ls = ls[len(ls)-n:]
+	}
+	io.WriteString(stdout, strings.Join(ls, ""))
+	return ret
+}
+
+/* shWc counts lines, words, and bytes */
+func shWc(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	flags, files := splitFlags(args[1:])
+	in, ret := sh.inputs(args[0], files, stdin, stderr)
+	var cs []string
+	if "" == flags || strings.Contains(flags, "l") {
+		cs = append(cs, strconv.Itoa(bytes.Count(in, []byte("\n"))))
+	}
+	if "" == flags || strings.Contains(flags, "w") {
+		cs = append(cs, strconv.Itoa(len(bytes.Fields(in))))
+	}
+	if "" == flags || strings.Contains(flags, "c") {
+		cs = append(cs, strconv.Itoa(len(in)))
+	}
+	fmt.Fprintf(stdout, "%v\n", strings.Join(cs, " "))
+	return ret
+}
+
+/* inputs returns the contents of the named files, or stdin if there are no
+files.  Errors are written to stderr, prefixed with the command name. */
+func (sh *fakeShell) inputs(
+	cmd string,
+	files []string,
+	stdin []byte,
+	stderr io.Writer,
+) ([]byte, int) {
+	if 0 == len(files) {
+		return stdin, 0
+	}
+	var (
+		b   []byte
+		ret int
+	)
+	for _, n := range files {
+		f, _, err := sh.fs.Lookup(sh.cwd, n)
+		if nil == err && nil != f.kids {
+			err = fmt.Errorf("Is a directory")
+		}
+		if nil != err {
+			fmt.Fprintf(stderr, "%v: %v: %v\n", cmd, n, err)
+			ret = 2
+			continue
+		}
+		b = append(b, f.data...)
+	}
+	return b, ret
+}
+
+/* shHostname prints the hostname */
+func shHostname(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	fmt.Fprintf(stdout, "%v\n", sh.hostname)
+	return 0
+}
+
+/* shID prints user and group IDs */
+func shID(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	id := 1000
+	if "root" == sh.user {
+		id = 0
+	}
+	fmt.Fprintf(
+		stdout,
+		"uid=%v(%v) gid=%v(%v) groups=%v(%v)\n",
+		id, sh.user, id, sh.user, id, sh.user,
+	)
+	return 0
+}
+
+/* shWhoami prints the username */
+func shWhoami(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	fmt.Fprintf(stdout, "%v\n", sh.user)
+	return 0
+}
+
+/* shPwd prints the working directory */
+func shPwd(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	fmt.Fprintf(stdout, "%v\n", sh.cwd)
+	return 0
+}
+
+/* shNproc prints the number of processors */
+func shNproc(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	io.WriteString(stdout, "1\n")
+	return 0
+}
+
+/* shUptime prints a plausible uptime */
+func shUptime(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	fmt.Fprintf(
+		stdout,
+		" %v up 41 days,  3:17,  1 user,  load average: 0.00, "+
+			"0.01, 0.00\n",
+		time.Now().Format("15:04:05"),
+	)
+	return 0
+}
+
+/* shUname prints system information.  The kernel release and version may be
+set with /proc/sys/kernel/osrelease and /proc/sys/kernel/version in the fake
+filesystem. */
+func shUname(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	flags, _ := splitFlags(args[1:])
+	if "" == flags {
+		flags = "s"
+	}
+	if strings.Contains(flags, "a") {
+		flags = "snrvmo"
+	}
+	rel := sh.procValue("/proc/sys/kernel/osrelease", FAKEKERNEL)
+	ver := sh.procValue("/proc/sys/kernel/version", FAKEKERNELVERSION)
+	var out []string
+	for _, v := range []struct {
+		f byte
+		s string
+	}{
+		{'s', "Linux"},
+		{'n', sh.hostname},
+		{'r', rel},
+		{'v', ver},
+		{'m', FAKEARCH},
+		{'p', FAKEARCH},
+		{'i', FAKEARCH},
+		{'o', "GNU/Linux"},
+	} {
+		if -1 != strings.IndexByte(flags, v.f) {
+			out = append(out, v.s)
+		}
+	}
+	fmt.Fprintf(stdout, "%v\n", strings.Join(out, " "))
+	return 0
+}
+
+/* procValue returns the trimmed contents of the file n, or def if it doesn't
+exist. */
+func (sh *fakeShell) procValue(n, def string) string {
+	f, _, err := sh.fs.Lookup("/", n)
+	if nil != err || nil != f.kids {
+		return def
+	}
+	return strings.TrimSpace(string(f.data))
+}
+
+/* shMkdir makes directories */
+func shMkdir(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	_, ds := splitFlags(args[1:])
+	ret := 0
+	for _, d := range ds {
+		if err := sh.fs.Mkdir(sh.cwd, d); nil != err {
+			fmt.Fprintf(
+				stderr,
+				"mkdir: cannot create directory '%v': %v\n",
+				d,
+				err,
+			)
+			ret = 1
+		}
+	}
+	return ret
+}
+
+/* shRm removes files */
+func shRm(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	flags, fs := splitFlags(args[1:])
+	ret := 0
+	for _, f := range fs {
+		if err := sh.fs.Remove(sh.cwd, f); nil != err &&
+			!strings.Contains(flags, "f") {
+			fmt.Fprintf(
+				stderr,
+				"rm: cannot remove '%v': %v\n",
+				f,
+				err,
+			)
+			ret = 1
+		}
+	}
+	return ret
+}
+
+/* shTouch makes empty files */
+func shTouch(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	_, fs := splitFlags(args[1:])
+	ret := 0
+	for _, f := range fs {
+		if err := sh.fs.WriteFile(sh.cwd, f, nil, true); nil != err {
+			fmt.Fprintf(
+				stderr,
+				"touch: cannot touch '%v': %v\n",
+				f,
+				err,
+			)
+			ret = 1
+		}
+	}
+	return ret
+}
+
+/* shLs lists files */
+func shLs(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	flags, ps := splitFlags(args[1:])
+	long := strings.Contains(flags, "l")
+	all := strings.Contains(flags, "a")
+	dirOnly := strings.Contains(flags, "d")
+	one := strings.Contains(flags, "1") || !sh.tty
+	if 0 == len(ps) {
+		ps = []string{"."}
+	}
+	ret := 0
+	for i, p := range ps {
+		f, _, err := sh.fs.Lookup(sh.cwd, p)
+		if nil != err {
+			fmt.Fprintf(
+				stderr,
+				"ls: cannot access '%v': %v\n",
+				p,
+				err,
+			)
+			ret = 2
+			continue
+		}
+		/* Files are easy */
+		if nil == f.kids || dirOnly {
+			lsPrint(stdout, []lsEntry{{p, f}}, long, one)
+			continue
+		}
+		/* Directories need their contents listed */
+		if 1 < len(ps) {
+			if 0 != i {
+				io.WriteString(stdout, "\n")
+			}
+			fmt.Fprintf(stdout, "%v:\n", p)
+		}
+		var es []lsEntry
+		if all {
+			es = append(es, lsEntry{".", f})
+			pf, _, _ := sh.fs.Lookup(sh.cwd, path.Join(p, ".."))
+			es = append(es, lsEntry{"..", pf})
+		}
+		for _, k := range sh.fs.List(f) {
+			if !all && strings.HasPrefix(k.name, ".") {
+				continue
+			}
+			es = append(es, lsEntry{k.name, k})
+		}
+		if long {
+			var t int64
+			for _, e := range es {
+				t += (e.f.size + 4095) / 4096 * 4
+			}
+			fmt.Fprintf(stdout, "total %v\n", t)
+		}
+		lsPrint(stdout, es, long, one)
+	}
+	return ret
+}
+
+/* lsEntry is a file to be listed by ls, with the name to list it as */
+type lsEntry struct {
+	n string
+	f *fakeFile
+}
+
+/* lsPrint prints the entries es to w.  If long is true, the output is like
+ls -l.  If one is true, names are printed one per line. */
+func lsPrint(w io.Writer, es []lsEntry, long, one bool) {
+	if !long {
+		ns := make([]string, len(es))
+		for i, e := range es {
+			ns[i] = e.n
+		}
+		sep := "  "
+		if one {
+			sep = "\n"
+		}
+		if 0 != len(ns) {
+			fmt.Fprintf(w, "%v\n", strings.Join(ns, sep))
+		}
+		return
+	}
+	for _, e := range es {
+		nlink := 1
+		if nil != e.f.kids {
+			nlink = 2
+		}
+		ts := e.f.mtime.Format("Jan _2 15:04")
+		if time.Since(e.f.mtime) > 180*24*time.Hour {
+			ts = e.f.mtime.Format("Jan _2  2006")
+		}
+		n := e.n
+		if "" != e.f.link {
+			n += " -> " + e.f.link
+		}
+		fmt.Fprintf(
+			w,
+			"%v %v %v %v %5v %v %v\n",
+			lsMode(e.f),
+			nlink,
+			e.f.owner,
+			e.f.group,
+			e.f.size,
+			ts,
+			n,
+		)
+	}
+}
+
+/* lsMode returns the mode string for f, as ls -l would print it */
+func lsMode(f *fakeFile) string {
+	b := []byte("-rwxrwxrwx")
+	switch {
+	case nil != f.kids:
+		b[0] = 'd'
+	case "" != f.link:
+		b[0] = 'l'
+	}
+	for i := uint(0); i < 9; i++ {
+		if 0 == f.mode.Perm()&(1<<(8-i)) {
+			b[i+1] = '-'
+		}
+	}
+	if 0 != f.mode&os.ModeSticky {
+		if 'x' == b[9] {
+			b[9] = 't'
+		} else {
+			b[9] = 'T'
+		}
+	}
+	return string(b)
+}
+
+/* shWget pretends to download files */
+func shWget(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	us := downloadURLs(args[1:], WGETVALUEDFLAGS)
+	if 0 == len(us) {
+		fmt.Fprintf(stderr, "wget: missing URL\n")
+		return 1
+	}
+	for _, u := range us {
+		host, port := urlHostPort(u)
+		fmt.Fprintf(
+			stderr,
+			"--%v--  %v\n",
+			time.Now().Format("2006-01-02 15:04:05"),
+			u,
+		)
+		if nil != net.ParseIP(host) {
+			fmt.Fprintf(
+				stderr,
+				"Connecting to %v:%v... failed: Connection "+
+					"refused.\n",
+				host,
+				port,
+			)
+			continue
+		}
+		fmt.Fprintf(
+			stderr,
+			"Resolving %v (%v)... failed: Name or service not "+
+				"known.\nwget: unable to resolve host "+
+				"address '%v'\n",
+			host,
+			host,
+			host,
+		)
+	}
+	return 4
+}
+
+/* shCurl pretends to download files */
+func shCurl(
+	sh *fakeShell,
+	args []string,
+	stdin []byte,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	us := downloadURLs(args[1:], CURLVALUEDFLAGS)
+	if 0 == len(us) {
+		fmt.Fprintf(
+			stderr,
+			"curl: try 'curl --help' or 'curl --manual' for "+
+				"more information\n",
+		)
+		return 2
+	}
+	ret := 0
+	for _, u := range us {
+		host, port := urlHostPort(u)
+		if nil != net.ParseIP(host) {
+			fmt.Fprintf(
+				stderr,
+				"curl: (7) Failed to connect to %v port %v: "+
+					"Connection refused\n",
+				host,
+				port,
+			)
+			ret = 7
+			continue
+		}
+		fmt.Fprintf(
+			stderr,
+			"curl: (6) Could not resolve host: %v\n",
+			host,
+		)
+		ret = 6
+	}
+	return ret
+}
+
+/* downloadURLs returns the URLs in args, which are the arguments to a
+download command.  valued is the set of single-letter flags which take a
+value, which will be skipped. */
+func downloadURLs(args []string, valued string) []string {
+	var us []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if strings.HasPrefix(a, "--") {
+			continue
+		}
+		if strings.HasPrefix(a, "-") && 1 < len(a) {
+			/* Skip the next argument if it's the value of a
+			flag given on its own. */
+			if 2 == len(a) &&
+				-1 != strings.IndexByte(valued, a[1]) {
+				i++
+			}
+			continue
+		}
+		us = append(us, a)
+	}
+	return us
+}
+
+/* urlHostPort returns the host and port from a URL given to a download
+command.  URLs without a scheme are assumed to be http. */
+func urlHostPort(u string) (string, string) {
+	if !strings.Contains(u, "://") {
+		u = "http://" + u
+	}
+	pu, err := url.Parse(u)
+	if nil != err {
+		return u, "80"
+	}
+	port := pu.Port()
+	if "" == port {
+		switch pu.Scheme {
+		case "https":
+			port = "443"
+		case "ftp":
+			port = "21"
+		case "tftp":
+			port = "69"
+		default:
+			port = "80"
+		}
+	}
+	return pu.Hostname(), port
+}
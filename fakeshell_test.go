@@ -0,0 +1,44 @@
+package sshhipot
+
+/*
+ * fakeshell_test.go
+ * Tests for the fallback shell
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFakeShellNesting(t *testing.T) {
+	sh := newFakeShell(defaultFakeFS("svr"), "root", "svr")
+
+	/* Nesting a few deep is fine */
+	var buf bytes.Buffer
+	sh.Run(`sh -c "bash -c 'echo hi'"`, &buf)
+	if "hi\n" != buf.String() || 0 != sh.status {
+		t.Errorf("Nested shells output %q, status %v", buf, sh.status)
+	}
+
+	/* A script which runs itself shouldn't take the stack with it */
+	for _, l := range []string{
+		"echo 'sh /tmp/x' > /tmp/x; sh /tmp/x",
+		"echo 'cat /tmp/y | bash' > /tmp/y; bash /tmp/y",
+	} {
+		buf.Reset()
+		sh.Run(l, &buf)
+		if !strings.Contains(
+			buf.String(),
+			"maximum nesting level exceeded",
+		) || 0 == sh.status {
+			t.Errorf("%q: output %q, status %v", l, buf, sh.status)
+		}
+		if 0 != sh.depth {
+			t.Errorf("%q: depth %v after running", l, sh.depth)
+		}
+	}
+}
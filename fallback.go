@@ -0,0 +1,476 @@
+package sshhipot
+
+/*
+ * fallback.go
+ * Serve sessions without an upstream server
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+/* FALLBACKUPSTREAM is noted as the upstream for sessions served by the
+fallback shell. */
+const FALLBACKUPSTREAM = "fallback"
+
+/* fallback serves sessions with an emulated shell, for when there's no
+upstream server or policy says not to use it. */
+type fallback struct {
+	fs       *fakeFS
+	hostname string
+	prompt   string
+	always   bool     /* Never use the upstream server */
+	versions []string /* Client versions routed to the fallback */
+	users    []string /* Users routed to the fallback */
+}
+
+/* newFallback makes a new fallback.  The filesystem is read from the tarball
+named tn, or a small default filesystem is used if tn is empty.  Connections
+are routed to the fallback if always is true, or the client version contains
+any of the comma-separated strings in versions, or the username is any of the
+comma-separated names in users. */
+func newFallback(
+	tn string,
+	hostname string,
+	prompt string,
+	always bool,
+	versions string,
+	users string,
+) (*fallback, error) {
+	f := &fallback{
+		hostname: hostname,
+		prompt:   prompt,
+		always:   always,
+		versions: splitList(versions),
+		users:    splitList(users),
+	}
+	if "" == tn {
+		f.fs = defaultFakeFS(hostname)
+		return f, nil
+	}
+	var err error
+	if f.fs, err = loadFakeFS(tn); nil != err {
+		return nil, err
+	}
+	return f, nil
+}
+
+/* splitList splits a comma-separated list, ignoring empty elements */
+func splitList(s string) []string {
+	var l []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); "" != v {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+/* Routes returns true if the connection c should be served by the fallback
+and not the upstream server. */
+func (f *fallback) Routes(c ssh.ConnMetadata) bool {
+	if nil == f {
+		return false
+	}
+	if f.always {
+		return true
+	}
+	for _, v := range f.versions {
+		if strings.Contains(string(c.ClientVersion()), v) {
+			return true
+		}
+	}
+	for _, u := range f.users {
+		if c.User() == u {
+			return true
+		}
+	}
+	return false
+}
+
+/* noUpstream is a Requestable which refuses all requests */
+type noUpstream struct{}
+
+/* SendRequest implements Requestable */
+func (noUpstream) SendRequest(string, bool, []byte) (bool, []byte, error) {
+	return false, []byte{}, nil
+}
+
+/* Serve serves the channels and requests from sc with the fallback shell,
+logging as handle and handleChan would.  It returns when sc is closed. */
+func (f *fallback) Serve(
+	sc *ssh.ServerConn,
+	chans <-chan ssh.NewChannel,
+	reqs <-chan *ssh.Request,
+	ldir string,
+	lg *log.Logger,
+	rlg *log.Logger,
+	sess *Session,
+	live *liveSession,
+	gov *governor,
+) {
+	sess.setUpstream(FALLBACKUPSTREAM)
+	/* Each session gets its own copy of the filesystem */
+	fs := f.fs.Clone()
+	go handleReqs(
+		reqs,
+		noUpstream{},
+		rlg,
+		TAGTOSERVER,
+		sess.requestHook(nil, TAGTOSERVER),
+	)
+	go func() {
+		for nc := range chans {
+			sess.goChannel(func() {
+				f.handleChan(nc, fs, ldir, lg, sess, live, gov)
+			})
+		}
+	}()
+	sc.Wait()
+}
+
+/* handleChan handles a single channel request with the fallback shell.  Only
+session channels are accepted. */
+func (f *fallback) handleChan(
+	nc ssh.NewChannel,
+	fs *fakeFS,
+	ldir string,
+	lg *log.Logger,
+	sess *Session,
+	live *liveSession,
+	gov *governor,
+) {
+	cs := sess.newChannel(nc, TAGTOSERVER)
+	defer sess.endChannel(cs)
+	crl := channelLogLine(nc, TAGTOSERVER)
+	if !gov.OpenChannel() {
+		sess.rejectChannel(cs, channelLimitError)
+		rejectChannel(channelLimitError, crl, nc, lg)
+		return
+	}
+	defer gov.CloseChannel()
+
+	/* We can only really do shells */
+	if "session" != nc.ChannelType() {
+		err := &ssh.OpenChannelError{
+			Reason:  ssh.ConnectionFailed,
+			Message: "Connection refused",
+		}
+		sess.rejectChannel(cs, err)
+		rejectChannel(err, crl, nc, lg)
+		return
+	}
+	ac, areqs, err := nc.Accept()
+	if nil != err {
+		lg.Printf(
+			"Unable to accept channel request of type %q: %v",
+			nc.ChannelType(),
+			err,
+		)
+		return
+	}
+	defer ac.Close()
+
+	/* Log like a proxied channel */
+	clg, lf, clgn, err := sess.srv.logChannel(ldir, nc, sess.ID)
+	if nil != err {
+		lg.Printf(
+			"Unable to open log file for channel of type %q:%v",
+			nc.ChannelType(),
+			err,
+		)
+		return
+	}
+	defer lf.Close()
+	clg.Printf("Start of log")
+	rlg := sess.srv.newLogger(lf, sess.ID, SUBSYSREQUEST, LEVELDEBUG)
+	dlg := sess.srv.newLogger(lf, sess.ID, SUBSYSCHANNEL, LEVELTRACE)
+	sess.setChannelLog(cs, clgn)
+	tr := sess.channelTranscript(cs, clgn, clg)
+	defer tr.Close()
+	lch := live.addChannel(cs, ac, clg)
+	defer lch.Done()
+	lg.Printf("Channel %s Log:%q", crl, clgn)
+	le := NewLineEditor(false, func(l string) {
+		clg.Printf("[%v] Command:%q", TAGTOSERVER, l)
+		sess.addCommand(cs, l)
+	})
+	budget := sess.channelBudget()
+	lc := &loggedChannel{
+		ch: ac,
+		r:  gov.Channel(clg).Up(lch.Input()),
+		in: newDataLogger(dlg, tr, TAGTOSERVER, func(b []byte) {
+			sess.addBytes(cs, TAGTOSERVER, b)
+			le.Input(b)
+		}, budget),
+		out: newDataLogger(dlg, tr, TAGTOATTACKER, func(b []byte) {
+			sess.addBytes(cs, TAGTOATTACKER, b)
+			le.Output(b)
+			lch.Output(b)
+		}, budget),
+	}
+
+	/* The shell itself */
+	sh := newFakeShell(fs, sess.User, f.hostname)
+	fc := &fakeChannel{}
+	noteAReq := sess.requestHook(cs, TAGTOSERVER)
+	areqHook := func(r *ssh.Request, ok bool) {
+		noteAReq(r, ok)
+		if ok && "shell" == r.Type {
+			le.Enable()
+		}
+	}
+
+	/* Handle requests until we get a shell or exec, at which point the
+	shell starts. */
+	for r := range areqs {
+		handleRequest(r, fc, rlg, TAGTOSERVER, areqHook)
+		if fc.Started() {
+			go f.run(
+				sh,
+				fc,
+				lc,
+				rlg,
+				sess.requestHook(cs, TAGTOATTACKER),
+			)
+		}
+	}
+}
+
+/* run runs the shell or command requested on fc, sends the exit status, which
+is logged to rlg, and closes the channel. */
+func (f *fallback) run(
+	sh *fakeShell,
+	fc *fakeChannel,
+	lc *loggedChannel,
+	rlg *log.Logger,
+	hook func(*ssh.Request, bool),
+) {
+	defer lc.ch.Close()
+	cmd, isExec, tty := fc.Command()
+	sh.tty = tty
+	switch {
+	case isExec && tty:
+		sh.Run(cmd, crlfWriter{lc})
+	case isExec:
+		sh.Run(cmd, lc)
+	case tty:
+		f.interact(sh, fc, lc)
+	default:
+		/* No terminal, just lines of commands */
+		s := bufio.NewScanner(lc)
+		for s.Scan() {
+			if sh.Run(s.Text(), lc) {
+				break
+			}
+		}
+	}
+
+	/* Tell the attacker how it went */
+	es := struct{ Status uint32 }{uint32(sh.status)}
+	r := &ssh.Request{Type: "exit-status", Payload: ssh.Marshal(es)}
+	ok, err := lc.ch.SendRequest(r.Type, r.WantReply, r.Payload)
+	if nil != err {
+		rlg.Printf(
+			"Unable to send request %s Error:%v",
+			requestLogLine(r, TAGTOATTACKER),
+			err,
+		)
+		return
+	}
+	hook(r, ok)
+	rlg.Printf(
+		"Request %s Ok:%v Response:%q",
+		requestLogLine(r, TAGTOATTACKER),
+		ok,
+		[]byte{},
+	)
+	lc.ch.CloseWrite()
+}
+
+/* interact runs an interactive shell on a terminal */
+func (f *fallback) interact(
+	sh *fakeShell,
+	fc *fakeChannel,
+	lc *loggedChannel,
+) {
+	t := term.NewTerminal(interruptible{lc}, sh.Prompt(f.prompt))
+	fc.SetTerminal(t)
+	/* Say hello */
+	if m, _, err := sh.fs.Lookup("/", "/etc/motd"); nil == err &&
+		nil == m.kids {
+		t.Write(m.data)
+	}
+	for {
+		l, err := t.ReadLine()
+		if nil != err {
+			return
+		}
+		if sh.Run(l, t) {
+			return
+		}
+		t.SetPrompt(sh.Prompt(f.prompt))
+	}
+}
+
+/* fakeChannel is a Requestable which handles the requests for a session
+channel served by the fallback shell. */
+type fakeChannel struct {
+	l       sync.Mutex
+	tty     bool
+	w, h    int
+	t       *term.Terminal
+	cmd     string
+	isExec  bool
+	started bool /* Shell or exec requested */
+	running bool /* Started has returned true */
+}
+
+/* SendRequest implements Requestable */
+func (c *fakeChannel) SendRequest(
+	name string,
+	wantReply bool,
+	payload []byte,
+) (bool, []byte, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	switch name {
+	case "pty-req":
+		var p struct {
+			Term   string
+			W, H   uint32
+			PW, PH uint32
+			Modes  string
+		}
+		if nil != ssh.Unmarshal(payload, &p) || c.started {
+			return false, []byte{}, nil
+		}
+		c.tty, c.w, c.h = true, int(p.W), int(p.H)
+		return true, []byte{}, nil
+	case "window-change":
+		if 8 > len(payload) {
+			return false, []byte{}, nil
+		}
+		c.w = int(binary.BigEndian.Uint32(payload))
+		c.h = int(binary.BigEndian.Uint32(payload[4:]))
+		if nil != c.t {
+			c.t.SetSize(c.w, c.h)
+		}
+		return true, []byte{}, nil
+	case "env":
+		return true, []byte{}, nil
+	case "shell":
+		if c.started {
+			return false, []byte{}, nil
+		}
+		c.started = true
+		return true, []byte{}, nil
+	case "exec":
+		cmd, ok := sshString(payload)
+		if !ok || c.started {
+			return false, []byte{}, nil
+		}
+		c.started, c.isExec, c.cmd = true, true, cmd
+		return true, []byte{}, nil
+	}
+	return false, []byte{}, nil
+}
+
+/* Started returns true the first time it's called after a shell or exec
+request has been accepted. */
+func (c *fakeChannel) Started() bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if !c.started || c.running {
+		return false
+	}
+	c.running = true
+	return true
+}
+
+/* Command returns the command requested with exec (and true), or false if a
+shell was requested, as well as whether a pty was requested. */
+func (c *fakeChannel) Command() (string, bool, bool) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.cmd, c.isExec, c.tty
+}
+
+/* SetTerminal sets the terminal to resize on window-change requests. */
+func (c *fakeChannel) SetTerminal(t *term.Terminal) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.t = t
+	if 0 != c.w && 0 != c.h {
+		t.SetSize(c.w, c.h)
+	}
+}
+
+/* loggedChannel wraps a channel and logs everything read from or written to
+it.  Reads come from r, which should read from ch. */
+type loggedChannel struct {
+	ch  ssh.Channel
+	r   io.Reader
+	in  *dataLogger
+	out *dataLogger
+}
+
+/* Read implements io.Reader */
+func (c *loggedChannel) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if 0 < n {
+		c.in.Log(p[:n])
+	}
+	return n, err
+}
+
+/* Write implements io.Writer */
+func (c *loggedChannel) Write(p []byte) (int, error) {
+	n, err := c.ch.Write(p)
+	if 0 < n {
+		c.out.Log(p[:n])
+	}
+	return n, err
+}
+
+/* interruptible turns the ^Cs read from its io.ReadWriter into a cleared
+line and a newline, as term.Terminal otherwise treats ^C as end-of-file. */
+type interruptible struct {
+	io.ReadWriter
+}
+
+/* Read implements io.Reader */
+func (i interruptible) Read(p []byte) (int, error) {
+	/* Leave room for every byte to be a ^C */
+	n, err := i.ReadWriter.Read(p[:(len(p)+1)/2])
+	b := bytes.ReplaceAll(p[:n], []byte{0x03}, []byte{0x15, '\r'})
+	return copy(p, b), err
+}
+
+/* crlfWriter turns newlines into carriage return-newline pairs, as a terminal
+would. */
+type crlfWriter struct {
+	w io.Writer
+}
+
+/* Write implements io.Writer */
+func (c crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(
+		bytes.ReplaceAll(p, []byte{'\n'}, []byte("\r\n")),
+	); nil != err {
+		return 0, err
+	}
+	return len(p), nil
+}
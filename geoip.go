@@ -0,0 +1,181 @@
+package sshhipot
+
+/*
+ * geoip.go
+ * Work out where attackers are from
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+/* GEOCACHESIZE is the number of addresses' lookups to keep before starting the
+cache over */
+const GEOCACHESIZE = 65536
+
+/* GeoInfo is what we know about where an address is. */
+type GeoInfo struct {
+	Country     string `json:"country,omitempty"`
+	CountryCode string `json:"country_code,omitempty"`
+	City        string `json:"city,omitempty"`
+	ASN         uint   `json:"asn,omitempty"`
+	Org         string `json:"org,omitempty"`
+}
+
+/* String describes g in a way suitable for logging.  If g is nil, the empty
+string is returned. */
+func (g *GeoInfo) String() string {
+	if nil == g {
+		return ""
+	}
+	return fmt.Sprintf(
+		"Country:%q City:%q ASN:%v Org:%q",
+		g.CountryCode,
+		g.City,
+		g.ASN,
+		g.Org,
+	)
+}
+
+/* geoRecord holds the fields we use from MaxMind's City, Country, and ASN
+databases, as well as those in GeoLite2 and DB-IP's lookalikes. */
+type geoRecord struct {
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	ASN uint   `maxminddb:"autonomous_system_number"`
+	Org string `maxminddb:"autonomous_system_organization"`
+}
+
+/* geoIP looks up addresses in one or more mmdb files.  A nil *geoIP finds
+nothing. */
+type geoIP struct {
+	dbs    []*maxminddb.Reader
+	levels logLevels /* Log verbosity */
+
+	l     sync.Mutex
+	cache map[string]*GeoInfo
+}
+
+/* openGeoIP opens the comma-separated mmdb files in fns.  City and ASN data
+usually come in different files; every file is searched for every address.
+What happens is logged at the verbosity set by levels.  If fns is the empty
+string, nil is returned. */
+func openGeoIP(fns string, levels logLevels) (*geoIP, error) {
+	if "" == fns {
+		return nil, nil
+	}
+	g := &geoIP{cache: make(map[string]*GeoInfo), levels: levels}
+	for _, fn := range splitList(fns) {
+		r, err := maxminddb.Open(fn)
+		if nil != err {
+			g.Close()
+			return nil, fmt.Errorf("opening %v: %v", fn, err)
+		}
+		g.dbs = append(g.dbs, r)
+		built := time.Unix(int64(r.Metadata.BuildEpoch), 0)
+		logf(
+			g.levels,
+			LEVELINFO,
+			SUBSYSGENERAL,
+			"Loaded %v GeoIP database %v built %v",
+			r.Metadata.DatabaseType,
+			fn,
+			built.Format("2006-01-02"),
+		)
+	}
+	return g, nil
+}
+
+/* Close closes g's files. */
+func (g *geoIP) Close() error {
+	if nil == g {
+		return nil
+	}
+	for _, r := range g.dbs {
+		r.Close()
+	}
+	return nil
+}
+
+/* Lookup returns what's known about the host, an IP address.  If nothing's
+known, Lookup returns nil.  Lookups are cached. */
+func (g *geoIP) Lookup(host string) *GeoInfo {
+	if nil == g {
+		return nil
+	}
+
+	/* Try the cache first */
+	g.l.Lock()
+	gi, ok := g.cache[host]
+	g.l.Unlock()
+	if ok {
+		return gi
+	}
+
+	/* Nope, ask the databases */
+	gi = g.lookup(host)
+	g.l.Lock()
+	defer g.l.Unlock()
+	if GEOCACHESIZE <= len(g.cache) {
+		g.cache = make(map[string]*GeoInfo)
+	}
+	g.cache[host] = gi
+	return gi
+}
+
+/* lookup looks up host in every database, uncached. */
+func (g *geoIP) lookup(host string) *GeoInfo {
+	ip := net.ParseIP(host)
+	if nil == ip {
+		return nil
+	}
+	var (
+		gi    GeoInfo
+		found bool
+	)
+	for _, r := range g.dbs {
+		var rec geoRecord
+		if err := r.Lookup(ip, &rec); nil != err {
+			logf(
+				g.levels,
+				LEVELWARN,
+				SUBSYSGENERAL,
+				"Unable to look up %v: %v",
+				host,
+				err,
+			)
+			continue
+		}
+		if "" != rec.Country.ISOCode {
+			gi.CountryCode = rec.Country.ISOCode
+			gi.Country = rec.Country.Names["en"]
+			found = true
+		}
+		if n := rec.City.Names["en"]; "" != n {
+			gi.City = n
+			found = true
+		}
+		if 0 != rec.ASN {
+			gi.ASN = rec.ASN
+			gi.Org = rec.Org
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return &gi
+}
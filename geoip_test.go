@@ -0,0 +1,283 @@
+package sshhipot
+
+/*
+ * geoip_test.go
+ * Tests for working out where attackers are from
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/* testGeoPrefix is an IPv4 network and what's known about it */
+type testGeoPrefix struct {
+	network string
+	record  map[string]interface{}
+}
+
+/* mmdbEncode encodes v in MaxMind DB format.  Only strings, unsigned integers,
+maps, and arrays, all shorter than 285 bytes or elements, are supported. */
+func mmdbEncode(v interface{}) []byte {
+	ctrl := func(typ, size int) []byte {
+		var b []byte
+		if 7 >= typ {
+			b = []byte{byte(typ << 5)}
+		} else {
+			b = []byte{0, byte(typ - 7)}
+		}
+		if 29 > size {
+			b[0] |= byte(size)
+			return b
+		}
+		b[0] |= 29
+		return append(b, byte(size-29))
+	}
+	num := func(typ int, n uint64) []byte {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, n)
+		b = bytes.TrimLeft(b, "\x00")
+		return append(ctrl(typ, len(b)), b...)
+	}
+	switch v := v.(type) {
+	case string:
+		return append(ctrl(2, len(v)), v...)
+	case uint16:
+		return num(5, uint64(v))
+	case uint32:
+		return num(6, uint64(v))
+	case uint64:
+		return num(9, v)
+	case map[string]interface{}:
+		b := ctrl(7, len(v))
+		for k, e := range v {
+			b = append(b, mmdbEncode(k)...)
+			b = append(b, mmdbEncode(e)...)
+		}
+		return b
+	case []interface{}:
+		b := ctrl(11, len(v))
+		for _, e := range v {
+			b = append(b, mmdbEncode(e)...)
+		}
+		return b
+	}
+	panic("unsupported mmdb type")
+}
+
+/* writeTestMMDB writes an IPv4 MaxMind DB of type typ, with the records in
+ps, to a file in dir and returns the file's name. */
+func writeTestMMDB(
+	t *testing.T,
+	dir string,
+	typ string,
+	ps []testGeoPrefix,
+) string {
+	t.Helper()
+	/* Data section, and where each record is in it */
+	var (
+		data []byte
+		offs []int
+	)
+	for _, p := range ps {
+		offs = append(offs, len(data))
+		data = append(data, mmdbEncode(p.record)...)
+	}
+
+	/* Search tree, with negative numbers for records */
+	nodes := [][2]int{{0, 0}}
+	for i, p := range ps {
+		_, n, err := net.ParseCIDR(p.network)
+		if nil != err {
+			t.Fatalf("Bad network %q: %v", p.network, err)
+		}
+		ip := binary.BigEndian.Uint32(n.IP.To4())
+		plen, _ := n.Mask.Size()
+		cur := 0
+		for b := 0; b < plen; b++ {
+			bit := (ip >> (31 - uint32(b))) & 1
+			if plen-1 == b {
+				nodes[cur][bit] = -(i + 1)
+				break
+			}
+			if 0 == nodes[cur][bit] {
+				nodes = append(nodes, [2]int{})
+				nodes[cur][bit] = len(nodes) - 1
+			}
+			cur = nodes[cur][bit]
+		}
+	}
+	var tree []byte
+	for _, n := range nodes {
+		for _, r := range n {
+			v := len(nodes) /* Nothing here */
+			if 0 < r {
+				v = r
+			} else if 0 > r {
+				v = len(nodes) + 16 + offs[-r-1]
+			}
+			tree = append(tree, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+
+	/* Put it all together */
+	b := append(tree, make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, "\xab\xcd\xefMaxMind.com"...)
+	b = append(b, mmdbEncode(map[string]interface{}{
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(4),
+		"database_type":               typ,
+		"languages":                   []interface{}{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1700000000),
+		"description": map[string]interface{}{
+			"en": "test",
+		},
+	})...)
+	fn := filepath.Join(dir, typ+".mmdb")
+	if err := ioutil.WriteFile(fn, b, 0600); nil != err {
+		t.Fatalf("Unable to write %v: %v", fn, err)
+	}
+	return fn
+}
+
+/* openTestGeoIP opens a City and an ASN database which know about a couple
+of networks. */
+func openTestGeoIP(t *testing.T) *geoIP {
+	t.Helper()
+	dir := t.TempDir()
+	city := writeTestMMDB(t, dir, "GeoLite2-City", []testGeoPrefix{{
+		network: "192.0.2.0/24",
+		record: map[string]interface{}{
+			"country": map[string]interface{}{
+				"iso_code": "NZ",
+				"names": map[string]interface{}{
+					"en": "New Zealand",
+				},
+			},
+			"city": map[string]interface{}{
+				"names": map[string]interface{}{
+					"en": "Wellington",
+				},
+			},
+		},
+	}, {
+		network: "198.51.100.0/24",
+		record: map[string]interface{}{
+			"country": map[string]interface{}{
+				"iso_code": "IS",
+			},
+		},
+	}})
+	asn := writeTestMMDB(t, dir, "GeoLite2-ASN", []testGeoPrefix{{
+		network: "192.0.2.0/25",
+		record: map[string]interface{}{
+			"autonomous_system_number":       uint32(64500),
+			"autonomous_system_organization": "Example Net",
+		},
+	}})
+	g, err := openGeoIP(city+","+asn, nil)
+	if nil != err {
+		t.Fatalf("Unable to open GeoIP databases: %v", err)
+	}
+	t.Cleanup(func() { g.Close() })
+	return g
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	g := openTestGeoIP(t)
+	for host, want := range map[string]string{
+		"192.0.2.1": `Country:"NZ" City:"Wellington" ASN:64500 ` +
+			`Org:"Example Net"`,
+		"192.0.2.200":   `Country:"NZ" City:"Wellington" ASN:0 Org:""`,
+		"198.51.100.10": `Country:"IS" City:"" ASN:0 Org:""`,
+		"203.0.113.1":   "",
+		"localhost":     "",
+	} {
+		if got := g.Lookup(host).String(); got != want {
+			t.Errorf("%v: got %v, want %v", host, got, want)
+		}
+	}
+
+	/* Lookups which fail are logged */
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	if gi := g.Lookup("2001:db8::1"); nil != gi {
+		t.Errorf("IPv6 lookup in IPv4 database found %v", gi)
+	}
+	if !strings.Contains(buf.String(), "Unable to look up 2001:db8::1") {
+		t.Errorf("Failed lookup not logged: %q", buf.String())
+	}
+}
+
+func TestGeoIPCache(t *testing.T) {
+	g := openTestGeoIP(t)
+	gi := g.Lookup("192.0.2.1")
+	if nil == gi {
+		t.Fatalf("Lookup failed")
+	}
+	g.Lookup("203.0.113.1")
+
+	/* Cached answers, including not knowing, don't need the
+	databases */
+	dbs := g.dbs
+	g.dbs = nil
+	if got := g.Lookup("192.0.2.1"); gi != got {
+		t.Errorf("Uncached lookup %v", got)
+	}
+	if 2 != len(g.cache) {
+		t.Errorf("Cache has %v entries, want 2", len(g.cache))
+	}
+	g.dbs = dbs
+
+	/* A full cache starts over */
+	for i := len(g.cache); i < GEOCACHESIZE; i++ {
+		g.cache[strconv.Itoa(i)] = nil
+	}
+	if nil == g.Lookup("198.51.100.1") {
+		t.Errorf("Lookup with full cache failed")
+	}
+	if 1 != len(g.cache) {
+		t.Errorf(
+			"Full cache not emptied, has %v entries",
+			len(g.cache),
+		)
+	}
+}
+
+func TestGeoIPNil(t *testing.T) {
+	g, err := openGeoIP("", nil)
+	if nil != err || nil != g {
+		t.Fatalf("No files gave %v (%v)", g, err)
+	}
+	if gi := g.Lookup("192.0.2.1"); nil != gi {
+		t.Errorf("Nil geoIP found %v", gi)
+	}
+	if err := g.Close(); nil != err {
+		t.Errorf("Closing nil geoIP: %v", err)
+	}
+	if s := (*GeoInfo)(nil).String(); "" != s {
+		t.Errorf("Nil GeoInfo is %q", s)
+	}
+	if _, err := openGeoIP(
+		filepath.Join(t.TempDir(), "nonexistent.mmdb"),
+		nil,
+	); nil == err {
+		t.Errorf("Opened nonexistent database")
+	}
+}
@@ -1,14 +1,15 @@
-package main
+package sshhipot
 
 /*
  * handle.go
  * Handle an SSH connection
  * By J. Stuart McMurray
  * Created 20160514
- * Last Modified 20160605
+ * Last Modified 20261018
  */
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -22,112 +23,275 @@ import (
 const (
 	LOGFORMAT = "2006-01-02T15.04.05.999999999Z0700"
 	LOGNAME   = "log"
+	/* LOGFLAGS are the flags for session and channel logs */
+	LOGFLAGS = log.LstdFlags | log.Lmicroseconds | log.Lmsgprefix
+	/* LOGTIMEFORMAT is the timestamp format used by log.Logger with
+	log.LstdFlags|log.Lmicroseconds. */
+	LOGTIMEFORMAT = "2006/01/02 15:04:05.000000"
 )
 
 /* handle handles an incoming connection */
-func handle(
-	c net.Conn,
-	sconfig *ssh.ServerConfig,
-	saddr string,
-	cconfig *ssh.ClientConfig,
-	logDir string,
-	hideBanners bool,
-) {
+func (s *Server) handle(c net.Conn) {
 	defer c.Close()
-	log.Printf("Address:%v New Connection", c.RemoteAddr())
 
-	/* Try to turn it into an SSH connection */
-	sc, achans, areqs, err := ssh.NewServerConn(c, sconfig)
+	/* Give the connection an ID, which the auth callbacks can find */
+	pc := newPendingConn()
+	id := pc.id
+	ci := fmt.Sprintf("ID:%v Address:%v", id, c.RemoteAddr())
+	host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	gi := s.geo.Lookup(host)
+	if nil != gi {
+		ci += " " + gi.String()
+	}
+	s.logf(LEVELINFO, SUBSYSAUTH, "%v New Connection", ci)
+	s.db.Connection(id, c.RemoteAddr().String(), host, gi)
+	s.obs.Connect(id, c.RemoteAddr(), gi)
+
+	/* Tell the observer when we're done, with a copy of the summary if
+	there is one.  The copy means the observer needn't worry about
+	anything still running, and may do what it likes with it. */
+	var sess *Session
+	defer func() {
+		if nil == sess {
+			s.obs.Disconnect(id, nil)
+			return
+		}
+		ss, err := sess.snapshot()
+		if nil != err {
+			s.logf(
+				LEVELERROR,
+				SUBSYSGENERAL,
+				"%v Unable to copy summary: %v",
+				ci,
+				err,
+			)
+		}
+		s.obs.Disconnect(id, ss)
+	}()
+
+	/* Try to turn it into an SSH connection, fingerprinting the client
+	on the way */
+	hc := newHASSHConn(c)
+	sc, achans, areqs, err := ssh.NewServerConn(hc, s.connConfig(pc))
 	if nil != err {
+		s.db.ConnectionResult(id, err.Error())
 		/* Done unless we're supposed to report banner-grabbing */
-		if hideBanners {
+		if s.conf.HideBanners {
 			return
 		}
 		/* EOF means the client gave up */
 		if io.EOF == err {
-			log.Printf(
-				"Address:%v Pre-Auth Disconnect",
-				c.RemoteAddr(),
+			s.logf(
+				LEVELINFO,
+				SUBSYSAUTH,
+				"%v Pre-Auth Disconnect",
+				ci,
 			)
 		} else {
-			log.Printf(
-				"Address:%v Pre-Auth Error:%q",
-				c.RemoteAddr(),
+			s.logf(
+				LEVELINFO,
+				SUBSYSAUTH,
+				"%v Pre-Auth Error:%q",
+				ci,
 				err,
 			)
 		}
 		return
 	}
 	defer sc.Close()
+	s.db.ConnectionResult(id, "authenticated")
 
-	/* Get a logger */
-	lg, ln, ld, lf, err := connectionLogger(sc, logDir)
+	/* Get a log file */
+	h, algs := hc.HASSH()
+	ln, ld, lf, err := connectionLog(
+		sc,
+		s.conf.LogDir,
+		s.paths,
+		id,
+		h,
+	)
 	if nil != err {
-		log.Printf(
-			"Address:%v Unable to cerate log: %v",
-			c.RemoteAddr(),
+		s.logf(
+			LEVELERROR,
+			SUBSYSGENERAL,
+			"%v Unable to cerate log: %v",
+			ci,
 			err,
 		)
 		return
 	}
 	defer lf.Close()
-	log.Printf("Address:%v Log:%q", c.RemoteAddr(), ln)
+	lg := s.newLogger(lf, id, SUBSYSGENERAL, LEVELINFO)
+	defer setSessionActive(ld, false)
+	s.logf(LEVELINFO, SUBSYSGENERAL, "%v Log:%q", ci, ln)
 	lg.Printf("Start of log")
 
-	/* Connect to the real server */
-	client, cchans, creqs, err := clientDial(saddr, cconfig)
+	/* Summarize the session when it's done */
+	sess = newSession(s, sc, id, pc.takeAttempts())
+	defer func() {
+		if err := sess.Write(ld); nil != err {
+			s.logf(
+				LEVELERROR,
+				SUBSYSGENERAL,
+				"%v Unable to write summary: %v",
+				ci,
+				err,
+			)
+		}
+	}()
+
+	/* Fingerprint the client and tell someone it's here */
+	sess.setHASSH(h, algs)
+	sess.setGeo(gi)
+	sess.storeStart()
+	lg.Printf("HASSH:%v Algorithms:%q", h, algs)
+	if nil != gi {
+		lg.Printf("Location %v", gi)
+	}
+	s.alerts.Send(sess.event(EVENTLOGIN, nil))
+	if s.alerts.NewHASSH(h) {
+		s.alerts.Send(sess.event(EVENTHASSH, nil))
+	}
+	defer s.alerts.Watch(sess)()
+
+	/* Let the operator keep an eye on things */
+	live := s.live.goLive(sess, sc, lg)
+	defer live.Done()
+
+	/* Don't let the attacker hog the server */
+	gov := newGovernor(s.lim, sc, lg, sess)
+	defer gov.Done()
+
+	/* Note the attempts which got us here */
+	alg := s.newLogger(lf, id, SUBSYSAUTH, LEVELINFO)
+	for _, a := range sess.AuthAttempts {
+		alg.Printf(
+			"Authorization Attempt Time:%v Version:%q User:%q "+
+				"%v Successful:%v",
+			a.Time.Format(time.RFC3339Nano),
+			sess.ClientVersion,
+			a.User,
+			a.logCredential(),
+			a.Successful,
+		)
+	}
+
+	/* Some connections never see the real server */
+	ulg := s.newLogger(lf, id, SUBSYSUPSTREAM, LEVELINFO)
+	rlg := s.newLogger(lf, id, SUBSYSREQUEST, LEVELDEBUG)
+	if s.fb.Routes(sc) {
+		s.logf(
+			LEVELINFO,
+			SUBSYSUPSTREAM,
+			"%v Using fallback shell",
+			ci,
+		)
+		ulg.Printf("Using fallback shell")
+		s.fb.Serve(sc, achans, areqs, ld, lg, rlg, sess, live, gov)
+		s.logf(LEVELINFO, SUBSYSGENERAL, "%v Finished", ci)
+		return
+	}
+
+	/* Connect to the real server, or fake it if we can't */
+	saddr := s.conf.UpstreamAddr
+	client, cchans, creqs, err := clientDial(saddr, s.cconfig)
 	if nil != err {
-		log.Printf("Unable to connect to %v: %v", saddr, err)
+		s.logf(
+			LEVELWARN,
+			SUBSYSUPSTREAM,
+			"%v Unable to connect to %v: %v",
+			ci,
+			saddr,
+			err,
+		)
+		ulg.Printf(
+			"Unable to connect to upstream server %v: %v",
+			saddr,
+			err,
+		)
+		ulg.Printf("Using fallback shell")
+		s.fb.Serve(sc, achans, areqs, ld, lg, rlg, sess, live, gov)
+		s.logf(LEVELINFO, SUBSYSGENERAL, "%v Finished", ci)
 		return
 	}
 	defer client.Close()
-	lg.Printf("Connected to upstream server %v@%v", cconfig.User, saddr)
+	ulg.Printf("Connected to upstream server %v@%v", s.cconfig.User, saddr)
+	sess.setUpstream(s.cconfig.User + "@" + saddr)
 
-	/* Handle requests and channels */
-	go handleReqs(areqs, client, lg, "attacker->server")
-	go handleReqs(creqs, sc, lg, "server->attacker")
-	go handleChans(achans, client, ld, lg, "attacker->server")
-	go handleChans(cchans, sc, ld, lg, "server->attacker")
+	/* Handle requests and channels, keeping each side's in order */
+	go handleChans(
+		achans,
+		areqs,
+		interceptRequests(client, s.icpt, id, nil, TAGTOSERVER, rlg),
+		sess.requestHook(nil, TAGTOSERVER),
+		client,
+		ld,
+		lg,
+		rlg,
+		sess,
+		live,
+		gov,
+		s.rules,
+		s.icpt,
+		TAGTOSERVER,
+	)
+	go handleChans(
+		cchans,
+		creqs,
+		interceptRequests(sc, s.icpt, id, nil, TAGTOATTACKER, rlg),
+		sess.requestHook(nil, TAGTOATTACKER),
+		sc,
+		ld,
+		lg,
+		rlg,
+		sess,
+		live,
+		gov,
+		s.rules,
+		s.icpt,
+		TAGTOATTACKER,
+	)
 
 	/* Wait for SSH session to end */
 	wc := make(chan struct{}, 2)
 	go waitChan(sc, wc)
 	go waitChan(client, wc)
 	<-wc
-	log.Printf("Address:%v Finished", c.RemoteAddr())
+	s.logf(LEVELINFO, SUBSYSGENERAL, "%v Finished", ci)
 
+	/* Once one side's gone, the other's no use.  Closing both lets the
+	channels finish up before the summary's written. */
+	client.Close()
+	sc.Close()
 }
 
-/* connectionLogger opens a log file for the authenticated connection in the
-given logDir.  It returns the logger itself, as well as the name of the
-logfile and the session directory.  Should look like
+/* connectionLog opens a log file for the authenticated connection with the
+given ID and client HASSH in the given logDir.  It returns the name of the
+logfile and the session directory as well as the file itself.  Where the
+session directory goes is set by paths, and by default should look like
 	logdir/address/sessiontime/log
 The returned *os.File must be closed when it's no longer needed to prevent
-memory/fd leakage.
+memory/fd leakage.  The session directory is marked active, as for
+setSessionActive, and should be marked inactive when the session's over.
 */
-func connectionLogger(
+func connectionLog(
 	sc *ssh.ServerConn,
 	logDir string,
-) (lg *log.Logger, name, dir string, file *os.File, err error) {
-	/* Each host gets its own directory */
-	addrDir, _, err := net.SplitHostPort(sc.RemoteAddr().String())
+	paths pathTemplate,
+	id string,
+	hassh string,
+) (name, dir string, file *os.File, err error) {
+	/* Each authenticated session gets its own directory */
+	sessionDir, err := paths.sessionDir(logDir, newPathInfo(
+		time.Now(),
+		sc.RemoteAddr().String(),
+		sc.LocalAddr().String(),
+		sc.User(),
+		id,
+		hassh,
+	))
 	if nil != err {
-		log.Printf(
-			"Address:%v Unable to split host from port: %v",
-			sc.RemoteAddr().String(),
-			err,
-		)
-		addrDir = sc.RemoteAddr().String() + "err"
-	}
-
-	/* Each authenticated session does, as well */
-	sessionDir := filepath.Join(
-		logDir,
-		addrDir,
-		time.Now().Format(LOGFORMAT),
-	)
-	if err := os.MkdirAll(sessionDir, 0700); nil != err {
-		return nil, "", "", nil, err
+		return "", "", nil, err
 	}
 	/* Open the main logfile */
 	logName := filepath.Join(sessionDir, LOGNAME)
@@ -137,16 +301,16 @@ func connectionLogger(
 		0600,
 	)
 	if nil != err {
-		return nil, "", "", nil, err
+		setSessionActive(sessionDir, false)
+		return "", "", nil, err
 	}
+	return logName, sessionDir, lf, nil
+}
 
-	/* Logify it. */
-	return log.New(
-		//lf,
-		io.MultiWriter(lf, os.Stderr), /* DEBUG */
-		"",
-		log.LstdFlags|log.Lmicroseconds,
-	), logName, sessionDir, lf, nil
+/* logPrefix returns the prefix for lines in logs for the connection with the
+given ID. */
+func logPrefix(id string) string {
+	return "ID:" + id + " "
 }
 
 /* waitChan puts an empty struct in wc when c's Wait method returns. */
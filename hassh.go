@@ -0,0 +1,137 @@
+package sshhipot
+
+/*
+ * hassh.go
+ * Fingerprint clients by their key exchange algorithms
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	/* MAXHASSHBUF is the most we'll buffer looking for a KEXINIT */
+	MAXHASSHBUF = 64 * 1024
+	/* MSGKEXINIT is the SSH message number for SSH_MSG_KEXINIT */
+	MSGKEXINIT = 20
+)
+
+/* hasshConn is a net.Conn which works out the HASSH of the client's KEXINIT
+as the client's data is read.  See https://github.com/salesforce/hassh. */
+type hasshConn struct {
+	net.Conn
+	l     sync.Mutex
+	buf   []byte
+	done  bool
+	hassh string
+	algs  string
+}
+
+/* newHASSHConn wraps c to work out its HASSH */
+func newHASSHConn(c net.Conn) *hasshConn {
+	return &hasshConn{Conn: c}
+}
+
+/* Read implements io.Reader */
+func (h *hasshConn) Read(b []byte) (int, error) {
+	n, err := h.Conn.Read(b)
+	if 0 < n {
+		h.sniff(b[:n])
+	}
+	return n, err
+}
+
+/* HASSH returns the HASSH and the algorithms from which it was calculated, or
+empty strings if the client's KEXINIT hasn't been read. */
+func (h *hasshConn) HASSH() (string, string) {
+	h.l.Lock()
+	defer h.l.Unlock()
+	return h.hassh, h.algs
+}
+
+/* sniff looks for the KEXINIT in the client's data b */
+func (h *hasshConn) sniff(b []byte) {
+	h.l.Lock()
+	defer h.l.Unlock()
+	if h.done {
+		return
+	}
+	h.buf = append(h.buf, b...)
+	if MAXHASSHBUF < len(h.buf) {
+		h.done = true
+		h.buf = nil
+		return
+	}
+
+	/* Skip past the version line */
+	buf := h.buf
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if -1 == i {
+			return
+		}
+		l := buf[:i]
+		buf = buf[i+1:]
+		if bytes.HasPrefix(l, []byte("SSH-")) {
+			break
+		}
+	}
+
+	/* Get the first packet, which isn't encrypted */
+	if 5 > len(buf) {
+		return
+	}
+	plen := binary.BigEndian.Uint32(buf)
+	if MAXHASSHBUF < plen {
+		h.done = true
+		h.buf = nil
+		return
+	}
+	if uint32(len(buf)-4) < plen {
+		return
+	}
+	h.done = true
+	h.buf = nil
+	pad := uint32(buf[4])
+	if plen < pad+1 {
+		return
+	}
+	h.hassh, h.algs = kexinitHASSH(buf[5 : 4+plen-pad])
+}
+
+/* kexinitHASSH returns the HASSH of the KEXINIT message p, as well as the
+algorithms from which it was calculated.  If p isn't a KEXINIT, empty strings
+are returned. */
+func kexinitHASSH(p []byte) (string, string) {
+	/* Skip message number and cookie */
+	if 17 > len(p) || MSGKEXINIT != p[0] {
+		return "", ""
+	}
+	p = p[17:]
+	/* Grab the name lists we need */
+	var lists []string
+	for i := 0; i < 7; i++ {
+		s, ok := sshString(p)
+		if !ok {
+			return "", ""
+		}
+		p = p[4+len(s):]
+		lists = append(lists, s)
+	}
+	algs := strings.Join([]string{
+		lists[0], /* Key exchange */
+		lists[2], /* Client to server encryption */
+		lists[4], /* Client to server MAC */
+		lists[6], /* Client to server compression */
+	}, ";")
+	return fmt.Sprintf("%x", md5.Sum([]byte(algs))), algs
+}
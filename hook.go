@@ -0,0 +1,214 @@
+package sshhipot
+
+/*
+ * hook.go
+ * Let other code watch and meddle
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"io"
+	"log"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* ChannelInfo identifies a channel in callbacks.  ID is unique within the
+connection.  Direction is TAGTOSERVER for channels opened by the attacker and
+TAGTOATTACKER for channels opened by the server. */
+type ChannelInfo struct {
+	ID        int
+	Type      string
+	Data      []byte
+	Direction string
+}
+
+/* Observer is told what happens on each connection.  Every connection is
+identified by its ID, the same as in the logs.  Observer's methods are called
+synchronously from the goroutines proxying the connection, so they should
+return quickly.  Slices passed to Observer's methods must not be retained. */
+type Observer interface {
+	/* Connect is called when a client connects, before the SSH
+	handshake.  geo is nil unless the address was found in the GeoIP
+	database. */
+	Connect(id string, addr net.Addr, geo *GeoInfo)
+
+	/* Auth is called after every authentication attempt. */
+	Auth(id string, a AuthAttempt)
+
+	/* ChannelOpen is called when a channel is requested, before it's
+	proxied. */
+	ChannelOpen(id string, c ChannelInfo)
+
+	/* ChannelClose is called when a channel is finished, whether or not
+	it was opened. */
+	ChannelClose(id string, c ChannelInfo)
+
+	/* Request is called after a request is proxied.  c is nil for
+	connection-level (global) requests. */
+	Request(id string, c *ChannelInfo, r RequestSummary)
+
+	/* Data is called with each chunk of data proxied from one side of a
+	channel to the other, as it was read before any Interceptor changed
+	it.  direction is one of the TAG* constants. */
+	Data(id string, c ChannelInfo, direction string, b []byte)
+
+	/* Disconnect is called when the connection is finished.  s is a copy
+	of the session's summary, or nil if the client never authenticated.
+	The observer may keep s and call its Write method.  ChannelClose may
+	still be called for channels which were open when the connection
+	ended. */
+	Disconnect(id string, s *Session)
+}
+
+/* NopObserver is an Observer which does nothing.  It may be embedded in
+types which only need some of Observer's methods. */
+type NopObserver struct{}
+
+/* Connect implements Observer */
+func (NopObserver) Connect(string, net.Addr, *GeoInfo) {}
+
+/* Auth implements Observer */
+func (NopObserver) Auth(string, AuthAttempt) {}
+
+/* ChannelOpen implements Observer */
+func (NopObserver) ChannelOpen(string, ChannelInfo) {}
+
+/* ChannelClose implements Observer */
+func (NopObserver) ChannelClose(string, ChannelInfo) {}
+
+/* Request implements Observer */
+func (NopObserver) Request(string, *ChannelInfo, RequestSummary) {}
+
+/* Data implements Observer */
+func (NopObserver) Data(string, ChannelInfo, string, []byte) {}
+
+/* Disconnect implements Observer */
+func (NopObserver) Disconnect(string, *Session) {}
+
+/* Interceptor can stop or change what's proxied between the attacker and the
+upstream server.  It isn't consulted for connections handled by the fallback
+shell, which has no upstream to protect.  Like Observer's, its methods are
+called synchronously and should return quickly. */
+type Interceptor interface {
+	/* Request is called before a request is proxied.  It may change r's
+	Payload.  If Request returns false, the request is refused without
+	being proxied.  c is nil for connection-level (global) requests. */
+	Request(
+		id string,
+		c *ChannelInfo,
+		direction string,
+		r *ssh.Request,
+	) bool
+
+	/* Data is called with each chunk of data read from one side of a
+	channel.  It returns the data to send to the other side, which may be
+	b itself, or nothing to drop the chunk.  b must not be retained. */
+	Data(id string, c ChannelInfo, direction string, b []byte) []byte
+}
+
+/* channelInfo returns the ChannelInfo describing c. */
+func channelInfo(c *ChannelSummary) ChannelInfo {
+	return ChannelInfo{
+		ID:        c.ID,
+		Type:      c.Type,
+		Data:      []byte(c.Data),
+		Direction: c.Direction,
+	}
+}
+
+/* interceptRequests returns a Requestable which asks icpt about requests
+sent in the given direction on the channel c (or the connection, if c is nil)
+of the connection with the given ID before sending them on to rable.  Refused
+requests are logged to lg.  If icpt is nil, rable is returned. */
+func interceptRequests(
+	rable Requestable,
+	icpt Interceptor,
+	id string,
+	c *ChannelInfo,
+	direction string,
+	lg *log.Logger,
+) Requestable {
+	if nil == icpt {
+		return rable
+	}
+	return hookedRequestable{
+		rable:     rable,
+		icpt:      icpt,
+		id:        id,
+		c:         c,
+		direction: direction,
+		lg:        lg,
+	}
+}
+
+/* hookedRequestable is the Requestable returned by interceptRequests. */
+type hookedRequestable struct {
+	rable     Requestable
+	icpt      Interceptor
+	id        string
+	c         *ChannelInfo
+	direction string
+	lg        *log.Logger
+}
+
+/* SendRequest implements Requestable */
+func (h hookedRequestable) SendRequest(
+	name string,
+	wantReply bool,
+	payload []byte,
+) (bool, []byte, error) {
+	r := &ssh.Request{Type: name, WantReply: wantReply, Payload: payload}
+	if !h.icpt.Request(h.id, h.c, h.direction, r) {
+		h.lg.Printf("Interceptor Refused Request %s", requestLogLine(
+			r,
+			h.direction,
+		))
+		return false, nil, nil
+	}
+	return h.rable.SendRequest(r.Type, r.WantReply, r.Payload)
+}
+
+/* interceptData returns a writer which passes what's written to it through
+icpt before writing it to w.  Written data is assumed to be going in the given
+direction on the channel c of the connection with the given ID.  If icpt is
+nil, w is returned. */
+func interceptData(
+	w io.Writer,
+	icpt Interceptor,
+	id string,
+	c ChannelInfo,
+	direction string,
+) io.Writer {
+	if nil == icpt {
+		return w
+	}
+	return hookedWriter{
+		w: w,
+		f: func(b []byte) []byte {
+			return icpt.Data(id, c, direction, b)
+		},
+	}
+}
+
+/* hookedWriter is the writer returned by interceptData */
+type hookedWriter struct {
+	w io.Writer
+	f func([]byte) []byte
+}
+
+/* Write implements io.Writer.  It reports all of b as written, even if the
+interceptor changed it. */
+func (h hookedWriter) Write(b []byte) (int, error) {
+	o := h.f(b)
+	if 0 == len(o) {
+		return len(b), nil
+	}
+	if _, err := h.w.Write(o); nil != err {
+		return 0, err
+	}
+	return len(b), nil
+}
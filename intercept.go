@@ -0,0 +1,529 @@
+package sshhipot
+
+/*
+ * intercept.go
+ * Stop attackers doing anything too nasty to the upstream server
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* Actions a rule may take */
+const (
+	ACTIONPASS      = "pass"
+	ACTIONBLOCK     = "block"
+	ACTIONREPLACE   = "replace"
+	ACTIONRATELIMIT = "ratelimit"
+	ACTIONKILL      = "kill"
+)
+
+/* MUTETIMEOUT is the longest the attacker's output will be muted while a
+replaced command is echoed by the server. */
+const MUTETIMEOUT = 2 * time.Second
+
+/* A rules file has one rule per line, of the form
+
+	action regex [argument]
+
+Blank lines and lines starting with # are ignored.  The regex may not contain
+spaces; use \s instead.  Commands typed in shells and sent in exec requests
+are checked against each rule in order, and the first rule with a matching
+regex decides what happens to the command:
+
+	pass
+		Send the command to the server.
+	block [error]
+		Don't run the command, but print error (default: bash's
+		Permission denied) as if the command had failed.
+	replace command
+		Run command instead.
+	ratelimit n/duration [error]
+		Pass the first n matching commands in any period of duration
+		(e.g. 3/1m), and block the rest.  The count is kept per rule
+		and shared by every session.  Only the rate of commands is
+		limited; use Config's ChannelUpRate and friends to limit
+		bandwidth.
+	kill
+		Disconnect the attacker.
+
+Commands sent to the standard input of an exec'd shell (e.g. echo id | ssh
+host sh) are checked as well.  Typed commands edited with keys the LineEditor
+doesn't understand (e.g. Ctrl+Y or Ctrl+R) are blocked, as the shell might not
+run the command the rules see. */
+
+/* rule is a single interception rule */
+type rule struct {
+	l      sync.Mutex
+	text   string /* The line from the rules file */
+	action string
+	re     *regexp.Regexp
+	arg    string
+	limit  int           /* Commands allowed per period, for ratelimit */
+	period time.Duration /* Period for ratelimit */
+	hits   []time.Time   /* Recent commands, for ratelimit */
+}
+
+/* loadRules reads the rules from the file named fn.  If fn is the empty
+string, there are no rules. */
+func loadRules(fn string) ([]*rule, error) {
+	if "" == fn {
+		return nil, nil
+	}
+	f, err := os.Open(fn)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+	var (
+		rs []*rule
+		s  = bufio.NewScanner(f)
+		ln int
+	)
+	for s.Scan() {
+		ln++
+		l := strings.TrimSpace(s.Text())
+		if "" == l || strings.HasPrefix(l, "#") {
+			continue
+		}
+		r, err := parseRule(l)
+		if nil != err {
+			return nil, fmt.Errorf("line %v: %v", ln, err)
+		}
+		rs = append(rs, r)
+	}
+	return rs, s.Err()
+}
+
+/* parseRule parses a single line from a rules file */
+func parseRule(l string) (*rule, error) {
+	fs := strings.Fields(l)
+	if 2 > len(fs) {
+		return nil, fmt.Errorf("need an action and regex")
+	}
+	r := &rule{text: l, action: fs[0]}
+	var err error
+	if r.re, err = regexp.Compile(fs[1]); nil != err {
+		return nil, err
+	}
+	/* Argument's whatever's after the regex */
+	r.arg = strings.TrimSpace(
+		strings.TrimPrefix(strings.TrimSpace(l[len(fs[0]):]), fs[1]),
+	)
+	switch r.action {
+	case ACTIONPASS, ACTIONBLOCK, ACTIONKILL:
+	case ACTIONREPLACE:
+		if "" == r.arg {
+			return nil, fmt.Errorf("replace needs a command")
+		}
+	case ACTIONRATELIMIT:
+		if 3 > len(fs) {
+			return nil, fmt.Errorf("ratelimit needs a rate")
+		}
+		parts := strings.SplitN(fs[2], "/", 2)
+		if 2 != len(parts) {
+			return nil, fmt.Errorf("rate must be n/duration")
+		}
+		if r.limit, err = strconv.Atoi(parts[0]); nil != err {
+			return nil, err
+		}
+		if r.period, err = time.ParseDuration(parts[1]); nil != err {
+			return nil, err
+		}
+		r.arg = strings.TrimSpace(strings.TrimPrefix(r.arg, fs[2]))
+	default:
+		return nil, fmt.Errorf("unknown action %q", r.action)
+	}
+	return r, nil
+}
+
+/* decide works out what to do with cmd, which has matched the rule.  It
+returns the action (which is never ratelimit) and, for blocks and
+replacements, the command to run instead. */
+func (r *rule) decide(cmd string) (string, string) {
+	switch r.action {
+	case ACTIONBLOCK:
+		return ACTIONBLOCK, blockCommand(cmd, r.arg)
+	case ACTIONREPLACE:
+		return ACTIONREPLACE, r.arg
+	case ACTIONRATELIMIT:
+		r.l.Lock()
+		defer r.l.Unlock()
+		/* Forget about old commands */
+		now := time.Now()
+		for 0 != len(r.hits) && now.Sub(r.hits[0]) > r.period {
+			r.hits = r.hits[1:]
+		}
+		if len(r.hits) >= r.limit {
+			return ACTIONBLOCK, blockCommand(cmd, r.arg)
+		}
+		r.hits = append(r.hits, now)
+		return ACTIONPASS, ""
+	}
+	return r.action, ""
+}
+
+/* blockCommand returns a command which prints msg (or bash's Permission
+denied for cmd, if msg is empty) to stderr and fails.  It starts with a space
+to keep it out of bash's history. */
+func blockCommand(cmd, msg string) string {
+	if "" == msg {
+		w := strings.Fields(cmd)
+		if 0 == len(w) {
+			w = []string{cmd}
+		}
+		msg = fmt.Sprintf("-bash: %v: Permission denied", w[0])
+	}
+	return fmt.Sprintf(
+		" printf '%%s\\n' '%v' >&2; false",
+		strings.Replace(msg, "'", `'\''`, -1),
+	)
+}
+
+/* interceptor sits between the attacker and the server on a channel, and
+applies the rules to commands before they're sent to the server. */
+type interceptor struct {
+	l      sync.Mutex
+	rules  []*rule
+	le     *LineEditor /* Reconstructs typed commands */
+	w      io.Writer   /* To the server */
+	mute   *muteWriter /* To the attacker */
+	tty    bool        /* A pty was requested */
+	buf    []byte      /* Partial line, if not a tty */
+	onFire func(cmd string, r *rule, action string)
+	kill   func()
+	ready  chan struct{} /* Closed once input may be checked */
+	once   sync.Once
+}
+
+/* newInterceptor returns an interceptor which applies rules to commands
+reconstructed by le before writing them to w.  Output to the attacker should
+be written to the interceptor's Output.  onFire is called whenever a rule
+matches a command, and kill is called to disconnect the attacker. */
+func newInterceptor(
+	rules []*rule,
+	le *LineEditor,
+	w io.Writer,
+	toAttacker io.Writer,
+	onFire func(cmd string, r *rule, action string),
+	kill func(),
+) *interceptor {
+	return &interceptor{
+		rules:  rules,
+		le:     le,
+		w:      w,
+		mute:   &muteWriter{w: toAttacker},
+		onFire: onFire,
+		kill:   kill,
+		ready:  closedChan,
+	}
+}
+
+/* closedChan is a closed channel, for interceptors which needn't wait */
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+/* Hold makes the interceptor wait to handle input until Release is called.
+This keeps input sent before a shell or exec request's been handled from
+slipping past the rules.  It must be called before the interceptor is used,
+and is a no-op if there are no rules. */
+func (ic *interceptor) Hold() {
+	if 0 == len(ic.rules) {
+		return
+	}
+	ic.ready = make(chan struct{})
+}
+
+/* Release lets the interceptor handle input after a call to Hold.  It may be
+called more than once. */
+func (ic *interceptor) Release() {
+	ic.once.Do(func() {
+		if closedChan != ic.ready {
+			close(ic.ready)
+		}
+	})
+}
+
+/* SetTTY notes whether a pty was requested, and therefore whether the server
+echoes what's typed. */
+func (ic *interceptor) SetTTY(tty bool) {
+	ic.l.Lock()
+	defer ic.l.Unlock()
+	ic.tty = tty
+}
+
+/* Output returns the writer for output to the attacker */
+func (ic *interceptor) Output() io.Writer {
+	return ic.mute
+}
+
+/* unsureRule is reported as the rule which blocked a typed command edited
+with keys the LineEditor doesn't understand.  The shell might run something
+other than what the rules would check. */
+var unsureRule = &rule{
+	text:   "(edited with unrecognized keys)",
+	action: ACTIONBLOCK,
+}
+
+/* checkTyped is like check, but for a line reconstructed by the interceptor's
+LineEditor.  Lines which might not be what the shell sees are blocked. */
+func (ic *interceptor) checkTyped(line string) (string, string) {
+	if !ic.le.Unsure() {
+		return ic.check(line)
+	}
+	ic.onFire(line, unsureRule, ACTIONBLOCK)
+	return ACTIONBLOCK, blockCommand(line, "")
+}
+
+/* check finds the rule matching cmd, if any, and returns what to do */
+func (ic *interceptor) check(cmd string) (string, string) {
+	if "" == strings.TrimSpace(cmd) {
+		return ACTIONPASS, ""
+	}
+	for _, r := range ic.rules {
+		if !r.re.MatchString(cmd) {
+			continue
+		}
+		action, repl := r.decide(cmd)
+		ic.onFire(cmd, r, action)
+		return action, repl
+	}
+	return ACTIONPASS, ""
+}
+
+/* Write sends the attacker's keystrokes b to the server, holding the Enter
+at the end of each line until the line's been checked. */
+func (ic *interceptor) Write(b []byte) (int, error) {
+	<-ic.ready
+	ic.l.Lock()
+	defer ic.l.Unlock()
+	n := len(b)
+	for 0 != len(b) {
+		/* Find the end of the line */
+		i := bytes.IndexAny(b, "\r\n")
+		if -1 == i {
+			return n, ic.forward(b)
+		}
+		pre, enter := b[:i], b[i:i+1]
+		b = b[i+1:]
+		if err := ic.forward(pre); nil != err {
+			return n, err
+		}
+		line, enabled := ic.le.Line()
+		if !enabled || 0 == len(ic.rules) {
+			if err := ic.forward(enter); nil != err {
+				return n, err
+			}
+			continue
+		}
+
+		/* Work out what to do, and note the command */
+		action, repl := ic.checkTyped(line)
+		ic.le.Input(enter)
+		switch action {
+		case ACTIONKILL:
+			ic.kill()
+			return n, fmt.Errorf("killed by rule")
+		case ACTIONBLOCK, ACTIONREPLACE:
+			/* If the server's echoing, clear the line and hide the
+			replacement */
+			if ic.tty {
+				ic.mute.Mute()
+				repl = "\x05\x15" + repl
+			}
+			ic.buf = nil
+			if _, err := ic.w.Write(
+				append([]byte(repl), enter...),
+			); nil != err {
+				return n, err
+			}
+		default:
+			if !ic.tty {
+				pre = ic.buf
+				ic.buf = nil
+				if _, err := ic.w.Write(pre); nil != err {
+					return n, err
+				}
+			}
+			if _, err := ic.w.Write(enter); nil != err {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+/* Flush checks and sends the partial line held back because there's no tty,
+if any.  This is for when the attacker sends EOF without finishing the last
+line. */
+func (ic *interceptor) Flush() error {
+	<-ic.ready
+	ic.l.Lock()
+	defer ic.l.Unlock()
+	if 0 == len(ic.buf) {
+		return nil
+	}
+	line, _ := ic.le.Line()
+	b := ic.buf
+	ic.buf = nil
+	switch action, repl := ic.checkTyped(line); action {
+	case ACTIONKILL:
+		ic.kill()
+		return fmt.Errorf("killed by rule")
+	case ACTIONBLOCK, ACTIONREPLACE:
+		b = []byte(repl)
+	}
+	_, err := ic.w.Write(b)
+	return err
+}
+
+/* forward sends b, which doesn't contain an Enter, on to the server and the
+LineEditor.  If there's no tty, it's buffered until we know what to do with
+the line. */
+func (ic *interceptor) forward(b []byte) error {
+	if 0 == len(b) {
+		return nil
+	}
+	ic.le.Input(b)
+	_, enabled := ic.le.Line()
+	if !ic.tty && enabled && 0 != len(ic.rules) {
+		ic.buf = append(ic.buf, b...)
+		return nil
+	}
+	_, err := ic.w.Write(b)
+	return err
+}
+
+/* shellNames are the shells whose standard input is checked when they're
+exec'd */
+var shellNames = map[string]bool{
+	"sh":   true,
+	"ash":  true,
+	"bash": true,
+	"dash": true,
+	"ksh":  true,
+	"zsh":  true,
+}
+
+/* shellWrappers are commands which run the rest of their arguments */
+var shellWrappers = map[string]bool{
+	"busybox": true,
+	"env":     true,
+	"exec":    true,
+	"nohup":   true,
+	"sudo":    true,
+}
+
+/* execShell returns true if cmd, sent in an exec request, starts a shell
+which reads commands from its standard input, e.g. sh or sudo bash -s. */
+func execShell(cmd string) bool {
+	fs := strings.Fields(cmd)
+	/* Skip things like sudo and env FOO=bar */
+	for 0 != len(fs) && (shellWrappers[path.Base(fs[0])] ||
+		strings.Contains(fs[0], "=")) {
+		fs = fs[1:]
+	}
+	if 0 == len(fs) || !shellNames[path.Base(fs[0])] {
+		return false
+	}
+	/* sh -c and sh script don't read commands from stdin, but sh -s
+	does, whatever follows */
+	for _, f := range fs[1:] {
+		switch {
+		case "-s" == f:
+			return true
+		case strings.HasPrefix(f, "--"):
+		case strings.HasPrefix(f, "-") && !strings.Contains(f, "c"):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+/* Requests returns a Requestable which checks exec requests against the rules
+before passing them to rable. */
+func (ic *interceptor) Requests(rable Requestable) Requestable {
+	return interceptedRequestable{rable: rable, ic: ic}
+}
+
+/* interceptedRequestable checks exec requests before passing them on */
+type interceptedRequestable struct {
+	rable Requestable
+	ic    *interceptor
+}
+
+/* SendRequest implements Requestable */
+func (r interceptedRequestable) SendRequest(
+	name string,
+	wantReply bool,
+	payload []byte,
+) (bool, []byte, error) {
+	if "exec" != name {
+		return r.rable.SendRequest(name, wantReply, payload)
+	}
+	cmd, ok := sshString(payload)
+	if !ok {
+		return r.rable.SendRequest(name, wantReply, payload)
+	}
+	switch action, repl := r.ic.check(cmd); action {
+	case ACTIONKILL:
+		r.ic.kill()
+		return false, []byte{}, nil
+	case ACTIONBLOCK, ACTIONREPLACE:
+		payload = ssh.Marshal(struct{ Command string }{repl})
+	}
+	return r.rable.SendRequest(name, wantReply, payload)
+}
+
+/* muteWriter is a writer which can be told to drop everything up to the
+next newline, which is replaced with a carriage return and newline. */
+type muteWriter struct {
+	l     sync.Mutex
+	w     io.Writer
+	until time.Time /* Muted until this time, or the next newline */
+}
+
+/* Mute drops output until the next newline or MUTETIMEOUT */
+func (m *muteWriter) Mute() {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.until = time.Now().Add(MUTETIMEOUT)
+}
+
+/* Write implements io.Writer */
+func (m *muteWriter) Write(b []byte) (int, error) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	n := len(b)
+	if time.Now().Before(m.until) {
+		i := bytes.IndexByte(b, '\n')
+		if -1 == i {
+			return n, nil
+		}
+		m.until = time.Time{}
+		b = append([]byte("\r\n"), b[i+1:]...)
+	}
+	if _, err := m.w.Write(b); nil != err {
+		return 0, err
+	}
+	return n, nil
+}
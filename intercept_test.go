@@ -0,0 +1,281 @@
+package sshhipot
+
+/*
+ * intercept_test.go
+ * Tests for command interception
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* testInterceptor is an interceptor with a record of what it did */
+type testInterceptor struct {
+	*interceptor
+	server *bytes.Buffer /* What was sent to the server */
+	fired  []string      /* Commands and actions of rules which fired */
+	killed bool
+}
+
+/* newTestInterceptor returns an enabled interceptor with the given rules, one
+per line.  There's no tty. */
+func newTestInterceptor(t *testing.T, rules ...string) *testInterceptor {
+	var rs []*rule
+	for _, l := range rules {
+		r, err := parseRule(l)
+		if nil != err {
+			t.Fatalf("Unable to parse rule %q: %v", l, err)
+		}
+		rs = append(rs, r)
+	}
+	ti := &testInterceptor{server: new(bytes.Buffer)}
+	ti.interceptor = newInterceptor(
+		rs,
+		NewLineEditor(true, func(string) {}),
+		ti.server,
+		ioutil.Discard,
+		func(cmd string, r *rule, action string) {
+			ti.fired = append(ti.fired, cmd+" "+action)
+		},
+		func() { ti.killed = true },
+	)
+	return ti
+}
+
+/* send writes each line to the interceptor, with a newline */
+func (ti *testInterceptor) send(t *testing.T, lines ...string) {
+	for _, l := range lines {
+		if _, err := ti.Write([]byte(l + "\n")); nil != err {
+			t.Fatalf("Error sending %q: %v", l, err)
+		}
+	}
+}
+
+/* checkServer checks that the server got want, and forgets it */
+func (ti *testInterceptor) checkServer(t *testing.T, want string) {
+	t.Helper()
+	if got := ti.server.String(); want != got {
+		t.Errorf("Server got %q, want %q", got, want)
+	}
+	ti.server.Reset()
+}
+
+func TestInterceptorBlock(t *testing.T) {
+	ti := newTestInterceptor(
+		t,
+		`block ^rm\s`,
+		`block ^shred -bash: shred: Read-only file system`,
+	)
+	ti.send(t, "ls -l")
+	ti.checkServer(t, "ls -l\n")
+	ti.send(t, "rm -rf /")
+	ti.checkServer(t, blockCommand("rm -rf /", "")+"\n")
+	ti.send(t, "shred x")
+	ti.checkServer(
+		t,
+		blockCommand("", "-bash: shred: Read-only file system")+"\n",
+	)
+	if want := []string{
+		"rm -rf / " + ACTIONBLOCK,
+		"shred x " + ACTIONBLOCK,
+	}; strings.Join(want, ",") != strings.Join(ti.fired, ",") {
+		t.Errorf("Fired %q, want %q", ti.fired, want)
+	}
+}
+
+func TestInterceptorReplace(t *testing.T) {
+	ti := newTestInterceptor(t, `replace ^passwd\b echo 'no'`)
+	ti.send(t, "passwd root")
+	ti.checkServer(t, "echo 'no'\n")
+	ti.send(t, "passwdx")
+	ti.checkServer(t, "passwdx\n")
+}
+
+func TestInterceptorKill(t *testing.T) {
+	ti := newTestInterceptor(t, `kill ^reboot`)
+	if _, err := ti.Write([]byte("reboot\n")); nil == err {
+		t.Errorf("No error after kill")
+	}
+	if !ti.killed {
+		t.Errorf("Not killed")
+	}
+	ti.checkServer(t, "")
+}
+
+func TestInterceptorRatelimit(t *testing.T) {
+	ti := newTestInterceptor(t, `ratelimit ^wget\s 2/1m slow down`)
+	ti.send(t, "wget a", "wget b", "id", "wget c")
+	ti.checkServer(
+		t,
+		"wget a\nwget b\nid\n"+blockCommand("wget c", "slow down")+"\n",
+	)
+
+	/* Old commands are forgotten */
+	r := ti.rules[0]
+	r.hits[0] = r.hits[0].Add(-2 * time.Minute)
+	ti.send(t, "wget d", "wget e")
+	ti.checkServer(t, "wget d\n"+blockCommand("wget e", "slow down")+"\n")
+}
+
+func TestInterceptorFlush(t *testing.T) {
+	ti := newTestInterceptor(t, `block ^rm\s`)
+	if _, err := ti.Write([]byte("rm -rf /")); nil != err {
+		t.Fatalf("Write error: %v", err)
+	}
+	ti.checkServer(t, "")
+	if err := ti.Flush(); nil != err {
+		t.Fatalf("Flush error: %v", err)
+	}
+	ti.checkServer(t, blockCommand("rm -rf /", ""))
+}
+
+func TestInterceptorUnsure(t *testing.T) {
+	ti := newTestInterceptor(t, `block ^rm\s`)
+	for _, c := range []struct {
+		keys  string
+		fired string /* What the rules saw, and what happened */
+	}{
+		{"\x1b[200~rm -rf /\x1b[201~", "rm -rf /"}, /* Paste */
+		{"rm -rf /\x01\x0b\x19", ""},               /* Kill and yank */
+		{"\x12rm\x1b[C", "rm"},                     /* Reverse search */
+		{"echo \x1b.", "echo "},                    /* Last argument */
+		{"rm -rf /\x01\x0b\x03\x19", ""},           /* Abandoned */
+		{"mr\x14 -rf /", "mr -rf /"},               /* Transpose */
+	} {
+		ti.fired = nil
+		ti.send(t, c.keys)
+		ti.server.Reset()
+		if want := []string{
+			c.fired + " " + ACTIONBLOCK,
+		}; strings.Join(want, ",") != strings.Join(ti.fired, ",") {
+			t.Errorf(
+				"%q: fired %q, want %q",
+				c.keys,
+				ti.fired,
+				want,
+			)
+		}
+	}
+
+	/* Recalling an unsure line is unsure, too */
+	ti.fired = nil
+	ti.send(t, "\x10")
+	if 1 != len(ti.fired) || "mr -rf / "+ACTIONBLOCK != ti.fired[0] {
+		t.Errorf("Recalled unsure line fired %q", ti.fired)
+	}
+	ti.server.Reset()
+	ti.fired = nil
+	ti.send(t, "id")
+	ti.checkServer(t, "id\n")
+	if 0 != len(ti.fired) {
+		t.Errorf("Line after unsure lines fired %q", ti.fired)
+	}
+}
+
+func TestInterceptorHold(t *testing.T) {
+	ti := newTestInterceptor(t, `block ^rm\s`)
+	ti.Hold()
+	done := make(chan error, 1)
+	go func() {
+		_, err := ti.Write([]byte("rm x\n"))
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatalf("Input handled while held")
+	case <-time.After(10 * time.Millisecond):
+	}
+	ti.Release()
+	ti.Release()
+	if err := <-done; nil != err {
+		t.Fatalf("Write error: %v", err)
+	}
+	ti.checkServer(t, blockCommand("rm x", "")+"\n")
+}
+
+/* testRequestable records the last request sent to it */
+type testRequestable struct {
+	name    string
+	payload []byte
+}
+
+/* SendRequest implements Requestable */
+func (r *testRequestable) SendRequest(
+	name string,
+	wantReply bool,
+	payload []byte,
+) (bool, []byte, error) {
+	r.name = name
+	r.payload = payload
+	return true, nil, nil
+}
+
+func TestInterceptorRequests(t *testing.T) {
+	ti := newTestInterceptor(
+		t,
+		`block ^rm\s`,
+		`replace ^passwd echo no`,
+		`kill ^reboot`,
+	)
+	tr := new(testRequestable)
+	rable := ti.Requests(tr)
+	for _, c := range []struct {
+		cmd  string
+		want string /* Empty if the request shouldn't be sent */
+	}{
+		{"id", "id"},
+		{"rm -rf /", blockCommand("rm -rf /", "")},
+		{"passwd", "echo no"},
+		{"reboot", ""},
+	} {
+		*tr = testRequestable{}
+		ok, _, err := rable.SendRequest(
+			"exec",
+			true,
+			ssh.Marshal(struct{ Command string }{c.cmd}),
+		)
+		if nil != err {
+			t.Errorf("%q: error: %v", c.cmd, err)
+			continue
+		}
+		if "" == c.want {
+			if ok || "" != tr.name || !ti.killed {
+				t.Errorf("%q: not killed", c.cmd)
+			}
+			continue
+		}
+		if got, _ := sshString(tr.payload); c.want != got {
+			t.Errorf("%q: sent %q, want %q", c.cmd, got, c.want)
+		}
+	}
+}
+
+func TestExecShell(t *testing.T) {
+	for cmd, want := range map[string]bool{
+		"sh":                     true,
+		"/bin/bash":              true,
+		"bash -i":                true,
+		"sh -s foo bar":          true,
+		"sudo bash --login":      true,
+		"env FOO=bar busybox sh": true,
+		"sh -c id":               false,
+		"bash -ec id":            false,
+		"sh script.sh":           false,
+		"shred x":                false,
+		"sudo":                   false,
+		"":                       false,
+	} {
+		if got := execShell(cmd); want != got {
+			t.Errorf("%q: got %v, want %v", cmd, got, want)
+		}
+	}
+}
@@ -1,11 +1,11 @@
-package main
+package sshhipot
 
 /*
  * key.go
  * Get or make a key
  * By J. Stuart McMurray
  * Created 20160515
- * Last Modified 20160515
+ * Last Modified 20261018
  */
 
 import (
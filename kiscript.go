@@ -0,0 +1,161 @@
+package sshhipot
+
+/*
+ * kiscript.go
+ * Scripted keyboard-interactive challenges
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/* A keyboard-interactive script is a text file with one directive per line.
+Blank lines and lines starting with # are ignored.  The directives are
+
+	round
+		Start a new challenge.  The first challenge needn't start with a
+		round line.
+	name text
+		The challenge's name.
+	instruction text
+		The challenge's instruction.  More than one instruction line may
+		be given, which will be joined with newlines.
+	prompt check echo text
+		A prompt.  check is either password, in which case the answer
+		must be one of the allowed passwords, or any, in which case any
+		answer is allowed.  echo is either echo or noecho, and controls
+		whether the client shows what's typed.  Everything after the
+		single space following echo is the prompt, trailing spaces and
+		all.
+
+In all text, %u is replaced with the username, %h with the hostname, and %%
+with a %.  Challenges are sent in order until an answer isn't allowed. */
+
+/* kiPrompt is a single prompt in a keyboard-interactive challenge */
+type kiPrompt struct {
+	text  string
+	echo  bool
+	check bool /* Answer must be an allowed password */
+}
+
+/* kiRound is a single keyboard-interactive challenge */
+type kiRound struct {
+	name        string
+	instruction string
+	prompts     []kiPrompt
+}
+
+/* defaultKIScript asks for a password, like OpenSSH */
+var defaultKIScript = []kiRound{{prompts: []kiPrompt{{
+	text:  "%u@%h's password:",
+	check: true,
+}}}}
+
+/* loadKIScript reads a keyboard-interactive script from the file named fn.
+If fn is the empty string, defaultKIScript is returned. */
+func loadKIScript(fn string) ([]kiRound, error) {
+	if "" == fn {
+		return defaultKIScript, nil
+	}
+	f, err := os.Open(fn)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		rs  []kiRound
+		cur *kiRound
+		s   = bufio.NewScanner(f)
+		ln  int
+	)
+	for s.Scan() {
+		ln++
+		l := strings.TrimRight(s.Text(), "\r")
+		if "" == strings.TrimSpace(l) ||
+			strings.HasPrefix(strings.TrimSpace(l), "#") {
+			continue
+		}
+		parts := strings.SplitN(l, " ", 2)
+		kw, rest := parts[0], ""
+		if 2 == len(parts) {
+			rest = parts[1]
+		}
+		/* Directives before the first round line start a round */
+		if nil == cur || "round" == kw {
+			rs = append(rs, kiRound{})
+			cur = &rs[len(rs)-1]
+		}
+		switch kw {
+		case "round":
+		case "name":
+			cur.name = rest
+		case "instruction":
+			if "" != cur.instruction {
+				cur.instruction += "\n"
+			}
+			cur.instruction += rest
+		case "prompt":
+			p, err := parseKIPrompt(rest)
+			if nil != err {
+				return nil, fmt.Errorf("line %v: %v", ln, err)
+			}
+			cur.prompts = append(cur.prompts, p)
+		default:
+			return nil, fmt.Errorf(
+				"line %v: unknown directive %q",
+				ln,
+				kw,
+			)
+		}
+	}
+	if err := s.Err(); nil != err {
+		return nil, err
+	}
+	if 0 == len(rs) {
+		return nil, fmt.Errorf("no challenges")
+	}
+	return rs, nil
+}
+
+/* parseKIPrompt parses the part of a prompt line after the word prompt */
+func parseKIPrompt(s string) (kiPrompt, error) {
+	parts := strings.SplitN(s, " ", 3)
+	if 3 != len(parts) {
+		return kiPrompt{}, fmt.Errorf(
+			"prompt needs a check, echo, and text",
+		)
+	}
+	var p kiPrompt
+	switch parts[0] {
+	case "password":
+		p.check = true
+	case "any":
+	default:
+		return kiPrompt{}, fmt.Errorf("unknown check %q", parts[0])
+	}
+	switch parts[1] {
+	case "echo":
+		p.echo = true
+	case "noecho":
+	default:
+		return kiPrompt{}, fmt.Errorf("unknown echo %q", parts[1])
+	}
+	p.text = parts[2]
+	return p, nil
+}
+
+/* kiExpand replaces %u in s with user, %h with hostname, and %% with %. */
+func kiExpand(s, user, hostname string) string {
+	return strings.NewReplacer(
+		"%u", user,
+		"%h", hostname,
+		"%%", "%",
+	).Replace(s)
+}
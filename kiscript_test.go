@@ -0,0 +1,207 @@
+package sshhipot
+
+/*
+ * kiscript_test.go
+ * Tests for scripted keyboard-interactive challenges
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* testKIScript is a two-round script, a password and then a code */
+const testKIScript = `# Password, then a second factor
+
+name Login
+prompt password noecho Password:
+round
+name Two-factor
+instruction Welcome to %h, %u.
+instruction Check your phone, 100%% secure.
+prompt any echo Code:
+prompt any noecho PIN:
+`
+
+/* writeKIScript writes s to a file and returns the file's name */
+func writeKIScript(t *testing.T, s string) string {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "ki")
+	if err := ioutil.WriteFile(fn, []byte(s), 0600); nil != err {
+		t.Fatalf("Unable to write script: %v", err)
+	}
+	return fn
+}
+
+func TestLoadKIScript(t *testing.T) {
+	rs, err := loadKIScript(writeKIScript(t, testKIScript))
+	if nil != err {
+		t.Fatalf("Unable to load script: %v", err)
+	}
+	want := []kiRound{{
+		name: "Login",
+		prompts: []kiPrompt{
+			{text: "Password:", check: true},
+		},
+	}, {
+		name: "Two-factor",
+		instruction: "Welcome to %h, %u.\n" +
+			"Check your phone, 100%% secure.",
+		prompts: []kiPrompt{
+			{text: "Code:", echo: true},
+			{text: "PIN:"},
+		},
+	}}
+	if !reflect.DeepEqual(rs, want) {
+		t.Errorf("Got\n%+v\nwant\n%+v", rs, want)
+	}
+
+	/* No file, no script */
+	if rs, err := loadKIScript(""); nil != err ||
+		!reflect.DeepEqual(rs, defaultKIScript) {
+		t.Errorf("Default script %+v (%v)", rs, err)
+	}
+}
+
+func TestLoadKIScriptErrors(t *testing.T) {
+	for _, c := range []struct {
+		s   string
+		err string
+	}{
+		{"", "no challenges"},
+		{"# Just a comment\n\n", "no challenges"},
+		{"prompt password echo\n", "line 1: prompt needs"},
+		{"name x\nprompt maybe echo x\n", "line 2: unknown check"},
+		{"prompt any loud x\n", "line 1: unknown echo"},
+		{"\nquestion x\n", "line 2: unknown directive"},
+	} {
+		_, err := loadKIScript(writeKIScript(t, c.s))
+		if nil == err {
+			t.Errorf("%q: no error", c.s)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), c.err) {
+			t.Errorf("%q: error %q, want %q", c.s, err, c.err)
+		}
+	}
+}
+
+func TestKIExpand(t *testing.T) {
+	for in, want := range map[string]string{
+		"%u@%h's password:": "root@web01's password:",
+		"100%% sure":        "100% sure",
+		"%%u is %u":         "%u is root",
+		"%x%":               "%x%",
+	} {
+		if got := kiExpand(in, "root", "web01"); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
+
+/* testMeta is enough ssh.ConnMetadata to log an authentication attempt */
+type testMeta struct{ ssh.ConnMetadata }
+
+func (testMeta) User() string          { return "root" }
+func (testMeta) RemoteAddr() net.Addr  { return &net.TCPAddr{} }
+func (testMeta) ClientVersion() []byte { return []byte("SSH-2.0-Go") }
+
+/* authObserver records authentication attempts */
+type authObserver struct {
+	NopObserver
+	l        sync.Mutex
+	attempts []AuthAttempt
+}
+
+/* Auth implements Observer */
+func (o *authObserver) Auth(_ string, a AuthAttempt) {
+	o.l.Lock()
+	defer o.l.Unlock()
+	o.attempts = append(o.attempts, a)
+}
+
+func TestKIChallenges(t *testing.T) {
+	rs, err := loadKIScript(writeKIScript(t, testKIScript))
+	if nil != err {
+		t.Fatalf("Unable to load script: %v", err)
+	}
+	for _, c := range []struct {
+		password string
+		answers  int /* Number of answers to the second round */
+		rounds   []string
+		prompts  []string
+		ok       bool
+	}{{
+		password: "hunter2",
+		answers:  2,
+		rounds:   []string{"Login", "Two-factor"},
+		prompts:  []string{"Password:", "Code:", "PIN:"},
+		ok:       true,
+	}, {
+		password: "hunter3",
+		answers:  2,
+		rounds:   []string{"Login"},
+		prompts:  []string{"Password:"},
+	}, {
+		password: "hunter2",
+		answers:  1,
+		rounds:   []string{"Login", "Two-factor"},
+		prompts:  []string{"Password:", ""},
+	}} {
+		o := &authObserver{}
+		s := &Server{obs: o}
+		var rounds []string
+		_, err := s.keyboardInteractiveCallback(
+			map[string]struct{}{"hunter2": {}},
+			rs,
+			"web01",
+			0,
+			0,
+		)(testMeta{}, func(
+			name string,
+			instruction string,
+			qs []string,
+			es []bool,
+		) ([]string, error) {
+			rounds = append(rounds, name)
+			if "Login" == name {
+				return []string{c.password}, nil
+			}
+			if w := "Welcome to web01, root.\nCheck your " +
+				"phone, 100% secure."; w != instruction {
+				t.Errorf("Instruction %q", instruction)
+			}
+			if !reflect.DeepEqual(es, []bool{true, false}) {
+				t.Errorf("Echos %v", es)
+			}
+			return []string{"123456", "0000"}[:c.answers], nil
+		})
+		if c.ok != (nil == err) {
+			t.Errorf("%+v: error %v", c, err)
+		}
+		if !reflect.DeepEqual(rounds, c.rounds) {
+			t.Errorf("%+v: rounds %q", c, rounds)
+		}
+		var ps []string
+		for _, a := range o.attempts {
+			ps = append(ps, a.Prompt)
+			if "Keyboard" != a.Method || "root" != a.User {
+				t.Errorf("%+v: attempt %+v", c, a)
+			}
+		}
+		if fmt.Sprintf("%q", ps) != fmt.Sprintf("%q", c.prompts) {
+			t.Errorf("%+v: prompts %q", c, ps)
+		}
+	}
+}
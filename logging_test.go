@@ -0,0 +1,160 @@
+package sshhipot
+
+/*
+ * logging_test.go
+ * Tests for leveled logging
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevels(t *testing.T) {
+	for _, c := range []struct {
+		def  string
+		subs string
+		want logLevels
+		err  bool
+	}{{
+		want: logLevels{
+			SUBSYSAUTH:     LEVELINFO,
+			SUBSYSCHANNEL:  LEVELINFO,
+			SUBSYSREQUEST:  LEVELINFO,
+			SUBSYSUPSTREAM: LEVELINFO,
+			SUBSYSGENERAL:  LEVELINFO,
+		},
+	}, {
+		def:  "WARN",
+		subs: " auth=debug, channel=trace,",
+		want: logLevels{
+			SUBSYSAUTH:     LEVELDEBUG,
+			SUBSYSCHANNEL:  LEVELTRACE,
+			SUBSYSREQUEST:  LEVELWARN,
+			SUBSYSUPSTREAM: LEVELWARN,
+			SUBSYSGENERAL:  LEVELWARN,
+		},
+	}, {
+		def: "loud",
+		err: true,
+	}, {
+		subs: "auth",
+		err:  true,
+	}, {
+		subs: "kex=debug",
+		err:  true,
+	}, {
+		subs: "auth=chatty",
+		err:  true,
+	}} {
+		got, err := parseLogLevels(c.def, c.subs)
+		if c.err {
+			if nil == err {
+				t.Errorf("%q %q: no error", c.def, c.subs)
+			}
+			continue
+		}
+		if nil != err {
+			t.Errorf("%q %q: error: %v", c.def, c.subs, err)
+			continue
+		}
+		if len(c.want) != len(got) {
+			t.Errorf("%q %q: got %v", c.def, c.subs, got)
+		}
+		for s, l := range c.want {
+			if got[s] != l {
+				t.Errorf(
+					"%q %q: %v is %v, want %v",
+					c.def,
+					c.subs,
+					s,
+					got[s],
+					l,
+				)
+			}
+		}
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	ls, err := parseLogLevels("warn", "channel=debug")
+	if nil != err {
+		t.Fatalf("Unable to parse levels: %v", err)
+	}
+	var file, debug bytes.Buffer
+	s := &Server{debug: &lockedWriter{w: &debug}, levels: ls}
+	for _, c := range []struct {
+		sub string
+		lvl Level
+		msg string
+	}{
+		{SUBSYSCHANNEL, LEVELINFO, "mirrored info"},
+		{SUBSYSCHANNEL, LEVELDEBUG, "mirrored debug"},
+		{SUBSYSCHANNEL, LEVELTRACE, "unmirrored trace"},
+		{SUBSYSAUTH, LEVELWARN, "mirrored warn"},
+		{SUBSYSAUTH, LEVELINFO, "unmirrored info"},
+	} {
+		s.newLogger(&file, "x", c.sub, c.lvl).Printf("%v", c.msg)
+	}
+	/* The file gets everything, the debug log only what's enabled */
+	if n := strings.Count(file.String(), "ID:x "); 5 != n {
+		t.Errorf("File has %v lines, want 5:\n%s", n, file.String())
+	}
+	dls := strings.Split(strings.TrimSpace(debug.String()), "\n")
+	for _, l := range dls {
+		if !strings.Contains(l, "ID:x mirrored") {
+			t.Errorf("Unexpected mirrored line %q", l)
+		}
+	}
+	if 3 != len(dls) {
+		t.Errorf("Debug log has %v lines, want 3", len(dls))
+	}
+
+	/* Another Server's levels are its own */
+	other := &Server{debug: &lockedWriter{w: &debug}}
+	other.newLogger(&file, "x", SUBSYSCHANNEL, LEVELDEBUG).Printf("no")
+	if 3 != strings.Count(debug.String(), "\n") {
+		t.Errorf("Server used another Server's levels")
+	}
+
+	/* No debug log, no mirroring */
+	var ns *Server
+	ns.newLogger(&file, "x", SUBSYSCHANNEL, LEVELINFO).Printf("ok")
+	if 3 != strings.Count(debug.String(), "\n") {
+		t.Errorf("Logger without a Server mirrored a line")
+	}
+}
+
+func TestLogfLevels(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	ls, err := parseLogLevels("", "general=debug")
+	if nil != err {
+		t.Fatalf("Unable to parse levels: %v", err)
+	}
+
+	/* Components log with their own Server's levels, not anybody else's */
+	logf(ls, LEVELDEBUG, SUBSYSGENERAL, "shown")
+	logf(nil, LEVELDEBUG, SUBSYSGENERAL, "hidden")
+	logf(nil, LEVELINFO, SUBSYSGENERAL, "default")
+	(&Server{levels: ls}).logf(LEVELDEBUG, SUBSYSGENERAL, "server")
+	(&Server{}).logf(LEVELDEBUG, SUBSYSGENERAL, "other")
+	got := buf.String()
+	for _, s := range []string{"shown", "default", "server"} {
+		if !strings.Contains(got, s) {
+			t.Errorf("Missing %q in log:\n%s", s, got)
+		}
+	}
+	for _, s := range []string{"hidden", "other"} {
+		if strings.Contains(got, s) {
+			t.Errorf("Unexpected %q in log:\n%s", s, got)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package sshhipot
+
+/*
+ * order.go
+ * Keep channels and requests in order
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import "golang.org/x/crypto/ssh"
+
+/* sequence passes channel opens from chans to open and global requests from
+reqs to request, in the order in which they were sent.  Both should come from
+the same side of a connection.  open should return once the channel's been
+opened (or not) on the other side, so that a request sent after a channel open
+isn't proxied before the open's finished.  open and request are called from
+sequence's goroutine.  sequence returns when chans and reqs are both closed.
+
+The ssh library reads messages one at a time and queues each one before
+reading the next, so any channel open sent before a request will already be
+waiting in chans by the time the request's in reqs.  Waiting channel opens are
+therefore always handled before requests. */
+func sequence(
+	chans <-chan ssh.NewChannel,
+	reqs <-chan *ssh.Request,
+	open func(nc ssh.NewChannel),
+	request func(r *ssh.Request),
+) {
+	for nil != chans || nil != reqs {
+		/* Channels first, if there's any waiting */
+		select {
+		case nc, ok := <-chans:
+			if !ok {
+				chans = nil
+				continue
+			}
+			open(nc)
+			continue
+		default:
+		}
+
+		/* Nope, wait for whatever's next */
+		select {
+		case nc, ok := <-chans:
+			if !ok {
+				chans = nil
+				continue
+			}
+			open(nc)
+		case r, ok := <-reqs:
+			if !ok {
+				reqs = nil
+				continue
+			}
+			request(r)
+		}
+	}
+}
@@ -5,7 +5,7 @@ package main
  * Handle MitMing channels
  * By J. Stuart McMurray
  * Created 20160122
- * Last Modified 20160122
+ * Last Modified 20261018
  */
 
 import (
@@ -17,21 +17,62 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-/* handleNewChannels handles proxying channel requests read from chans to the
-SSH connection sc.  info is used for logging. */
+/* handleNewChannels handles proxying channel requests read from chans and
+global requests read from reqs to the SSH connection sc, in the order in which
+they were sent.  A channel request which is waiting when a global request
+arrives was sent first, so it's opened on sc before the global request is sent.
+chanInfo and reqInfo are used for logging. */
 func handleNewChannels(
 	chans <-chan ssh.NewChannel,
+	reqs <-chan *ssh.Request,
 	sc ssh.Conn,
-	info string,
+	chanInfo string,
+	reqInfo string,
 ) {
-	for cr := range chans {
-		go handleNewChannel(cr, sc, info)
+	/* open opens a channel and waits for sc to say yes or no */
+	open := func(cr ssh.NewChannel) {
+		opened := make(chan struct{})
+		go handleNewChannel(cr, sc, chanInfo, opened)
+		<-opened
+	}
+	for nil != chans || nil != reqs {
+		/* Channels first, if there's any waiting */
+		select {
+		case cr, ok := <-chans:
+			if !ok {
+				chans = nil
+				continue
+			}
+			open(cr)
+			continue
+		default:
+		}
+		/* Whatever comes next */
+		select {
+		case cr, ok := <-chans:
+			if !ok {
+				chans = nil
+				continue
+			}
+			open(cr)
+		case r, ok := <-reqs:
+			if !ok {
+				reqs = nil
+				continue
+			}
+			handleConnRequest(r, sc, reqInfo)
+		}
 	}
 }
 
 /* handleChannel proxies a channel request command or shell to the ssh
-connection sc. */
-func handleNewChannel(cr ssh.NewChannel, sc ssh.Conn, info string) {
+connection sc.  opened is closed when sc has opened the channel, or not. */
+func handleNewChannel(
+	cr ssh.NewChannel,
+	sc ssh.Conn,
+	info string,
+	opened chan<- struct{},
+) {
 	log.Printf(
 		"%v Type:%q Data:%q NewChannel",
 		info,
@@ -41,6 +82,7 @@ func handleNewChannel(cr ssh.NewChannel, sc ssh.Conn, info string) {
 
 	/* Make the same request to the other side */
 	och, oreqs, err := sc.OpenChannel(cr.ChannelType(), cr.ExtraData())
+	close(opened)
 	if nil != err {
 		/* If we can't log it, and reject the client */
 		oe, ok := err.(*ssh.OpenChannelError)
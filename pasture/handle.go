@@ -5,7 +5,7 @@ package main
  * Handle incoming clients
  * By J. Stuart McMurray
  * Created 20160122
- * Last Modified 20160122
+ * Last Modified 20261018
  */
 
 import (
@@ -48,12 +48,20 @@ func handle(c net.Conn, conf *ssh.ServerConfig) {
 	info := ci(cc)
 
 	/* Spawn handlers for channels and requests */
-	go handleNewChannels(vchans, cc, info+" ChanDirection:Victim->Client")
-	go handleNewChannels(cchans, vc, info+" ChanDirection:Client->Victim")
-	go handleConnRequests(vreqs, cc, info+" ReqDirection:Victim->Client")
-	go handleConnRequests(creqs, vc, info+" ReqDirection:Client->Victim")
-	_ = vreqs
-	_ = creqs
+	go handleNewChannels(
+		vchans,
+		vreqs,
+		cc,
+		info+" ChanDirection:Victim->Client",
+		info+" ReqDirection:Victim->Client",
+	)
+	go handleNewChannels(
+		cchans,
+		creqs,
+		vc,
+		info+" ChanDirection:Client->Victim",
+		info+" ReqDirection:Client->Victim",
+	)
 
 	/* Wait until the connection's shut down */
 	err = cc.Wait()
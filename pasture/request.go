@@ -5,33 +5,24 @@ package main
  * Handles allowed requests
  * By J. Stuart McMurray
  * Created 20160122
- * Last Modified 20160122
+ * Last Modified 20261018
  */
 
 import (
 	"log"
-	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
-/* Sleep a bit before these requests to "avoid" race conditions.  Lousy, but
-it should work.  Pull request, anybody? */
-var delayedReqs = map[string]time.Duration{
-	/* Workaround for requests getting there faster than channels */
-	"no-more-sessions@openssh.com": 10 * time.Second,
-	"shell": 3 * time.Second,
-}
-
 /* handleChannelRequests handles proxying requests read from reqs to the SSH
-channel c.  info is used for logging. */
+channel c, in order.  info is used for logging. */
 func handleChannelRequests(
 	reqs <-chan *ssh.Request,
 	c ssh.Channel,
 	info string,
 ) {
 	for r := range reqs {
-		go handleRequest(
+		handleRequest(
 			r,
 			func( /* Ugh, a closure */
 				name string,
@@ -47,27 +38,21 @@ func handleChannelRequests(
 	}
 }
 
-/* handleConnRequests handles proxying requests read from reqs to the SSH
-connection sc.  info is used for logging */
-func handleConnRequests(
-	reqs <-chan *ssh.Request,
-	c ssh.Conn,
-	info string,
-) {
-	for r := range reqs {
-		go handleRequest(
-			r,
-			func(
-				name string,
-				wantReply bool,
-				payload []byte,
-			) (bool, []byte, error) {
-				return c.SendRequest(name, wantReply, payload)
-			},
-			func() error { return c.Close() },
-			info,
-		)
-	}
+/* handleConnRequest handles proxying a request r to the SSH connection c.
+info is used for logging */
+func handleConnRequest(r *ssh.Request, c ssh.Conn, info string) {
+	handleRequest(
+		r,
+		func(
+			name string,
+			wantReply bool,
+			payload []byte,
+		) (bool, []byte, error) {
+			return c.SendRequest(name, wantReply, payload)
+		},
+		func() error { return c.Close() },
+		info,
+	)
 }
 
 /* handleRequest handles proxying a request r via sr, which should be a closure
@@ -83,16 +68,6 @@ func handleRequest(
 	) (bool, []byte, error),
 	cl func() error,
 	info string) {
-	/* If this is the wrong sort of request, respond no */
-	if s, ok := delayedReqs[r.Type]; ok {
-		log.Printf(
-			"%v Type:%v Delay:%v",
-			info,
-			r.Type,
-			s,
-		)
-		time.Sleep(s)
-	}
 	logRequest(r, info)
 	/* Ask the other side */
 	ok, data, err := sr(r.Type, r.WantReply, r.Payload)
@@ -0,0 +1,414 @@
+package sshhipot
+
+/*
+ * pathtemplate.go
+ * Work out where sessions' logs go
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	/* DEFAULTPATHTEMPLATE is the path template used if none is given.
+	It puts each session in a directory named after its start time in a
+	directory named after the attacker's address. */
+	DEFAULTPATHTEMPLATE = "{ip}/{time}"
+	/* MAXPATHFIELD is the longest a field in a path template may
+	expand to */
+	MAXPATHFIELD = 64
+	/* UNKNOWNPATHFIELD replaces empty fields in path templates */
+	UNKNOWNPATHFIELD = "unknown"
+)
+
+/* pathFields are the fields which may be used in a path template, and how to
+get them from a session. */
+var pathFields = map[string]func(pathInfo) string{
+	"date": func(i pathInfo) string {
+		return i.Time.Format("2006-01-02")
+	},
+	"year":  func(i pathInfo) string { return i.Time.Format("2006") },
+	"month": func(i pathInfo) string { return i.Time.Format("01") },
+	"day":   func(i pathInfo) string { return i.Time.Format("02") },
+	"time": func(i pathInfo) string {
+		return i.Time.Format(LOGFORMAT)
+	},
+	"ip":         func(i pathInfo) string { return i.IP },
+	"port":       func(i pathInfo) string { return i.Port },
+	"listener":   func(i pathInfo) string { return i.Listener },
+	"user":       func(i pathInfo) string { return i.User },
+	"session_id": func(i pathInfo) string { return i.SessionID },
+	"hassh":      func(i pathInfo) string { return i.HASSH },
+}
+
+/* pathInfo is what's known about a session when its directory is made */
+type pathInfo struct {
+	Time      time.Time /* Session start, in local time */
+	IP        string
+	Port      string
+	Listener  string /* Address on which the connection was accepted */
+	User      string
+	SessionID string
+	HASSH     string
+}
+
+/* newPathInfo returns a pathInfo for a session with the given start time,
+attacker and listener addresses, user, ID, and HASSH. */
+func newPathInfo(
+	start time.Time,
+	addr string,
+	listener string,
+	user string,
+	id string,
+	hassh string,
+) pathInfo {
+	i := pathInfo{
+		Time:      start.Local(),
+		Listener:  listener,
+		User:      user,
+		SessionID: id,
+		HASSH:     hassh,
+	}
+	var err error
+	if i.IP, i.Port, err = net.SplitHostPort(addr); nil != err {
+		i.IP = addr
+	}
+	return i
+}
+
+/* pathTemplate turns a pathInfo into a relative path.  It alternates between
+literal text and field names, starting with literal text. */
+type pathTemplate []string
+
+/* parsePathTemplate parses a path template, which is a slash-separated
+relative path containing fields in braces, like {ip}.  The empty string means
+DEFAULTPATHTEMPLATE.  The template must contain {time} or {session_id}, so
+sessions don't end up in the same directory. */
+func parsePathTemplate(s string) (pathTemplate, error) {
+	if "" == s {
+		s = DEFAULTPATHTEMPLATE
+	}
+	if strings.HasPrefix(s, "/") || filepath.IsAbs(s) {
+		return nil, fmt.Errorf("path template must be relative")
+	}
+	var (
+		t      pathTemplate
+		unique bool
+		rest   = s
+	)
+	for {
+		start := strings.IndexAny(rest, "{}")
+		if -1 == start {
+			t = append(t, rest)
+			break
+		}
+		if '}' == rest[start] {
+			return nil, fmt.Errorf("unexpected } in %q", s)
+		}
+		end := strings.IndexAny(rest[start+1:], "{}")
+		if -1 == end || '{' == rest[start+1+end] {
+			return nil, fmt.Errorf("unterminated { in %q", s)
+		}
+		end += start + 1
+		f := rest[start+1 : end]
+		if _, ok := pathFields[f]; !ok {
+			return nil, fmt.Errorf("unknown field {%v}", f)
+		}
+		if "time" == f || "session_id" == f {
+			unique = true
+		}
+		t = append(t, rest[:start], f)
+		rest = rest[end+1:]
+	}
+	if !unique {
+		return nil, fmt.Errorf(
+			"path template must contain {time} or {session_id}",
+		)
+	}
+	return t, nil
+}
+
+/* Expand returns the relative path for the session described by i.  Fields
+are sanitized so they can't add directories or climb out of the log
+directory, and are no longer than MAXPATHFIELD.  A nil pathTemplate expands
+as DEFAULTPATHTEMPLATE. */
+func (t pathTemplate) Expand(i pathInfo) string {
+	if nil == t {
+		t, _ = parsePathTemplate(DEFAULTPATHTEMPLATE)
+	}
+	var sb strings.Builder
+	for n, s := range t {
+		if 0 == n%2 {
+			sb.WriteString(s)
+			continue
+		}
+		sb.WriteString(sanitizePathField(pathFields[s](i)))
+	}
+
+	/* Make sure every directory is a real, safe name */
+	ps := strings.Split(sb.String(), "/")
+	for n, p := range ps {
+		switch p {
+		case "", ".", "..":
+			ps[n] = "_"
+		}
+	}
+	/* Leave the artifacts alone */
+	if ARTIFACTDIR == ps[0] {
+		ps[0] = "_" + ps[0]
+	}
+	return filepath.Join(ps...)
+}
+
+/* sanitizePathField makes f safe to use as part of a directory name.  Bytes
+other than letters, numbers, and a few punctuation characters are replaced
+with underscores, so IPv6 addresses become things like 2001_db8__1. */
+func sanitizePathField(f string) string {
+	if "" == f {
+		return UNKNOWNPATHFIELD
+	}
+	b := []byte(f)
+	if MAXPATHFIELD < len(b) {
+		b = b[:MAXPATHFIELD]
+	}
+	for i, c := range b {
+		switch {
+		case 'a' <= c && 'z' >= c,
+			'A' <= c && 'Z' >= c,
+			'0' <= c && '9' >= c,
+			-1 != strings.IndexByte("-_.+=@,", c):
+		default:
+			b[i] = '_'
+		}
+	}
+	/* Don't make hidden files or things which look like options */
+	switch b[0] {
+	case '.', '-':
+		b[0] = '_'
+	}
+	return string(b)
+}
+
+/* sessionDir makes the directory for the session described by i in logDir,
+according to t.  If the directory already exists, an error is returned.  The
+directory is marked active before it's made, so the janitor leaves it alone;
+the caller should mark it inactive with setSessionActive when the session's
+finished. */
+func (t pathTemplate) sessionDir(logDir string, i pathInfo) (string, error) {
+	d := filepath.Join(logDir, t.Expand(i))
+	if !claimSession(d) {
+		return "", &os.PathError{Op: "mkdir", Path: d, Err: os.ErrExist}
+	}
+	var err error
+	/* The janitor may remove an empty parent between making it and
+	making d, in which case we try again. */
+	for n := 0; n < 3; n++ {
+		if err = os.MkdirAll(filepath.Dir(d), 0700); nil != err {
+			break
+		}
+		if err = os.Mkdir(d, 0700); !os.IsNotExist(err) {
+			break
+		}
+	}
+	if nil != err {
+		setSessionActive(d, false)
+		return "", err
+	}
+	return d, nil
+}
+
+/* MigrateLogDir moves the sessions in the per-connection log directory logDir
+to where they'd be if they'd been logged with the path template tmpl, as for
+Config.PathTemplate.  Sessions are found as for Config.Quota.  Sessions
+without summaries are assumed to be in the original layout, {ip}/{time}, and
+their IDs are taken from their logs.  Paths in summaries of uncompressed
+sessions are updated.  If dryRun is true, nothing is moved.  For each session
+which needs moving, f is called with the session's old and new paths and
+what went wrong moving it, if anything.  The honeypot shouldn't be running
+while sessions are being moved. */
+func MigrateLogDir(
+	logDir string,
+	tmpl string,
+	dryRun bool,
+	f func(from, to string, err error),
+) error {
+	t, err := parsePathTemplate(tmpl)
+	if nil != err {
+		return err
+	}
+	es, _, err := scanSessions(logDir)
+	if nil != err {
+		return err
+	}
+	for _, e := range es {
+		/* Work out where it should go */
+		i, err := sessionPathInfo(e)
+		if nil != err {
+			f(e.path, "", err)
+			continue
+		}
+		to := filepath.Join(logDir, t.Expand(i))
+		if e.compressed {
+			to += COMPRESSEDSUFFIX
+		}
+		if filepath.Clean(e.path) == to {
+			continue
+		}
+		if dryRun {
+			f(e.path, to, nil)
+			continue
+		}
+		f(e.path, to, moveSession(logDir, e, to))
+	}
+	return nil
+}
+
+/* sessionPathInfo gets what's needed to work out where the session e goes. */
+func sessionPathInfo(e sessionEntry) (pathInfo, error) {
+	/* Easy if we have a summary */
+	var (
+		b   []byte
+		err error
+	)
+	if e.compressed {
+		b, err = compressedSummary(e.path)
+	} else {
+		b, err = ioutil.ReadFile(filepath.Join(e.path, SUMMARYNAME))
+	}
+	if nil == err {
+		var s Session
+		if err := json.Unmarshal(b, &s); nil != err {
+			return pathInfo{}, fmt.Errorf(
+				"parsing summary: %v",
+				err,
+			)
+		}
+		return newPathInfo(
+			s.Start,
+			s.Address,
+			s.Listener,
+			s.User,
+			s.ID,
+			s.HASSH,
+		), nil
+	} else if !os.IsNotExist(err) {
+		return pathInfo{}, fmt.Errorf("reading summary: %v", err)
+	} else if e.compressed {
+		return pathInfo{}, fmt.Errorf("no summary")
+	}
+
+	/* If not, it's probably ip/time */
+	start, err := time.ParseInLocation(
+		LOGFORMAT,
+		filepath.Base(e.path),
+		time.Local,
+	)
+	if nil != err {
+		return pathInfo{}, fmt.Errorf(
+			"no summary and unable to get time from name: %v",
+			err,
+		)
+	}
+	i := newPathInfo(
+		start,
+		strings.TrimSuffix(filepath.Base(filepath.Dir(e.path)), "err"),
+		"",
+		"",
+		"",
+		"",
+	)
+
+	/* The log has the ID */
+	lf, err := os.Open(filepath.Join(e.path, LOGNAME))
+	if nil != err {
+		return pathInfo{}, err
+	}
+	defer lf.Close()
+	s := bufio.NewScanner(lf)
+	if !s.Scan() {
+		return i, nil
+	}
+	if n := bytes.Index(s.Bytes(), []byte("ID:")); -1 != n {
+		if fs := strings.Fields(string(s.Bytes()[n+3:])); 0 != len(fs) {
+			i.SessionID = fs[0]
+		}
+	}
+	return i, nil
+}
+
+/* moveSession moves the session e in logDir to to and updates its summary, if
+it has one. */
+func moveSession(logDir string, e sessionEntry, to string) error {
+	if _, err := os.Lstat(to); nil == err {
+		return fmt.Errorf("%v already exists", to)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0700); nil != err {
+		return err
+	}
+	if err := os.Rename(e.path, to); nil != err {
+		return err
+	}
+	removeEmptyParents(logDir, e.path)
+	if e.compressed {
+		return nil
+	}
+	if err := movedSummary(to); nil != err {
+		return fmt.Errorf("updating summary: %v", err)
+	}
+	return nil
+}
+
+/* movedSummary updates the paths to logs and transcripts in the summary in
+the session directory dir, which has been moved.  Anything we don't know
+about in the summary is left alone. */
+func movedSummary(dir string) error {
+	fn := filepath.Join(dir, SUMMARYNAME)
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil
+	} else if nil != err {
+		return err
+	}
+	var s map[string]interface{}
+	if err := json.Unmarshal(b, &s); nil != err {
+		return err
+	}
+	cs, _ := s["channels"].([]interface{})
+	for _, c := range cs {
+		c, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, k := range []string{"log", "transcript"} {
+			if p, ok := c[k].(string); ok && "" != p {
+				c[k] = filepath.Join(dir, filepath.Base(p))
+			}
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(s); nil != err {
+		return err
+	}
+	tfn := fn + ".tmp"
+	if err := ioutil.WriteFile(tfn, buf.Bytes(), 0600); nil != err {
+		return err
+	}
+	return os.Rename(tfn, fn)
+}
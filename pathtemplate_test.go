@@ -0,0 +1,222 @@
+package sshhipot
+
+/*
+ * pathtemplate_test.go
+ * Tests for session directory path templates
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPathTemplateExpand(t *testing.T) {
+	start := time.Date(2026, 10, 18, 1, 2, 3, 4, time.Local)
+	for _, c := range []struct {
+		tmpl string
+		addr string
+		user string
+		want string
+	}{{
+		tmpl: "",
+		addr: "192.0.2.1:1234",
+		want: "192.0.2.1/" + start.Format(LOGFORMAT),
+	}, {
+		tmpl: "{date}/{ip}_{port}/{session_id}",
+		addr: "[2001:db8::1%eth0]:22",
+		want: "2026-10-18/2001_db8__1_eth0_22/abc",
+	}, {
+		tmpl: "{year}/{month}/{day}/{user}/{session_id}",
+		addr: "192.0.2.1:1234",
+		user: "../../etc/passwd",
+		want: "2026/10/18/_._.._etc_passwd/abc",
+	}, {
+		tmpl: "{user}/{session_id}",
+		addr: "192.0.2.1:1234",
+		user: "..",
+		want: "_./abc",
+	}, {
+		tmpl: "{user}/{session_id}",
+		addr: "192.0.2.1:1234",
+		user: ARTIFACTDIR,
+		want: "_" + ARTIFACTDIR + "/abc",
+	}, {
+		tmpl: "{user}/{hassh}/{session_id}",
+		addr: "not an address",
+		user: strings.Repeat("x", 100),
+		want: strings.Repeat("x", MAXPATHFIELD) + "/" +
+			UNKNOWNPATHFIELD + "/abc",
+	}, {
+		tmpl: "x/{listener}//{ip}/{session_id}",
+		addr: "not an address",
+		want: "x/127.0.0.1_2222/_/not_an_address/abc",
+	}} {
+		pt, err := parsePathTemplate(c.tmpl)
+		if nil != err {
+			t.Errorf("Unable to parse %q: %v", c.tmpl, err)
+			continue
+		}
+		got := pt.Expand(newPathInfo(
+			start,
+			c.addr,
+			"127.0.0.1:2222",
+			c.user,
+			"abc",
+			"",
+		))
+		if filepath.FromSlash(c.want) != got {
+			t.Errorf(
+				"Template %q, address %q, user %q\n"+
+					" got: %v\nwant: %v",
+				c.tmpl,
+				c.addr,
+				c.user,
+				got,
+				c.want,
+			)
+		}
+	}
+}
+
+func TestParsePathTemplateErrors(t *testing.T) {
+	for _, tmpl := range []string{
+		"/abs/{time}",
+		"{ip}",
+		"{nope}/{time}",
+		"{time",
+		"{time}}",
+		"{ip{time}}",
+	} {
+		if _, err := parsePathTemplate(tmpl); nil == err {
+			t.Errorf("Parsed invalid template %q", tmpl)
+		}
+	}
+}
+
+func TestMigrateLogDir(t *testing.T) {
+	logDir := t.TempDir()
+	start := time.Date(2026, 10, 18, 1, 2, 3, 0, time.Local)
+	ts := start.Format(LOGFORMAT)
+
+	/* One session with a summary, one without */
+	mkSession := func(d, id string, summary bool) {
+		d = filepath.Join(logDir, d)
+		if err := os.MkdirAll(d, 0700); nil != err {
+			t.Fatalf("Unable to make %v: %v", d, err)
+		}
+		if err := ioutil.WriteFile(
+			filepath.Join(d, LOGNAME),
+			[]byte("2026/10/18 01:02:03.000000 ID:"+id+
+				" Start of log\n"),
+			0600,
+		); nil != err {
+			t.Fatalf("Unable to write log: %v", err)
+		}
+		if !summary {
+			return
+		}
+		b, err := json.Marshal(map[string]interface{}{
+			"id":      id,
+			"start":   start,
+			"address": "192.0.2.2:22",
+			"user":    "root",
+			"channels": []map[string]interface{}{{
+				"log":   filepath.Join(d, ts+"-session"),
+				"extra": "kept",
+			}},
+		})
+		if nil != err {
+			t.Fatalf("Unable to marshal summary: %v", err)
+		}
+		if err := ioutil.WriteFile(
+			filepath.Join(d, SUMMARYNAME),
+			b,
+			0600,
+		); nil != err {
+			t.Fatalf("Unable to write summary: %v", err)
+		}
+	}
+	mkSession(filepath.Join("192.0.2.1", ts), "aaa", false)
+	mkSession(filepath.Join("192.0.2.2", ts), "bbb", true)
+	os.MkdirAll(filepath.Join(logDir, ARTIFACTDIR), 0700)
+
+	/* A dry run shouldn't move anything */
+	n := 0
+	if err := MigrateLogDir(
+		logDir,
+		"{date}/{user}/{session_id}",
+		true,
+		func(from, to string, err error) { n++ },
+	); nil != err || 2 != n {
+		t.Fatalf("Dry run found %v sessions: %v", n, err)
+	}
+	if _, err := os.Stat(
+		filepath.Join(logDir, "192.0.2.1", ts, LOGNAME),
+	); nil != err {
+		t.Fatalf("Dry run moved session: %v", err)
+	}
+
+	/* A real one should */
+	if err := MigrateLogDir(
+		logDir,
+		"{date}/{user}/{session_id}",
+		false,
+		func(from, to string, err error) {
+			if nil != err {
+				t.Errorf("Moving %v: %v", from, err)
+			}
+		},
+	); nil != err {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	var got []string
+	filepath.Walk(logDir, func(p string, fi os.FileInfo, err error) error {
+		if nil == err && !fi.IsDir() {
+			r, _ := filepath.Rel(logDir, p)
+			got = append(got, filepath.ToSlash(r))
+		}
+		return nil
+	})
+	want := []string{
+		"2026-10-18/root/bbb/" + LOGNAME,
+		"2026-10-18/root/bbb/" + SUMMARYNAME,
+		"2026-10-18/" + UNKNOWNPATHFIELD + "/aaa/" + LOGNAME,
+	}
+	if strings.Join(want, "\n") != strings.Join(got, "\n") {
+		t.Errorf("After migration, got\n%v\nwant\n%v",
+			strings.Join(got, "\n"),
+			strings.Join(want, "\n"),
+		)
+	}
+	for _, d := range []string{"192.0.2.1", "192.0.2.2"} {
+		if _, err := os.Stat(filepath.Join(logDir, d)); nil == err {
+			t.Errorf("Old directory %v not removed", d)
+		}
+	}
+
+	/* Summary should point to the new place */
+	nd := filepath.Join(logDir, "2026-10-18", "root", "bbb")
+	b, err := ioutil.ReadFile(filepath.Join(nd, SUMMARYNAME))
+	if nil != err {
+		t.Fatalf("Unable to read moved summary: %v", err)
+	}
+	var s struct {
+		Channels []map[string]string `json:"channels"`
+	}
+	if err := json.Unmarshal(b, &s); nil != err {
+		t.Fatalf("Unable to parse moved summary: %v", err)
+	}
+	if 1 != len(s.Channels) ||
+		filepath.Join(nd, ts+"-session") != s.Channels[0]["log"] ||
+		"kept" != s.Channels[0]["extra"] {
+		t.Errorf("Moved summary channels %v", s.Channels)
+	}
+}
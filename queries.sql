@@ -0,0 +1,71 @@
+-- queries.sql
+-- Example queries for sshhipot's SQLite database (-db)
+-- Run with something like sqlite3 -header -column sshhipot.db < queries.sql
+
+-- Passwords tried most in the last week
+SELECT credential AS password, COUNT(*) AS tries
+FROM auth_attempts
+WHERE method = 'Password' AND time > datetime('now', '-7 days')
+GROUP BY credential
+ORDER BY tries DESC
+LIMIT 20;
+
+-- Usernames tried most in the last week
+SELECT user, COUNT(*) AS tries
+FROM auth_attempts
+WHERE time > datetime('now', '-7 days')
+GROUP BY user
+ORDER BY tries DESC
+LIMIT 20;
+
+-- Hosts which connected most, and how many of their connections got in
+SELECT
+        host,
+        COUNT(*) AS connections,
+        SUM(result = 'authenticated') AS authenticated
+FROM connections
+GROUP BY host
+ORDER BY connections DESC
+LIMIT 20;
+
+-- Commands run most
+SELECT command, COUNT(*) AS runs, COUNT(DISTINCT session) AS sessions
+FROM commands
+GROUP BY command
+ORDER BY runs DESC
+LIMIT 20;
+
+-- Client versions and HASSHes of authenticated clients
+SELECT client_version, hassh, COUNT(*) AS sessions
+FROM sessions
+GROUP BY client_version, hassh
+ORDER BY sessions DESC;
+
+-- Longest sessions, with their logs' directories
+SELECT s.id, s.address, s.user, s.duration, s.upstream, c.log
+FROM sessions AS s
+LEFT JOIN channels AS c ON c.session = s.id AND c.channel = 1
+ORDER BY s.duration DESC
+LIMIT 10;
+
+-- Files uploaded by attackers
+SELECT f.time, s.address, f.name, f.mode, f.size
+FROM files AS f
+JOIN sessions AS s ON s.id = f.session
+WHERE f.direction = 'upload'
+ORDER BY f.time DESC;
+
+-- Channel types requested, and how often they were rejected
+SELECT type, COUNT(*) AS opened, COUNT(rejected) AS rejected
+FROM channels
+GROUP BY type
+ORDER BY opened DESC;
+
+-- Networks connections come from, with -geo
+SELECT asn, org, country_code, COUNT(*) AS connections,
+	COUNT(DISTINCT host) AS hosts
+FROM connections
+WHERE asn IS NOT NULL
+GROUP BY asn
+ORDER BY connections DESC
+LIMIT 20;
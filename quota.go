@@ -0,0 +1,520 @@
+package sshhipot
+
+/*
+ * quota.go
+ * Keep logs from filling the disk
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	/* JANITORINTERVAL is how often the log directory is checked for old
+	sessions and the disk quota is enforced. */
+	JANITORINTERVAL = time.Minute
+	/* COMPRESSEDSUFFIX is appended to the names of compressed session
+	directories. */
+	COMPRESSEDSUFFIX = ".tar.gz"
+	/* TMPSUFFIX is appended to the names of compressed sessions while
+	they're being written. */
+	TMPSUFFIX = ".tmp"
+)
+
+/* logBudget limits the number of bytes of payload logged.  A logBudget may
+have a parent, in which case bytes are taken from both.  A nil *logBudget is
+unlimited. */
+type logBudget struct {
+	l      sync.Mutex
+	left   int64
+	limit  bool
+	parent *logBudget
+}
+
+/* newLogBudget returns a logBudget which allows n bytes to be logged, or any
+number of bytes if n is 0.  Bytes will also be taken from parent, which may be
+nil. */
+func newLogBudget(n int64, parent *logBudget) *logBudget {
+	return &logBudget{left: n, limit: 0 != n, parent: parent}
+}
+
+/* Take tries to take n bytes from the budget.  If there aren't n bytes left,
+Take returns false and the budget is exhausted. */
+func (b *logBudget) Take(n int) bool {
+	if nil == b {
+		return true
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.limit && b.left < int64(n) {
+		b.left = 0
+		return false
+	}
+	if !b.parent.Take(n) {
+		return false
+	}
+	if b.limit {
+		b.left -= int64(n)
+	}
+	return true
+}
+
+/* Session directories in use, which won't be removed or compressed */
+var (
+	activeSessions  = make(map[string]struct{})
+	activeSessionsL sync.Mutex
+)
+
+/* setSessionActive marks the session directory dir as in use (or not). */
+func setSessionActive(dir string, active bool) {
+	activeSessionsL.Lock()
+	defer activeSessionsL.Unlock()
+	dir = filepath.Clean(dir)
+	if active {
+		activeSessions[dir] = struct{}{}
+	} else {
+		delete(activeSessions, dir)
+	}
+}
+
+/* claimSession marks the session directory dir as in use and returns true,
+unless it's already in use, in which case claimSession returns false. */
+func claimSession(dir string) bool {
+	activeSessionsL.Lock()
+	defer activeSessionsL.Unlock()
+	dir = filepath.Clean(dir)
+	if _, ok := activeSessions[dir]; ok {
+		return false
+	}
+	activeSessions[dir] = struct{}{}
+	return true
+}
+
+/* sessionActive returns true if the session directory dir is in use. */
+func sessionActive(dir string) bool {
+	activeSessionsL.Lock()
+	defer activeSessionsL.Unlock()
+	_, ok := activeSessions[filepath.Clean(dir)]
+	return ok
+}
+
+/* sessionEntry is a session directory, or a compressed session directory, in
+the log directory. */
+type sessionEntry struct {
+	path       string
+	size       int64
+	mtime      time.Time /* Latest modification time */
+	compressed bool
+}
+
+/* janitor periodically removes sessions older than retention from logDir and
+removes (or compresses if compress is true) the oldest finished sessions while
+logDir is larger than quota bytes.  Before that, the least-recently-seen
+artifacts in art are removed while it's larger than artQuota bytes.  A
+retention, quota, or artQuota of 0 disables that check.  What's removed is
+logged at the verbosity set by levels.  janitor does not return. */
+func janitor(
+	logDir string,
+	quota int64,
+	retention time.Duration,
+	compress bool,
+	art *artifactStore,
+	artQuota int64,
+	levels logLevels,
+) {
+	for {
+		if err := cleanLogs(
+			logDir,
+			quota,
+			retention,
+			compress,
+			art,
+			artQuota,
+			levels,
+		); nil != err {
+			logf(
+				levels,
+				LEVELERROR,
+				SUBSYSGENERAL,
+				"Unable to clean log directory: %v",
+				err,
+			)
+		}
+		time.Sleep(JANITORINTERVAL)
+	}
+}
+
+/* cleanLogs does one round of janitor's work */
+func cleanLogs(
+	logDir string,
+	quota int64,
+	retention time.Duration,
+	compress bool,
+	art *artifactStore,
+	artQuota int64,
+	levels logLevels,
+) error {
+	/* Artifacts have their own quota, but count towards the whole */
+	if 0 != artQuota {
+		if err := art.Trim(artQuota); nil != err {
+			return err
+		}
+	}
+	/* Half-written tarballs from an interrupted compression */
+	if err := removeStaleTemps(logDir, levels); nil != err {
+		return err
+	}
+	es, total, err := scanSessions(logDir)
+	if nil != err {
+		return err
+	}
+	sort.Slice(es, func(i, j int) bool {
+		return es[i].mtime.Before(es[j].mtime)
+	})
+
+	/* Get rid of anything too old */
+	var keep []sessionEntry
+	for _, e := range es {
+		if 0 != retention &&
+			time.Since(e.mtime) > retention &&
+			!sessionActive(e.path) {
+			if err := removeSession(logDir, e); nil != err {
+				return err
+			}
+			logf(
+				levels,
+				LEVELINFO,
+				SUBSYSGENERAL,
+				"Removed expired session %v",
+				e.path,
+			)
+			total -= e.size
+			continue
+		}
+		keep = append(keep, e)
+	}
+	es = keep
+
+	/* Compress the oldest sessions, if we're allowed */
+	if 0 == quota || total <= quota {
+		return nil
+	}
+	for i, e := range es {
+		if !compress || total <= quota {
+			break
+		}
+		if e.compressed || sessionActive(e.path) {
+			continue
+		}
+		n, err := compressSession(e.path, e.mtime)
+		if nil != err {
+			return err
+		}
+		logf(
+			levels,
+			LEVELINFO,
+			SUBSYSGENERAL,
+			"Compressed session %v (%v -> %v bytes) to enforce "+
+				"quota",
+			e.path,
+			e.size,
+			n,
+		)
+		total -= e.size - n
+		es[i].path += COMPRESSEDSUFFIX
+		es[i].size = n
+		es[i].compressed = true
+	}
+
+	/* If we're still over, remove the oldest */
+	for _, e := range es {
+		if total <= quota {
+			break
+		}
+		if sessionActive(e.path) {
+			continue
+		}
+		if err := removeSession(logDir, e); nil != err {
+			return err
+		}
+		logf(
+			levels,
+			LEVELINFO,
+			SUBSYSGENERAL,
+			"Removed session %v to enforce quota",
+			e.path,
+		)
+		total -= e.size
+	}
+	if total > quota {
+		logf(
+			levels,
+			LEVELWARN,
+			SUBSYSGENERAL,
+			"Log directory %v still %v bytes over quota",
+			logDir,
+			total-quota,
+		)
+	}
+	return nil
+}
+
+/* removeStaleTemps removes the temporary files left in logDir by interrupted
+calls to compressSession.  To avoid pulling files out from under another
+compressSession, only files which haven't been written for JANITORINTERVAL are
+removed. */
+func removeStaleTemps(logDir string, levels logLevels) error {
+	err := filepath.Walk(logDir, func(
+		p string,
+		fi os.FileInfo,
+		err error,
+	) error {
+		if nil != err {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() {
+			if p == filepath.Join(logDir, ARTIFACTDIR) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(p, COMPRESSEDSUFFIX+TMPSUFFIX) ||
+			time.Since(fi.ModTime()) < JANITORINTERVAL {
+			return nil
+		}
+		if err := os.Remove(p); nil != err && !os.IsNotExist(err) {
+			return err
+		}
+		logf(
+			levels,
+			LEVELINFO,
+			SUBSYSGENERAL,
+			"Removed incomplete compressed session %v",
+			p,
+		)
+		return nil
+	})
+	return err
+}
+
+/* scanSessions finds the session directories (directories containing a file
+named LOGNAME) and compressed sessions in logDir, as well as the total size of
+everything in logDir, including the artifact store. */
+func scanSessions(logDir string) ([]sessionEntry, int64, error) {
+	var (
+		es    []sessionEntry
+		total int64
+	)
+	err := filepath.Walk(logDir, func(
+		p string,
+		fi os.FileInfo,
+		err error,
+	) error {
+		if nil != err {
+			/* Don't bother if the log directory's not there */
+			if os.IsNotExist(err) && p == logDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		/* Compressed sessions */
+		if !fi.IsDir() {
+			total += fi.Size()
+			if strings.HasSuffix(p, COMPRESSEDSUFFIX) {
+				es = append(es, sessionEntry{
+					path:       p,
+					size:       fi.Size(),
+					mtime:      fi.ModTime(),
+					compressed: true,
+				})
+			}
+			return nil
+		}
+		/* Artifacts aren't sessions and aren't ours to remove, but
+		they take up space all the same */
+		if p == filepath.Join(logDir, ARTIFACTDIR) {
+			e, err := sessionSize(p)
+			if nil != err {
+				return err
+			}
+			total += e.size
+			return filepath.SkipDir
+		}
+		/* Directories which aren't sessions */
+		if _, err := os.Stat(filepath.Join(p, LOGNAME)); nil != err {
+			return nil
+		}
+		e, err := sessionSize(p)
+		if nil != err {
+			return err
+		}
+		es = append(es, e)
+		total += e.size
+		return filepath.SkipDir
+	})
+	return es, total, err
+}
+
+/* sessionSize gets the size and last modification time of the files in the
+session directory d. */
+func sessionSize(d string) (sessionEntry, error) {
+	e := sessionEntry{path: d}
+	err := filepath.Walk(d, func(p string, fi os.FileInfo, err error) error {
+		if nil != err {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if fi.ModTime().After(e.mtime) {
+			e.mtime = fi.ModTime()
+		}
+		e.size += fi.Size()
+		return nil
+	})
+	return e, err
+}
+
+/* compressedSummary returns the session summary from the compressed session
+tn. */
+func compressedSummary(tn string) ([]byte, error) {
+	f, err := os.Open(tn)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if nil != err {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if io.EOF == err {
+			return nil, os.ErrNotExist
+		} else if nil != err {
+			return nil, err
+		}
+		if SUMMARYNAME == path.Base(h.Name) {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+/* removeSession removes the session e, as well as any directories between it
+and logDir which are left empty. */
+func removeSession(logDir string, e sessionEntry) error {
+	if err := os.RemoveAll(e.path); nil != err {
+		return err
+	}
+	removeEmptyParents(logDir, e.path)
+	return nil
+}
+
+/* removeEmptyParents removes the directories between p and logDir which are
+empty. */
+func removeEmptyParents(logDir, p string) {
+	logDir = filepath.Clean(logDir)
+	for d := filepath.Dir(p); d != logDir &&
+		strings.HasPrefix(d, logDir); d = filepath.Dir(d) {
+		fis, err := ioutil.ReadDir(d)
+		if nil != err || 0 != len(fis) {
+			break
+		}
+		if err := os.Remove(d); nil != err {
+			break
+		}
+	}
+}
+
+/* compressSession replaces the session directory d with a gzipped tarball
+named d+COMPRESSEDSUFFIX with a modification time of mtime.  It returns the
+size of the tarball. */
+func compressSession(d string, mtime time.Time) (int64, error) {
+	tn := d + COMPRESSEDSUFFIX
+	f, err := os.OpenFile(
+		tn+TMPSUFFIX,
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		0600,
+	)
+	if nil != err {
+		return 0, err
+	}
+	defer os.Remove(tn + TMPSUFFIX)
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+
+	/* Add all the files */
+	base := filepath.Dir(d)
+	if err := filepath.Walk(d, func(
+		p string,
+		fi os.FileInfo,
+		err error,
+	) error {
+		if nil != err {
+			return err
+		}
+		h, err := tar.FileInfoHeader(fi, "")
+		if nil != err {
+			return err
+		}
+		if h.Name, err = filepath.Rel(base, p); nil != err {
+			return err
+		}
+		h.Name = filepath.ToSlash(h.Name)
+		if err := tw.WriteHeader(h); nil != err {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		sf, err := os.Open(p)
+		if nil != err {
+			return err
+		}
+		defer sf.Close()
+		_, err = io.Copy(tw, sf)
+		return err
+	}); nil != err {
+		return 0, err
+	}
+	if err := tw.Close(); nil != err {
+		return 0, err
+	}
+	if err := zw.Close(); nil != err {
+		return 0, err
+	}
+	fi, err := f.Stat()
+	if nil != err {
+		return 0, err
+	}
+	if err := f.Close(); nil != err {
+		return 0, err
+	}
+
+	/* Swap the tarball in for the directory */
+	if err := os.Rename(tn+TMPSUFFIX, tn); nil != err {
+		return 0, err
+	}
+	if err := os.Chtimes(tn, mtime, mtime); nil != err {
+		return 0, err
+	}
+	return fi.Size(), os.RemoveAll(d)
+}
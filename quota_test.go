@@ -0,0 +1,283 @@
+package sshhipot
+
+/*
+ * quota_test.go
+ * Tests for keeping logs from filling the disk
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* testSession makes a session directory in logDir named name with a log of n
+bytes and a summary, all last modified at mtime. */
+func testSession(
+	t *testing.T,
+	logDir string,
+	name string,
+	n int,
+	mtime time.Time,
+) string {
+	t.Helper()
+	d := filepath.Join(logDir, name)
+	if err := os.MkdirAll(d, 0700); nil != err {
+		t.Fatalf("Unable to make session directory %v: %v", d, err)
+	}
+	for fn, b := range map[string][]byte{
+		LOGNAME:     bytes.Repeat([]byte("x"), n),
+		SUMMARYNAME: []byte(`{"id":"` + name + `"}`),
+	} {
+		p := filepath.Join(d, fn)
+		if err := ioutil.WriteFile(p, b, 0600); nil != err {
+			t.Fatalf("Unable to write %v: %v", p, err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); nil != err {
+			t.Fatalf("Unable to set time of %v: %v", p, err)
+		}
+	}
+	return d
+}
+
+/* exists returns true if p exists */
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return nil == err
+}
+
+func TestCompressSession(t *testing.T) {
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	d := testSession(t, t.TempDir(), "s", 1000, mtime)
+	n, err := compressSession(d, mtime)
+	if nil != err {
+		t.Fatalf("Compress failed: %v", err)
+	}
+	tn := d + COMPRESSEDSUFFIX
+	fi, err := os.Stat(tn)
+	if nil != err {
+		t.Fatalf("Tarball missing: %v", err)
+	}
+	if fi.Size() != n {
+		t.Errorf("Compressed size %v, tarball is %v", n, fi.Size())
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("Tarball time %v, want %v", fi.ModTime(), mtime)
+	}
+	if exists(d) || exists(tn+TMPSUFFIX) {
+		t.Errorf("Directory or temporary file left behind")
+	}
+	s, err := compressedSummary(tn)
+	if nil != err {
+		t.Fatalf("Unable to read compressed summary: %v", err)
+	}
+	if `{"id":"s"}` != string(s) {
+		t.Errorf("Compressed summary %q", s)
+	}
+
+	/* Don't clobber something which is already there */
+	d = testSession(t, filepath.Dir(d), "t", 10, mtime)
+	if err := ioutil.WriteFile(
+		d+COMPRESSEDSUFFIX+TMPSUFFIX,
+		nil,
+		0600,
+	); nil != err {
+		t.Fatalf("Unable to make temporary file: %v", err)
+	}
+	if _, err := compressSession(d, mtime); nil == err {
+		t.Errorf("Compressed over existing temporary file")
+	}
+	if !exists(d) {
+		t.Errorf("Failed compression removed the session")
+	}
+}
+
+func TestCleanLogsRetention(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		old = time.Now().Add(-2 * time.Hour)
+		a   = testSession(t, dir, "1.2.3.4/a", 10, old)
+		b   = testSession(t, dir, "1.2.3.4/b", 10, old)
+		c   = testSession(t, dir, "5.6.7.8/c", 10, old)
+		d   = testSession(t, dir, "5.6.7.8/d", 10, time.Now())
+	)
+	setSessionActive(b, true)
+	defer setSessionActive(b, false)
+	if err := cleanLogs(
+		dir,
+		0,
+		time.Hour,
+		false,
+		nil,
+		0,
+		nil,
+	); nil != err {
+		t.Fatalf("Cleaning failed: %v", err)
+	}
+	for p, want := range map[string]bool{
+		a:                             false,
+		b:                             true, /* Active */
+		c:                             false,
+		d:                             true, /* New */
+		filepath.Join(dir, "1.2.3.4"): true,
+	} {
+		if got := exists(p); got != want {
+			t.Errorf("%v exists: %v, want %v", p, got, want)
+		}
+	}
+
+	/* Empty parents go away */
+	if err := os.Remove(d + "/" + LOGNAME); nil != err {
+		t.Fatalf("Unable to unsessionify %v: %v", d, err)
+	}
+	setSessionActive(b, false)
+	if err := cleanLogs(dir, 0, time.Hour, false, nil, 0, nil); nil != err {
+		t.Fatalf("Cleaning failed: %v", err)
+	}
+	if exists(filepath.Join(dir, "1.2.3.4")) {
+		t.Errorf("Empty parent directory not removed")
+	}
+}
+
+func TestCleanLogsQuota(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		now = time.Now()
+		ss  []string
+	)
+	for i, n := range []string{"a", "b", "c", "d"} {
+		ss = append(ss, testSession(
+			t,
+			dir,
+			n,
+			10000,
+			now.Add(time.Duration(i-10)*time.Minute),
+		))
+	}
+	setSessionActive(ss[0], true)
+	defer setSessionActive(ss[0], false)
+
+	/* Compression should get us under quota without removing
+	anything, oldest first, but not the active one. */
+	if err := cleanLogs(dir, 25000, 0, true, nil, 0, nil); nil != err {
+		t.Fatalf("Cleaning failed: %v", err)
+	}
+	if !exists(ss[0]) || exists(ss[0]+COMPRESSEDSUFFIX) {
+		t.Errorf("Active session compressed")
+	}
+	if !exists(ss[1] + COMPRESSEDSUFFIX) {
+		t.Errorf("Oldest inactive session not compressed")
+	}
+	if !exists(ss[3]) {
+		t.Errorf("Newest session compressed needlessly")
+	}
+
+	/* Without compression, the oldest inactive sessions go */
+	if err := cleanLogs(dir, 15000, 0, false, nil, 0, nil); nil != err {
+		t.Fatalf("Cleaning failed: %v", err)
+	}
+	_, total, err := scanSessions(dir)
+	if nil != err {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if 15000 < total {
+		t.Errorf("Still %v bytes, over quota", total)
+	}
+	if !exists(ss[0]) {
+		t.Errorf("Active session removed")
+	}
+	if exists(ss[1]+COMPRESSEDSUFFIX) || exists(ss[2]) {
+		t.Errorf("Older sessions kept")
+	}
+
+	/* An active session is kept, even if we're over */
+	if err := cleanLogs(dir, 1, 0, false, nil, 0, nil); nil != err {
+		t.Fatalf("Cleaning failed: %v", err)
+	}
+	if !exists(ss[0]) || exists(ss[3]) {
+		t.Errorf("Wrong sessions removed when over quota")
+	}
+}
+
+func TestCleanLogsTemps(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		stale = filepath.Join(dir, "a"+COMPRESSEDSUFFIX+TMPSUFFIX)
+		fresh = filepath.Join(dir, "b"+COMPRESSEDSUFFIX+TMPSUFFIX)
+		other = filepath.Join(dir, "c"+TMPSUFFIX)
+	)
+	for _, p := range []string{stale, fresh, other} {
+		if err := ioutil.WriteFile(p, []byte("x"), 0600); nil != err {
+			t.Fatalf("Unable to write %v: %v", p, err)
+		}
+	}
+	then := time.Now().Add(-2 * JANITORINTERVAL)
+	for _, p := range []string{stale, other} {
+		if err := os.Chtimes(p, then, then); nil != err {
+			t.Fatalf("Unable to set time of %v: %v", p, err)
+		}
+	}
+	if err := cleanLogs(dir, 0, 0, false, nil, 0, nil); nil != err {
+		t.Fatalf("Cleaning failed: %v", err)
+	}
+	if exists(stale) {
+		t.Errorf("Stale temporary file not removed")
+	}
+	if !exists(fresh) {
+		t.Errorf("Temporary file in use removed")
+	}
+	if !exists(other) {
+		t.Errorf("Unrelated file removed")
+	}
+}
+
+func TestSessionDirActive(t *testing.T) {
+	dir := t.TempDir()
+	pt, err := parsePathTemplate("")
+	if nil != err {
+		t.Fatalf("Unable to parse default template: %v", err)
+	}
+	i := newPathInfo(
+		time.Now(),
+		"1.2.3.4:5678",
+		"127.0.0.1:22",
+		"root",
+		"id",
+		"hassh",
+	)
+	d, err := pt.sessionDir(dir, i)
+	if nil != err {
+		t.Fatalf("Unable to make session directory: %v", err)
+	}
+	defer setSessionActive(d, false)
+	if !sessionActive(d) {
+		t.Errorf("New session directory not active")
+	}
+	if !strings.HasPrefix(d, dir) {
+		t.Errorf("Session directory %v not in %v", d, dir)
+	}
+
+	/* Trying again doesn't take it from the first session */
+	if _, err := pt.sessionDir(dir, i); nil == err {
+		t.Fatalf("Made the same session directory twice")
+	}
+	if !sessionActive(d) {
+		t.Errorf("Failed duplicate deactivated original")
+	}
+
+	/* A directory we couldn't make isn't left active */
+	setSessionActive(d, false)
+	if _, err := pt.sessionDir(dir, i); nil == err {
+		t.Fatalf("Made an existing session directory")
+	}
+	if sessionActive(d) {
+		t.Errorf("Failed session directory left active")
+	}
+}
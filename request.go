@@ -1,17 +1,18 @@
-package main
+package sshhipot
 
 /*
  * request.go
  * Handle ssh requests
  * By J. Stuart McMurray
  * Created 20160517
- * Last Modified 20160702
+ * Last Modified 20261018
  */
 
 import (
 	"crypto/subtle"
 	"fmt"
 	"log"
+	"sync"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -28,34 +29,50 @@ type Requestable interface {
 /* handleReqs logs each received request and proxies it to the server. */
 /* handleReqs handles the requests which come in on reqs and proxies them to
 rable.  All of this is logged to lg, prefixed with desc, which should
-indicate the direction (e.g. attacker->server) of the request. */
+indicate the direction (e.g. attacker->server) of the request.  If hook isn't
+nil, it's called with each request proxied and whether it succeeded. */
 func handleReqs(
 	reqs <-chan *ssh.Request,
 	rable Requestable,
 	lg *log.Logger,
 	direction string,
+	hook func(r *ssh.Request, ok bool),
 ) {
 	/* Read requests until there's no more */
 	for r := range reqs {
-		handleRequest(r, rable, lg, direction)
+		handleRequest(r, rable, lg, direction, hook)
+	}
+}
+
+/* handleReqsLocked is like handleReqs, but holds l while each request is
+handled, so the channel it came in on can be kept open until it's been answered
+by taking l before closing it. */
+func handleReqsLocked(
+	reqs <-chan *ssh.Request,
+	rable Requestable,
+	lg *log.Logger,
+	direction string,
+	hook func(r *ssh.Request, ok bool),
+	l *sync.Mutex,
+) {
+	for r := range reqs {
+		l.Lock()
+		handleRequest(r, rable, lg, direction, hook)
+		l.Unlock()
 	}
 }
 
 /* handleRequest handles a single request, which is proxied to rable and logged
-via lg. */
+via lg.  hook, if not nil, is called after the request is proxied but before
+the reply is sent back. */
 func handleRequest(
 	r *ssh.Request,
 	rable Requestable,
 	lg *log.Logger,
 	direction string,
+	hook func(r *ssh.Request, ok bool),
 ) {
-	rl := fmt.Sprintf(
-		"Type:%q WantReply:%v Payload:%q Direction:%q",
-		r.Type,
-		r.WantReply,
-		r.Payload,
-		direction,
-	)
+	rl := requestLogLine(r, direction)
 	/* Ignore certain requests, because we're bad people */
 	if IGNORENMS {
 		for _, ir := range IGNOREREQUESTS {
@@ -75,6 +92,10 @@ func handleRequest(
 		return
 	}
 
+	if nil != hook {
+		hook(r, ok)
+	}
+
 	/* TODO: Pass to server */
 	if err := r.Reply(ok, data); nil != err {
 		lg.Printf("Unable to respond to request %s Error:%v", rl, err)
@@ -83,3 +104,15 @@ func handleRequest(
 
 	lg.Printf("Request %s Ok:%v Response:%q", rl, ok, data)
 }
+
+/* requestLogLine describes the request r, sent in the given direction, for
+logging. */
+func requestLogLine(r *ssh.Request, direction string) string {
+	return fmt.Sprintf(
+		"Type:%q WantReply:%v Payload:%q Direction:%q",
+		r.Type,
+		r.WantReply,
+		r.Payload,
+		direction,
+	)
+}
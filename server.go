@@ -0,0 +1,346 @@
+/* Package sshhipot is a high-interaction SSH honeypot which proxies attackers
+to a real server and logs everything they do.  Make a Server with NewServer and
+start it with Serve.  What happens may be watched with an Observer and changed
+with an Interceptor. */
+package sshhipot
+
+/*
+ * server.go
+ * The honeypot, as something to embed
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* Config configures a Server.  Files named in a Config are read by NewServer.
+The zero value of most fields means the feature is disabled or unlimited. */
+type Config struct {
+	/* Authentication */
+	NoClientAuth   bool          /* Let clients in without authenticating */
+	ServerVersion  string        /* e.g. SSH-2.0-OpenSSH_7.2 */
+	Password       string        /* Password to accept */
+	PasswordFile   string        /* Passwords to accept, one per line */
+	PasswordChance float64       /* Probability of accepting any password */
+	Hostname       string        /* For challenges and the fallback shell */
+	KIScriptFile   string        /* Keyboard-interactive challenge script */
+	BannerFile     string        /* Pre-authentication banner */
+	FailDelay      time.Duration /* Approximate delay after a failure */
+	HostKeyFile    string        /* Created if it doesn't exist */
+
+	/* MaxAuthTries is the number of authentication failures allowed
+	before disconnecting, 0 for 6 or <0 for any number.  The disconnect
+	message is the SSH library's "too many authentication failures", not
+	OpenSSH's "Too many authentication failures"; the library doesn't
+	allow sending any other. */
+	MaxAuthTries int
+
+	/* EnabledAuthMethods is a comma-separated set of methods to offer.
+	The SSH library always offers them in the order password, publickey,
+	keyboard-interactive (see AUTHMETHODORDER), whatever the order here.
+	OpenSSH offers publickey first, so the order can't be made to match
+	an upstream's sshd_config.  A warning is logged if it's asked for. */
+	EnabledAuthMethods string
+
+	/* Logging */
+	LogDir        string /* Per-connection log directory */
+	PathTemplate  string /* Session directories in LogDir */
+	HideBanners   bool   /* Don't log connections which don't auth */
+	SessionLogCap int64  /* Bytes of channel data logged per session */
+	ChannelLogCap int64  /* Bytes of channel data logged per channel */
+	Transcripts   bool   /* Also log channel data in binary */
+	Quota         int64  /* Maximum size of LogDir */
+	Retention     time.Duration
+	Compress      bool   /* Compress old sessions to enforce Quota */
+	DBFile        string /* SQLite database */
+	GeoIPFiles    string /* Comma-separated mmdb files */
+	AlertFile     string /* Alert rules */
+	AdminSocket   string /* Admin console Unix socket */
+
+	/* Verbosity of this Server's lines in the global log, including
+	those about its database, downloads, and so on, and of DebugLog.
+	Session logs always get everything. */
+	LogLevel  string    /* Default level, e.g. info */
+	LogLevels string    /* Per-subsystem, e.g. auth=debug,channel=trace */
+	DebugLog  io.Writer /* Mirror of session logs, or nil */
+
+	/* Keeping what attackers send and download */
+	Artifacts       bool   /* Store files in LogDir/ARTIFACTDIR */
+	ArtifactQuota   int64  /* Maximum size of LogDir/ARTIFACTDIR */
+	YARARulesDir    string /* Tag new artifacts with these rules */
+	Downloads       bool   /* Download URLs; implies Artifacts */
+	DownloadProxy   string /* HTTP or SOCKS5 proxy URL */
+	DownloadOffline bool   /* Only save URLs to download later */
+
+	/* Download from loopback and private addresses, for testing */
+	downloadAnywhere bool
+
+	/* Upstream server */
+	UpstreamAddr        string
+	UpstreamUser        string
+	UpstreamKeyFile     string /* Created if it doesn't exist */
+	UpstreamFingerprint string
+
+	/* Fallback shell */
+	FakeFSFile       string /* Filesystem tarball */
+	FallbackPrompt   string
+	FallbackAlways   bool   /* Never use the upstream server */
+	FallbackVersions string /* Comma-separated client versions */
+	FallbackUsers    string /* Comma-separated usernames */
+
+	/* Protecting the upstream */
+	RulesFile       string /* Command interception rules */
+	ChannelUpRate   int64  /* Bytes per second */
+	ChannelDownRate int64
+	SessionUpRate   int64
+	SessionDownRate int64
+	IdleTimeout     time.Duration
+	MaxDuration     time.Duration
+	MaxChannels     int
+
+	/* Hooks */
+	Observer    Observer    /* Told what happens, may be nil */
+	Interceptor Interceptor /* May change what happens, or nil */
+}
+
+/* Server is an SSH honeypot which proxies attackers to an upstream server. */
+type Server struct {
+	conf    Config
+	sconfig *ssh.ServerConfig
+	cconfig *ssh.ClientConfig
+	fb      *fallback
+	rules   []*rule
+	lim     limits
+	db      *database
+	geo     *geoIP
+	alerts  *alerter
+	paths   pathTemplate
+	art     *artifactStore
+	dl      *downloader
+	obs     Observer
+	icpt    Interceptor
+	admin   net.Listener
+	live    liveSessions /* For the admin console */
+	debug   io.Writer    /* Mirror of session logs */
+	levels  logLevels    /* Verbosity of the global and debug logs */
+	once    sync.Once    /* Starts the janitor and admin console */
+}
+
+/* NewServer makes a new Server configured by conf. */
+func NewServer(conf Config) (*Server, error) {
+	s := &Server{
+		conf: conf,
+		obs:  conf.Observer,
+		icpt: conf.Interceptor,
+		lim: limits{
+			chanUp:   conf.ChannelUpRate,
+			chanDown: conf.ChannelDownRate,
+			sessUp:   conf.SessionUpRate,
+			sessDown: conf.SessionDownRate,
+			idle:     conf.IdleTimeout,
+			duration: conf.MaxDuration,
+			channels: conf.MaxChannels,
+		},
+	}
+	if nil == s.obs {
+		s.obs = NopObserver{}
+	}
+	var err error
+
+	/* How much to log, and where */
+	if s.levels, err = parseLogLevels(
+		conf.LogLevel,
+		conf.LogLevels,
+	); nil != err {
+		return nil, fmt.Errorf("parsing log levels: %v", err)
+	}
+	if nil != conf.DebugLog {
+		s.debug = &lockedWriter{w: conf.DebugLog}
+	}
+
+	/* Where sessions' logs go */
+	if s.paths, err = parsePathTemplate(conf.PathTemplate); nil != err {
+		return nil, fmt.Errorf("parsing path template: %v", err)
+	}
+
+	/* SSH configs */
+	if s.sconfig, err = s.makeServerConfig(); nil != err {
+		return nil, err
+	}
+	if s.cconfig, err = s.makeClientConfig(
+		conf.UpstreamUser,
+		conf.UpstreamKeyFile,
+		conf.UpstreamFingerprint,
+	); nil != err {
+		return nil, err
+	}
+
+	/* Shell to use if there's no upstream */
+	if s.fb, err = newFallback(
+		conf.FakeFSFile,
+		conf.Hostname,
+		conf.FallbackPrompt,
+		conf.FallbackAlways,
+		conf.FallbackVersions,
+		conf.FallbackUsers,
+	); nil != err {
+		return nil, fmt.Errorf("loading fallback filesystem: %v", err)
+	}
+
+	/* Rules to protect the upstream */
+	if s.rules, err = loadRules(conf.RulesFile); nil != err {
+		return nil, fmt.Errorf(
+			"loading rules from %v: %v",
+			conf.RulesFile,
+			err,
+		)
+	}
+	if 0 != len(s.rules) {
+		s.logf(
+			LEVELINFO,
+			SUBSYSGENERAL,
+			"Loaded %v interception rules",
+			len(s.rules),
+		)
+	}
+
+	/* Somewhere to put what happens */
+	if s.db, err = openDB(conf.DBFile, s.levels); nil != err {
+		return nil, fmt.Errorf(
+			"opening database %v: %v",
+			conf.DBFile,
+			err,
+		)
+	}
+	if nil != s.db {
+		s.logf(
+			LEVELINFO,
+			SUBSYSGENERAL,
+			"Storing connections and sessions in %v",
+			conf.DBFile,
+		)
+	}
+
+	/* Where attackers are from */
+	if s.geo, err = openGeoIP(conf.GeoIPFiles, s.levels); nil != err {
+		return nil, fmt.Errorf("opening GeoIP database: %v", err)
+	}
+
+	/* Rules for telling someone what's going on */
+	if s.alerts, err = loadAlerts(
+		conf.AlertFile,
+		conf.LogDir,
+		s.levels,
+	); nil != err {
+		return nil, fmt.Errorf(
+			"loading alerts from %v: %v",
+			conf.AlertFile,
+			err,
+		)
+	}
+	if nil != s.alerts {
+		s.logf(
+			LEVELINFO,
+			SUBSYSGENERAL,
+			"Loaded %v alert rules",
+			len(s.alerts.rules),
+		)
+	}
+
+	/* Somewhere to put what attackers send and download */
+	if conf.Artifacts || conf.Downloads {
+		/* Artifacts count towards the quota but are removed last,
+		so they need their own */
+		if 0 != conf.Quota && 0 == conf.ArtifactQuota {
+			return nil, fmt.Errorf(
+				"storing artifacts with a quota needs an " +
+					"artifact quota",
+			)
+		}
+		ad := filepath.Join(conf.LogDir, ARTIFACTDIR)
+		if s.art, err = openArtifactStore(
+			ad,
+			conf.YARARulesDir,
+			s.levels,
+		); nil != err {
+			return nil, fmt.Errorf(
+				"opening artifact store %v: %v",
+				ad,
+				err,
+			)
+		}
+		if 0 != len(s.art.rules) {
+			s.logf(
+				LEVELINFO,
+				SUBSYSGENERAL,
+				"Loaded %v YARA rule files",
+				len(s.art.rules),
+			)
+		}
+	}
+	if conf.Downloads {
+		if s.dl, err = newDownloader(
+			s.art,
+			conf.DownloadProxy,
+			conf.DownloadOffline,
+			conf.downloadAnywhere,
+		); nil != err {
+			return nil, fmt.Errorf("preparing downloader: %v", err)
+		}
+	}
+
+	/* Let the operator watch */
+	if "" != conf.AdminSocket {
+		if s.admin, err = s.adminListen(conf.AdminSocket); nil != err {
+			return nil, fmt.Errorf(
+				"listening for admin connections: %v",
+				err,
+			)
+		}
+	}
+
+	return s, nil
+}
+
+/* Serve accepts attackers' connections on l and handles them.  It returns
+when l.Accept returns an error.  The first call to Serve also starts the
+admin console and log directory cleanup, if configured. */
+func (s *Server) Serve(l net.Listener) error {
+	s.once.Do(func() {
+		/* Let the operator watch */
+		if nil != s.admin {
+			go s.adminServe(s.admin)
+		}
+		/* Keep the logs from growing forever */
+		if 0 != s.conf.Quota ||
+			0 != s.conf.Retention ||
+			0 != s.conf.ArtifactQuota {
+			go janitor(
+				s.conf.LogDir,
+				s.conf.Quota,
+				s.conf.Retention,
+				s.conf.Compress,
+				s.art,
+				s.conf.ArtifactQuota,
+				s.levels,
+			)
+		}
+	})
+	for {
+		c, err := l.Accept()
+		if nil != err {
+			return err
+		}
+		go s.handle(c)
+	}
+}
@@ -0,0 +1,618 @@
+package sshhipot
+
+/*
+ * session.go
+ * Keep track of what happened in a session
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* SUMMARYNAME is the name of the per-session summary file */
+const SUMMARYNAME = "summary.json"
+
+/* CHANNELWAIT is how long a finished session's summary waits for its channels
+to be finished with */
+const CHANNELWAIT = 10 * time.Second
+
+/* Session holds a summary of an authenticated connection, suitable for
+serializing to JSON when the connection's finished. */
+type Session struct {
+	l sync.Mutex
+
+	ID            string            `json:"id"`
+	Start         time.Time         `json:"start"`
+	End           time.Time         `json:"end"`
+	Duration      float64           `json:"duration"`
+	Address       string            `json:"address"`
+	Listener      string            `json:"listener,omitempty"`
+	ClientVersion string            `json:"client_version"`
+	HASSH         string            `json:"hassh,omitempty"`
+	HASSHAlgs     string            `json:"hassh_algorithms,omitempty"`
+	Geo           *GeoInfo          `json:"geo,omitempty"`
+	User          string            `json:"user"`
+	AuthAttempts  []AuthAttempt     `json:"auth_attempts"`
+	Upstream      string            `json:"upstream"`
+	Channels      []*ChannelSummary `json:"channels"`
+	Requests      []RequestSummary  `json:"requests"`
+	Bytes         map[string]uint64 `json:"bytes"`
+	Commands      []CommandSummary  `json:"commands"`
+	Files         []FileSummary     `json:"files"`
+	Downloads     []DownloadSummary `json:"downloads"`
+	Artifacts     []string          `json:"artifacts"`
+	Interceptions []Interception    `json:"interceptions"`
+	Limit         string            `json:"limit,omitempty"`
+
+	srv     *Server        /* Database, alerts, and observer */
+	nChan   int            /* Channel counter */
+	budget  *logBudget     /* Payload logging allowed for the session */
+	chanCap int64          /* Payload logging allowed per channel */
+	chans   sync.WaitGroup /* Channels being handled */
+	dls     sync.WaitGroup /* Downloads in progress */
+	ending  bool           /* Write's waiting for channels and downloads */
+	written bool           /* The summary's been written */
+}
+
+/* ChannelSummary describes a single channel */
+type ChannelSummary struct {
+	ID         int               `json:"id"`
+	Type       string            `json:"type"`
+	Data       string            `json:"data"`
+	Direction  string            `json:"direction"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Duration   float64           `json:"duration"`
+	Address    string            `json:"address,omitempty"`
+	Originator string            `json:"originator,omitempty"`
+	Log        string            `json:"log,omitempty"`
+	Transcript string            `json:"transcript,omitempty"`
+	Rejected   string            `json:"rejected,omitempty"`
+	Requests   []RequestSummary  `json:"requests"`
+	Bytes      map[string]uint64 `json:"bytes"`
+	ExitStatus *uint32           `json:"exit_status,omitempty"`
+	ExitSignal string            `json:"exit_signal,omitempty"`
+}
+
+/* RequestSummary describes a single request */
+type RequestSummary struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Direction string    `json:"direction"`
+	WantReply bool      `json:"want_reply"`
+	Payload   string    `json:"payload"`
+	OK        bool      `json:"ok"`
+}
+
+/* CommandSummary describes a command run by the attacker, either typed into a
+shell or sent in an exec request. */
+type CommandSummary struct {
+	Time    time.Time `json:"time"`
+	Channel int       `json:"channel"`
+	Command string    `json:"command"`
+}
+
+/* FileSummary describes a file sent over a channel */
+type FileSummary struct {
+	Time      time.Time `json:"time"`
+	Channel   int       `json:"channel"`
+	Direction string    `json:"direction"`
+	Name      string    `json:"name"`
+	Mode      string    `json:"mode"`
+	Size      uint64    `json:"size"`
+	SHA256    string    `json:"sha256,omitempty"`
+}
+
+/* DownloadSummary describes a URL the attacker tried to download from */
+type DownloadSummary struct {
+	Time    time.Time `json:"time"`
+	Channel int       `json:"channel"`
+	Command string    `json:"command"`
+	URL     string    `json:"url"`
+	SHA256  string    `json:"sha256,omitempty"`
+}
+
+/* Interception describes a command which matched an interception rule */
+type Interception struct {
+	Time    time.Time `json:"time"`
+	Channel int       `json:"channel"`
+	Command string    `json:"command"`
+	Rule    string    `json:"rule"`
+	Action  string    `json:"action"`
+}
+
+/* AuthAttempt is a single authentication attempt */
+type AuthAttempt struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	User       string    `json:"user"`
+	Prompt     string    `json:"prompt,omitempty"`
+	Credential string    `json:"credential"`
+	Successful bool      `json:"successful"`
+}
+
+/* logCredential returns the method, prompt (if there was one), and credential
+of the attempt a, formatted for logging. */
+func (a AuthAttempt) logCredential() string {
+	if "" == a.Prompt {
+		return fmt.Sprintf("%v:%q", a.Method, a.Credential)
+	}
+	return fmt.Sprintf("Prompt:%q %v:%q", a.Prompt, a.Method, a.Credential)
+}
+
+/* newSession makes a new session for the authenticated connection sc, which
+has the ID id, was accepted by srv, and made the authentication attempts
+attempts.  What happens is stored in and sent to srv's database, alerts, and
+observer, and srv's Config limits how much channel data is logged. */
+func newSession(
+	srv *Server,
+	sc *ssh.ServerConn,
+	id string,
+	attempts []AuthAttempt,
+) *Session {
+	return &Session{
+		ID:            id,
+		Start:         time.Now(),
+		Address:       sc.RemoteAddr().String(),
+		Listener:      sc.LocalAddr().String(),
+		ClientVersion: string(sc.ClientVersion()),
+		User:          sc.User(),
+		AuthAttempts:  attempts,
+		Bytes:         make(map[string]uint64),
+		srv:           srv,
+		budget:        newLogBudget(srv.conf.SessionLogCap, nil),
+		chanCap:       srv.conf.ChannelLogCap,
+	}
+}
+
+/* channelBudget returns a new logBudget for a channel in the session. */
+func (s *Session) channelBudget() *logBudget {
+	return newLogBudget(s.chanCap, s.budget)
+}
+
+/* setHASSH notes the client's HASSH, h, and the algorithms, algs, from which
+it was calculated. */
+func (s *Session) setHASSH(h, algs string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.HASSH = h
+	s.HASSHAlgs = algs
+}
+
+/* setGeo notes where the client's from. */
+func (s *Session) setGeo(g *GeoInfo) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.Geo = g
+}
+
+/* event returns an event of the given type for the session, optionally on
+channel c. */
+func (s *Session) event(typ string, c *ChannelSummary) event {
+	s.l.Lock()
+	defer s.l.Unlock()
+	e := event{
+		Type:          typ,
+		Time:          time.Now(),
+		Session:       s.ID,
+		Address:       s.Address,
+		User:          s.User,
+		ClientVersion: s.ClientVersion,
+		HASSH:         s.HASSH,
+		Upstream:      s.Upstream,
+		Geo:           s.Geo,
+	}
+	if nil != c {
+		e.Channel = c.ID
+	}
+	return e
+}
+
+/* storeStart notes the start of the session in the database.  It should be
+called once the session's HASSH is known. */
+func (s *Session) storeStart() {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.srv.db.SessionStart(s)
+}
+
+/* setUpstream notes the upstream server used for the session. */
+func (s *Session) setUpstream(u string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.Upstream = u
+}
+
+/* setLimit notes the session was ended because it reached the named limit. */
+func (s *Session) setLimit(limit string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.Limit = limit
+}
+
+/* newChannel adds a channel to the session and returns its summary. */
+func (s *Session) newChannel(
+	nc ssh.NewChannel,
+	direction string,
+) *ChannelSummary {
+	s.l.Lock()
+	s.nChan++
+	c := &ChannelSummary{
+		ID:        s.nChan,
+		Type:      nc.ChannelType(),
+		Data:      string(nc.ExtraData()),
+		Direction: direction,
+		Start:     time.Now(),
+		Bytes:     make(map[string]uint64),
+	}
+	c.Address, c.Originator = forwardAddresses(nc)
+	s.Channels = append(s.Channels, c)
+	s.srv.db.ChannelStart(s.ID, c)
+	ci := channelInfo(c)
+	s.l.Unlock()
+	s.srv.obs.ChannelOpen(s.ID, ci)
+	return c
+}
+
+/* forwardAddresses returns the host and port to which nc, if it's a
+direct-tcpip or forwarded-tcpip channel, is connected, and the host and port
+from which the connection came.  Both are empty for other channels. */
+func forwardAddresses(nc ssh.NewChannel) (address, originator string) {
+	switch nc.ChannelType() {
+	case "direct-tcpip", "forwarded-tcpip":
+	default:
+		return "", ""
+	}
+	var d struct {
+		Host  string
+		Port  uint32
+		OHost string
+		OPort uint32
+	}
+	if nil != ssh.Unmarshal(nc.ExtraData(), &d) {
+		return "", ""
+	}
+	return net.JoinHostPort(d.Host, strconv.Itoa(int(d.Port))),
+		net.JoinHostPort(d.OHost, strconv.Itoa(int(d.OPort)))
+}
+
+/* setChannelLog notes the name of the log file for channel c. */
+func (s *Session) setChannelLog(c *ChannelSummary, name string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	c.Log = name
+}
+
+/* rejectChannel notes the channel c was rejected with the error err. */
+func (s *Session) rejectChannel(c *ChannelSummary, err error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	c.Rejected = err.Error()
+}
+
+/* goChannel calls f, which handles a channel, in its own goroutine.  Write
+waits for f to return, unless Write's already been called. */
+func (s *Session) goChannel(f func()) {
+	s.l.Lock()
+	track := !s.ending
+	if track {
+		s.chans.Add(1)
+	}
+	s.l.Unlock()
+	go func() {
+		if track {
+			defer s.chans.Done()
+		}
+		f()
+	}()
+}
+
+/* endChannel notes that the channel c is finished. */
+func (s *Session) endChannel(c *ChannelSummary) {
+	s.l.Lock()
+	c.End = time.Now()
+	c.Duration = c.End.Sub(c.Start).Seconds()
+	s.srv.db.ChannelEnd(s.ID, c)
+	s.l.Unlock()
+	s.srv.obs.ChannelClose(s.ID, channelInfo(c))
+}
+
+/* addBytes notes that b was sent in the direction tag on channel c. */
+func (s *Session) addBytes(c *ChannelSummary, tag string, b []byte) {
+	s.l.Lock()
+	c.Bytes[tag] += uint64(len(b))
+	s.Bytes[tag] += uint64(len(b))
+	s.l.Unlock()
+	s.srv.obs.Data(s.ID, channelInfo(c), tag, b)
+}
+
+/* addCommand notes the attacker ran a command on channel c, as well as
+anything the command tries to download. */
+func (s *Session) addCommand(c *ChannelSummary, cmd string) {
+	cs := CommandSummary{
+		Time:    time.Now(),
+		Channel: c.ID,
+		Command: cmd,
+	}
+	s.l.Lock()
+	s.Commands = append(s.Commands, cs)
+	s.srv.db.Command(s.ID, cs)
+	s.l.Unlock()
+	e := s.event(EVENTCOMMAND, c)
+	e.Command = cmd
+	s.srv.alerts.Send(e)
+	for _, u := range commandURLs(cmd) {
+		s.addDownload(c, cmd, u)
+	}
+}
+
+/* addFile notes a file was sent on channel c. */
+func (s *Session) addFile(c *ChannelSummary, f FileSummary) {
+	s.l.Lock()
+	f.Channel = c.ID
+	s.Files = append(s.Files, f)
+	s.srv.db.File(s.ID, f)
+	s.l.Unlock()
+	if UPLOAD == f.Direction {
+		e := s.event(EVENTUPLOAD, c)
+		e.File = &f
+		s.srv.alerts.Send(e)
+	}
+}
+
+/* addDownload notes the attacker used cmd on channel c to try to download
+from the URL u, and downloads it ourselves if it's the first time the URL's
+been seen in the session. */
+func (s *Session) addDownload(c *ChannelSummary, cmd, u string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	d := DownloadSummary{
+		Time:    time.Now(),
+		Channel: c.ID,
+		Command: cmd,
+		URL:     u,
+	}
+	for _, o := range s.Downloads {
+		if o.URL == u {
+			s.Downloads = append(s.Downloads, d)
+			return
+		}
+	}
+	s.Downloads = append(s.Downloads, d)
+	i := len(s.Downloads) - 1
+	/* Write waits for downloads, unless it's already waiting */
+	track := !s.ending
+	if track {
+		s.dls.Add(1)
+	}
+	go s.srv.dl.Download(ArtifactSource{
+		Time:    d.Time,
+		Kind:    ARTIFACTURL,
+		URL:     u,
+		Session: s.ID,
+		Channel: c.ID,
+		Command: cmd,
+		Address: s.Address,
+	}, func(sha string) {
+		if track {
+			defer s.dls.Done()
+		}
+		s.l.Lock()
+		defer s.l.Unlock()
+		/* Too late for the summary, but the file's still in the
+		artifact store */
+		if "" == sha || s.written {
+			return
+		}
+		for j := i; j < len(s.Downloads); j++ {
+			if s.Downloads[j].URL == u {
+				s.Downloads[j].SHA256 = sha
+			}
+		}
+		s.Artifacts = addUnique(s.Artifacts, sha)
+	})
+}
+
+/* addArtifact notes the session captured the artifact with the given hash */
+func (s *Session) addArtifact(sha string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.Artifacts = addUnique(s.Artifacts, sha)
+}
+
+/* addInterception notes that cmd, sent on channel c, matched rule, which
+caused action to be taken. */
+func (s *Session) addInterception(
+	c *ChannelSummary,
+	cmd string,
+	rule string,
+	action string,
+) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.Interceptions = append(s.Interceptions, Interception{
+		Time:    time.Now(),
+		Channel: c.ID,
+		Command: cmd,
+		Rule:    rule,
+		Action:  action,
+	})
+}
+
+/* requestHook returns a function suitable for passing to handleReqs which
+notes requests sent in the given direction on channel c, or the connection
+itself if c is nil.  Exec requests are noted as commands, and exit-status and
+exit-signal requests are saved with the channel. */
+func (s *Session) requestHook(
+	c *ChannelSummary,
+	direction string,
+) func(*ssh.Request, bool) {
+	return func(r *ssh.Request, ok bool) {
+		rs := RequestSummary{
+			Time:      time.Now(),
+			Type:      r.Type,
+			Direction: direction,
+			WantReply: r.WantReply,
+			Payload:   string(r.Payload),
+			OK:        ok,
+		}
+		/* Connection-level requests */
+		if nil == c {
+			s.l.Lock()
+			s.Requests = append(s.Requests, rs)
+			s.srv.db.Request(s.ID, nil, rs)
+			s.l.Unlock()
+			s.srv.obs.Request(s.ID, nil, rs)
+			return
+		}
+
+		ci := channelInfo(c)
+		s.srv.obs.Request(s.ID, &ci, rs)
+		s.l.Lock()
+		c.Requests = append(c.Requests, rs)
+		s.srv.db.Request(s.ID, c, rs)
+		switch r.Type {
+		case "exit-status":
+			if 4 <= len(r.Payload) {
+				es := binary.BigEndian.Uint32(r.Payload)
+				c.ExitStatus = &es
+			}
+		case "exit-signal":
+			if sig, ok := sshString(r.Payload); ok {
+				c.ExitSignal = sig
+			}
+		}
+		s.l.Unlock()
+
+		if ok && "exec" == r.Type {
+			if cmd, ok := sshString(r.Payload); ok {
+				s.addCommand(c, cmd)
+			}
+		}
+	}
+}
+
+/* Write writes the session summary to the file named SUMMARYNAME in the
+directory dir.  It waits up to CHANNELWAIT for channels to be finished with
+and then up to DOWNLOADWAIT for downloads to finish, so channels' ends and
+downloads' hashes make it into the summary.  The session isn't changed
+afterwards. */
+func (s *Session) Write(dir string) error {
+	end := time.Now()
+	s.l.Lock()
+	s.ending = true
+	s.l.Unlock()
+	waitTimeout(&s.chans, CHANNELWAIT)
+	waitTimeout(&s.dls, DOWNLOADWAIT)
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.written = true
+	s.End = end
+	s.Duration = s.End.Sub(s.Start).Seconds()
+	if nil != s.srv {
+		s.srv.db.SessionEnd(s)
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(s); nil != err {
+		return err
+	}
+	return ioutil.WriteFile(
+		filepath.Join(dir, SUMMARYNAME),
+		b.Bytes(),
+		0600,
+	)
+}
+
+/* waitTimeout waits for wg, but no longer than d. */
+func waitTimeout(wg *sync.WaitGroup, d time.Duration) {
+	waited := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(d):
+	}
+}
+
+/* snapshot returns a copy of the session's summary which shares nothing with
+the session and isn't tied to a Server. */
+func (s *Session) snapshot() (*Session, error) {
+	s.l.Lock()
+	b, err := json.Marshal(s)
+	s.l.Unlock()
+	if nil != err {
+		return nil, err
+	}
+	c := new(Session)
+	if err := json.Unmarshal(b, c); nil != err {
+		return nil, err
+	}
+	return c, nil
+}
+
+/* ReadSummaries reads the summaries of the finished sessions in the
+per-connection log directory logDir, including those which have been
+compressed. */
+func ReadSummaries(logDir string) ([]*Session, error) {
+	es, _, err := scanSessions(logDir)
+	if nil != err {
+		return nil, err
+	}
+	var ss []*Session
+	for _, e := range es {
+		var b []byte
+		if e.compressed {
+			b, err = compressedSummary(e.path)
+		} else {
+			b, err = ioutil.ReadFile(
+				filepath.Join(e.path, SUMMARYNAME),
+			)
+		}
+		if os.IsNotExist(err) {
+			/* Still going, or never finished */
+			continue
+		} else if nil != err {
+			return nil, fmt.Errorf("%v: %v", e.path, err)
+		}
+		s := new(Session)
+		if err := json.Unmarshal(b, s); nil != err {
+			return nil, fmt.Errorf("%v: %v", e.path, err)
+		}
+		ss = append(ss, s)
+	}
+	return ss, nil
+}
+
+/* sshString returns the SSH string (uint32 length and data) at the start of
+b.  It returns false if b is too short. */
+func sshString(b []byte) (string, bool) {
+	if 4 > len(b) {
+		return "", false
+	}
+	l := binary.BigEndian.Uint32(b)
+	if uint64(len(b)-4) < uint64(l) {
+		return "", false
+	}
+	return string(b[4 : 4+l]), true
+}
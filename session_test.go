@@ -0,0 +1,73 @@
+package sshhipot
+
+/*
+ * session_test.go
+ * Tests for session summaries
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* testNewChannel is an ssh.NewChannel which can only be described */
+type testNewChannel struct {
+	ssh.NewChannel
+	typ string
+}
+
+/* ChannelType implements ssh.NewChannel */
+func (nc testNewChannel) ChannelType() string { return nc.typ }
+
+/* ExtraData implements ssh.NewChannel */
+func (nc testNewChannel) ExtraData() []byte { return nil }
+
+/* snapshotObserver takes a snapshot of a session when a channel opens */
+type snapshotObserver struct {
+	NopObserver
+	sess  *Session
+	snaps chan *Session
+}
+
+/* ChannelOpen implements Observer */
+func (o *snapshotObserver) ChannelOpen(string, ChannelInfo) {
+	s, err := o.sess.snapshot()
+	if nil != err {
+		panic(err)
+	}
+	o.snaps <- s
+}
+
+func TestSessionObserverUnlocked(t *testing.T) {
+	o := &snapshotObserver{snaps: make(chan *Session, 1)}
+	o.sess = &Session{
+		ID:    "0123456789abcdef",
+		Bytes: make(map[string]uint64),
+		srv:   &Server{obs: o},
+	}
+
+	/* The observer should be able to look at the session */
+	done := make(chan *ChannelSummary, 1)
+	go func() {
+		done <- o.sess.newChannel(
+			testNewChannel{typ: "session"},
+			TAGTOSERVER,
+		)
+	}()
+	select {
+	case c := <-done:
+		if 1 != c.ID || "session" != c.Type {
+			t.Errorf("Wrong channel %+v", c)
+		}
+	case <-time.After(TESTTIMEOUT):
+		t.Fatalf("Observer deadlocked opening a channel")
+	}
+	if s := <-o.snaps; 1 != len(s.Channels) {
+		t.Errorf("Observer saw %v channels", len(s.Channels))
+	}
+}
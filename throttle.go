@@ -0,0 +1,267 @@
+package sshhipot
+
+/*
+ * throttle.go
+ * Keep attackers from using too much of the upstream server
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	/* WATCHINTERVAL is how often sessions are checked for idleness and
+	age */
+	WATCHINTERVAL = time.Second
+	/* RATEBURST is how long a rateLimiter may save up unused bytes for
+	a burst */
+	RATEBURST = time.Second
+)
+
+/* limits are the limits placed on each connection.  A 0 means no limit. */
+type limits struct {
+	chanUp   int64 /* Bytes per second, attacker->server, per channel */
+	chanDown int64 /* Bytes per second, server->attacker, per channel */
+	sessUp   int64 /* Bytes per second, attacker->server, per session */
+	sessDown int64 /* Bytes per second, server->attacker, per session */
+	idle     time.Duration
+	duration time.Duration
+	channels int /* Channels the attacker may have open at once */
+}
+
+/* rateLimiter limits the number of bytes per second read in one direction.  A
+rateLimiter may have a parent, in which case reads are limited by both.  A nil
+*rateLimiter is unlimited. */
+type rateLimiter struct {
+	l      sync.Mutex
+	rate   int64
+	next   time.Time /* When the bytes read so far are paid for */
+	parent *rateLimiter
+	lg     *log.Logger
+	tag    string
+	logged bool /* Already logged that the limit was reached */
+}
+
+/* newRateLimiter returns a rateLimiter which allows rate bytes per second in
+the direction tag, or any number if rate is 0.  Reads will also be limited by
+parent, which may be nil.  The first time the limit is reached, it is logged
+to lg. */
+func newRateLimiter(
+	rate int64,
+	parent *rateLimiter,
+	lg *log.Logger,
+	tag string,
+) *rateLimiter {
+	return &rateLimiter{rate: rate, parent: parent, lg: lg, tag: tag}
+}
+
+/* Wait sleeps long enough that n more bytes won't exceed the rate. */
+func (r *rateLimiter) Wait(n int) {
+	if nil == r {
+		return
+	}
+	if 0 != r.rate {
+		r.l.Lock()
+		now := time.Now()
+		/* Allow a short burst after a quiet spell */
+		if earliest := now.Add(-RATEBURST); r.next.Before(earliest) {
+			r.next = earliest
+		}
+		r.next = r.next.Add(
+			time.Duration(int64(n) * int64(time.Second) / r.rate),
+		)
+		d := r.next.Sub(now)
+		if 0 < d && !r.logged {
+			r.lg.Printf(
+				"[%v] Bandwidth limit of %v bytes/s reached",
+				r.tag,
+				r.rate,
+			)
+			r.logged = true
+		}
+		r.l.Unlock()
+		time.Sleep(d)
+	}
+	r.parent.Wait(n)
+}
+
+/* governor enforces limits on a connection. */
+type governor struct {
+	l      sync.Mutex
+	lim    limits
+	conn   ssh.Conn
+	lg     *log.Logger
+	sess   *Session
+	up     *rateLimiter
+	down   *rateLimiter
+	active time.Time /* Last time anything happened */
+	nChan  int       /* Open channels */
+	done   chan struct{}
+}
+
+/* newGovernor returns a governor which enforces lim on conn, which is logged
+to lg and summarized in sess.  The governor's Done method should be called
+when the connection's finished. */
+func newGovernor(
+	lim limits,
+	conn ssh.Conn,
+	lg *log.Logger,
+	sess *Session,
+) *governor {
+	g := &governor{
+		lim:    lim,
+		conn:   conn,
+		lg:     lg,
+		sess:   sess,
+		up:     newRateLimiter(lim.sessUp, nil, lg, TAGTOSERVER),
+		down:   newRateLimiter(lim.sessDown, nil, lg, TAGTOATTACKER),
+		active: time.Now(),
+		done:   make(chan struct{}),
+	}
+	if 0 != lim.idle || 0 != lim.duration {
+		go g.watch()
+	}
+	return g
+}
+
+/* Done stops watching the connection */
+func (g *governor) Done() {
+	close(g.done)
+}
+
+/* touch notes that something happened on the connection */
+func (g *governor) touch() {
+	g.l.Lock()
+	defer g.l.Unlock()
+	g.active = time.Now()
+}
+
+/* watch disconnects the attacker when the connection's been idle or open for
+too long.  It returns when the connection is done. */
+func (g *governor) watch() {
+	t := time.NewTicker(WATCHINTERVAL)
+	defer t.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-t.C:
+		}
+		g.l.Lock()
+		idle := time.Since(g.active)
+		g.l.Unlock()
+		switch {
+		case 0 != g.lim.idle && idle >= g.lim.idle:
+			g.disconnect("idle", g.lim.idle)
+			return
+		case 0 != g.lim.duration &&
+			time.Since(g.sess.Start) >= g.lim.duration:
+			g.disconnect("duration", g.lim.duration)
+			return
+		}
+	}
+}
+
+/* disconnect logs that the limit named what, which was lim, was reached and
+closes the connection, which the attacker's client will report as closed by
+the remote host. */
+func (g *governor) disconnect(what string, lim time.Duration) {
+	g.lg.Printf("Session limit reached Limit:%v Value:%v", what, lim)
+	g.sess.setLimit(what)
+	g.conn.Close()
+}
+
+/* OpenChannel notes the attacker is opening a channel.  If the attacker
+already has as many channels open as allowed, the limit is logged and
+OpenChannel returns false.  Otherwise, CloseChannel should be called when the
+channel is closed. */
+func (g *governor) OpenChannel() bool {
+	g.touch()
+	g.l.Lock()
+	defer g.l.Unlock()
+	if 0 != g.lim.channels && g.nChan >= g.lim.channels {
+		g.lg.Printf(
+			"Session limit reached Limit:channels Value:%v",
+			g.lim.channels,
+		)
+		return false
+	}
+	g.nChan++
+	return true
+}
+
+/* CloseChannel notes the attacker's closed a channel opened with
+OpenChannel. */
+func (g *governor) CloseChannel() {
+	g.l.Lock()
+	defer g.l.Unlock()
+	g.nChan--
+}
+
+/* channelLimitError is returned to attackers with too many channels open,
+like OpenSSH's MaxSessions. */
+var channelLimitError = &ssh.OpenChannelError{
+	Reason:  ssh.Prohibited,
+	Message: "open failed",
+}
+
+/* Channel returns the rate limiters for a new channel, which log to clg. */
+func (g *governor) Channel(clg *log.Logger) *channelGovernor {
+	return &channelGovernor{
+		g:  g,
+		up: newRateLimiter(g.lim.chanUp, g.up, clg, TAGTOSERVER),
+		down: newRateLimiter(
+			g.lim.chanDown,
+			g.down,
+			clg,
+			TAGTOATTACKER,
+		),
+	}
+}
+
+/* channelGovernor limits the rate at which data flows on a channel */
+type channelGovernor struct {
+	g    *governor
+	up   *rateLimiter
+	down *rateLimiter
+}
+
+/* Up returns a reader which reads from r, which should be the attacker's side
+of the channel, no faster than allowed.  Reads count as activity, as do reads
+from Down's readers. */
+func (c *channelGovernor) Up(r io.Reader) io.Reader {
+	return throttledReader{r: r, rl: c.up, touch: c.g.touch}
+}
+
+/* Down returns a reader which reads from r, which should be the server's side
+of the channel, no faster than allowed. */
+func (c *channelGovernor) Down(r io.Reader) io.Reader {
+	return throttledReader{r: r, rl: c.down, touch: c.g.touch}
+}
+
+/* throttledReader is a reader which waits on a rateLimiter after every read.
+Reading slowly lets SSH's flow control slow down the sender. */
+type throttledReader struct {
+	r     io.Reader
+	rl    *rateLimiter
+	touch func() /* Called after every successful read */
+}
+
+/* Read implements io.Reader */
+func (t throttledReader) Read(b []byte) (int, error) {
+	n, err := t.r.Read(b)
+	if 0 == n {
+		return n, err
+	}
+	t.touch()
+	t.rl.Wait(n)
+	return n, err
+}
@@ -0,0 +1,232 @@
+package sshhipot
+
+/*
+ * throttle_test.go
+ * Tests for keeping attackers from using too much of the upstream server
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* timeWaits returns how long it takes to Wait for each of ns in turn */
+func timeWaits(r *rateLimiter, ns ...int) time.Duration {
+	start := time.Now()
+	for _, n := range ns {
+		r.Wait(n)
+	}
+	return time.Since(start)
+}
+
+/* checkDuration fails the test if d isn't roughly want */
+func checkDuration(t *testing.T, what string, d, want time.Duration) {
+	t.Helper()
+	if d < want*9/10 || d > want+want/2+100*time.Millisecond {
+		t.Errorf("%v took %v, want about %v", what, d, want)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var buf bytes.Buffer
+	lg := log.New(&buf, "", 0)
+
+	/* Nil and zero-rate limiters don't limit */
+	var nr *rateLimiter
+	checkDuration(t, "Nil limiter", timeWaits(nr, 1<<30), 0)
+	checkDuration(
+		t,
+		"Unlimited limiter",
+		timeWaits(newRateLimiter(0, nil, lg, "x"), 1<<30),
+		0,
+	)
+
+	/* A second's worth is allowed as a burst, after which reads are
+	held to the rate */
+	r := newRateLimiter(10000, nil, lg, "up")
+	checkDuration(t, "Burst", timeWaits(r, 5000, 5000), 0)
+	checkDuration(t, "Limited", timeWaits(r, 2500, 2500), time.Second/2)
+	if n := strings.Count(buf.String(), "[up] Bandwidth limit of 10000 "+
+		"bytes/s reached"); 1 != n {
+		t.Errorf("Limit logged %v times:\n%s", n, buf.String())
+	}
+
+	/* Quiet spells don't save up more than a burst */
+	r = newRateLimiter(10000, nil, lg, "up")
+	r.next = time.Now().Add(-time.Hour)
+	checkDuration(
+		t,
+		"Post-quiet",
+		timeWaits(r, 10000, 5000),
+		time.Second/2,
+	)
+}
+
+func TestRateLimiterParent(t *testing.T) {
+	lg := log.New(ioutil.Discard, "", 0)
+	for _, c := range []struct {
+		child  int64
+		parent int64
+	}{
+		{0, 10000},      /* Only the parent limits */
+		{100000, 10000}, /* The parent's slower */
+		{10000, 100000}, /* The child's slower */
+	} {
+		p := newRateLimiter(c.parent, nil, lg, "p")
+		r := newRateLimiter(c.child, p, lg, "c")
+		checkDuration(
+			t,
+			"Parented limiter",
+			timeWaits(r, 10000, 5000),
+			time.Second/2,
+		)
+	}
+
+	/* Children share their parent */
+	p := newRateLimiter(10000, nil, lg, "p")
+	p.Wait(10000)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			newRateLimiter(0, p, lg, "c").Wait(2500)
+		}()
+	}
+	wg.Wait()
+	checkDuration(t, "Siblings", time.Since(start), time.Second/2)
+}
+
+func TestThrottledReader(t *testing.T) {
+	var (
+		touches int
+		lg      = log.New(ioutil.Discard, "", 0)
+	)
+	tr := throttledReader{
+		r:     strings.NewReader(strings.Repeat("x", 15000)),
+		rl:    newRateLimiter(10000, nil, lg, "x"),
+		touch: func() { touches++ },
+	}
+	start := time.Now()
+	b, err := ioutil.ReadAll(io.LimitReader(tr, 15000))
+	if nil != err || 15000 != len(b) {
+		t.Fatalf("Read %v bytes: %v", len(b), err)
+	}
+	checkDuration(t, "Throttled read", time.Since(start), time.Second/2)
+	if 0 == touches {
+		t.Errorf("Reads didn't count as activity")
+	}
+}
+
+/* closeConn is an ssh.Conn which notes when it's closed */
+type closeConn struct {
+	ssh.Conn
+	closed chan struct{}
+}
+
+/* Close implements ssh.Conn */
+func (c closeConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestGovernorChannels(t *testing.T) {
+	var buf bytes.Buffer
+	g := newGovernor(
+		limits{channels: 2},
+		nil,
+		log.New(&buf, "", 0),
+		&Session{Start: time.Now()},
+	)
+	defer g.Done()
+	for i, want := range []bool{true, true, false, false} {
+		if got := g.OpenChannel(); got != want {
+			t.Errorf("Open %v allowed: %v", i, got)
+		}
+	}
+	if n := strings.Count(
+		buf.String(),
+		"Session limit reached Limit:channels Value:2",
+	); 2 != n {
+		t.Errorf("Limit logged %v times:\n%s", n, buf.String())
+	}
+	g.CloseChannel()
+	if !g.OpenChannel() {
+		t.Errorf("Unable to open channel after closing one")
+	}
+	if g.OpenChannel() {
+		t.Errorf("Opened too many channels after closing one")
+	}
+}
+
+func TestGovernorDisconnect(t *testing.T) {
+	for _, c := range []struct {
+		what  string
+		lim   limits
+		start time.Time
+	}{
+		{"idle", limits{idle: time.Millisecond}, time.Now()},
+		{"duration", limits{duration: time.Minute}, time.Now().Add(
+			-time.Hour,
+		)},
+	} {
+		var (
+			buf  bytes.Buffer
+			conn = closeConn{closed: make(chan struct{})}
+			sess = &Session{Start: c.start}
+			lg   = log.New(&buf, "", 0)
+			g    = newGovernor(c.lim, conn, lg, sess)
+		)
+		select {
+		case <-conn.closed:
+		case <-time.After(WATCHINTERVAL + TESTTIMEOUT):
+			t.Fatalf("%v: not disconnected", c.what)
+		}
+		g.Done()
+		if c.what != sess.Limit {
+			t.Errorf("%v: session limit %q", c.what, sess.Limit)
+		}
+		if !strings.Contains(
+			buf.String(),
+			"Session limit reached Limit:"+c.what,
+		) {
+			t.Errorf(
+				"%v: limit not logged:\n%s",
+				c.what,
+				buf.String(),
+			)
+		}
+	}
+
+	/* Activity keeps an idle connection alive */
+	conn := closeConn{closed: make(chan struct{})}
+	g := newGovernor(
+		limits{idle: WATCHINTERVAL * 3 / 2},
+		conn,
+		log.New(ioutil.Discard, "", 0),
+		&Session{Start: time.Now()},
+	)
+	defer g.Done()
+	for end := time.Now().Add(2 * WATCHINTERVAL); time.Now().Before(
+		end,
+	); time.Sleep(WATCHINTERVAL / 10) {
+		g.Channel(nil).Up(strings.NewReader("x")).Read(make([]byte, 1))
+	}
+	select {
+	case <-conn.closed:
+		t.Errorf("Active connection disconnected")
+	default:
+	}
+}
@@ -0,0 +1,328 @@
+package sshhipot
+
+/*
+ * transcript.go
+ * Binary, byte-exact channel transcripts
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/* A transcript is TRANSCRIPTMAGIC, the start time as big-endian nanoseconds
+since the Unix epoch, and then records.  Each record is
+	uint32 length of the rest of the record
+	uint8  direction: 0 for attacker->server, 1 for server->attacker
+	uint8  stream: 0 for normal data, 1 for stderr
+	uint64 nanoseconds since the start of the transcript
+	       data
+with the integers big-endian.  Times come from the monotonic clock, so
+they're exact relative to each other even if the wall clock changes. */
+const (
+	/* TRANSCRIPTMAGIC starts every transcript */
+	TRANSCRIPTMAGIC = "SSHHIPOT-TRANSCRIPT-1\n"
+	/* TRANSCRIPTSUFFIX is added to a channel log's name to get its
+	transcript's */
+	TRANSCRIPTSUFFIX = ".transcript"
+	/* transcriptRecordHeader is the size of the part of a record between
+	the length and the data */
+	transcriptRecordHeader = 1 + 1 + 8
+	/* maxTranscriptRecord is the largest record which will be read */
+	maxTranscriptRecord = 16 * 1024 * 1024
+)
+
+/* TranscriptRecord is a single chunk of data proxied on a channel */
+type TranscriptRecord struct {
+	Time      time.Time     /* Transcript start plus Offset */
+	Offset    time.Duration /* Since the start of the transcript */
+	Direction string        /* TAGTOSERVER or TAGTOATTACKER */
+	Stderr    bool          /* Sent as extended data */
+	Data      []byte
+}
+
+/* Tag returns the tag used in text logs for r's direction and stream. */
+func (r TranscriptRecord) Tag() string {
+	switch {
+	case TAGTOSERVER == r.Direction && r.Stderr:
+		return TAGERRTOSERVER
+	case TAGTOATTACKER == r.Direction && r.Stderr:
+		return TAGERRTOATTACKER
+	}
+	return r.Direction
+}
+
+/* TranscriptWriter writes a transcript.  It is safe for concurrent use.  A
+nil *TranscriptWriter discards everything. */
+type TranscriptWriter struct {
+	l     sync.Mutex
+	w     io.Writer
+	start time.Time
+	err   error
+}
+
+/* NewTranscriptWriter writes a transcript header to w and returns a
+TranscriptWriter which writes records to w with times relative to start. */
+func NewTranscriptWriter(
+	w io.Writer,
+	start time.Time,
+) (*TranscriptWriter, error) {
+	h := make([]byte, len(TRANSCRIPTMAGIC)+8)
+	copy(h, TRANSCRIPTMAGIC)
+	binary.BigEndian.PutUint64(
+		h[len(TRANSCRIPTMAGIC):],
+		uint64(start.UnixNano()),
+	)
+	if _, err := w.Write(h); nil != err {
+		return nil, err
+	}
+	return &TranscriptWriter{w: w, start: start}, nil
+}
+
+/* Record writes a record of b, sent in the direction and on the stream
+indicated by tag, which must be one of the TAG* constants.  Once writing a
+record fails, Record returns the same error without writing anything else. */
+func (t *TranscriptWriter) Record(tag string, b []byte) error {
+	if nil == t {
+		return nil
+	}
+	var dir, stream byte
+	switch tag {
+	case TAGTOSERVER:
+	case TAGERRTOSERVER:
+		stream = 1
+	case TAGTOATTACKER:
+		dir = 1
+	case TAGERRTOATTACKER:
+		dir, stream = 1, 1
+	default:
+		return fmt.Errorf("unknown tag %q", tag)
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	if nil != t.err {
+		return t.err
+	}
+	r := make([]byte, 4+transcriptRecordHeader+len(b))
+	binary.BigEndian.PutUint32(
+		r,
+		uint32(transcriptRecordHeader+len(b)),
+	)
+	r[4] = dir
+	r[5] = stream
+	binary.BigEndian.PutUint64(r[6:], uint64(time.Since(t.start)))
+	copy(r[4+transcriptRecordHeader:], b)
+	_, t.err = t.w.Write(r)
+	return t.err
+}
+
+/* Close closes the underlying writer, if it's an io.Closer. */
+func (t *TranscriptWriter) Close() error {
+	if nil == t {
+		return nil
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	if c, ok := t.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+/* IsTranscript returns true if head, the start of a file, looks like the start
+of a transcript. */
+func IsTranscript(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(TRANSCRIPTMAGIC))
+}
+
+/* TranscriptReader reads a transcript */
+type TranscriptReader struct {
+	r     *bufio.Reader
+	start time.Time
+}
+
+/* NewTranscriptReader reads the transcript header from r and returns a
+TranscriptReader which reads the records after it. */
+func NewTranscriptReader(r io.Reader) (*TranscriptReader, error) {
+	br := bufio.NewReader(r)
+	h := make([]byte, len(TRANSCRIPTMAGIC)+8)
+	if _, err := io.ReadFull(br, h); nil != err {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	if !IsTranscript(h) {
+		return nil, fmt.Errorf("not a transcript")
+	}
+	return &TranscriptReader{
+		r: br,
+		start: time.Unix(0, int64(binary.BigEndian.Uint64(
+			h[len(TRANSCRIPTMAGIC):],
+		))),
+	}, nil
+}
+
+/* Start returns the time the transcript was started */
+func (t *TranscriptReader) Start() time.Time {
+	return t.start
+}
+
+/* Next returns the next record.  At the end of the transcript, Next returns
+io.EOF.  If the transcript ends partway through a record, as happens if the
+honeypot's killed while writing one, Next returns io.ErrUnexpectedEOF. */
+func (t *TranscriptReader) Next() (TranscriptRecord, error) {
+	var rec TranscriptRecord
+	lb := make([]byte, 4)
+	if _, err := io.ReadFull(t.r, lb); nil != err {
+		return rec, err
+	}
+	l := binary.BigEndian.Uint32(lb)
+	if transcriptRecordHeader > l || maxTranscriptRecord < l {
+		return rec, fmt.Errorf("invalid record length %v", l)
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(t.r, b); nil != err {
+		if io.EOF == err {
+			err = io.ErrUnexpectedEOF
+		}
+		return rec, err
+	}
+	rec.Direction = TAGTOSERVER
+	if 0 != b[0] {
+		rec.Direction = TAGTOATTACKER
+	}
+	rec.Stderr = 0 != b[1]
+	rec.Offset = time.Duration(binary.BigEndian.Uint64(b[2:]))
+	rec.Time = t.start.Add(rec.Offset)
+	rec.Data = b[transcriptRecordHeader:]
+	return rec, nil
+}
+
+/* ReadTranscript reads all of the records from the transcript in r.  A
+truncated final record is ignored. */
+func ReadTranscript(r io.Reader) ([]TranscriptRecord, error) {
+	tr, err := NewTranscriptReader(r)
+	if nil != err {
+		return nil, err
+	}
+	var recs []TranscriptRecord
+	for {
+		rec, err := tr.Next()
+		switch err {
+		case nil:
+			recs = append(recs, rec)
+		case io.EOF, io.ErrUnexpectedEOF:
+			return recs, nil
+		default:
+			return recs, err
+		}
+	}
+}
+
+/* WriteTextLog writes recs to w in the same format as the data lines in the
+text channel logs of the connection with the given ID, which may be the empty
+string to leave it out. */
+func WriteTextLog(w io.Writer, id string, recs []TranscriptRecord) error {
+	bw := bufio.NewWriter(w)
+	prefix := ""
+	if "" != id {
+		prefix = logPrefix(id)
+	}
+	for _, rec := range recs {
+		ts := rec.Time.Local().Format(LOGTIMEFORMAT)
+		for _, l := range bytes.SplitAfter(rec.Data, []byte{'\n'}) {
+			if 0 == len(l) {
+				continue
+			}
+			fmt.Fprintf(
+				bw,
+				"%v %v[%v] %q\n",
+				ts,
+				prefix,
+				rec.Tag(),
+				l,
+			)
+		}
+	}
+	return bw.Flush()
+}
+
+/* WriteAsciicast writes recs to w as an asciicast v2 recording of a terminal
+of the given size which started at start.  What's sent to the attacker is
+output and what's sent by the attacker is input. */
+func WriteAsciicast(
+	w io.Writer,
+	recs []TranscriptRecord,
+	start time.Time,
+	width int,
+	height int,
+) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(struct {
+		Version   int   `json:"version"`
+		Width     int   `json:"width"`
+		Height    int   `json:"height"`
+		Timestamp int64 `json:"timestamp"`
+	}{2, width, height, start.Unix()}); nil != err {
+		return err
+	}
+	for _, rec := range recs {
+		typ := "o"
+		if TAGTOSERVER == rec.Direction {
+			typ = "i"
+		}
+		if err := enc.Encode([]interface{}{
+			rec.Time.Sub(start).Seconds(),
+			typ,
+			string(rec.Data),
+		}); nil != err {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+/* channelTranscript opens a transcript for the channel c, whose text log is
+named logName, if s's Server is configured to write transcripts.  Errors are
+logged to clg.  If there's no transcript to write, channelTranscript returns
+nil. */
+func (s *Session) channelTranscript(
+	c *ChannelSummary,
+	logName string,
+	clg *log.Logger,
+) *TranscriptWriter {
+	if !s.srv.conf.Transcripts {
+		return nil
+	}
+	fn := logName + TRANSCRIPTSUFFIX
+	f, err := os.OpenFile(
+		fn,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL,
+		0600,
+	)
+	if nil != err {
+		clg.Printf("Unable to open transcript: %v", err)
+		return nil
+	}
+	tr, err := NewTranscriptWriter(f, time.Now())
+	if nil != err {
+		clg.Printf("Unable to start transcript %v: %v", fn, err)
+		f.Close()
+		return nil
+	}
+	clg.Printf("Transcript:%q", fn)
+	s.l.Lock()
+	defer s.l.Unlock()
+	c.Transcript = fn
+	return tr
+}
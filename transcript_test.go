@@ -0,0 +1,121 @@
+package sshhipot
+
+/*
+ * transcript_test.go
+ * Write and read back transcripts
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranscriptRoundTrip(t *testing.T) {
+	var (
+		buf   bytes.Buffer
+		start = time.Now()
+		want  = []TranscriptRecord{
+			{Direction: TAGTOSERVER, Data: []byte("ls\r")},
+			{Direction: TAGTOATTACKER, Data: []byte("\x00\xff\n")},
+			{
+				Direction: TAGTOATTACKER,
+				Stderr:    true,
+				Data:      []byte("x"),
+			},
+			{Direction: TAGTOSERVER, Stderr: true, Data: []byte{}},
+		}
+	)
+	tw, err := NewTranscriptWriter(&buf, start)
+	if nil != err {
+		t.Fatalf("Unable to start transcript: %v", err)
+	}
+	for _, rec := range want {
+		if err := tw.Record(rec.Tag(), rec.Data); nil != err {
+			t.Fatalf("Unable to write %+v: %v", rec, err)
+		}
+	}
+	if err := tw.Record("bad", nil); nil == err {
+		t.Errorf("Wrote record with bad tag")
+	}
+
+	/* Read it back, with a bit of a record at the end */
+	b := append(buf.Bytes(), 0, 0, 0, 20, 1)
+	tr, err := NewTranscriptReader(bytes.NewReader(b))
+	if nil != err {
+		t.Fatalf("Unable to read transcript: %v", err)
+	}
+	if !tr.Start().Equal(start) {
+		t.Errorf("Start %v, expected %v", tr.Start(), start)
+	}
+	var last time.Duration
+	for i, w := range want {
+		got, err := tr.Next()
+		if nil != err {
+			t.Fatalf("Error reading record %v: %v", i, err)
+		}
+		if w.Direction != got.Direction ||
+			w.Stderr != got.Stderr ||
+			!bytes.Equal(w.Data, got.Data) {
+			t.Errorf("Record %v is %+v, expected %+v", i, got, w)
+		}
+		if got.Offset < last {
+			t.Errorf("Record %v went back in time", i)
+		}
+		last = got.Offset
+		if !got.Time.Equal(start.Add(got.Offset)) {
+			t.Errorf("Record %v has time %v", i, got.Time)
+		}
+	}
+	if _, err := tr.Next(); io.ErrUnexpectedEOF != err {
+		t.Errorf("Truncated record got %v", err)
+	}
+	recs, err := ReadTranscript(bytes.NewReader(b))
+	if nil != err || len(want) != len(recs) {
+		t.Fatalf("ReadTranscript got %v records, %v", len(recs), err)
+	}
+
+	/* Convert it */
+	var tl strings.Builder
+	if err := WriteTextLog(&tl, "abc", recs); nil != err {
+		t.Fatalf("Unable to write text log: %v", err)
+	}
+	for _, l := range []string{
+		` ID:abc [attacker->server] "ls\r"`,
+		` ID:abc [server->attacker] "\x00\xff\n"`,
+		` ID:abc [server-(err)->attacker] "x"`,
+	} {
+		if !strings.Contains(tl.String(), l+"\n") {
+			t.Errorf("Text log missing %q:\n%s", l, tl.String())
+		}
+	}
+	var ac bytes.Buffer
+	if err := WriteAsciicast(&ac, recs, start, 80, 24); nil != err {
+		t.Fatalf("Unable to write asciicast: %v", err)
+	}
+	dec := json.NewDecoder(&ac)
+	var h struct{ Version, Width, Height int }
+	if err := dec.Decode(&h); nil != err || 2 != h.Version ||
+		80 != h.Width || 24 != h.Height {
+		t.Errorf("Bad asciicast header %+v: %v", h, err)
+	}
+	for i, w := range []string{"i", "o", "o", "i"} {
+		var ev []interface{}
+		if err := dec.Decode(&ev); nil != err || 3 != len(ev) {
+			t.Fatalf("Bad asciicast event %v: %v %v", i, ev, err)
+		}
+		if w != ev[1] {
+			t.Errorf("Asciicast event %v is %q, expected %q",
+				i,
+				ev[1],
+				w,
+			)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package sshhipot
+
+/*
+ * transfer.go
+ * Notice files sent with scp and SFTP
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Directions in which files may be transferred */
+const (
+	UPLOAD   = "upload"
+	DOWNLOAD = "download"
+)
+
+/* MAXSCPLINE is the longest scp control line we'll bother parsing */
+const MAXSCPLINE = 4096
+
+/* scpWatcher watches an scp session and notes the files sent.  It does nothing
+until Enable is called with the direction of the transfer, after which Input
+should be fed the attacker's data and Output the server's.  onFile is called
+for every file transferred, along with the file's contents if it was uploaded
+and there's an artifact store. */
+type scpWatcher struct {
+	l         sync.Mutex
+	direction string   /* UPLOAD or DOWNLOAD, or "" if not enabled */
+	line      []byte   /* Partial control line */
+	dirs      []string /* Directories we're in */
+	remain    uint64   /* Bytes of file data left */
+	skipNUL   bool     /* Skip the NUL after file data */
+	cur       FileSummary
+	hash      hash.Hash       /* Hashes the current file's contents */
+	st        *artifactStore  /* Saves uploaded files */
+	w         *artifactWriter /* The current file's contents */
+	onFile    func(FileSummary, *artifactWriter)
+}
+
+/* newSCPWatcher returns an scpWatcher which calls onFile for every file it
+sees.  Uploaded files are written to st. */
+func newSCPWatcher(
+	st *artifactStore,
+	onFile func(FileSummary, *artifactWriter),
+) *scpWatcher {
+	return &scpWatcher{st: st, onFile: onFile}
+}
+
+/* Enable starts watching for files sent in the given direction. */
+func (s *scpWatcher) Enable(direction string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.direction = direction
+}
+
+/* Input processes data sent by the attacker */
+func (s *scpWatcher) Input(b []byte) { s.feed(UPLOAD, b) }
+
+/* Output processes data sent by the server */
+func (s *scpWatcher) Output(b []byte) { s.feed(DOWNLOAD, b) }
+
+/* feed processes data sent in direction dir */
+func (s *scpWatcher) feed(dir string, b []byte) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if dir != s.direction {
+		return
+	}
+	for 0 != len(b) {
+		/* Skip file contents */
+		if 0 != s.remain {
+			n := uint64(len(b))
+			if n > s.remain {
+				n = s.remain
+			}
+			s.remain -= n
+			s.hash.Write(b[:n])
+			s.w.Write(b[:n])
+			b = b[n:]
+			if 0 == s.remain {
+				s.fileDone()
+			}
+			continue
+		}
+		/* Files are followed by a NUL */
+		if s.skipNUL {
+			s.skipNUL = false
+			if 0 == b[0] {
+				b = b[1:]
+			}
+			continue
+		}
+		/* Anything else is part of a control line */
+		if '\n' != b[0] {
+			if MAXSCPLINE > len(s.line) {
+				s.line = append(s.line, b[0])
+			}
+			b = b[1:]
+			continue
+		}
+		b = b[1:]
+		s.control(string(s.line))
+		s.line = s.line[:0]
+	}
+}
+
+/* control handles an scp control line */
+func (s *scpWatcher) control(l string) {
+	if "" == l {
+		return
+	}
+	switch l[0] {
+	case 'C', 'D':
+		/* Cmmmm size name */
+		parts := strings.SplitN(l[1:], " ", 3)
+		if 3 != len(parts) {
+			return
+		}
+		if 'D' == l[0] {
+			s.dirs = append(s.dirs, parts[2])
+			return
+		}
+		size, err := strconv.ParseUint(parts[1], 10, 64)
+		if nil != err {
+			return
+		}
+		s.cur = FileSummary{
+			Time:      time.Now(),
+			Direction: s.direction,
+			Name:      path.Join(append(s.dirs, parts[2])...),
+			Mode:      parts[0],
+			Size:      size,
+		}
+		s.remain = size
+		s.hash = sha256.New()
+		if UPLOAD == s.direction && ARTIFACTMAX >= size {
+			var err error
+			if s.w, err = s.st.Create(); nil != err {
+				logf(
+					s.st.levels,
+					LEVELERROR,
+					SUBSYSGENERAL,
+					"Unable to save scp upload: %v",
+					err,
+				)
+			}
+		}
+		if 0 == size {
+			s.fileDone()
+		}
+	case 'E':
+		if 0 != len(s.dirs) {
+			s.dirs = s.dirs[:len(s.dirs)-1]
+		}
+	}
+}
+
+/* fileDone is called when the current file's contents have been sent */
+func (s *scpWatcher) fileDone() {
+	s.cur.SHA256 = hex.EncodeToString(s.hash.Sum(nil))
+	s.onFile(s.cur, s.w)
+	s.w = nil
+	s.skipNUL = true
+}
+
+/* Finish throws away the contents of a file which wasn't completely sent. */
+func (s *scpWatcher) Finish() {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.w.Abort()
+	s.w = nil
+}
+
+/* scpDirection returns the direction in which files will be sent if cmd is an
+scp command run on the server, or "" if it isn't. */
+func scpDirection(cmd string) string {
+	fs := strings.Fields(cmd)
+	if 0 == len(fs) || "scp" != filepath.Base(fs[0]) {
+		return ""
+	}
+	for _, f := range fs[1:] {
+		if !strings.HasPrefix(f, "-") || strings.HasPrefix(f, "--") {
+			continue
+		}
+		if strings.Contains(f, "t") {
+			return UPLOAD
+		}
+		if strings.Contains(f, "f") {
+			return DOWNLOAD
+		}
+	}
+	return ""
+}
+
+/* SFTP packet types and flags we care about.  See
+https://datatracker.ietf.org/doc/html/draft-ietf-secsh-filexfer-02 */
+const (
+	sftpOpen       = 3
+	sftpClose      = 4
+	sftpWrite      = 6
+	sftpStatus     = 101
+	sftpHandle     = 102
+	sftpOpenWrite  = 0x02 /* SSH_FXF_WRITE */
+	sftpAttrSize   = 0x01 /* SSH_FILEXFER_ATTR_SIZE */
+	sftpAttrUIDGID = 0x02 /* SSH_FILEXFER_ATTR_UIDGID */
+	sftpAttrPerms  = 0x04 /* SSH_FILEXFER_ATTR_PERMISSIONS */
+)
+
+/* MAXSFTPPACKET is the largest SFTP packet an sftpWatcher will parse.  Larger
+packets stop it watching. */
+const MAXSFTPPACKET = 1024 * 1024
+
+/* errShortSFTPPacket is returned when an SFTP packet's too short to hold a
+field. */
+var errShortSFTPPacket = errors.New("short packet")
+
+/* sftpFile is a file being uploaded with SFTP */
+type sftpFile struct {
+	cur FileSummary
+	w   *artifactWriter
+}
+
+/* sftpWatcher watches an SFTP session and notes the files uploaded.  It does
+nothing until Enable is called, after which Input should be fed the attacker's
+data and Output the server's.  onFile is called for every file uploaded, along
+with its contents if there's an artifact store.  The FileSummary's SHA256 isn't
+set. */
+type sftpWatcher struct {
+	l       sync.Mutex
+	enabled bool
+	in, out []byte               /* Partial packets */
+	opens   map[uint32]sftpFile  /* Files being opened, by request ID */
+	files   map[string]*sftpFile /* Open files, by handle */
+	st      *artifactStore
+	onFile  func(FileSummary, *artifactWriter)
+}
+
+/* newSFTPWatcher returns an sftpWatcher which calls onFile for every file it
+sees uploaded.  Files are written to st. */
+func newSFTPWatcher(
+	st *artifactStore,
+	onFile func(FileSummary, *artifactWriter),
+) *sftpWatcher {
+	return &sftpWatcher{
+		opens:  make(map[uint32]sftpFile),
+		files:  make(map[string]*sftpFile),
+		st:     st,
+		onFile: onFile,
+	}
+}
+
+/* Enable starts watching for files. */
+func (s *sftpWatcher) Enable() {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.enabled = true
+}
+
+/* Input processes data sent by the attacker */
+func (s *sftpWatcher) Input(b []byte) { s.feed(&s.in, b, s.request) }
+
+/* Output processes data sent by the server */
+func (s *sftpWatcher) Output(b []byte) { s.feed(&s.out, b, s.response) }
+
+/* feed adds b to the partial packet in buf and passes whole packets to
+handle. */
+func (s *sftpWatcher) feed(buf *[]byte, b []byte, handle func([]byte)) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if !s.enabled {
+		return
+	}
+	*buf = append(*buf, b...)
+	for 4 <= len(*buf) {
+		l := binary.BigEndian.Uint32(*buf)
+		if MAXSFTPPACKET < l {
+			/* Not SFTP, or not something we understand */
+			s.enabled = false
+			s.in, s.out = nil, nil
+			return
+		}
+		if uint64(len(*buf)-4) < uint64(l) {
+			return
+		}
+		handle((*buf)[4 : 4+l])
+		*buf = (*buf)[4+l:]
+	}
+	/* Don't hang on to big buffers */
+	if 0 == len(*buf) {
+		*buf = nil
+	}
+}
+
+/* request handles a packet sent by the attacker */
+func (s *sftpWatcher) request(p []byte) {
+	r := sftpReader{b: p}
+	typ := r.byte()
+	id := r.uint32()
+	switch typ {
+	case sftpOpen:
+		name := r.string()
+		pflags := r.uint32()
+		mode := ""
+		if flags := r.uint32(); 0 != flags&sftpAttrPerms {
+			if 0 != flags&sftpAttrSize {
+				r.uint64()
+			}
+			if 0 != flags&sftpAttrUIDGID {
+				r.uint32()
+				r.uint32()
+			}
+			mode = fmt.Sprintf("%04o", r.uint32()&07777)
+		}
+		if nil != r.err || 0 == pflags&sftpOpenWrite {
+			return
+		}
+		s.opens[id] = sftpFile{cur: FileSummary{
+			Time:      time.Now(),
+			Direction: UPLOAD,
+			Name:      name,
+			Mode:      mode,
+		}}
+	case sftpWrite:
+		f, ok := s.files[r.string()]
+		off := r.uint64()
+		data := r.string()
+		if !ok || nil != r.err {
+			return
+		}
+		if end := off + uint64(len(data)); end > f.cur.Size {
+			f.cur.Size = end
+		}
+		f.w.WriteAt([]byte(data), int64(off))
+	case sftpClose:
+		h := r.string()
+		if nil != r.err {
+			return
+		}
+		if f, ok := s.files[h]; ok {
+			delete(s.files, h)
+			s.onFile(f.cur, f.w)
+		}
+	}
+}
+
+/* response handles a packet sent by the server */
+func (s *sftpWatcher) response(p []byte) {
+	r := sftpReader{b: p}
+	typ := r.byte()
+	id := r.uint32()
+	f, ok := s.opens[id]
+	if !ok {
+		return
+	}
+	delete(s.opens, id)
+	if sftpHandle != typ {
+		return /* Probably a failure status */
+	}
+	h := r.string()
+	if nil != r.err {
+		return
+	}
+	var err error
+	if f.w, err = s.st.Create(); nil != err {
+		logf(
+			s.st.levels,
+			LEVELERROR,
+			SUBSYSGENERAL,
+			"Unable to save SFTP upload: %v",
+			err,
+		)
+	}
+	s.files[h] = &f
+}
+
+/* Finish notes files which were still open when the channel closed. */
+func (s *sftpWatcher) Finish() {
+	s.l.Lock()
+	defer s.l.Unlock()
+	for h, f := range s.files {
+		delete(s.files, h)
+		s.onFile(f.cur, f.w)
+	}
+}
+
+/* sftpReader reads fields from an SFTP packet.  Once there's not enough
+packet left to read a field, err is set and zero values are returned. */
+type sftpReader struct {
+	b   []byte
+	err error
+}
+
+/* next returns the next n bytes, or nil if there aren't that many */
+func (r *sftpReader) next(n uint64) []byte {
+	if nil != r.err || uint64(len(r.b)) < n {
+		r.err = errShortSFTPPacket
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+/* byte reads a byte */
+func (r *sftpReader) byte() byte {
+	if b := r.next(1); nil != b {
+		return b[0]
+	}
+	return 0
+}
+
+/* uint32 reads a big-endian uint32 */
+func (r *sftpReader) uint32() uint32 {
+	if b := r.next(4); nil != b {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+/* uint64 reads a big-endian uint64 */
+func (r *sftpReader) uint64() uint64 {
+	if b := r.next(8); nil != b {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+/* string reads a length-prefixed string */
+func (r *sftpReader) string() string {
+	return string(r.next(uint64(r.uint32())))
+}
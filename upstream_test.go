@@ -0,0 +1,340 @@
+package sshhipot
+
+/*
+ * upstream_test.go
+ * Fake upstream server for tests
+ * By J. Stuart McMurray
+ * Created 20261018
+ * Last Modified 20261018
+ */
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* Things the fake upstream server does */
+const (
+	/* TESTUSER is the user the honeypot uses to log into the upstream
+	server */
+	TESTUSER = "root"
+	/* TESTSUBSYSTEM is the one subsystem the upstream server has.  It
+	echos back what it's sent. */
+	TESTSUBSYSTEM = "echo"
+	/* TESTGLOBALREQ is the one global request the upstream server
+	accepts.  It replies with the request's payload. */
+	TESTGLOBALREQ = "echo@sshhipot.test"
+	/* TESTEXITSTATUS is the exit status of exec'd commands */
+	TESTEXITSTATUS = 3
+	/* TESTCAT, TESTSH, and TESTHALF are commands which read input */
+	TESTCAT  = "cat"
+	TESTSH   = "sh"
+	TESTHALF = "half"
+	/* TESTPROMPT is the upstream server's shell prompt */
+	TESTPROMPT = "upstream$ "
+	/* TESTSLOWCHAN is a type of channel the upstream server takes
+	TESTSLOWDELAY to open */
+	TESTSLOWCHAN  = "slow@sshhipot.test"
+	TESTSLOWDELAY = 100 * time.Millisecond
+)
+
+/* testUpstream is an in-process SSH server which stands in for the real
+server behind the honeypot.  Commands sent via exec aren't run; the output is
+"ran: " and the command.  Lines sent to a shell get the same treatment.  The
+exceptions are TESTCAT and TESTSH, which send back their input until EOF,
+TESTHALF, which sends EOF straight away and exits with the number of bytes it
+reads before EOF, and scp, which reads its input until EOF. */
+type testUpstream struct {
+	addr        string
+	fingerprint string
+
+	l      sync.Mutex
+	ptys   []string /* Terminal types from pty-reqs */
+	events []string /* Channels opened and global requests received */
+}
+
+/* newTestUpstream starts a testUpstream which only lets in TESTUSER with the
+public key from the private key file keyFile.  It's stopped when the test
+finishes. */
+func newTestUpstream(t *testing.T, keyFile string) *testUpstream {
+	/* Key the honeypot will use to log in */
+	k, _, err := getKey(keyFile)
+	if nil != err {
+		t.Fatalf("Unable to read upstream client key: %v", err)
+	}
+	ck := k.PublicKey().Marshal()
+	conf := &ssh.ServerConfig{PublicKeyCallback: func(
+		cm ssh.ConnMetadata,
+		key ssh.PublicKey,
+	) (*ssh.Permissions, error) {
+		if TESTUSER != cm.User() || !bytes.Equal(ck, key.Marshal()) {
+			return nil, fmt.Errorf("denied")
+		}
+		return nil, nil
+	}}
+	hk := testKey(t)
+	conf.AddHostKey(hk)
+
+	/* Serve until the test's done */
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Unable to listen for upstream connections: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	u := &testUpstream{
+		addr:        l.Addr().String(),
+		fingerprint: ssh.FingerprintSHA256(hk.PublicKey()),
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			go u.handle(c, conf)
+		}
+	}()
+	return u
+}
+
+/* Ptys returns the terminal types of the pty-reqs the upstream server's
+accepted. */
+func (u *testUpstream) Ptys() []string {
+	u.l.Lock()
+	defer u.l.Unlock()
+	return append([]string{}, u.ptys...)
+}
+
+/* Events returns the channels the upstream server's opened and the global
+requests it's received, in order. */
+func (u *testUpstream) Events() []string {
+	u.l.Lock()
+	defer u.l.Unlock()
+	return append([]string{}, u.events...)
+}
+
+/* event notes an event for Events */
+func (u *testUpstream) event(f string, a ...interface{}) {
+	u.l.Lock()
+	defer u.l.Unlock()
+	u.events = append(u.events, fmt.Sprintf(f, a...))
+}
+
+/* handle handles a connection from the honeypot */
+func (u *testUpstream) handle(c net.Conn, conf *ssh.ServerConfig) {
+	defer c.Close()
+	sc, chans, reqs, err := ssh.NewServerConn(c, conf)
+	if nil != err {
+		return
+	}
+	defer sc.Close()
+	go func() {
+		for r := range reqs {
+			u.event("request %v", r.Type)
+			if TESTGLOBALREQ == r.Type {
+				r.Reply(true, r.Payload)
+				continue
+			}
+			r.Reply(false, nil)
+		}
+	}()
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			go u.handleSession(nc)
+		case "direct-tcpip":
+			go u.handleDirectTCPIP(nc)
+		case TESTSLOWCHAN:
+			go u.handleSlow(nc)
+		default:
+			nc.Reject(ssh.UnknownChannelType, "unknown type")
+		}
+	}
+}
+
+/* handleSession handles a session channel */
+func (u *testUpstream) handleSession(nc ssh.NewChannel) {
+	ch, reqs, err := nc.Accept()
+	if nil != err {
+		return
+	}
+	defer ch.Close()
+	for r := range reqs {
+		switch r.Type {
+		case "pty-req":
+			term, _ := sshString(r.Payload)
+			u.l.Lock()
+			u.ptys = append(u.ptys, term)
+			u.l.Unlock()
+			r.Reply(true, nil)
+		case "env":
+			r.Reply(true, nil)
+		case "exec":
+			cmd, _ := sshString(r.Payload)
+			r.Reply(true, nil)
+			switch cmd {
+			case TESTCAT, TESTSH:
+				io.Copy(ch, ch)
+				sendExitStatus(ch, 0)
+				return
+			case TESTHALF:
+				ch.CloseWrite()
+				n, _ := io.Copy(ioutil.Discard, ch)
+				sendExitStatus(ch, uint32(n))
+				return
+			}
+			if "" != scpDirection(cmd) {
+				io.Copy(ioutil.Discard, ch)
+				sendExitStatus(ch, 0)
+				return
+			}
+			fmt.Fprintf(ch, "ran: %s\n", cmd)
+			fmt.Fprintf(ch.Stderr(), "err: %s\n", cmd)
+			sendExitStatus(ch, TESTEXITSTATUS)
+			return
+		case "shell":
+			r.Reply(true, nil)
+			go testShell(ch)
+		case "subsystem":
+			name, _ := sshString(r.Payload)
+			if TESTSUBSYSTEM != name {
+				r.Reply(false, nil)
+				continue
+			}
+			r.Reply(true, nil)
+			go io.Copy(ch, ch)
+		default:
+			r.Reply(false, nil)
+		}
+	}
+}
+
+/* testShell is a shell which doesn't run anything.  It echos what it's sent
+and on every carriage return sends the line, as if it were the output of a
+command. */
+func testShell(ch ssh.Channel) {
+	io.WriteString(ch, TESTPROMPT)
+	var (
+		line []byte
+		buf  = make([]byte, BUFLEN)
+	)
+	for {
+		n, err := ch.Read(buf)
+		for _, b := range buf[:n] {
+			if '\r' != b {
+				ch.Write([]byte{b})
+				line = append(line, b)
+				continue
+			}
+			if "exit" == string(line) {
+				io.WriteString(ch, "\r\n")
+				sendExitStatus(ch, 0)
+				ch.Close()
+				return
+			}
+			fmt.Fprintf(ch, "\r\nran: %s\r\n%s", line, TESTPROMPT)
+			line = line[:0]
+		}
+		if nil != err {
+			return
+		}
+	}
+}
+
+/* handleDirectTCPIP connects a direct-tcpip channel to the address it
+requests. */
+func (u *testUpstream) handleDirectTCPIP(nc ssh.NewChannel) {
+	var d struct {
+		Host  string
+		Port  uint32
+		OHost string
+		OPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &d); nil != err {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	c, err := net.Dial(
+		"tcp",
+		net.JoinHostPort(d.Host, fmt.Sprintf("%v", d.Port)),
+	)
+	if nil != err {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer c.Close()
+	ch, reqs, err := nc.Accept()
+	if nil != err {
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	go io.Copy(ch, c)
+	io.Copy(c, ch)
+}
+
+/* handleSlow accepts a channel after TESTSLOWDELAY and then ignores it */
+func (u *testUpstream) handleSlow(nc ssh.NewChannel) {
+	time.Sleep(TESTSLOWDELAY)
+	ch, reqs, err := nc.Accept()
+	if nil != err {
+		return
+	}
+	defer ch.Close()
+	u.event("open %v", nc.ChannelType())
+	go ssh.DiscardRequests(reqs)
+	io.Copy(ioutil.Discard, ch)
+}
+
+/* sendExitStatus sends an exit-status request on ch */
+func sendExitStatus(ch ssh.Channel, status uint32) {
+	ch.SendRequest(
+		"exit-status",
+		false,
+		ssh.Marshal(struct{ Status uint32 }{status}),
+	)
+}
+
+/* testKey makes an ed25519 key for tests */
+func testKey(t *testing.T) ssh.Signer {
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if nil != err {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	s, err := ssh.NewSignerFromKey(k)
+	if nil != err {
+		t.Fatalf("Unable to make signer: %v", err)
+	}
+	return s
+}
+
+/* writeTestKey writes a new ed25519 private key to the file named fn.  This
+is a good bit faster than letting getKey make an RSA key. */
+func writeTestKey(t *testing.T, fn string) {
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if nil != err {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	b, err := ssh.MarshalPrivateKey(k, "")
+	if nil != err {
+		t.Fatalf("Unable to marshal key: %v", err)
+	}
+	if err := ioutil.WriteFile(
+		fn,
+		pem.EncodeToMemory(b),
+		0600,
+	); nil != err {
+		t.Fatalf("Unable to write key to %v: %v", fn, err)
+	}
+}